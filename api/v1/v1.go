@@ -0,0 +1,506 @@
+// Package v1 defines the response bodies of the /v1 API. The types are built
+// from the persistence models but never embed them, so adding a column or an
+// association can't change what clients receive. A /v2 gets its own package
+// with its own shapes, and both can be served side by side.
+package v1
+
+import (
+	"encoding/json"
+	"liven-one-go/models"
+	"time"
+)
+
+// User is an account as shown to its owner.
+type User struct {
+	ID               uint   `json:"id"`
+	Email            string `json:"email"`
+	UserType         string `json:"user_type"`
+	EmailVerified    bool   `json:"email_verified"`
+	TwoFactorEnabled bool   `json:"two_factor_enabled"`
+	// PendingEmail is the address the account is changing to, until the
+	// link mailed there is opened.
+	PendingEmail string `json:"pending_email,omitempty"`
+}
+
+// NewUser builds the response for an account.
+func NewUser(user *models.User) User {
+	return User{
+		ID:               user.ID,
+		Email:            user.Email,
+		UserType:         user.UserType,
+		EmailVerified:    user.EmailVerifiedAt != nil,
+		TwoFactorEnabled: user.TwoFactorEnabled(),
+		PendingEmail:     user.PendingEmail,
+	}
+}
+
+// Profile is an account with the details its owner manages.
+type Profile struct {
+	User
+	DisplayName      string `json:"display_name"`
+	Phone            string `json:"phone"`
+	AvatarURL        string `json:"avatar_url"`
+	Locale           string `json:"locale"`
+	MarketingConsent bool   `json:"marketing_consent"`
+}
+
+// NewProfile builds the response for an account's profile.
+func NewProfile(user *models.User) Profile {
+	return Profile{
+		User:             NewUser(user),
+		DisplayName:      user.DisplayName,
+		Phone:            user.Phone,
+		AvatarURL:        user.AvatarURL,
+		Locale:           user.Locale,
+		MarketingConsent: user.MarketingConsentAt != nil,
+	}
+}
+
+// DataExport is everything stored about an account, as its owner downloads it.
+type DataExport struct {
+	ExportedAt time.Time       `json:"exported_at"`
+	Account    ExportedAccount `json:"account"`
+	Orders     []OrderDetail   `json:"orders"`
+	// Sessions are the devices the account is logged in on, including
+	// expired logins not yet cleaned up.
+	Sessions []Session `json:"sessions"`
+	// Identities are the accounts at identity providers linked to it.
+	Identities []ExportedIdentity `json:"identities"`
+	// Activity is the audit log of the changes the account made, with the
+	// IP addresses they were made from.
+	Activity []AuditEntry `json:"activity"`
+	// History is the audit log of the changes made to the account, by it
+	// or by others. Only its own IP addresses are included.
+	History []AuditEntry `json:"history"`
+}
+
+// ExportedAccount is an account with every detail stored about it.
+type ExportedAccount struct {
+	Profile
+	EmailVerifiedAt    *time.Time `json:"email_verified_at"`
+	MarketingConsentAt *time.Time `json:"marketing_consent_at"`
+	TwoFactorEnabledAt *time.Time `json:"two_factor_enabled_at"`
+	DeletionDueAt      *time.Time `json:"deletion_due_at"`
+}
+
+// ExportedIdentity is an account at an identity provider linked to a user.
+type ExportedIdentity struct {
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ExportSources is what an export is built from.
+type ExportSources struct {
+	User       *models.User
+	Orders     []models.Order
+	Sessions   []models.Session
+	Identities []models.UserIdentity
+	Activity   []models.AuditEntry
+	History    []models.AuditEntry
+	// CurrentSessionID marks the session the export was requested from.
+	CurrentSessionID uint
+}
+
+// NewDataExport builds the export of an account. It expects what
+// NewOrderDetail and NewAuditEntry do to be loaded.
+func NewDataExport(sources ExportSources, now time.Time) DataExport {
+	user := sources.User
+	return DataExport{
+		ExportedAt: now,
+		Account: ExportedAccount{
+			Profile:            NewProfile(user),
+			EmailVerifiedAt:    user.EmailVerifiedAt,
+			MarketingConsentAt: user.MarketingConsentAt,
+			TwoFactorEnabledAt: user.TOTPEnabledAt,
+			DeletionDueAt:      user.DeletionDueAt,
+		},
+		Orders:   mapAll(sources.Orders, NewOrderDetail),
+		Sessions: NewSessions(sources.Sessions, sources.CurrentSessionID),
+		Identities: mapAll(sources.Identities, func(identity *models.UserIdentity) ExportedIdentity {
+			return ExportedIdentity{Provider: identity.Provider, Subject: identity.Subject, CreatedAt: identity.CreatedAt}
+		}),
+		Activity: NewAuditEntries(sources.Activity),
+		History:  NewAuditEntries(sources.History),
+	}
+}
+
+// AdminUser is an account as platform administrators see it.
+type AdminUser struct {
+	User
+	MerchantID       *uint      `json:"merchant_id,omitempty"`
+	Suspended        bool       `json:"suspended"`
+	SuspendedAt      *time.Time `json:"suspended_at,omitempty"`
+	SuspensionReason string     `json:"suspension_reason,omitempty"`
+	LockedUntil      *time.Time `json:"locked_until,omitempty"`
+	DeletionDueAt    *time.Time `json:"deletion_due_at,omitempty"`
+}
+
+// NewAdminUser builds the administrators' response for an account.
+func NewAdminUser(user *models.User) AdminUser {
+	return AdminUser{
+		User:             NewUser(user),
+		MerchantID:       user.MerchantID,
+		Suspended:        user.Suspended(),
+		SuspendedAt:      user.SuspendedAt,
+		SuspensionReason: user.SuspensionReason,
+		LockedUntil:      user.LockedUntil,
+		DeletionDueAt:    user.DeletionDueAt,
+	}
+}
+
+// NewAdminUsers builds the administrators' responses for a list of accounts.
+func NewAdminUsers(users []models.User) []AdminUser {
+	return mapAll(users, NewAdminUser)
+}
+
+// StaffAccount is a staff account as shown to its owner, with the venues it
+// works at.
+type StaffAccount struct {
+	User
+	Venues []StaffVenue `json:"venues"`
+}
+
+// NewStaffAccount builds the response for a staff account and its venue
+// assignments.
+func NewStaffAccount(staff *models.User, assignments []models.StaffAssignment) StaffAccount {
+	return StaffAccount{User: NewUser(staff), Venues: mapAll(assignments, NewStaffVenue)}
+}
+
+// PublicVenue is a venue as anyone can see it.
+type PublicVenue struct {
+	ID          uint   `json:"id"`
+	Name        string `json:"name"`
+	Address     string `json:"address"`
+	LatLong     string `json:"lat_long"`
+	Description string `json:"description"`
+	CuisineType string `json:"cuisine_type"`
+}
+
+// NewPublicVenue builds the public response for a venue.
+func NewPublicVenue(venue *models.Venue) PublicVenue {
+	return PublicVenue{
+		ID:          venue.ID,
+		Name:        venue.Name,
+		Address:     venue.Address,
+		LatLong:     venue.LatLong,
+		Description: venue.Description,
+		CuisineType: venue.CuisineType,
+	}
+}
+
+// NewPublicVenues builds the public responses for a list of venues.
+func NewPublicVenues(venues []models.Venue) []PublicVenue {
+	return mapAll(venues, NewPublicVenue)
+}
+
+// MerchantVenue is a venue as its owner sees it.
+type MerchantVenue struct {
+	PublicVenue
+	MerchantID uint      `json:"merchant_id"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// NewMerchantVenue builds the owner's response for a venue.
+func NewMerchantVenue(venue *models.Venue) MerchantVenue {
+	return MerchantVenue{
+		PublicVenue: NewPublicVenue(venue),
+		MerchantID:  venue.MerchantID,
+		CreatedAt:   venue.CreatedAt,
+		UpdatedAt:   venue.UpdatedAt,
+	}
+}
+
+// NewMerchantVenues builds the owner's responses for a list of venues.
+func NewMerchantVenues(venues []models.Venue) []MerchantVenue {
+	return mapAll(venues, NewMerchantVenue)
+}
+
+// StaffMember is a staff account as its merchant sees it. Pending members
+// haven't accepted their invitation yet.
+type StaffMember struct {
+	ID      uint         `json:"id"`
+	Email   string       `json:"email"`
+	Pending bool         `json:"pending"`
+	Venues  []StaffVenue `json:"venues"`
+}
+
+// StaffVenue is what a staff account may do at one venue.
+type StaffVenue struct {
+	VenueID     uint                     `json:"venue_id"`
+	VenueName   string                   `json:"venue_name"`
+	Permissions []models.StaffPermission `json:"permissions"`
+}
+
+// NewStaffMember builds the response for a staff account and its venue
+// assignments.
+func NewStaffMember(staff *models.User, assignments []models.StaffAssignment) StaffMember {
+	return StaffMember{
+		ID:      staff.ID,
+		Email:   staff.Email,
+		Pending: staff.Password == "",
+		Venues:  mapAll(assignments, NewStaffVenue),
+	}
+}
+
+// NewStaffVenue builds the response for a venue assignment.
+func NewStaffVenue(assignment *models.StaffAssignment) StaffVenue {
+	return StaffVenue{
+		VenueID:     assignment.VenueID,
+		VenueName:   assignment.Venue.Name,
+		Permissions: assignment.Permissions(),
+	}
+}
+
+// APIKey is an API key as its merchant sees it. The key itself is only
+// returned when it is created.
+type APIKey struct {
+	ID     uint   `json:"id"`
+	Name   string `json:"name"`
+	Prefix string `json:"prefix"`
+	// VenueID is the only venue the key works at, or null for all of them.
+	VenueID     *uint                    `json:"venue_id"`
+	Permissions []models.StaffPermission `json:"permissions"`
+	ExpiresAt   *time.Time               `json:"expires_at"`
+	LastUsedAt  *time.Time               `json:"last_used_at"`
+	RevokedAt   *time.Time               `json:"revoked_at"`
+	CreatedAt   time.Time                `json:"created_at"`
+}
+
+// NewAPIKey builds the response for an API key.
+func NewAPIKey(key *models.APIKey) APIKey {
+	return APIKey{
+		ID:          key.ID,
+		Name:        key.Name,
+		Prefix:      key.Prefix,
+		VenueID:     key.VenueID,
+		Permissions: key.Permissions(),
+		ExpiresAt:   key.ExpiresAt,
+		LastUsedAt:  key.LastUsedAt,
+		RevokedAt:   key.RevokedAt,
+		CreatedAt:   key.CreatedAt,
+	}
+}
+
+// NewAPIKeys builds the responses for a list of API keys.
+func NewAPIKeys(keys []models.APIKey) []APIKey {
+	return mapAll(keys, NewAPIKey)
+}
+
+// Session is a device an account is logged in on. Current marks the one
+// the request was made from.
+type Session struct {
+	ID         uint      `json:"id"`
+	DeviceName string    `json:"device_name"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
+
+// NewSessions builds the responses for the sessions of an account, marking
+// currentID as the current one.
+func NewSessions(sessions []models.Session, currentID uint) []Session {
+	return mapAll(sessions, func(session *models.Session) Session {
+		return Session{
+			ID:         session.ID,
+			DeviceName: session.DeviceName,
+			UserAgent:  session.UserAgent,
+			IP:         session.IP,
+			CreatedAt:  session.CreatedAt,
+			LastSeenAt: session.LastSeenAt,
+			ExpiresAt:  session.ExpiresAt,
+			Current:    session.ID == currentID,
+		}
+	})
+}
+
+// MenuItem is an item on the menu of a venue.
+type MenuItem struct {
+	ID           uint   `json:"id"`
+	VenueID      uint   `json:"venue_id"`
+	Name         string `json:"name"`
+	Description  string `json:"description"`
+	PriceInCents int64  `json:"price_in_cents"`
+	Category     string `json:"category"`
+}
+
+// NewMenuItem builds the response for a menu item.
+func NewMenuItem(item *models.MenuItem) MenuItem {
+	return MenuItem{
+		ID:           item.ID,
+		VenueID:      item.VenueId,
+		Name:         item.Name,
+		Description:  item.Description,
+		PriceInCents: item.PriceInCents,
+		Category:     item.Category,
+	}
+}
+
+// NewMenuItems builds the responses for a menu.
+func NewMenuItems(items []models.MenuItem) []MenuItem {
+	return mapAll(items, NewMenuItem)
+}
+
+// OrderVenue names the venue an order was placed at.
+type OrderVenue struct {
+	ID   uint   `json:"id"`
+	Name string `json:"name"`
+}
+
+// OrderSummary is an order as shown in lists.
+type OrderSummary struct {
+	ID                 uint               `json:"id"`
+	Status             models.OrderStatus `json:"status"`
+	DinerID            uint               `json:"diner_id"`
+	Venue              OrderVenue         `json:"venue"`
+	ItemCount          int64              `json:"item_count"`
+	TotalAmountInCents int64              `json:"total_amount_in_cents"`
+	PlacedAt           time.Time          `json:"placed_at"`
+	UpdatedAt          time.Time          `json:"updated_at"`
+}
+
+// NewOrderSummary builds the list response for an order. It expects the
+// order's items and venue to be loaded.
+func NewOrderSummary(order *models.Order) OrderSummary {
+	var itemCount int64
+	for _, item := range order.OrderItems {
+		itemCount += item.Quantity
+	}
+	return OrderSummary{
+		ID:                 order.ID,
+		Status:             order.Status,
+		DinerID:            order.DinerID,
+		Venue:              OrderVenue{ID: order.VenueID, Name: order.Venue.Name},
+		ItemCount:          itemCount,
+		TotalAmountInCents: order.TotalAmountInCents,
+		PlacedAt:           order.OrderTimestamp,
+		UpdatedAt:          order.UpdatedAt,
+	}
+}
+
+// NewOrderSummaries builds the list responses for orders.
+func NewOrderSummaries(orders []models.Order) []OrderSummary {
+	return mapAll(orders, NewOrderSummary)
+}
+
+// OrderLine is one item of an order, priced as it was when the order was placed.
+type OrderLine struct {
+	MenuItemID       uint   `json:"menu_item_id"`
+	Name             string `json:"name"`
+	Quantity         int64  `json:"quantity"`
+	UnitPriceInCents int64  `json:"unit_price_in_cents"`
+	TotalInCents     int64  `json:"total_in_cents"`
+}
+
+// OrderDetail is a single order with its lines.
+type OrderDetail struct {
+	OrderSummary
+	Items []OrderLine `json:"items"`
+}
+
+// NewOrderDetail builds the response for a single order. It expects the
+// order's items, their menu items and the venue to be loaded.
+func NewOrderDetail(order *models.Order) OrderDetail {
+	lines := make([]OrderLine, 0, len(order.OrderItems))
+	for _, item := range order.OrderItems {
+		lines = append(lines, OrderLine{
+			MenuItemID:       item.MenuItemID,
+			Name:             item.MenuItem.Name,
+			Quantity:         item.Quantity,
+			UnitPriceInCents: item.PriceInCentsAtOrder,
+			TotalInCents:     item.PriceInCentsAtOrder * item.Quantity,
+		})
+	}
+	return OrderDetail{OrderSummary: NewOrderSummary(order), Items: lines}
+}
+
+// AdminOrder is an order as platform administrators see it.
+type AdminOrder struct {
+	OrderDetail
+	// StatusReason is why an admin last forced the status.
+	StatusReason string `json:"status_reason,omitempty"`
+}
+
+// NewAdminOrder builds the administrators' response for an order. It expects
+// what NewOrderDetail does to be loaded.
+func NewAdminOrder(order *models.Order) AdminOrder {
+	return AdminOrder{OrderDetail: NewOrderDetail(order), StatusReason: order.StatusReason}
+}
+
+// AuditEntry is an entry of the audit log.
+type AuditEntry struct {
+	ID        uint      `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	ActorID   *uint     `json:"actor_id"`
+	ActorType string    `json:"actor_type"`
+	// ActorKeyID is the API key the change was made with, if any.
+	ActorKeyID *uint  `json:"actor_key_id,omitempty"`
+	Action     string `json:"action"`
+	EntityType string `json:"entity_type"`
+	EntityID   uint   `json:"entity_id"`
+	MerchantID *uint  `json:"merchant_id,omitempty"`
+	VenueID    *uint  `json:"venue_id,omitempty"`
+	// Changes maps each changed field to its values before and after.
+	Changes map[string]AuditChange `json:"changes"`
+	// IP is missing for changes made outside the API, and once the account
+	// that made the change is anonymized.
+	IP        string `json:"ip,omitempty"`
+	RequestID string `json:"request_id"`
+	PrevHash  string `json:"prev_hash"`
+	Hash      string `json:"hash"`
+}
+
+// AuditChange is a field's value before and after a change. Before is
+// missing for created fields and After for removed ones.
+type AuditChange struct {
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// NewAuditEntry builds the response for an audit entry. It expects ClientIP
+// to be loaded.
+func NewAuditEntry(entry *models.AuditEntry) AuditEntry {
+	changes := map[string]AuditChange{}
+	// Changes is written by audit.Record, so it always decodes.
+	_ = json.Unmarshal([]byte(entry.Changes), &changes)
+	var ip string
+	if entry.ClientIP != nil {
+		ip = entry.ClientIP.IP
+	}
+	return AuditEntry{
+		ID:         entry.ID,
+		CreatedAt:  entry.CreatedAt,
+		ActorID:    entry.ActorID,
+		ActorType:  entry.ActorType,
+		ActorKeyID: entry.ActorKeyID,
+		Action:     entry.Action,
+		EntityType: entry.EntityType,
+		EntityID:   entry.EntityID,
+		MerchantID: entry.MerchantID,
+		VenueID:    entry.VenueID,
+		Changes:    changes,
+		IP:         ip,
+		RequestID:  entry.RequestID,
+		PrevHash:   entry.PrevHash,
+		Hash:       entry.Hash,
+	}
+}
+
+// NewAuditEntries builds the responses for a page of the audit log.
+func NewAuditEntries(entries []models.AuditEntry) []AuditEntry {
+	return mapAll(entries, NewAuditEntry)
+}
+
+// mapAll converts every element of a list. The result is never nil, so empty
+// lists are encoded as [] rather than null.
+func mapAll[M, D any](items []M, convert func(*M) D) []D {
+	out := make([]D, 0, len(items))
+	for i := range items {
+		out = append(out, convert(&items[i]))
+	}
+	return out
+}
@@ -0,0 +1,577 @@
+package main
+
+import (
+	"encoding/json"
+	apiv1 "liven-one-go/api/v1"
+	"liven-one-go/apperror"
+	"liven-one-go/audit"
+	"liven-one-go/handlers"
+	"liven-one-go/keystore"
+	"liven-one-go/models"
+	"liven-one-go/openapi"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	openAPIPath = "/openapi.json"
+	docsPath    = "/docs"
+	jwksPath    = "/.well-known/jwks.json"
+)
+
+// apiSpec describes every route registered by setupRouter. TestOpenAPICoversRoutes
+// fails when a route is added there without an entry here.
+func apiSpec() *openapi.Spec {
+	spec := openapi.New(openapi.Info{
+		Title:   "Liven One API",
+		Version: "1.0.0",
+		Description: "Venues, menus and orders for diners and merchants. Routes under /v1/diner " +
+			"and /v1/merchant need the token returned by /v1/auth/login as a bearer token. Staff accounts " +
+			"invited by a merchant use the merchant venue, menu and order routes of the venues they are " +
+			"assigned to, as far as their permissions allow. Integrations use the same routes with an " +
+			"API key created by the merchant in the X-API-Key header instead of a token. Accounts " +
+			"with two-factor authentication get a challenge token from /v1/auth/login instead and " +
+			"exchange it with a code at /v1/auth/login/2fa. Without a password, accounts can log in with a " +
+			"mailed link from /v1/auth/magic-link or a texted or mailed code from /v1/auth/otp. Diners can also log in with a configured " +
+			"OpenID Connect provider through /v1/auth/oidc/{provider}, which responds like /v1/auth/login " +
+			"and creates their account on first use. Routes under /v1/admin need the token " +
+			"of an admin account. Suspended accounts are refused with 403. Changes made through the " +
+			"API are kept in a hash-chained audit log. Every login starts a session, named by the " +
+			"X-Device-Name header, that can be listed and signed out under /v1/me/sessions. Every /v1 " +
+			"route is rate limited and answers 429 with a Retry-After header when the limit is exceeded. The " +
+			"unversioned /auth, /public, /diner and /merchant paths of the first release still answer like " +
+			"their /v1 routes, with Deprecation and Sunset headers, until the sunset date.",
+	}, apperror.ContentType, apperror.Problem{})
+
+	spec.APIKeyHeader(handlers.APIKeyHeader)
+	spec.Enum(apperror.Code(""), apperror.Codes()...)
+	spec.Enum(models.OrderStatus(""),
+		models.OrderStatusPending, models.OrderStatusRejected, models.OrderStatusAccepted,
+		models.OrderStatusCancelled, models.OrderStatusPreparing, models.OrderStatusReadyForDelivery,
+		models.OrderStatusCompleted)
+	spec.Enum(models.StaffPermission(""),
+		models.PermissionManageMenu, models.PermissionManageOrders, models.PermissionViewAnalytics)
+	// Audit changes hold field values of any JSON type.
+	spec.Override(json.RawMessage(nil), openapi.Schema{})
+
+	message := openapi.Fields{"message": ""}
+	publicVenue := openapi.Fields{"venue": apiv1.PublicVenue{}}
+	publicVenues := openapi.Fields{"venues": []apiv1.PublicVenue{}}
+	venue := openapi.Fields{"venue": apiv1.MerchantVenue{}}
+	venues := openapi.Fields{"venues": []apiv1.MerchantVenue{}}
+	staffMember := openapi.Fields{"staff": apiv1.StaffMember{}}
+	adminUser := openapi.Fields{"user": apiv1.AdminUser{}}
+	statusFilter := openapi.QueryParam("status", "Only return orders with this status")
+	auditEntries := openapi.Fields{"entries": []apiv1.AuditEntry{}}
+	auditFilters := []openapi.Parameter{
+		openapi.QueryParam("venue_id", "Only return changes at this venue"),
+		openapi.QueryParam("actor_key_id", "Only return changes made with this API key"),
+		openapi.QueryParam("entity_type", "Only return changes to this type of entity"),
+		openapi.QueryParam("entity_id", "Only return changes to the entity with this ID"),
+		openapi.QueryParam("action", "Only return changes of this kind, such as menu_item.update"),
+		openapi.QueryParam("before_id", "Only return entries older than this one, to page through the log"),
+	}
+	readiness := openapi.Fields{"status": "", "checks": map[string]string{}}
+
+	operations := []openapi.Operation{
+		// Operations
+		{Method: http.MethodGet, Path: jwksPath, Tags: []string{"Operations"},
+			Summary:   "Public keys that verify the JWTs issued by /v1/auth/login",
+			Responses: map[int]any{http.StatusOK: keystore.JWKS{}}},
+		{Method: http.MethodGet, Path: "/healthz", Tags: []string{"Operations"},
+			Summary:   "Liveness probe",
+			Responses: map[int]any{http.StatusOK: openapi.Fields{"status": ""}}},
+		{Method: http.MethodGet, Path: "/readyz", Tags: []string{"Operations"},
+			Summary:   "Readiness probe: database, migrations and background workers",
+			Responses: map[int]any{http.StatusOK: readiness, http.StatusServiceUnavailable: readiness}},
+
+		// Authentication
+		{Method: http.MethodPost, Path: "/v1/auth/register", Tags: []string{"Authentication"},
+			Summary: "Create a diner or merchant account",
+			Request: handlers.RegisterRequest{},
+			Responses: map[int]any{
+				http.StatusCreated:    openapi.Fields{"message": "", "user": apiv1.User{}},
+				http.StatusBadRequest: nil, http.StatusConflict: nil,
+			}},
+		{Method: http.MethodPost, Path: "/v1/auth/login", Tags: []string{"Authentication"},
+			Summary: "Exchange credentials for a JWT, or for a challenge token when two-factor authentication is enabled",
+			Request: handlers.LoginRequest{},
+			Responses: map[int]any{
+				http.StatusOK:         openapi.Fields{"token": "", "two_factor_required": false, "challenge_token": "", "expires_in": 0},
+				http.StatusBadRequest: nil, http.StatusUnauthorized: nil,
+			}},
+		{Method: http.MethodPost, Path: "/v1/auth/login/2fa", Tags: []string{"Authentication"},
+			Summary: "Exchange a login challenge token and a TOTP or recovery code for a JWT",
+			Request: handlers.TwoFactorLoginRequest{},
+			Responses: map[int]any{
+				http.StatusOK:         openapi.Fields{"token": ""},
+				http.StatusBadRequest: nil, http.StatusUnauthorized: nil,
+			}},
+		{Method: http.MethodPost, Path: "/v1/auth/magic-link", Tags: []string{"Authentication"},
+			Summary: "Mail a link that logs the account in without a password",
+			Request: handlers.MagicLinkRequest{},
+			Responses: map[int]any{
+				http.StatusAccepted:   message,
+				http.StatusBadRequest: nil,
+			}},
+		{Method: http.MethodPost, Path: "/v1/auth/magic-link/verify", Tags: []string{"Authentication"},
+			Summary: "Log in with the token of a mailed login link",
+			Request: handlers.MagicLinkLoginRequest{},
+			Responses: map[int]any{
+				http.StatusOK:         openapi.Fields{"token": "", "two_factor_required": false, "challenge_token": "", "expires_in": 0},
+				http.StatusBadRequest: nil, http.StatusForbidden: nil,
+			}},
+		{Method: http.MethodPost, Path: "/v1/auth/otp", Tags: []string{"Authentication"},
+			Summary: "Text or mail a short code that logs the account in without a password",
+			Request: handlers.LoginCodeRequest{},
+			Responses: map[int]any{
+				http.StatusAccepted:   message,
+				http.StatusBadRequest: nil,
+			}},
+		{Method: http.MethodPost, Path: "/v1/auth/otp/verify", Tags: []string{"Authentication"},
+			Summary: "Log in with a texted or mailed code",
+			Request: handlers.LoginCodeLoginRequest{},
+			Responses: map[int]any{
+				http.StatusOK:         openapi.Fields{"token": "", "two_factor_required": false, "challenge_token": "", "expires_in": 0},
+				http.StatusBadRequest: nil, http.StatusUnauthorized: nil, http.StatusForbidden: nil,
+			}},
+		{Method: http.MethodPost, Path: "/v1/auth/oidc/:provider", Tags: []string{"Authentication"},
+			Summary: "Start logging in with an OpenID Connect provider and get the URL to send the browser to",
+			Responses: map[int]any{
+				http.StatusOK:         openapi.Fields{"authorization_url": "", "expires_in": 0},
+				http.StatusNotFound:   nil,
+				http.StatusBadGateway: nil,
+			}},
+		{Method: http.MethodPost, Path: "/v1/auth/oidc/:provider/callback", Tags: []string{"Authentication"},
+			Summary: "Finish logging in with the code and state the provider sent back, linking or creating the account",
+			Request: handlers.OIDCCallbackRequest{},
+			Responses: map[int]any{
+				http.StatusOK:         openapi.Fields{"token": "", "two_factor_required": false, "challenge_token": "", "expires_in": 0},
+				http.StatusBadRequest: nil, http.StatusUnauthorized: nil, http.StatusForbidden: nil,
+				http.StatusNotFound: nil, http.StatusConflict: nil, http.StatusBadGateway: nil,
+			}},
+		{Method: http.MethodPost, Path: "/v1/auth/2fa/setup", Tags: []string{"Authentication"}, Auth: true,
+			Summary: "Start enrolling an authenticator app",
+			Responses: map[int]any{
+				http.StatusOK:           openapi.Fields{"secret": "", "provisioning_uri": ""},
+				http.StatusUnauthorized: nil, http.StatusConflict: nil,
+			}},
+		{Method: http.MethodPost, Path: "/v1/auth/2fa/enable", Tags: []string{"Authentication"}, Auth: true,
+			Summary: "Confirm enrollment with a code and receive recovery codes",
+			Request: handlers.EnableTwoFactorRequest{},
+			Responses: map[int]any{
+				http.StatusOK:         openapi.Fields{"recovery_codes": []string{}, "token": ""},
+				http.StatusBadRequest: nil, http.StatusUnauthorized: nil, http.StatusConflict: nil,
+			}},
+		{Method: http.MethodPost, Path: "/v1/auth/2fa/disable", Tags: []string{"Authentication"}, Auth: true,
+			Summary: "Turn off two-factor authentication with the password and a code",
+			Request: handlers.DisableTwoFactorRequest{},
+			Responses: map[int]any{
+				http.StatusOK:         message,
+				http.StatusBadRequest: nil, http.StatusUnauthorized: nil, http.StatusForbidden: nil, http.StatusConflict: nil,
+			}},
+		{Method: http.MethodPost, Path: "/v1/auth/password/forgot", Tags: []string{"Authentication"},
+			Summary: "Email a password reset link",
+			Request: handlers.ForgotPasswordRequest{},
+			Responses: map[int]any{
+				http.StatusAccepted:   message,
+				http.StatusBadRequest: nil,
+			}},
+		{Method: http.MethodPost, Path: "/v1/auth/password/reset", Tags: []string{"Authentication"},
+			Summary: "Choose a new password with a token from a reset email",
+			Request: handlers.ResetPasswordRequest{},
+			Responses: map[int]any{
+				http.StatusOK:         message,
+				http.StatusBadRequest: nil,
+			}},
+		{Method: http.MethodPost, Path: "/v1/auth/verify-email", Tags: []string{"Authentication"},
+			Summary: "Verify an email address with a token from a verification email",
+			Request: handlers.VerifyEmailRequest{},
+			Responses: map[int]any{
+				http.StatusOK:         openapi.Fields{"message": "", "user": apiv1.User{}},
+				http.StatusBadRequest: nil,
+			}},
+		{Method: http.MethodPost, Path: "/v1/auth/email/confirm", Tags: []string{"Authentication"},
+			Summary: "Switch an account to its new address with a token from an email change",
+			Request: handlers.ConfirmEmailChangeRequest{},
+			Responses: map[int]any{
+				http.StatusOK:         openapi.Fields{"message": "", "user": apiv1.User{}},
+				http.StatusBadRequest: nil, http.StatusConflict: nil,
+			}},
+		{Method: http.MethodPost, Path: "/v1/auth/verify-email/resend", Tags: []string{"Authentication"}, Auth: true,
+			Summary: "Email a new verification link",
+			Responses: map[int]any{
+				http.StatusAccepted:     message,
+				http.StatusUnauthorized: nil, http.StatusConflict: nil,
+			}},
+		{Method: http.MethodPost, Path: "/v1/auth/staff/accept", Tags: []string{"Authentication"},
+			Summary: "Choose the password of a staff account with a token from its invitation email",
+			Request: handlers.AcceptStaffInviteRequest{},
+			Responses: map[int]any{
+				http.StatusOK:         openapi.Fields{"message": "", "user": apiv1.User{}},
+				http.StatusBadRequest: nil,
+			}},
+
+		// Public venues and menus
+		{Method: http.MethodGet, Path: "/v1/public/venues", Tags: []string{"Venues"},
+			Summary: "Search venues",
+			Query: []openapi.Parameter{
+				openapi.QueryParam("name", "Case-insensitive substring of the venue name"),
+				openapi.QueryParam("cuisine", "Case-insensitive substring of the cuisine type"),
+			},
+			Responses: map[int]any{http.StatusOK: publicVenues}},
+		{Method: http.MethodGet, Path: "/v1/public/venues/:venue_id", Tags: []string{"Venues"},
+			Summary:   "Get a venue",
+			Responses: map[int]any{http.StatusOK: publicVenue, http.StatusNotFound: nil}},
+		{Method: http.MethodGet, Path: "/v1/public/venues/:venue_id/menu", Tags: []string{"Menus"},
+			Summary:   "Get the menu of a venue",
+			Responses: map[int]any{http.StatusOK: []apiv1.MenuItem{}, http.StatusNotFound: nil}},
+
+		// Diners
+		{Method: http.MethodGet, Path: "/v1/diner", Tags: []string{"Diners"}, Auth: true,
+			Summary: "Get the account of the authenticated diner",
+			Responses: map[int]any{
+				http.StatusOK:           apiv1.User{},
+				http.StatusUnauthorized: nil, http.StatusForbidden: nil,
+			}},
+		{Method: http.MethodGet, Path: "/v1/diner/data-export", Tags: []string{"Diners"}, Auth: true,
+			Summary: "Download everything stored about the authenticated diner. With format=zip, the parts come as separate JSON files in a ZIP archive.",
+			Query:   []openapi.Parameter{openapi.QueryParam("format", "json (default) or zip")},
+			Responses: map[int]any{
+				http.StatusOK:         apiv1.DataExport{},
+				http.StatusBadRequest: nil, http.StatusUnauthorized: nil, http.StatusForbidden: nil,
+			}},
+		{Method: http.MethodPost, Path: "/v1/diner/orders", Tags: []string{"Orders"}, Auth: true,
+			Summary: "Place an order",
+			Request: handlers.PlaceOrderRequest{},
+			Responses: map[int]any{
+				http.StatusOK:         apiv1.OrderDetail{},
+				http.StatusBadRequest: nil, http.StatusUnauthorized: nil, http.StatusForbidden: nil, http.StatusNotFound: nil,
+			}},
+		{Method: http.MethodGet, Path: "/v1/diner/orders", Tags: []string{"Orders"}, Auth: true,
+			Summary: "List the orders of the authenticated diner, newest first",
+			Query:   []openapi.Parameter{statusFilter},
+			Responses: map[int]any{
+				http.StatusOK:           []apiv1.OrderSummary{},
+				http.StatusUnauthorized: nil, http.StatusForbidden: nil,
+			}},
+		{Method: http.MethodGet, Path: "/v1/diner/orders/:order_id", Tags: []string{"Orders"}, Auth: true,
+			Summary: "Get an order of the authenticated diner",
+			Responses: map[int]any{
+				http.StatusOK:           apiv1.OrderDetail{},
+				http.StatusUnauthorized: nil, http.StatusForbidden: nil, http.StatusNotFound: nil,
+			}},
+
+		// Merchants
+		{Method: http.MethodGet, Path: "/v1/merchant", Tags: []string{"Merchants"}, Auth: true,
+			Summary: "Get the account of the authenticated merchant",
+			Responses: map[int]any{
+				http.StatusOK:           apiv1.User{},
+				http.StatusUnauthorized: nil, http.StatusForbidden: nil,
+			}},
+		{Method: http.MethodPost, Path: "/v1/merchant/staff", Tags: []string{"Staff"}, Auth: true,
+			Summary: "Invite a staff account to work at venues of the authenticated merchant",
+			Request: handlers.InviteStaffRequest{},
+			Responses: map[int]any{
+				http.StatusCreated:    staffMember,
+				http.StatusBadRequest: nil, http.StatusUnauthorized: nil, http.StatusForbidden: nil,
+				http.StatusNotFound: nil, http.StatusConflict: nil,
+			}},
+		{Method: http.MethodGet, Path: "/v1/merchant/staff", Tags: []string{"Staff"}, Auth: true,
+			Summary: "List the staff accounts of the authenticated merchant",
+			Responses: map[int]any{
+				http.StatusOK:           openapi.Fields{"staff": []apiv1.StaffMember{}},
+				http.StatusUnauthorized: nil, http.StatusForbidden: nil,
+			}},
+		{Method: http.MethodGet, Path: "/v1/merchant/staff/:staff_id", Tags: []string{"Staff"}, Auth: true,
+			Summary: "Get a staff account of the authenticated merchant",
+			Responses: map[int]any{
+				http.StatusOK:           staffMember,
+				http.StatusUnauthorized: nil, http.StatusForbidden: nil, http.StatusNotFound: nil,
+			}},
+		{Method: http.MethodPut, Path: "/v1/merchant/staff/:staff_id", Tags: []string{"Staff"}, Auth: true,
+			Summary: "Replace the venues of a staff account and its permissions there",
+			Request: handlers.UpdateStaffRequest{},
+			Responses: map[int]any{
+				http.StatusOK:         staffMember,
+				http.StatusBadRequest: nil, http.StatusUnauthorized: nil, http.StatusForbidden: nil, http.StatusNotFound: nil,
+			}},
+		{Method: http.MethodDelete, Path: "/v1/merchant/staff/:staff_id", Tags: []string{"Staff"}, Auth: true,
+			Summary: "Revoke a staff account",
+			Responses: map[int]any{
+				http.StatusOK:           message,
+				http.StatusUnauthorized: nil, http.StatusForbidden: nil, http.StatusNotFound: nil,
+			}},
+
+		{Method: http.MethodPost, Path: "/v1/merchant/api-keys", Tags: []string{"API Keys"}, Auth: true,
+			Summary: "Create an API key for an integration. The key is only returned here.",
+			Request: handlers.CreateAPIKeyRequest{},
+			Responses: map[int]any{
+				http.StatusCreated:    openapi.Fields{"api_key": apiv1.APIKey{}, "key": ""},
+				http.StatusBadRequest: nil, http.StatusUnauthorized: nil, http.StatusForbidden: nil, http.StatusNotFound: nil,
+			}},
+		{Method: http.MethodGet, Path: "/v1/merchant/api-keys", Tags: []string{"API Keys"}, Auth: true,
+			Summary: "List the API keys of the authenticated merchant, revoked ones included",
+			Responses: map[int]any{
+				http.StatusOK:           openapi.Fields{"api_keys": []apiv1.APIKey{}},
+				http.StatusUnauthorized: nil, http.StatusForbidden: nil,
+			}},
+		{Method: http.MethodDelete, Path: "/v1/merchant/api-keys/:key_id", Tags: []string{"API Keys"}, Auth: true,
+			Summary: "Revoke an API key",
+			Responses: map[int]any{
+				http.StatusOK:           openapi.Fields{"api_key": apiv1.APIKey{}},
+				http.StatusUnauthorized: nil, http.StatusForbidden: nil, http.StatusNotFound: nil, http.StatusConflict: nil,
+			}},
+
+		// Sessions
+		{Method: http.MethodGet, Path: "/v1/me/sessions", Tags: []string{"Sessions"}, Auth: true,
+			Summary: "List the devices the authenticated account is logged in on, marking the current one",
+			Responses: map[int]any{
+				http.StatusOK:           openapi.Fields{"sessions": []apiv1.Session{}},
+				http.StatusUnauthorized: nil, http.StatusForbidden: nil,
+			}},
+		{Method: http.MethodDelete, Path: "/v1/me/sessions/:session_id", Tags: []string{"Sessions"}, Auth: true,
+			Summary: "Sign out a session. Its tokens stop working at once.",
+			Responses: map[int]any{
+				http.StatusOK:           message,
+				http.StatusUnauthorized: nil, http.StatusForbidden: nil, http.StatusNotFound: nil,
+			}},
+
+		// Staff
+		{Method: http.MethodGet, Path: "/v1/staff", Tags: []string{"Staff"}, Auth: true,
+			Summary: "Get the account of the authenticated staff member and the venues it works at",
+			Responses: map[int]any{
+				http.StatusOK:           apiv1.StaffAccount{},
+				http.StatusUnauthorized: nil, http.StatusForbidden: nil,
+			}},
+		{Method: http.MethodPost, Path: "/v1/merchant/venues", Tags: []string{"Venues"}, Auth: true,
+			Summary: "Create a venue",
+			Request: handlers.CreateVenueRequest{},
+			Responses: map[int]any{
+				http.StatusCreated:    venue,
+				http.StatusBadRequest: nil, http.StatusUnauthorized: nil, http.StatusForbidden: nil,
+			}},
+		{Method: http.MethodGet, Path: "/v1/merchant/venues", Tags: []string{"Venues"}, Auth: true, APIKey: true,
+			Summary: "List the venues of the authenticated merchant, those a staff account works at, or those an API key covers",
+			Responses: map[int]any{
+				http.StatusOK:           venues,
+				http.StatusUnauthorized: nil, http.StatusForbidden: nil,
+			}},
+		{Method: http.MethodGet, Path: "/v1/merchant/venues/:venue_id", Tags: []string{"Venues"}, Auth: true, APIKey: true,
+			Summary: "Get a venue of the authenticated merchant or staff account",
+			Responses: map[int]any{
+				http.StatusOK:           venue,
+				http.StatusUnauthorized: nil, http.StatusForbidden: nil, http.StatusNotFound: nil,
+			}},
+		{Method: http.MethodPut, Path: "/v1/merchant/venues/:venue_id", Tags: []string{"Venues"}, Auth: true,
+			Summary: "Update a venue. Empty fields are left unchanged.",
+			Request: handlers.UpdateVenueRequest{},
+			Responses: map[int]any{
+				http.StatusOK:         venue,
+				http.StatusBadRequest: nil, http.StatusUnauthorized: nil, http.StatusForbidden: nil, http.StatusNotFound: nil,
+			}},
+		{Method: http.MethodDelete, Path: "/v1/merchant/venues/:venue_id", Tags: []string{"Venues"}, Auth: true,
+			Summary: "Delete a venue",
+			Responses: map[int]any{
+				http.StatusOK:           message,
+				http.StatusUnauthorized: nil, http.StatusForbidden: nil, http.StatusNotFound: nil,
+			}},
+		{Method: http.MethodPost, Path: "/v1/merchant/venues/:venue_id/menuitems", Tags: []string{"Menus"}, Auth: true, APIKey: true,
+			Summary: "Add an item to the menu of a venue",
+			Request: handlers.CreateMenuItemRequest{},
+			Responses: map[int]any{
+				http.StatusCreated:    apiv1.MenuItem{},
+				http.StatusBadRequest: nil, http.StatusUnauthorized: nil, http.StatusForbidden: nil, http.StatusNotFound: nil,
+			}},
+		{Method: http.MethodGet, Path: "/v1/merchant/venues/:venue_id/menuitems", Tags: []string{"Menus"}, Auth: true, APIKey: true,
+			Summary: "List the menu items of a venue",
+			Responses: map[int]any{
+				http.StatusOK:           []apiv1.MenuItem{},
+				http.StatusUnauthorized: nil, http.StatusForbidden: nil, http.StatusNotFound: nil,
+			}},
+		{Method: http.MethodPut, Path: "/v1/merchant/venues/:venue_id/menuitems/:item_id", Tags: []string{"Menus"}, Auth: true, APIKey: true,
+			Summary: "Update a menu item. Omitted fields are left unchanged.",
+			Request: handlers.UpdateMenuItemRequest{},
+			Responses: map[int]any{
+				http.StatusOK:         apiv1.MenuItem{},
+				http.StatusBadRequest: nil, http.StatusUnauthorized: nil, http.StatusForbidden: nil, http.StatusNotFound: nil,
+			}},
+		{Method: http.MethodDelete, Path: "/v1/merchant/venues/:venue_id/menuitems/:item_id", Tags: []string{"Menus"}, Auth: true, APIKey: true,
+			Summary: "Delete a menu item",
+			Responses: map[int]any{
+				http.StatusOK:           message,
+				http.StatusUnauthorized: nil, http.StatusForbidden: nil, http.StatusNotFound: nil,
+			}},
+		{Method: http.MethodGet, Path: "/v1/merchant/venues/:venue_id/orders", Tags: []string{"Orders"}, Auth: true, APIKey: true,
+			Summary: "List the orders of a venue, newest first",
+			Query:   []openapi.Parameter{statusFilter},
+			Responses: map[int]any{
+				http.StatusOK:           []apiv1.OrderSummary{},
+				http.StatusUnauthorized: nil, http.StatusForbidden: nil, http.StatusNotFound: nil,
+			}},
+		{Method: http.MethodGet, Path: "/v1/merchant/audit", Tags: []string{"Audit"}, Auth: true,
+			Summary: "List the changes made to the merchant's venues, menus, orders and staff, newest first, 100 at a time",
+			Query:   auditFilters,
+			Responses: map[int]any{
+				http.StatusOK:         auditEntries,
+				http.StatusBadRequest: nil, http.StatusUnauthorized: nil, http.StatusForbidden: nil,
+			}},
+		{Method: http.MethodGet, Path: "/v1/merchant/orders/:order_id", Tags: []string{"Orders"}, Auth: true, APIKey: true,
+			Summary: "Get an order placed at one of the merchant's venues, or a venue where a staff account may see orders",
+			Responses: map[int]any{
+				http.StatusOK:           apiv1.OrderDetail{},
+				http.StatusUnauthorized: nil, http.StatusForbidden: nil, http.StatusNotFound: nil,
+			}},
+		{Method: http.MethodPut, Path: "/v1/merchant/orders/:order_id/status", Tags: []string{"Orders"}, Auth: true, APIKey: true,
+			Summary: "Change the status of an order placed at one of the merchant's venues, or a venue where a staff account manages orders",
+			Request: handlers.UpdateOrderStatusRequest{},
+			Responses: map[int]any{
+				http.StatusOK:         apiv1.OrderDetail{},
+				http.StatusBadRequest: nil, http.StatusUnauthorized: nil, http.StatusForbidden: nil, http.StatusNotFound: nil,
+			}},
+
+		// Admin
+		{Method: http.MethodGet, Path: "/v1/admin/users", Tags: []string{"Admin"}, Auth: true,
+			Summary: "Search accounts, newest first",
+			Query: []openapi.Parameter{
+				openapi.QueryParam("q", "Part of the email address"),
+				openapi.QueryParam("user_type", "Only return accounts of this type"),
+				openapi.QueryParam("suspended", "true or false to only return suspended or active accounts"),
+			},
+			Responses: map[int]any{
+				http.StatusOK:         openapi.Fields{"users": []apiv1.AdminUser{}},
+				http.StatusBadRequest: nil, http.StatusUnauthorized: nil, http.StatusForbidden: nil,
+			}},
+		{Method: http.MethodGet, Path: "/v1/admin/users/:user_id", Tags: []string{"Admin"}, Auth: true,
+			Summary: "Get any account",
+			Responses: map[int]any{
+				http.StatusOK:           adminUser,
+				http.StatusUnauthorized: nil, http.StatusForbidden: nil, http.StatusNotFound: nil,
+			}},
+		{Method: http.MethodPost, Path: "/v1/admin/users/:user_id/suspend", Tags: []string{"Admin"}, Auth: true,
+			Summary: "Suspend an account. Its tokens stop working and a merchant's venues are hidden from diners.",
+			Request: handlers.SuspendUserRequest{},
+			Responses: map[int]any{
+				http.StatusOK:         adminUser,
+				http.StatusBadRequest: nil, http.StatusUnauthorized: nil, http.StatusForbidden: nil,
+				http.StatusNotFound: nil, http.StatusConflict: nil,
+			}},
+		{Method: http.MethodPost, Path: "/v1/admin/users/:user_id/reinstate", Tags: []string{"Admin"}, Auth: true,
+			Summary: "Lift the suspension of an account",
+			Responses: map[int]any{
+				http.StatusOK:           adminUser,
+				http.StatusUnauthorized: nil, http.StatusForbidden: nil, http.StatusNotFound: nil, http.StatusConflict: nil,
+			}},
+		{Method: http.MethodPost, Path: "/v1/admin/users/:user_id/impersonate", Tags: []string{"Admin"}, Auth: true,
+			Summary: "Get a short-lived, read-only token that acts as the account",
+			Responses: map[int]any{
+				http.StatusOK:           openapi.Fields{"token": "", "expires_in": 0, "user": apiv1.AdminUser{}},
+				http.StatusUnauthorized: nil, http.StatusForbidden: nil, http.StatusNotFound: nil,
+			}},
+		{Method: http.MethodGet, Path: "/v1/admin/venues", Tags: []string{"Admin"}, Auth: true,
+			Summary: "Search venues, newest first",
+			Query: []openapi.Parameter{
+				openapi.QueryParam("q", "Part of the venue name"),
+				openapi.QueryParam("merchant_id", "Only return venues of this merchant"),
+			},
+			Responses: map[int]any{
+				http.StatusOK:         venues,
+				http.StatusBadRequest: nil, http.StatusUnauthorized: nil, http.StatusForbidden: nil,
+			}},
+		{Method: http.MethodGet, Path: "/v1/admin/orders", Tags: []string{"Admin"}, Auth: true,
+			Summary: "Search orders, newest first",
+			Query: []openapi.Parameter{
+				openapi.QueryParam("venue_id", "Only return orders placed at this venue"),
+				openapi.QueryParam("diner_id", "Only return orders placed by this diner"),
+				statusFilter,
+			},
+			Responses: map[int]any{
+				http.StatusOK:         []apiv1.OrderSummary{},
+				http.StatusBadRequest: nil, http.StatusUnauthorized: nil, http.StatusForbidden: nil,
+			}},
+		{Method: http.MethodGet, Path: "/v1/admin/orders/:order_id", Tags: []string{"Admin"}, Auth: true,
+			Summary: "Get any order",
+			Responses: map[int]any{
+				http.StatusOK:           apiv1.AdminOrder{},
+				http.StatusUnauthorized: nil, http.StatusForbidden: nil, http.StatusNotFound: nil,
+			}},
+		{Method: http.MethodPut, Path: "/v1/admin/orders/:order_id/status", Tags: []string{"Admin"}, Auth: true,
+			Summary: "Force the status of any order, recording the reason",
+			Request: handlers.ForceOrderStatusRequest{},
+			Responses: map[int]any{
+				http.StatusOK:         apiv1.AdminOrder{},
+				http.StatusBadRequest: nil, http.StatusUnauthorized: nil, http.StatusForbidden: nil, http.StatusNotFound: nil,
+			}},
+		{Method: http.MethodGet, Path: "/v1/admin/audit", Tags: []string{"Audit"}, Auth: true,
+			Summary: "List every change, newest first, 100 at a time",
+			Query: append([]openapi.Parameter{
+				openapi.QueryParam("actor_id", "Only return changes made by this account"),
+				openapi.QueryParam("merchant_id", "Only return changes to this merchant's venues and staff"),
+			}, auditFilters...),
+			Responses: map[int]any{
+				http.StatusOK:         auditEntries,
+				http.StatusBadRequest: nil, http.StatusUnauthorized: nil, http.StatusForbidden: nil,
+			}},
+		{Method: http.MethodGet, Path: "/v1/admin/audit/verify", Tags: []string{"Audit"}, Auth: true,
+			Summary: "Check the hash chain of the audit log. head is the hash of the newest entry, to keep elsewhere so removing the newest entries is detected.",
+			Responses: map[int]any{
+				http.StatusOK:           openapi.Fields{"valid": false, "report": audit.Report{}, "head": ""},
+				http.StatusUnauthorized: nil, http.StatusForbidden: nil,
+			}},
+	}
+	operations = append(operations, accountOperations("/v1/diner", "Diners", models.UserTypeDiner)...)
+	operations = append(operations, accountOperations("/v1/merchant", "Merchants", models.UserTypeMerchant)...)
+
+	for _, op := range operations {
+		if strings.HasPrefix(op.Path, "/v1/") {
+			op.Responses[http.StatusTooManyRequests] = nil
+		}
+		spec.Add(op)
+	}
+
+	return spec
+}
+
+// accountOperations describes the profile and account routes that diners and
+// merchants both have under path.
+func accountOperations(path, tag, userType string) []openapi.Operation {
+	profile := openapi.Fields{"profile": apiv1.Profile{}}
+	return []openapi.Operation{
+		{Method: http.MethodDelete, Path: path, Tags: []string{tag}, Auth: true,
+			Summary: "Delete the account of the authenticated " + userType + ", confirming the password. " +
+				"Its personal data is anonymized once the grace period is over, unless the " + userType + " logs in again before.",
+			Request: handlers.DeleteAccountRequest{},
+			Responses: map[int]any{
+				http.StatusAccepted:   openapi.Fields{"message": "", "deletion_due_at": time.Time{}},
+				http.StatusBadRequest: nil, http.StatusUnauthorized: nil, http.StatusForbidden: nil, http.StatusConflict: nil,
+			}},
+		{Method: http.MethodGet, Path: path + "/profile", Tags: []string{tag}, Auth: true,
+			Summary: "Get the profile of the authenticated " + userType,
+			Responses: map[int]any{
+				http.StatusOK:           profile,
+				http.StatusUnauthorized: nil, http.StatusForbidden: nil,
+			}},
+		{Method: http.MethodPut, Path: path + "/profile", Tags: []string{tag}, Auth: true,
+			Summary: "Replace the profile of the authenticated " + userType + ". Omitted fields are cleared.",
+			Request: handlers.UpdateProfileRequest{},
+			Responses: map[int]any{
+				http.StatusOK:         profile,
+				http.StatusBadRequest: nil, http.StatusUnauthorized: nil, http.StatusForbidden: nil,
+			}},
+		{Method: http.MethodPut, Path: path + "/password", Tags: []string{tag}, Auth: true,
+			Summary: "Change the password, signing out every other client. The response carries a new token for this one.",
+			Request: handlers.ChangePasswordRequest{},
+			Responses: map[int]any{
+				http.StatusOK:         openapi.Fields{"message": "", "token": ""},
+				http.StatusBadRequest: nil, http.StatusUnauthorized: nil, http.StatusForbidden: nil,
+			}},
+		{Method: http.MethodPost, Path: path + "/email", Tags: []string{tag}, Auth: true,
+			Summary: "Change the email address. It takes effect once the link mailed to the new address is opened.",
+			Request: handlers.ChangeEmailRequest{},
+			Responses: map[int]any{
+				http.StatusAccepted:   openapi.Fields{"message": "", "user": apiv1.User{}},
+				http.StatusBadRequest: nil, http.StatusUnauthorized: nil, http.StatusForbidden: nil, http.StatusConflict: nil,
+			}},
+	}
+}
@@ -0,0 +1,215 @@
+// Package apperror defines the errors the API reports to clients. Each has a
+// stable machine-readable code and is rendered as an RFC 7807 problem. The
+// underlying cause is kept for the logs and never sent to the client.
+package apperror
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// ContentType is the media type of rendered problems.
+const ContentType = "application/problem+json"
+
+// Code identifies a kind of error. Codes are part of the API contract: clients
+// branch on them, so existing codes must never be renamed.
+type Code string
+
+const (
+	CodeInvalidRequest      Code = "INVALID_REQUEST"
+	CodeValidationFailed    Code = "VALIDATION_FAILED"
+	CodeUnauthenticated     Code = "UNAUTHENTICATED"
+	CodeInvalidCredentials  Code = "INVALID_CREDENTIALS"
+	CodeWrongAccountType    Code = "WRONG_ACCOUNT_TYPE"
+	CodeEmailTaken          Code = "EMAIL_TAKEN"
+	CodeMerchantHasVenues   Code = "MERCHANT_HAS_VENUES"
+	CodeVenueNotFound       Code = "VENUE_NOT_FOUND"
+	CodeNotVenueOwner       Code = "NOT_VENUE_OWNER"
+	CodeMissingPermission   Code = "MISSING_PERMISSION"
+	CodeAPIKeyNotAllowed    Code = "API_KEY_NOT_ALLOWED"
+	CodeAPIKeyNotFound      Code = "API_KEY_NOT_FOUND"
+	CodeAPIKeyRevoked       Code = "API_KEY_ALREADY_REVOKED"
+	CodeSessionNotFound     Code = "SESSION_NOT_FOUND"
+	CodeMenuItemNotFound    Code = "MENU_ITEM_NOT_FOUND"
+	CodeMenuItemUnavailable Code = "MENU_ITEM_UNAVAILABLE"
+	CodeOrderNotFound       Code = "ORDER_NOT_FOUND"
+	CodeUserNotFound        Code = "USER_NOT_FOUND"
+	CodeStaffNotFound       Code = "STAFF_NOT_FOUND"
+	CodeInvalidOrderStatus  Code = "INVALID_ORDER_STATUS"
+	CodeRouteNotFound       Code = "ROUTE_NOT_FOUND"
+	CodeRateLimited         Code = "RATE_LIMITED"
+	CodeAccountLocked       Code = "ACCOUNT_LOCKED"
+	CodeAccountSuspended    Code = "ACCOUNT_SUSPENDED"
+	CodeAlreadySuspended    Code = "ACCOUNT_ALREADY_SUSPENDED"
+	CodeNotSuspended        Code = "ACCOUNT_NOT_SUSPENDED"
+	CodeReadOnly            Code = "IMPERSONATION_READ_ONLY"
+	CodeInvalidToken        Code = "INVALID_TOKEN"
+	CodeEmailNotVerified    Code = "EMAIL_NOT_VERIFIED"
+	CodeEmailVerified       Code = "EMAIL_ALREADY_VERIFIED"
+	CodeTwoFactorRequired   Code = "TWO_FACTOR_REQUIRED"
+	CodeTwoFactorEnabled    Code = "TWO_FACTOR_ALREADY_ENABLED"
+	CodeTwoFactorDisabled   Code = "TWO_FACTOR_NOT_ENABLED"
+	CodeInvalidTwoFactor    Code = "INVALID_TWO_FACTOR_CODE"
+	CodeProviderNotFound    Code = "IDENTITY_PROVIDER_NOT_FOUND"
+	CodeProviderFailed      Code = "IDENTITY_PROVIDER_ERROR"
+	CodeInternal            Code = "INTERNAL_ERROR"
+	CodeUnavailable         Code = "SERVICE_UNAVAILABLE"
+)
+
+type definition struct {
+	status int
+	title  string
+}
+
+var definitions = map[Code]definition{
+	CodeInvalidRequest:      {http.StatusBadRequest, "The request body is not valid JSON"},
+	CodeValidationFailed:    {http.StatusBadRequest, "The request failed validation"},
+	CodeUnauthenticated:     {http.StatusUnauthorized, "Authentication is required"},
+	CodeInvalidCredentials:  {http.StatusUnauthorized, "The email or password is incorrect"},
+	CodeWrongAccountType:    {http.StatusForbidden, "This account type can't perform the action"},
+	CodeEmailTaken:          {http.StatusConflict, "The email is already registered"},
+	CodeMerchantHasVenues:   {http.StatusConflict, "The merchant still owns venues"},
+	CodeVenueNotFound:       {http.StatusNotFound, "The venue does not exist"},
+	CodeNotVenueOwner:       {http.StatusForbidden, "The venue belongs to another merchant"},
+	CodeMissingPermission:   {http.StatusForbidden, "The staff account or API key lacks the permission for this venue"},
+	CodeAPIKeyNotAllowed:    {http.StatusForbidden, "API keys can't perform the action"},
+	CodeAPIKeyNotFound:      {http.StatusNotFound, "The API key does not exist"},
+	CodeAPIKeyRevoked:       {http.StatusConflict, "The API key is already revoked"},
+	CodeSessionNotFound:     {http.StatusNotFound, "The session does not exist or has ended"},
+	CodeMenuItemNotFound:    {http.StatusNotFound, "The menu item does not exist"},
+	CodeMenuItemUnavailable: {http.StatusBadRequest, "The menu item can't be ordered at this venue"},
+	CodeOrderNotFound:       {http.StatusNotFound, "The order does not exist"},
+	CodeUserNotFound:        {http.StatusNotFound, "The user does not exist"},
+	CodeStaffNotFound:       {http.StatusNotFound, "The staff member does not exist"},
+	CodeInvalidOrderStatus:  {http.StatusBadRequest, "The order status is not valid"},
+	CodeRouteNotFound:       {http.StatusNotFound, "No route matches the request"},
+	CodeRateLimited:         {http.StatusTooManyRequests, "Too many requests"},
+	CodeAccountLocked:       {http.StatusTooManyRequests, "The account is temporarily locked"},
+	CodeAccountSuspended:    {http.StatusForbidden, "The account is suspended"},
+	CodeAlreadySuspended:    {http.StatusConflict, "The account is already suspended"},
+	CodeNotSuspended:        {http.StatusConflict, "The account is not suspended"},
+	CodeReadOnly:            {http.StatusForbidden, "Impersonation tokens can only read"},
+	CodeInvalidToken:        {http.StatusBadRequest, "The token is invalid, expired or already used"},
+	CodeEmailNotVerified:    {http.StatusForbidden, "The email address is not verified"},
+	CodeEmailVerified:       {http.StatusConflict, "The email address is already verified"},
+	CodeTwoFactorRequired:   {http.StatusForbidden, "Two-factor authentication is required"},
+	CodeTwoFactorEnabled:    {http.StatusConflict, "Two-factor authentication is already enabled"},
+	CodeTwoFactorDisabled:   {http.StatusConflict, "Two-factor authentication is not enabled"},
+	CodeInvalidTwoFactor:    {http.StatusBadRequest, "The two-factor code is incorrect or was already used"},
+	CodeProviderNotFound:    {http.StatusNotFound, "The identity provider is not configured"},
+	CodeProviderFailed:      {http.StatusBadGateway, "The identity provider could not be reached"},
+	CodeInternal:            {http.StatusInternalServerError, "An unexpected error occurred"},
+	CodeUnavailable:         {http.StatusServiceUnavailable, "The service is temporarily unavailable"},
+}
+
+// Codes lists every error code, sorted.
+func Codes() []any {
+	codes := make([]any, 0, len(definitions))
+	for code := range definitions {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i].(Code) < codes[j].(Code) })
+	return codes
+}
+
+// Error is an error with a code, a message safe to show to clients and an
+// optional cause that is only logged.
+type Error struct {
+	Code   Code
+	Detail string
+	Fields []FieldError
+	Err    error
+}
+
+// FieldError reports one invalid field of a request body.
+type FieldError struct {
+	// Field is the JSON path of the field, such as items[0].quantity.
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// New returns an error with the given code and client-facing detail.
+func New(code Code, detail string) *Error {
+	return &Error{Code: code, Detail: detail}
+}
+
+// Internal wraps an unexpected failure. Clients only see a generic message.
+func Internal(err error) *Error {
+	return &Error{Code: CodeInternal, Err: err}
+}
+
+// Internalf wraps an unexpected failure with context for the logs.
+func Internalf(format string, args ...any) *Error {
+	return Internal(fmt.Errorf(format, args...))
+}
+
+func (e *Error) Error() string {
+	msg := string(e.Code)
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Status is the HTTP status code of the error.
+func (e *Error) Status() int {
+	if def, ok := definitions[e.Code]; ok {
+		return def.status
+	}
+	return http.StatusInternalServerError
+}
+
+// Title is the fixed summary of the error code.
+func (e *Error) Title() string {
+	if def, ok := definitions[e.Code]; ok {
+		return def.title
+	}
+	return definitions[CodeInternal].title
+}
+
+// From converts any error into an *Error. Errors that aren't already an
+// *Error are treated as internal failures.
+func From(err error) *Error {
+	var appErr *Error
+	if errors.As(err, &appErr) {
+		return appErr
+	}
+	return Internal(err)
+}
+
+// Problem is the RFC 7807 body of an error response, extended with the error
+// code, the request ID and per-field validation errors.
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      Code         `json:"code"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+}
+
+// Problem renders the error for the request at instance.
+func (e *Error) Problem(instance, requestID string) Problem {
+	return Problem{
+		Type:      "urn:liven-one:problem:" + string(e.Code),
+		Title:     e.Title(),
+		Status:    e.Status(),
+		Detail:    e.Detail,
+		Instance:  instance,
+		Code:      e.Code,
+		RequestID: requestID,
+		Errors:    e.Fields,
+	}
+}
@@ -0,0 +1,44 @@
+package apperror
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBindingMalformedJSON(t *testing.T) {
+	var dst struct {
+		Quantity int `json:"quantity"`
+	}
+	err := Binding(json.NewDecoder(strings.NewReader(`{"quantity": "two"}`)).Decode(&dst))
+	if err.Code != CodeValidationFailed || len(err.Fields) != 1 {
+		t.Fatalf("got %+v, want one field error", err)
+	}
+	if got := err.Fields[0]; got.Field != "quantity" || got.Message != "must be a number" {
+		t.Errorf("field error = %+v", got)
+	}
+
+	err = Binding(json.NewDecoder(strings.NewReader(`{"quantity":`)).Decode(&dst))
+	if err.Code != CodeInvalidRequest {
+		t.Errorf("truncated body code = %s, want %s", err.Code, CodeInvalidRequest)
+	}
+}
+
+func TestFromHidesInternalCauses(t *testing.T) {
+	err := From(errors.New("database is locked"))
+	if err.Status() != http.StatusInternalServerError {
+		t.Fatalf("status = %d", err.Status())
+	}
+	problem := err.Problem("/diner/orders", "req-1")
+	body, _ := json.Marshal(problem)
+	if strings.Contains(string(body), "locked") {
+		t.Errorf("problem leaks the cause: %s", body)
+	}
+
+	wrapped := From(errors.Join(errors.New("context"), New(CodeOrderNotFound, "Order not found")))
+	if wrapped.Code != CodeOrderNotFound {
+		t.Errorf("wrapped code = %s, want %s", wrapped.Code, CodeOrderNotFound)
+	}
+}
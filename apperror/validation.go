@@ -0,0 +1,121 @@
+package apperror
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// Binding converts the error of binding a request body into a client error:
+// malformed JSON becomes INVALID_REQUEST and failed validation rules become
+// VALIDATION_FAILED with one entry per field. The raw messages of the JSON
+// decoder and the validator are not exposed.
+func Binding(err error) *Error {
+	var validationErrs validator.ValidationErrors
+	if errors.As(err, &validationErrs) {
+		fields := make([]FieldError, 0, len(validationErrs))
+		for _, fieldErr := range validationErrs {
+			fields = append(fields, FieldError{
+				Field:   fieldPath(fieldErr.Namespace()),
+				Rule:    fieldErr.Tag(),
+				Message: ruleMessage(fieldErr),
+			})
+		}
+		return &Error{Code: CodeValidationFailed, Detail: "One or more fields are invalid", Fields: fields}
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return &Error{
+			Code:   CodeValidationFailed,
+			Detail: "One or more fields are invalid",
+			Fields: []FieldError{{
+				Field:   typeErr.Field,
+				Rule:    "type",
+				Message: "must be a " + jsonType(typeErr.Type.Kind().String()),
+			}},
+		}
+	}
+
+	if errors.Is(err, io.EOF) {
+		return &Error{Code: CodeInvalidRequest, Detail: "The request body is empty"}
+	}
+	return &Error{Code: CodeInvalidRequest, Detail: "The request body could not be parsed as JSON", Err: err}
+}
+
+// Validation reports a single invalid field found outside of binding.
+func Validation(field, rule, message string) *Error {
+	return &Error{
+		Code:   CodeValidationFailed,
+		Detail: "One or more fields are invalid",
+		Fields: []FieldError{{Field: field, Rule: rule, Message: message}},
+	}
+}
+
+// fieldPath drops the struct name the validator puts in front of the path.
+// It relies on the validator reporting JSON names, see handlers.init.
+func fieldPath(namespace string) string {
+	if _, path, ok := strings.Cut(namespace, "."); ok {
+		return path
+	}
+	return namespace
+}
+
+func ruleMessage(err validator.FieldError) string {
+	switch err.Tag() {
+	case "required":
+		return "is required"
+	case "email":
+		return "must be a valid email address"
+	case "e164":
+		return "must be a phone number in international format, such as +61412345678"
+	case "url":
+		return "must be a URL"
+	case "bcp47_language_tag":
+		return "must be a language tag, such as en-AU"
+	case "oneof":
+		return "must be one of: " + strings.Join(strings.Fields(err.Param()), ", ")
+	case "gt":
+		return "must be greater than " + err.Param()
+	case "gte":
+		return "must be at least " + err.Param()
+	case "min", "max":
+		return lengthMessage(err)
+	default:
+		return fmt.Sprintf("failed the %q rule", err.Tag())
+	}
+}
+
+func lengthMessage(err validator.FieldError) string {
+	bound := "at least"
+	if err.Tag() == "max" {
+		bound = "at most"
+	}
+	switch err.Kind().String() {
+	case "string":
+		return fmt.Sprintf("must be %s %s characters long", bound, err.Param())
+	case "slice", "array", "map":
+		return fmt.Sprintf("must have %s %s entries", bound, err.Param())
+	default:
+		return fmt.Sprintf("must be %s %s", bound, err.Param())
+	}
+}
+
+func jsonType(kind string) string {
+	switch {
+	case strings.HasPrefix(kind, "int"), strings.HasPrefix(kind, "uint"), strings.HasPrefix(kind, "float"):
+		return "number"
+	case kind == "bool":
+		return "boolean"
+	case kind == "slice", kind == "array":
+		return "array"
+	case kind == "struct", kind == "map":
+		return "object"
+	default:
+		return kind
+	}
+}
@@ -0,0 +1,279 @@
+// Package audit keeps the append-only log of changes made through the API.
+// Every entry carries the hash of the one before it, so an entry edited or
+// removed directly in the database is found by Verify.
+package audit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"liven-one-go/models"
+)
+
+// Entity types.
+const (
+	EntityVenue    = "venue"
+	EntityMenuItem = "menu_item"
+	EntityOrder    = "order"
+	EntityUser     = "user"
+	EntityAPIKey   = "api_key"
+)
+
+// Actions.
+const (
+	VenueCreate          = "venue.create"
+	VenueUpdate          = "venue.update"
+	VenueDelete          = "venue.delete"
+	VenueTransfer        = "venue.transfer"
+	MenuItemCreate       = "menu_item.create"
+	MenuItemUpdate       = "menu_item.update"
+	MenuItemDelete       = "menu_item.delete"
+	OrderPlace           = "order.place"
+	OrderStatus          = "order.status"
+	OrderForceStatus     = "order.force_status"
+	StaffInvite          = "staff.invite"
+	StaffUpdate          = "staff.update"
+	StaffRemove          = "staff.remove"
+	StaffAccept          = "staff.accept"
+	APIKeyCreate         = "api_key.create"
+	APIKeyRevoke         = "api_key.revoke"
+	UserCreate           = "user.create"
+	UserSuspend          = "user.suspend"
+	UserReinstate        = "user.reinstate"
+	UserImpersonate      = "user.impersonate"
+	UserProfileUpdate    = "user.profile_update"
+	UserPasswordChange   = "user.password_change"
+	UserPasswordReset    = "user.password_reset"
+	UserTwoFactorReset   = "user.two_factor_reset"
+	UserTwoFactorEnable  = "user.two_factor_enable"
+	UserTwoFactorDisable = "user.two_factor_disable"
+	UserSessionEnd       = "user.session_end"
+	UserUnlock           = "user.unlock"
+	UserEmailVerify      = "user.email_verify"
+	UserTokenIssue       = "user.token_issue"
+	UserEmailChange      = "user.email_change"
+	UserDelete           = "user.delete"
+	UserRestore          = "user.restore"
+	UserAnonymize        = "user.anonymize"
+	UserIdentityLink     = "user.identity_link"
+)
+
+// Actor types besides the user types.
+const (
+	// ActorSystem is the ActorType of changes the server makes on its own,
+	// such as anonymizing accounts whose deletion is due.
+	ActorSystem = "system"
+	// ActorOperator is the ActorType of changes made with the commands of
+	// the binary, by whoever has access to the server.
+	ActorOperator = "operator"
+)
+
+// Entry describes a change to record.
+type Entry struct {
+	ActorID   uint
+	ActorType string
+	// ActorKeyID is the API key the actor made the change with, if any.
+	ActorKeyID uint
+
+	Action     string
+	EntityType string
+	EntityID   uint
+	// MerchantID is looked up from VenueID when it is zero.
+	MerchantID uint
+	VenueID    uint
+
+	// Before and After are the entity before and after the change, as
+	// anything that encodes to a JSON object. Before is nil for creations
+	// and After for deletions.
+	Before, After any
+
+	// IP is stored beside the entry rather than in it; see models.AuditIP.
+	IP        string
+	RequestID string
+}
+
+// Change is a field's value before and after a change.
+type Change struct {
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// Record appends an entry to the log. It must run in the transaction that
+// makes the change, so the change isn't kept without its entry, and that
+// transaction serializes appends on the single writer connection.
+func Record(tx *gorm.DB, e Entry, now time.Time) (*models.AuditEntry, error) {
+	changes, err := Diff(e.Before, e.After)
+	if err != nil {
+		return nil, err
+	}
+	if e.MerchantID == 0 && e.VenueID != 0 {
+		var venue models.Venue
+		if err := tx.Unscoped().Select("merchant_id").First(&venue, e.VenueID).Error; err != nil {
+			return nil, fmt.Errorf("get venue merchant: %w", err)
+		}
+		e.MerchantID = venue.MerchantID
+	}
+
+	var last models.AuditEntry
+	if err := tx.Select("hash").Order("id DESC").Limit(1).Find(&last).Error; err != nil {
+		return nil, fmt.Errorf("get last audit entry: %w", err)
+	}
+
+	entry := &models.AuditEntry{
+		CreatedAt:  now.UTC().Truncate(time.Microsecond),
+		ActorID:    optional(e.ActorID),
+		ActorType:  e.ActorType,
+		ActorKeyID: optional(e.ActorKeyID),
+		Action:     e.Action,
+		EntityType: e.EntityType,
+		EntityID:   e.EntityID,
+		MerchantID: optional(e.MerchantID),
+		VenueID:    optional(e.VenueID),
+		Changes:    string(changes),
+		RequestID:  e.RequestID,
+		PrevHash:   last.Hash,
+	}
+	entry.Hash = Hash(entry)
+	if err := tx.Create(entry).Error; err != nil {
+		return nil, fmt.Errorf("create audit entry: %w", err)
+	}
+	if e.IP != "" {
+		entry.ClientIP = &models.AuditIP{AuditEntryID: entry.ID, ActorID: entry.ActorID, IP: e.IP}
+		if err := tx.Create(entry.ClientIP).Error; err != nil {
+			return nil, fmt.Errorf("create audit entry IP: %w", err)
+		}
+	}
+	return entry, nil
+}
+
+// Diff returns a JSON object of the top-level fields that differ between
+// before and after, each mapped to a Change.
+func Diff(before, after any) (json.RawMessage, error) {
+	beforeFields, err := fields(before)
+	if err != nil {
+		return nil, err
+	}
+	afterFields, err := fields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := map[string]Change{}
+	for name, value := range beforeFields {
+		if !bytes.Equal(value, afterFields[name]) {
+			changes[name] = Change{Before: value, After: afterFields[name]}
+		}
+	}
+	for name, value := range afterFields {
+		if _, ok := beforeFields[name]; !ok {
+			changes[name] = Change{After: value}
+		}
+	}
+	return json.Marshal(changes)
+}
+
+// fields encodes v and splits the resulting object into its fields, each
+// compacted so equal values compare equal.
+func fields(v any) (map[string]json.RawMessage, error) {
+	if v == nil {
+		return nil, nil
+	}
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("encode audited value: %w", err)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		return nil, fmt.Errorf("audited value is not a JSON object: %w", err)
+	}
+	for name, value := range fields {
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, value); err != nil {
+			return nil, err
+		}
+		fields[name] = compact.Bytes()
+	}
+	return fields, nil
+}
+
+// Hash computes the chain hash of an entry from its content and PrevHash.
+// The ID isn't covered, as it is assigned when the entry is stored, nor the
+// client IP, which is erased when its account is anonymized.
+func Hash(entry *models.AuditEntry) string {
+	content, _ := json.Marshal(struct {
+		CreatedAt string `json:"created_at"`
+		ActorID   *uint  `json:"actor_id"`
+		ActorType string `json:"actor_type"`
+		// Omitted when empty, so entries from before API keys keep their hash.
+		ActorKeyID *uint  `json:"actor_key_id,omitempty"`
+		Action     string `json:"action"`
+		EntityType string `json:"entity_type"`
+		EntityID   uint   `json:"entity_id"`
+		MerchantID *uint  `json:"merchant_id"`
+		VenueID    *uint  `json:"venue_id"`
+		Changes    string `json:"changes"`
+		RequestID  string `json:"request_id"`
+		PrevHash   string `json:"prev_hash"`
+	}{
+		entry.CreatedAt.UTC().Format(time.RFC3339Nano), entry.ActorID, entry.ActorType, entry.ActorKeyID, entry.Action,
+		entry.EntityType, entry.EntityID, entry.MerchantID, entry.VenueID, entry.Changes,
+		entry.RequestID, entry.PrevHash,
+	})
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// ErrBrokenChain is returned by Verify when an entry doesn't match its hash
+// or doesn't follow the entry before it.
+var ErrBrokenChain = errors.New("audit log hash chain is broken")
+
+// Report is the result of Verify.
+type Report struct {
+	// Entries is how many entries were checked.
+	Entries int `json:"entries"`
+	// BrokenAt is the ID of the first entry that failed, if any.
+	BrokenAt uint `json:"broken_at,omitempty"`
+}
+
+// Verify recomputes the hash chain from the first entry. It returns
+// ErrBrokenChain with the ID of the first entry that was edited, or that
+// follows a removed one. Removing the newest entries isn't detectable from
+// the chain alone; compare the last hash with one recorded elsewhere.
+func Verify(db *gorm.DB) (Report, error) {
+	var report Report
+	prevHash := ""
+	var batch []models.AuditEntry
+	err := db.Order("id").FindInBatches(&batch, 500, func(tx *gorm.DB, _ int) error {
+		for i := range batch {
+			entry := &batch[i]
+			if entry.PrevHash != prevHash || Hash(entry) != entry.Hash {
+				report.BrokenAt = entry.ID
+				return fmt.Errorf("%w at entry %d", ErrBrokenChain, entry.ID)
+			}
+			prevHash = entry.Hash
+			report.Entries++
+		}
+		return nil
+	}).Error
+	return report, err
+}
+
+// Head returns the hash of the newest entry, or "" when the log is empty.
+func Head(db *gorm.DB) (string, error) {
+	var last models.AuditEntry
+	err := db.Select("hash").Order("id DESC").Limit(1).Find(&last).Error
+	return last.Hash, err
+}
+
+func optional(id uint) *uint {
+	if id == 0 {
+		return nil
+	}
+	return &id
+}
@@ -0,0 +1,106 @@
+package audit
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"liven-one-go/database"
+	"liven-one-go/models"
+)
+
+func openDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	conns, err := database.Open(":memory:", database.Options{Tuned: true, Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conns.Close() })
+
+	if err := database.Migrate(conns.Write); err != nil {
+		t.Fatal(err)
+	}
+	return conns.Write
+}
+
+func TestDiff(t *testing.T) {
+	type item struct {
+		Name  string   `json:"name"`
+		Price int64    `json:"price"`
+		Tags  []string `json:"tags"`
+	}
+	before := item{Name: "Parma", Price: 2400, Tags: []string{"mains"}}
+	after := item{Name: "Parma", Price: 2600, Tags: []string{"mains"}}
+
+	changes, err := Diff(before, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(changes); got != `{"price":{"before":2400,"after":2600}}` {
+		t.Errorf("update diff = %s", got)
+	}
+
+	changes, err = Diff(nil, before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(changes); got != `{"name":{"after":"Parma"},"price":{"after":2400},"tags":{"after":["mains"]}}` {
+		t.Errorf("creation diff = %s", got)
+	}
+
+	if _, err := Diff("not an object", nil); err == nil {
+		t.Error("Diff accepted a value that isn't a JSON object")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	db := openDB(t)
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	var entries []*models.AuditEntry
+	for price := int64(1); price <= 3; price++ {
+		entry, err := Record(db, Entry{
+			ActorID: 1, ActorType: models.UserTypeMerchant, MerchantID: 1,
+			Action: MenuItemUpdate, EntityType: EntityMenuItem, EntityID: 7,
+			Before: map[string]int64{"price": price}, After: map[string]int64{"price": price + 1},
+		}, now.Add(time.Duration(price)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	if entries[0].PrevHash != "" || entries[1].PrevHash != entries[0].Hash {
+		t.Fatalf("entries aren't chained: %+v", entries)
+	}
+
+	report, err := Verify(db)
+	if err != nil || report.Entries != 3 {
+		t.Fatalf("Verify = %+v, %v; want 3 intact entries", report, err)
+	}
+	if head, err := Head(db); err != nil || head != entries[2].Hash {
+		t.Fatalf("Head = %q, %v; want %q", head, err, entries[2].Hash)
+	}
+
+	// Entries can't be changed through GORM or SQL...
+	if err := db.Model(entries[1]).Update("changes", "{}").Error; !errors.Is(err, models.ErrAuditAppendOnly) {
+		t.Fatalf("GORM update: err = %v", err)
+	}
+	if err := db.Exec("DELETE FROM audit_entries WHERE id = ?", entries[1].ID).Error; err == nil {
+		t.Fatal("SQL delete succeeded")
+	}
+
+	// ...and once the triggers are dropped, Verify finds the edit.
+	if err := db.Exec("DROP TRIGGER audit_entries_no_update").Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("UPDATE audit_entries SET changes = '{}' WHERE id = ?", entries[1].ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	report, err = Verify(db)
+	if !errors.Is(err, ErrBrokenChain) || report.BrokenAt != entries[1].ID || report.Entries != 1 {
+		t.Fatalf("Verify after tampering = %+v, %v; want broken at %d", report, err, entries[1].ID)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"liven-one-go/config"
+	"liven-one-go/database"
+	"liven-one-go/worker"
+	"log/slog"
+	"time"
+)
+
+// runBackup implements `backup [-dir DIR] [-keep N]`.
+func runBackup(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	dir := flags.String("dir", cfg.BackupDir, "directory to write the backup into")
+	keep := flags.Int("keep", cfg.BackupKeep, "number of backups to keep, 0 keeps all")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	path, err := database.Backup(cfg.DatabaseURI, *dir, *keep)
+	if err != nil {
+		return fmt.Errorf("backup failed: %w", err)
+	}
+	slog.Info("Backup written", "path", path)
+	return nil
+}
+
+// runRestore implements `restore -from FILE`.
+func runRestore(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	from := flags.String("from", "", "backup file to restore (required)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *from == "" {
+		flags.Usage()
+		return errMissingFlag("-from")
+	}
+
+	if err := database.Restore(*from, cfg.DatabaseURI); err != nil {
+		return fmt.Errorf("restore failed: %w", err)
+	}
+	slog.Info("Database restored", "database", database.FilePath(cfg.DatabaseURI), "backup", *from)
+	return nil
+}
+
+// startScheduledBackups backs up the database every BACKUP_INTERVAL while the
+// server runs. Scheduled backups are off when the interval is zero. A backup
+// in progress at shutdown is allowed to finish.
+func startScheduledBackups(cfg *config.Config, workers *worker.Group) {
+	if cfg.BackupInterval <= 0 {
+		return
+	}
+
+	slog.Info("Scheduled backups enabled", "dir", cfg.BackupDir, "interval", cfg.BackupInterval, "keep", cfg.BackupKeep)
+
+	workers.Go("scheduled-backups", func(ctx context.Context) error {
+		ticker := time.NewTicker(cfg.BackupInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+			}
+
+			path, err := database.Backup(cfg.DatabaseURI, cfg.BackupDir, cfg.BackupKeep)
+			if err != nil {
+				slog.Error("Scheduled backup failed", "error", err)
+				continue
+			}
+			slog.Info("Scheduled backup written", "path", path)
+		}
+	})
+}
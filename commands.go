@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"liven-one-go/audit"
+	"liven-one-go/config"
+	"liven-one-go/database"
+	"liven-one-go/keystore"
+	"liven-one-go/models"
+	"liven-one-go/seed"
+	"liven-one-go/services"
+	"liven-one-go/utils"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// command is one CLI subcommand. Grouped commands such as "user create" use a
+// two-word name.
+type command struct {
+	name    string
+	summary string
+	run     func(cfg *config.Config, args []string) error
+}
+
+var commands = []command{
+	{"serve", "Run the HTTP API server (default)", runServe},
+	{"migrate", "Create or update the database tables", runMigrate},
+	{"seed", "Generate demo merchants, diners, venues, menus and orders", runSeed},
+	{"user create", "Create a diner, merchant or admin account", runUserCreate},
+	{"user reset-password", "Set a new password for an account and sign it out everywhere", runUserResetPassword},
+	{"user unlock", "Lift the login lockout of an account", runUserUnlock},
+	{"user verify", "Mark the email address of an account as verified", runUserVerify},
+	{"user reset-2fa", "Turn off two-factor authentication for an account", runUserResetTwoFactor},
+	{"user purge", "Anonymize the accounts whose deletion is due", runUserPurge},
+	{"venue transfer", "Move a venue to another merchant", runVenueTransfer},
+	{"audit verify", "Check the hash chain of the audit log", runAuditVerify},
+	{"token issue", "Print a JWT for an account", runTokenIssue},
+	{"key generate", "Write a new JWT signing key to JWT_KEYS_DIR", runKeyGenerate},
+	{"backup", "Write an online backup of the database", runBackup},
+	{"restore", "Replace the database with a backup (server must be stopped)", runRestore},
+}
+
+// runCLI dispatches args to the matching command. No arguments runs the server
+// so the container entrypoint keeps working unchanged.
+func runCLI(cfg *config.Config, args []string) error {
+	if len(args) == 0 {
+		return runServe(cfg, nil)
+	}
+
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		printUsage()
+		return nil
+	}
+
+	if len(args) > 1 {
+		if cmd, ok := findCommand(args[0] + " " + args[1]); ok {
+			return cmd.run(cfg, args[2:])
+		}
+	}
+	if cmd, ok := findCommand(args[0]); ok {
+		return cmd.run(cfg, args[1:])
+	}
+
+	printUsage()
+	return fmt.Errorf("unknown command %q", strings.Join(args, " "))
+}
+
+func findCommand(name string) (command, bool) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-22s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '<command> -h' for the flags of a command.\n")
+}
+
+func errMissingFlag(name string) error {
+	return fmt.Errorf("missing required flag %s", name)
+}
+
+// withDatabase opens the database for a one-off command and closes it afterwards.
+func withDatabase(cfg *config.Config, fn func(db *gorm.DB) error) error {
+	conns, err := openDatabase(cfg)
+	if err != nil {
+		return err
+	}
+	defer conns.Close()
+	return fn(conns.Write)
+}
+
+// readPassword returns the flag value, or reads a line from stdin when the
+// flag was left empty so the password stays out of the shell history. Either
+// way it must be at least 8 characters, like passwords set through the API.
+func readPassword(value string) (string, error) {
+	password := value
+	if password == "" {
+		fmt.Fprint(os.Stderr, "Password: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("read password: %w", err)
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	if err := checkPassword(password); err != nil {
+		return "", err
+	}
+	return password, nil
+}
+
+// checkPassword enforces the minimum length of passwords set through the API
+// on passwords given to commands.
+func checkPassword(password string) error {
+	if len(password) < 8 {
+		return errors.New("password must be at least 8 characters")
+	}
+	return nil
+}
+
+func runServe(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	port := flags.String("port", cfg.Port, "port to listen on")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	cfg.Port = *port
+	return serve(cfg)
+}
+
+func runMigrate(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	return withDatabase(cfg, func(db *gorm.DB) error {
+		if err := database.Migrate(db); err != nil {
+			return fmt.Errorf("failed to migrate database: %w", err)
+		}
+		slog.Info("Database migrated", "database", cfg.DatabaseURI)
+		return nil
+	})
+}
+
+func runSeed(cfg *config.Config, args []string) error {
+	opts := seed.DefaultOptions()
+	flags := flag.NewFlagSet("seed", flag.ContinueOnError)
+	flags.Int64Var(&opts.Seed, "seed", opts.Seed, "random seed; the same seed produces the same data")
+	flags.IntVar(&opts.Merchants, "merchants", opts.Merchants, "number of merchant accounts")
+	flags.IntVar(&opts.VenuesPerMerchant, "venues", opts.VenuesPerMerchant, "venues per merchant")
+	flags.IntVar(&opts.ItemsPerVenue, "items", opts.ItemsPerVenue, "maximum menu items per venue")
+	flags.IntVar(&opts.Diners, "diners", opts.Diners, "number of diner accounts")
+	flags.IntVar(&opts.Orders, "orders", opts.Orders, "number of historical orders")
+	flags.IntVar(&opts.HistoryDays, "days", opts.HistoryDays, "days of order history")
+	flags.StringVar(&opts.Password, "password", opts.Password, "password for every generated account")
+	force := flags.Bool("force", false, "seed even though APP_ENV is neither development nor test")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	// The demo accounts share a known password, so they don't belong in
+	// production.
+	if !*force && !cfg.IsDevelopment() && !cfg.IsTest() {
+		return fmt.Errorf("refusing to seed demo data with APP_ENV=%q; set it to development or test, or pass -force", cfg.Env)
+	}
+	if err := checkPassword(opts.Password); err != nil {
+		return err
+	}
+
+	return withDatabase(cfg, func(db *gorm.DB) error {
+		if err := database.Migrate(db); err != nil {
+			return err
+		}
+
+		result, err := seed.Generate(db, opts)
+		if err != nil {
+			return err
+		}
+
+		slog.Info("Demo data seeded", "merchants", len(result.Merchants), "diners", len(result.Diners),
+			"venues", len(result.Venues), "menu_items", len(result.MenuItems), "orders", len(result.Orders))
+		if len(result.Merchants) > 0 && len(result.Diners) > 0 {
+			slog.Info("Demo accounts ready", "merchant", result.Merchants[0].Email, "diner", result.Diners[0].Email, "password", opts.Password)
+		}
+		return nil
+	})
+}
+
+func runUserCreate(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("user create", flag.ContinueOnError)
+	email := flags.String("email", "", "email address (required)")
+	password := flags.String("password", "", "password, read from stdin when empty")
+	userType := flags.String("type", models.UserTypeDiner, "account type: diner, merchant or admin")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *email == "" {
+		flags.Usage()
+		return errMissingFlag("-email")
+	}
+
+	pw, err := readPassword(*password)
+	if err != nil {
+		return err
+	}
+
+	return withDatabase(cfg, func(db *gorm.DB) error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			var user *models.User
+			var err error
+			if *userType == models.UserTypeAdmin {
+				user, err = services.CreateAdmin(tx, *email, pw)
+			} else {
+				user, err = services.CreateUser(tx, *email, pw, *userType)
+			}
+			if err != nil {
+				return err
+			}
+			// The operator vouches for the address, so no verification email is needed.
+			if err := services.MarkEmailVerified(tx, user, time.Now()); err != nil {
+				return err
+			}
+			// The audit log outlives the account, so the address stays out of it.
+			if err := recordOperatorChange(tx, audit.Entry{
+				Action: audit.UserCreate, EntityType: audit.EntityUser, EntityID: user.ID,
+				After: map[string]string{"user_type": user.UserType},
+			}); err != nil {
+				return err
+			}
+			slog.Info("User created", "user_id", user.ID, "email", user.Email, "user_type", user.UserType)
+			return nil
+		})
+	})
+}
+
+func runUserResetPassword(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("user reset-password", flag.ContinueOnError)
+	email := flags.String("email", "", "email address (required)")
+	password := flags.String("password", "", "new password, read from stdin when empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *email == "" {
+		flags.Usage()
+		return errMissingFlag("-email")
+	}
+
+	pw, err := readPassword(*password)
+	if err != nil {
+		return err
+	}
+
+	// Hash before the transaction: bcrypt is slow and would hold the writer.
+	var hashed models.User
+	if err := hashed.HashPassword(pw); err != nil {
+		return fmt.Errorf("hash password: %w", err)
+	}
+
+	return withDatabase(cfg, func(db *gorm.DB) error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			user, err := services.ResetPassword(tx, *email, hashed.Password, time.Now())
+			if err != nil {
+				return err
+			}
+			if err := recordOperatorChange(tx, audit.Entry{
+				Action: audit.UserPasswordReset, EntityType: audit.EntityUser, EntityID: user.ID,
+			}); err != nil {
+				return err
+			}
+			slog.Info("Password reset", "user_id", user.ID, "email", user.Email)
+			return nil
+		})
+	})
+}
+
+func runUserUnlock(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("user unlock", flag.ContinueOnError)
+	email := flags.String("email", "", "email address (required)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *email == "" {
+		flags.Usage()
+		return errMissingFlag("-email")
+	}
+
+	return withDatabase(cfg, func(db *gorm.DB) error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			user, err := services.UnlockUser(tx, *email)
+			if err != nil {
+				return err
+			}
+			if err := recordOperatorChange(tx, audit.Entry{
+				Action: audit.UserUnlock, EntityType: audit.EntityUser, EntityID: user.ID,
+			}); err != nil {
+				return err
+			}
+			slog.Info("Account unlocked", "user_id", user.ID, "email", user.Email)
+			return nil
+		})
+	})
+}
+
+func runUserVerify(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("user verify", flag.ContinueOnError)
+	email := flags.String("email", "", "email address (required)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *email == "" {
+		flags.Usage()
+		return errMissingFlag("-email")
+	}
+
+	return withDatabase(cfg, func(db *gorm.DB) error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			user, err := services.VerifyUser(tx, *email, time.Now())
+			if err != nil {
+				return err
+			}
+			if err := recordOperatorChange(tx, audit.Entry{
+				Action: audit.UserEmailVerify, EntityType: audit.EntityUser, EntityID: user.ID,
+			}); err != nil {
+				return err
+			}
+			slog.Info("Email verified", "user_id", user.ID, "email", user.Email)
+			return nil
+		})
+	})
+}
+
+func runUserResetTwoFactor(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("user reset-2fa", flag.ContinueOnError)
+	email := flags.String("email", "", "email address (required)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *email == "" {
+		flags.Usage()
+		return errMissingFlag("-email")
+	}
+
+	return withDatabase(cfg, func(db *gorm.DB) error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			user, err := services.ResetTwoFactor(tx, *email)
+			if err != nil {
+				return err
+			}
+			if err := recordOperatorChange(tx, audit.Entry{
+				Action: audit.UserTwoFactorReset, EntityType: audit.EntityUser, EntityID: user.ID,
+				Before: map[string]bool{"two_factor_enabled": true}, After: map[string]bool{"two_factor_enabled": false},
+			}); err != nil {
+				return err
+			}
+			slog.Info("Two-factor authentication turned off", "user_id", user.ID, "email", user.Email)
+			return nil
+		})
+	})
+}
+
+func runVenueTransfer(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("venue transfer", flag.ContinueOnError)
+	venueID := flags.Uint("venue", 0, "ID of the venue to transfer (required)")
+	to := flags.String("to", "", "email of the merchant receiving the venue (required)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *venueID == 0 || *to == "" {
+		flags.Usage()
+		return errMissingFlag("-venue and -to")
+	}
+
+	return withDatabase(cfg, func(db *gorm.DB) error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			var previous models.Venue
+			if err := tx.Select("merchant_id").Find(&previous, *venueID).Error; err != nil {
+				return err
+			}
+			venue, err := services.TransferVenue(tx, *venueID, *to)
+			if err != nil {
+				return err
+			}
+			if err := recordOperatorChange(tx, audit.Entry{
+				Action: audit.VenueTransfer, EntityType: audit.EntityVenue, EntityID: venue.ID, VenueID: venue.ID,
+				Before: map[string]uint{"merchant_id": previous.MerchantID}, After: map[string]uint{"merchant_id": venue.MerchantID},
+			}); err != nil {
+				return err
+			}
+			slog.Info("Venue transferred", "venue_id", venue.ID, "venue", venue.Name, "to", *to)
+			return nil
+		})
+	})
+}
+
+// recordOperatorChange audits a change made with a command. It must run in
+// the transaction that makes the change.
+func recordOperatorChange(tx *gorm.DB, entry audit.Entry) error {
+	entry.ActorType = audit.ActorOperator
+	_, err := audit.Record(tx, entry, time.Now())
+	return err
+}
+
+func runAuditVerify(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("audit verify", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	return withDatabase(cfg, func(db *gorm.DB) error {
+		report, err := audit.Verify(db)
+		if err != nil {
+			if errors.Is(err, audit.ErrBrokenChain) {
+				slog.Error("Audit log tampered with", "entries", report.Entries, "broken_at", report.BrokenAt)
+			}
+			return err
+		}
+		head, err := audit.Head(db)
+		if err != nil {
+			return err
+		}
+		slog.Info("Audit log intact", "entries", report.Entries, "head", head)
+		return nil
+	})
+}
+
+func runTokenIssue(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("token issue", flag.ContinueOnError)
+	email := flags.String("email", "", "email of the account (required)")
+	mfa := flags.Bool("mfa", false, "mark the token as two-factor authenticated")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *email == "" {
+		flags.Usage()
+		return errMissingFlag("-email")
+	}
+	if err := setupTokens(cfg); err != nil {
+		return err
+	}
+
+	return withDatabase(cfg, func(db *gorm.DB) error {
+		var token string
+		err := db.Transaction(func(tx *gorm.DB) error {
+			user, err := services.FindUserByEmail(tx, *email)
+			if err != nil {
+				return err
+			}
+			session, err := services.StartSession(tx, user.ID, services.SessionDetails{DeviceName: "command line"}, time.Now())
+			if err != nil {
+				return err
+			}
+			if err := recordOperatorChange(tx, audit.Entry{
+				Action: audit.UserTokenIssue, EntityType: audit.EntityUser, EntityID: user.ID,
+				After: map[string]any{"session_id": session.ID, "mfa": *mfa},
+			}); err != nil {
+				return err
+			}
+			generate := utils.GenerateToken
+			if *mfa {
+				generate = utils.GenerateMFAToken
+			}
+			token, err = generate(user.ID, user.UserType, session.ID)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		// Print only the token on stdout so it can be captured by scripts.
+		fmt.Println(token)
+		return nil
+	})
+}
+
+func runKeyGenerate(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("key generate", flag.ContinueOnError)
+	dir := flags.String("dir", cfg.JWTKeysDir, "key directory, JWT_KEYS_DIR by default")
+	kid := flags.String("kid", time.Now().UTC().Format("2006-01-02"), "key ID, also the file name")
+	algorithm := flags.String("alg", keystore.AlgorithmEdDSA, "algorithm: EdDSA or RS256")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *dir == "" {
+		flags.Usage()
+		return errMissingFlag("-dir")
+	}
+
+	key, err := keystore.GenerateKey(*algorithm)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*dir, 0o700); err != nil {
+		return err
+	}
+	// O_EXCL so a key that may have signed tokens is never overwritten.
+	path := filepath.Join(*dir, *kid+".pem")
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(key); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	slog.Info("Signing key written", "kid", *kid, "alg", *algorithm, "path", path,
+		"next", "deploy it everywhere, then set JWT_SIGNING_KEY="+*kid)
+	return nil
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"liven-one-go/audit"
+	"liven-one-go/config"
+	"liven-one-go/database"
+	"liven-one-go/models"
+	"liven-one-go/services"
+	"liven-one-go/utils"
+)
+
+// newCLI returns the configuration of a migrated database file for commands
+// to run against, and a connection to inspect it with.
+func newCLI(t *testing.T) (*config.Config, *gorm.DB) {
+	t.Helper()
+	cfg := &config.Config{
+		DatabaseURI: filepath.Join(t.TempDir(), "cli.db"),
+		Database:    database.Options{Logger: logger.Discard},
+		JWTSecret:   testJWTSecret,
+	}
+	runCommand(t, cfg, "migrate")
+
+	conns, err := database.Open(cfg.DatabaseURI, cfg.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conns.Close() })
+	return cfg, conns.Write
+}
+
+// runCommand runs a command line and fails the test when it errors.
+func runCommand(t *testing.T, cfg *config.Config, args ...string) {
+	t.Helper()
+	if err := runCLI(cfg, args); err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+}
+
+// captureStdout returns what fn prints on stdout.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	read, write, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = write
+	defer func() { os.Stdout = stdout }()
+
+	fn()
+	write.Close()
+	out, err := io.ReadAll(read)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+// operatorChanges returns the audit entries of action made with commands.
+func operatorChanges(t *testing.T, db *gorm.DB, action string) []models.AuditEntry {
+	t.Helper()
+	var entries []models.AuditEntry
+	if err := db.Where("action = ? AND actor_type = ?", action, audit.ActorOperator).Order("id").Find(&entries).Error; err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestUserCreate(t *testing.T) {
+	cfg, db := newCLI(t)
+	runCommand(t, cfg, "user", "create", "-email", "owner@example.com", "-password", "password123", "-type", "merchant")
+	runCommand(t, cfg, "user", "create", "-email", "ops@example.com", "-password", "password123", "-type", "admin")
+
+	for email, userType := range map[string]string{"owner@example.com": models.UserTypeMerchant, "ops@example.com": models.UserTypeAdmin} {
+		user, err := services.FindUserByEmail(db, email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The operator vouches for the address.
+		if user.UserType != userType || user.EmailVerifiedAt == nil || user.CheckPassword("password123") != nil {
+			t.Errorf("%s = %+v, want a verified %s", email, user, userType)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"-email", "owner@example.com", "-password", "password123"},
+		{"-email", "short@example.com", "-password", "short"},
+		{"-password", "password123"},
+	} {
+		if err := runCLI(cfg, append([]string{"user", "create"}, args...)); err == nil {
+			t.Errorf("user create %v succeeded", args)
+		}
+	}
+	if _, err := services.FindUserByEmail(db, "short@example.com"); err == nil {
+		t.Error("account with a short password was created")
+	}
+
+	// Only the two accounts created are audited, without their addresses.
+	entries := operatorChanges(t, db, audit.UserCreate)
+	if len(entries) != 2 || !strings.Contains(entries[1].Changes, models.UserTypeAdmin) {
+		t.Fatalf("user create audit entries = %+v", entries)
+	}
+	for _, entry := range entries {
+		if strings.Contains(entry.Changes, "@example.com") {
+			t.Errorf("user create audit changes = %s", entry.Changes)
+		}
+	}
+}
+
+func TestUserResetPassword(t *testing.T) {
+	cfg, db := newCLI(t)
+	runCommand(t, cfg, "user", "create", "-email", "lost@example.com", "-password", "password123")
+	user, err := services.FindUserByEmail(db, "lost@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := services.StartSession(db, user.ID, services.SessionDetails{DeviceName: "Stolen phone"}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runCLI(cfg, []string{"user", "reset-password", "-email", "lost@example.com", "-password", "short"}); err == nil {
+		t.Error("reset to a short password succeeded")
+	}
+
+	// The operator reset signs a possibly compromised account out everywhere.
+	runCommand(t, cfg, "user", "reset-password", "-email", "lost@example.com", "-password", "password456")
+	if err := db.First(user, user.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := user.CheckPassword("password456"); err != nil {
+		t.Errorf("new password: %v", err)
+	}
+	if user.TokensRevokedAt == nil {
+		t.Error("tokens weren't revoked")
+	}
+	var sessions int64
+	db.Model(&models.Session{}).Where("user_id = ?", user.ID).Count(&sessions)
+	if sessions != 0 {
+		t.Errorf("%d sessions left, want none", sessions)
+	}
+	if entries := operatorChanges(t, db, audit.UserPasswordReset); len(entries) != 1 || entries[0].EntityID != user.ID || entries[0].ActorID != nil {
+		t.Errorf("password reset audit entries = %+v", entries)
+	}
+}
+
+func TestUserUnlockAndVerify(t *testing.T) {
+	cfg, db := newCLI(t)
+	user, err := services.CreateUser(db, "locked@example.com", "password123", models.UserTypeDiner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(user).Updates(map[string]any{"failed_logins": 5, "locked_until": time.Now().Add(time.Hour)}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	runCommand(t, cfg, "user", "unlock", "-email", "locked@example.com")
+	runCommand(t, cfg, "user", "verify", "-email", "locked@example.com")
+	var updated models.User
+	if err := db.First(&updated, user.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if updated.LockedUntil != nil || updated.FailedLogins != 0 || updated.EmailVerifiedAt == nil {
+		t.Errorf("user = %+v, want unlocked and verified", updated)
+	}
+	for _, action := range []string{audit.UserUnlock, audit.UserEmailVerify} {
+		if entries := operatorChanges(t, db, action); len(entries) != 1 || entries[0].EntityID != user.ID {
+			t.Errorf("%s audit entries = %+v", action, entries)
+		}
+	}
+}
+
+func TestUserResetTwoFactor(t *testing.T) {
+	cfg, db := newCLI(t)
+	runCommand(t, cfg, "user", "create", "-email", "locked-out@example.com", "-password", "password123")
+	user, err := services.FindUserByEmail(db, "locked-out@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(user).Updates(map[string]any{"totp_secret": "secret", "totp_enabled_at": time.Now()}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	runCommand(t, cfg, "user", "reset-2fa", "-email", "locked-out@example.com")
+	var reset models.User
+	if err := db.First(&reset, user.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if reset.TwoFactorEnabled() || reset.TOTPSecret != "" {
+		t.Errorf("account = %+v, want two-factor authentication off", reset)
+	}
+	if err := runCLI(cfg, []string{"user", "reset-2fa", "-email", "locked-out@example.com"}); err == nil {
+		t.Error("resetting two-factor authentication that is off succeeded")
+	}
+	entries := operatorChanges(t, db, audit.UserTwoFactorReset)
+	if len(entries) != 1 || entries[0].EntityID != user.ID || entries[0].Changes != `{"two_factor_enabled":{"before":true,"after":false}}` {
+		t.Errorf("two-factor reset audit entries = %+v, want one for the successful reset", entries)
+	}
+}
+
+func TestVenueTransfer(t *testing.T) {
+	cfg, db := newCLI(t)
+	runCommand(t, cfg, "user", "create", "-email", "seller@example.com", "-password", "password123", "-type", "merchant")
+	runCommand(t, cfg, "user", "create", "-email", "buyer@example.com", "-password", "password123", "-type", "merchant")
+	runCommand(t, cfg, "user", "create", "-email", "diner@example.com", "-password", "password123")
+	seller, err := services.FindUserByEmail(db, "seller@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	venue := models.Venue{Name: "Sold Bistro", MerchantID: seller.ID}
+	if err := db.Create(&venue).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	venueID := strconv.FormatUint(uint64(venue.ID), 10)
+	if err := runCLI(cfg, []string{"venue", "transfer", "-venue", venueID, "-to", "diner@example.com"}); err == nil {
+		t.Error("transferring a venue to a diner succeeded")
+	}
+	if err := runCLI(cfg, []string{"venue", "transfer", "-venue", "999", "-to", "buyer@example.com"}); err == nil {
+		t.Error("transferring a missing venue succeeded")
+	}
+	runCommand(t, cfg, "venue", "transfer", "-venue", venueID, "-to", "buyer@example.com")
+
+	buyer, err := services.FindUserByEmail(db, "buyer@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.First(&venue, venue.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if venue.MerchantID != buyer.ID {
+		t.Errorf("venue belongs to %d, want %d", venue.MerchantID, buyer.ID)
+	}
+
+	// Only the transfer that happened is audited, and the new owner sees it.
+	entries := operatorChanges(t, db, audit.VenueTransfer)
+	want := fmt.Sprintf(`{"merchant_id":{"before":%d,"after":%d}}`, seller.ID, buyer.ID)
+	if len(entries) != 1 || entries[0].EntityID != venue.ID || entries[0].Changes != want ||
+		entries[0].MerchantID == nil || *entries[0].MerchantID != buyer.ID {
+		t.Errorf("venue transfer audit entries = %+v, want one with %s", entries, want)
+	}
+}
+
+func TestTokenIssue(t *testing.T) {
+	cfg, db := newCLI(t)
+	runCommand(t, cfg, "user", "create", "-email", "owner@example.com", "-password", "password123", "-type", "merchant")
+	user, err := services.FindUserByEmail(db, "owner@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the token is printed, so scripts can capture it.
+	out := captureStdout(t, func() { runCommand(t, cfg, "token", "issue", "-email", "owner@example.com", "-mfa") })
+	claims, err := utils.ValidateToken(strings.TrimSpace(out))
+	if err != nil {
+		t.Fatalf("issued token %q: %v", out, err)
+	}
+	if claims.UserID != user.ID || claims.UserType != models.UserTypeMerchant || !claims.MFA {
+		t.Errorf("claims = %+v", claims)
+	}
+	var session models.Session
+	if err := db.First(&session, claims.SessionID).Error; err != nil || session.UserID != user.ID {
+		t.Errorf("session of the token = %+v, %v", session, err)
+	}
+	// Minting a token for any account leaves a record of it.
+	if entries := operatorChanges(t, db, audit.UserTokenIssue); len(entries) != 1 || entries[0].EntityID != user.ID ||
+		!strings.Contains(entries[0].Changes, `"mfa"`) {
+		t.Errorf("token issue audit entries = %+v", entries)
+	}
+
+	if err := runCLI(cfg, []string{"token", "issue", "-email", "nobody@example.com"}); err == nil {
+		t.Error("issuing a token for a missing account succeeded")
+	}
+}
+
+func TestKeyGenerate(t *testing.T) {
+	// The first key is generated into a directory that holds none yet.
+	cfg := &config.Config{JWTKeysDir: t.TempDir()}
+	if err := runCLI(cfg, []string{"key", "generate", "-kid", "first"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := setupTokens(cfg); err != nil {
+		t.Fatalf("loading the generated key: %v", err)
+	}
+	if err := runCLI(cfg, []string{"key", "generate", "-kid", "first"}); err == nil {
+		t.Error("generating over an existing key succeeded")
+	}
+	if matches, _ := filepath.Glob(filepath.Join(cfg.JWTKeysDir, "*.pem")); len(matches) != 1 {
+		t.Errorf("key files = %v, want one", matches)
+	}
+}
+
+func TestUserPurgeContinuesPastFailures(t *testing.T) {
+	cfg, db := newCLI(t)
+	var users []*models.User
+	for _, email := range []string{"stuck@example.com", "gone@example.com"} {
+		runCommand(t, cfg, "user", "create", "-email", email, "-password", "password123")
+		user, err := services.FindUserByEmail(db, email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Model(user).Update("deletion_due_at", time.Now().Add(-time.Hour)).Error; err != nil {
+			t.Fatal(err)
+		}
+		users = append(users, user)
+	}
+	stuck, gone := users[0], users[1]
+	if err := db.Exec(fmt.Sprintf(`CREATE TRIGGER fail_anonymize BEFORE UPDATE OF email ON users WHEN OLD.id = %d
+BEGIN SELECT RAISE(ABORT, 'stuck'); END`, stuck.ID)).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// The failure is reported, but doesn't stop the accounts after it.
+	err := runCLI(cfg, []string{"user", "purge"})
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("anonymize user %d", stuck.ID)) {
+		t.Errorf("purge error = %v, want the stuck account's", err)
+	}
+	for _, user := range users {
+		if err := db.Unscoped().First(user, user.ID).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stuck.DeletedAt.Valid || !gone.DeletedAt.Valid {
+		t.Errorf("deleted: stuck = %v, gone = %v; want only gone", stuck.DeletedAt.Valid, gone.DeletedAt.Valid)
+	}
+	if audited := operatorChanges(t, db, audit.UserAnonymize); len(audited) != 1 || audited[0].EntityID != gone.ID {
+		t.Errorf("anonymizations audited = %+v, want one of %d", audited, gone.ID)
+	}
+}
+
+func TestSeed(t *testing.T) {
+	cfg, db := newCLI(t)
+	small := []string{"seed", "-merchants", "1", "-diners", "1", "-orders", "5"}
+	countUsers := func() int64 {
+		var users int64
+		db.Model(&models.User{}).Count(&users)
+		return users
+	}
+
+	// The demo accounts share a known password, so production is refused.
+	for _, env := range []string{"", "production"} {
+		cfg.Env = env
+		if err := runCLI(cfg, small); err == nil {
+			t.Errorf("seeding with APP_ENV=%q succeeded", env)
+		}
+	}
+	cfg.Env = "test"
+	if err := runCLI(cfg, append(small, "-password", "short")); err == nil {
+		t.Error("seeding with a short password succeeded")
+	}
+	if users := countUsers(); users != 0 {
+		t.Fatalf("refused seeds created %d accounts", users)
+	}
+
+	runCommand(t, cfg, small...)
+	if countUsers() == 0 {
+		t.Error("seed created no accounts")
+	}
+
+	cfg, db = newCLI(t)
+	cfg.Env = "production"
+	runCommand(t, cfg, append(small, "-force")...)
+	if countUsers() == 0 {
+		t.Error("forced seed created no accounts")
+	}
+}
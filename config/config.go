@@ -0,0 +1,435 @@
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"liven-one-go/database"
+	"liven-one-go/mail"
+	"liven-one-go/oidc"
+	"liven-one-go/ratelimit"
+	"liven-one-go/services"
+	"liven-one-go/sms"
+	"liven-one-go/tracing"
+	"liven-one-go/utils"
+)
+
+// Config holds the settings shared by every command of the binary. Values come
+// from the environment, optionally seeded from a .env file.
+type Config struct {
+	// Env is APP_ENV: "development", "debug", "test" or anything else for
+	// production.
+	Env  string
+	Port string
+
+	// HTTP server timeouts, from HTTP_READ_TIMEOUT, HTTP_WRITE_TIMEOUT and
+	// HTTP_IDLE_TIMEOUT. ShutdownTimeout is SHUTDOWN_TIMEOUT, the deadline for
+	// draining requests, stopping workers and closing the database on SIGTERM.
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration
+
+	// LogLevel is LOG_LEVEL, defaulting to "debug" in development and "info"
+	// elsewhere. LogFormat is LOG_FORMAT: "json" (default) or "text".
+	LogLevel  string
+	LogFormat string
+
+	DatabaseURI string
+	Database    database.Options
+
+	// JWTKeysDir is JWT_KEYS_DIR, a directory of PEM private keys (RS256 or
+	// EdDSA) named <kid>.pem. JWTSigningKey is JWT_SIGNING_KEY, the kid that
+	// signs new tokens, required once the directory holds several. JWTSecret is
+	// JWT_SECRET, a shared HS256 secret that signs only when there is no key
+	// directory and otherwise keeps verifying tokens it signed earlier.
+	// JWTIssuer and JWTAudience (JWT_ISSUER, JWT_AUDIENCE) are written into
+	// every token and required of every token presented. JWTLegacyCutoff is
+	// JWT_LEGACY_CUTOFF, an RFC 3339 time when the first release stopped
+	// issuing tokens; its tokens are accepted only if issued before it, so
+	// none works a day after. Unset, they are refused.
+	JWTSecret       string
+	JWTKeysDir      string
+	JWTSigningKey   string
+	JWTIssuer       string
+	JWTAudience     string
+	JWTLegacyCutoff time.Time
+
+	// RateLimits and LoginLockout protect the API from scripted clients.
+	RateLimits   RateLimits
+	LoginLockout services.LockoutPolicy
+
+	// TwoFactor comes from TWO_FACTOR_ISSUER, the name shown in
+	// authenticator apps, and TWO_FACTOR_REQUIRED_FOR_MERCHANTS, which keeps
+	// merchants and their staff out of the merchant API until they log in
+	// with a TOTP code.
+	TwoFactor services.TwoFactorPolicy
+
+	// AppURL is APP_URL, the base URL of the web app that mailed links point
+	// to. EmailVerificationTTL, PasswordResetTTL and StaffInviteTTL are how
+	// long those links work, from EMAIL_VERIFICATION_TTL, PASSWORD_RESET_TTL
+	// and STAFF_INVITE_TTL.
+	AppURL               string
+	EmailVerificationTTL time.Duration
+	PasswordResetTTL     time.Duration
+	StaffInviteTTL       time.Duration
+
+	// Passwordless comes from MAGIC_LINK_TTL, how long mailed login links
+	// work, LOGIN_CODE_TTL, how long texted or mailed login codes work, and
+	// LOGIN_CODE_ATTEMPTS, how many wrong tries end a code.
+	Passwordless services.PasswordlessPolicy
+
+	// OIDC lists the OpenID Connect providers users can log in with, named by
+	// OIDC_PROVIDERS, such as "google,apple". Each is configured by
+	// OIDC_<NAME>_ISSUER, OIDC_<NAME>_CLIENT_ID, OIDC_<NAME>_CLIENT_SECRET,
+	// OIDC_<NAME>_SCOPES (space-separated, "openid email profile" by
+	// default) and OIDC_<NAME>_REDIRECT_URL, which defaults to the app's
+	// /oidc/<name>/callback page.
+	OIDC []oidc.Config
+
+	// Mail comes from MAILER ("none", "console", "file" or "smtp"),
+	// MAIL_FROM, MAIL_FILE, SMTP_ADDR, SMTP_USERNAME and SMTP_PASSWORD. The
+	// mailer defaults to "smtp" when SMTP_ADDR is set, "console" in
+	// development and "none" otherwise.
+	Mail mail.Options
+
+	// SMS comes from SMS_SENDER ("none", "console", "file" or "webhook"),
+	// SMS_FILE, SMS_WEBHOOK_URL and SMS_WEBHOOK_TOKEN. The webhook receives
+	// each message as JSON for an SMS gateway to deliver. The sender
+	// defaults to "webhook" when SMS_WEBHOOK_URL is set, "console" in
+	// development and "none" otherwise.
+	SMS sms.Options
+
+	// TrustedProxies is TRUSTED_PROXIES, a comma-separated list of the IPs or
+	// CIDRs of reverse proxies whose X-Forwarded-For header is believed.
+	// Without it the client IP is the address of the connection, so clients
+	// can't dodge rate limits by forging the header.
+	TrustedProxies []string
+
+	// MetricsAddr is METRICS_ADDR, an admin listen address such as ":9090"
+	// serving /metrics apart from the public API. Without it, /metrics is
+	// served on the API port to callers presenting METRICS_TOKEN, and not at
+	// all when neither is set.
+	MetricsAddr  string
+	MetricsToken string
+
+	// Tracing comes from TRACING_EXPORTER ("none", "stdout", "file" or
+	// "otlp"), TRACING_FILE and OTEL_SERVICE_NAME. The exporter defaults to
+	// "otlp" when OTEL_EXPORTER_OTLP_ENDPOINT is set and "none" otherwise.
+	Tracing tracing.Options
+
+	BackupDir      string
+	BackupKeep     int
+	BackupInterval time.Duration
+
+	// AccountDeletionGrace is ACCOUNT_DELETION_GRACE, how long after asking
+	// to delete their account an owner can still restore it by logging in.
+	// AccountDeletionInterval is ACCOUNT_DELETION_INTERVAL, how often the
+	// accounts past it are anonymized.
+	AccountDeletionGrace    time.Duration
+	AccountDeletionInterval time.Duration
+}
+
+// RateLimits come from RATE_LIMIT_LOGIN and RATE_LIMIT_REGISTER, counted per
+// client IP, and RATE_LIMIT_API, counted per account on authenticated routes
+// and per IP on public ones. Each is written as "<requests>/<duration>", such
+// as "10/1m", or "off". Store is RATE_LIMIT_STORE: "memory" (default) or
+// "sqlite" to share limits between processes using the same database.
+type RateLimits struct {
+	Store    string
+	Login    ratelimit.Limit
+	Register ratelimit.Limit
+	API      ratelimit.Limit
+}
+
+// Load reads the configuration from the environment.
+func Load() (*Config, error) {
+	// A missing .env is normal in containers, where the platform sets the environment.
+	if err := godotenv.Load(); err != nil && !os.IsNotExist(err) {
+		slog.Warn("Failed to load .env file", "error", err)
+	}
+
+	cfg := &Config{
+		Env:           os.Getenv("APP_ENV"),
+		Port:          getString("PORT", "8080"),
+		DatabaseURI:   getString("DATABASE_URI", "test.db"),
+		Database:      database.DefaultOptions(),
+		JWTSecret:     os.Getenv("JWT_SECRET"),
+		JWTKeysDir:    os.Getenv("JWT_KEYS_DIR"),
+		JWTSigningKey: os.Getenv("JWT_SIGNING_KEY"),
+		JWTIssuer:     getString("JWT_ISSUER", utils.DefaultIssuer),
+		JWTAudience:   getString("JWT_AUDIENCE", utils.DefaultAudience),
+		MetricsAddr:   os.Getenv("METRICS_ADDR"),
+		MetricsToken:  os.Getenv("METRICS_TOKEN"),
+		BackupDir:     getString("BACKUP_DIR", "backups"),
+		BackupKeep:    7,
+		LogFormat:     getString("LOG_FORMAT", "json"),
+	}
+
+	cfg.Tracing = tracing.Options{
+		Exporter:    tracing.ExporterNone,
+		File:        getString("TRACING_FILE", "traces.jsonl"),
+		ServiceName: getString("OTEL_SERVICE_NAME", "liven-one-go"),
+	}
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != "" {
+		cfg.Tracing.Exporter = tracing.ExporterOTLP
+	}
+	cfg.Tracing.Exporter = getString("TRACING_EXPORTER", cfg.Tracing.Exporter)
+
+	cfg.LogLevel = "info"
+	if cfg.IsDevelopment() {
+		cfg.LogLevel = "debug"
+	}
+	cfg.LogLevel = getString("LOG_LEVEL", cfg.LogLevel)
+
+	if os.Getenv("DATABASE_URI") == "" {
+		slog.Warn("DATABASE_URI not set, using the default", "database_uri", cfg.DatabaseURI)
+	}
+
+	var err error
+	if os.Getenv("SQLITE_TUNED") == "false" {
+		cfg.Database.Tuned = false
+	}
+	if cfg.Database.BusyTimeout, err = getDuration("SQLITE_BUSY_TIMEOUT", cfg.Database.BusyTimeout); err != nil {
+		return nil, err
+	}
+	if cfg.Database.MaxReadConns, err = getInt("SQLITE_MAX_READ_CONNS", cfg.Database.MaxReadConns); err != nil {
+		return nil, err
+	}
+	if cfg.BackupKeep, err = getInt("BACKUP_KEEP", cfg.BackupKeep); err != nil {
+		return nil, err
+	}
+	if cfg.BackupInterval, err = getDuration("BACKUP_INTERVAL", 0); err != nil {
+		return nil, err
+	}
+	if cfg.JWTLegacyCutoff, err = getTime("JWT_LEGACY_CUTOFF"); err != nil {
+		return nil, err
+	}
+	if cfg.AccountDeletionGrace, err = getDuration("ACCOUNT_DELETION_GRACE", 30*24*time.Hour); err != nil {
+		return nil, err
+	}
+	if cfg.AccountDeletionInterval, err = getDuration("ACCOUNT_DELETION_INTERVAL", time.Hour); err != nil {
+		return nil, err
+	}
+	if cfg.ReadTimeout, err = getDuration("HTTP_READ_TIMEOUT", 10*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.WriteTimeout, err = getDuration("HTTP_WRITE_TIMEOUT", 30*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.IdleTimeout, err = getDuration("HTTP_IDLE_TIMEOUT", 120*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.ShutdownTimeout, err = getDuration("SHUTDOWN_TIMEOUT", 20*time.Second); err != nil {
+		return nil, err
+	}
+
+	cfg.RateLimits.Store = getString("RATE_LIMIT_STORE", ratelimit.StoreMemory)
+	if cfg.RateLimits.Store != ratelimit.StoreMemory && cfg.RateLimits.Store != ratelimit.StoreSQLite {
+		return nil, fmt.Errorf("invalid RATE_LIMIT_STORE %q: must be %q or %q", cfg.RateLimits.Store, ratelimit.StoreMemory, ratelimit.StoreSQLite)
+	}
+	if cfg.RateLimits.Login, err = getLimit("RATE_LIMIT_LOGIN", "10/1m"); err != nil {
+		return nil, err
+	}
+	if cfg.RateLimits.Register, err = getLimit("RATE_LIMIT_REGISTER", "5/1h"); err != nil {
+		return nil, err
+	}
+	if cfg.RateLimits.API, err = getLimit("RATE_LIMIT_API", "300/1m"); err != nil {
+		return nil, err
+	}
+	if cfg.LoginLockout.Threshold, err = getInt("LOGIN_LOCKOUT_THRESHOLD", 5); err != nil {
+		return nil, err
+	}
+	if cfg.LoginLockout.Duration, err = getDuration("LOGIN_LOCKOUT_DURATION", time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.LoginLockout.MaxDuration, err = getDuration("LOGIN_LOCKOUT_MAX", time.Hour); err != nil {
+		return nil, err
+	}
+	if cfg.TrustedProxies, err = getProxies("TRUSTED_PROXIES"); err != nil {
+		return nil, err
+	}
+	cfg.TwoFactor.Issuer = getString("TWO_FACTOR_ISSUER", "Liven One")
+	if cfg.TwoFactor.RequireMerchants, err = getBool("TWO_FACTOR_REQUIRED_FOR_MERCHANTS", false); err != nil {
+		return nil, err
+	}
+
+	cfg.AppURL = getString("APP_URL", "http://localhost:"+cfg.Port)
+	if cfg.EmailVerificationTTL, err = getDuration("EMAIL_VERIFICATION_TTL", 48*time.Hour); err != nil {
+		return nil, err
+	}
+	if cfg.PasswordResetTTL, err = getDuration("PASSWORD_RESET_TTL", time.Hour); err != nil {
+		return nil, err
+	}
+	if cfg.StaffInviteTTL, err = getDuration("STAFF_INVITE_TTL", 72*time.Hour); err != nil {
+		return nil, err
+	}
+	if cfg.Passwordless.MagicLinkTTL, err = getDuration("MAGIC_LINK_TTL", 15*time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.Passwordless.CodeTTL, err = getDuration("LOGIN_CODE_TTL", 10*time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.Passwordless.CodeAttempts, err = getInt("LOGIN_CODE_ATTEMPTS", 5); err != nil {
+		return nil, err
+	}
+	if cfg.OIDC, err = getOIDCProviders("OIDC_PROVIDERS", cfg.AppURL); err != nil {
+		return nil, err
+	}
+	cfg.Mail = mail.Options{
+		Transport:    mail.TransportNone,
+		From:         getString("MAIL_FROM", "Liven One <no-reply@localhost>"),
+		File:         getString("MAIL_FILE", "mail.log"),
+		SMTPAddr:     os.Getenv("SMTP_ADDR"),
+		SMTPUsername: os.Getenv("SMTP_USERNAME"),
+		SMTPPassword: os.Getenv("SMTP_PASSWORD"),
+	}
+	if cfg.Mail.SMTPAddr != "" {
+		cfg.Mail.Transport = mail.TransportSMTP
+	} else if cfg.IsDevelopment() {
+		cfg.Mail.Transport = mail.TransportConsole
+	}
+	cfg.Mail.Transport = getString("MAILER", cfg.Mail.Transport)
+
+	cfg.SMS = sms.Options{
+		Transport:    sms.TransportNone,
+		File:         getString("SMS_FILE", "sms.log"),
+		WebhookURL:   os.Getenv("SMS_WEBHOOK_URL"),
+		WebhookToken: os.Getenv("SMS_WEBHOOK_TOKEN"),
+	}
+	if cfg.SMS.WebhookURL != "" {
+		cfg.SMS.Transport = sms.TransportWebhook
+	} else if cfg.IsDevelopment() {
+		cfg.SMS.Transport = sms.TransportConsole
+	}
+	cfg.SMS.Transport = getString("SMS_SENDER", cfg.SMS.Transport)
+
+	return cfg, nil
+}
+
+// IsDevelopment reports whether the app runs in a local development environment.
+func (c *Config) IsDevelopment() bool {
+	return c.Env == "debug" || c.Env == "development"
+}
+
+// IsTest reports whether the app runs against a test environment.
+func (c *Config) IsTest() bool {
+	return c.Env == "test"
+}
+
+// RequireJWTKeys fails when no JWT key is configured. Commands that issue or
+// verify tokens call it before doing anything else.
+func (c *Config) RequireJWTKeys() error {
+	if c.JWTSecret == "" && c.JWTKeysDir == "" {
+		return fmt.Errorf("neither JWT_KEYS_DIR nor JWT_SECRET is set")
+	}
+	return nil
+}
+
+func getString(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func getInt(key string, fallback int) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", key, value, err)
+	}
+	return n, nil
+}
+
+func getBool(key string, fallback bool) (bool, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: %w", key, value, err)
+	}
+	return b, nil
+}
+
+func getLimit(key, fallback string) (ratelimit.Limit, error) {
+	limit, err := ratelimit.ParseLimit(getString(key, fallback))
+	if err != nil {
+		return ratelimit.Limit{}, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return limit, nil
+}
+
+func getProxies(key string) ([]string, error) {
+	var proxies []string
+	for _, proxy := range strings.Split(os.Getenv(key), ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			return nil, fmt.Errorf("invalid %s entry %q: not an IP or CIDR", key, proxy)
+		}
+		proxies = append(proxies, proxy)
+	}
+	return proxies, nil
+}
+
+func getOIDCProviders(key, appURL string) ([]oidc.Config, error) {
+	var providers []oidc.Config
+	for _, name := range strings.Split(os.Getenv(key), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		provider := oidc.Config{
+			Name:         name,
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  getString(prefix+"REDIRECT_URL", appURL+"/oidc/"+name+"/callback"),
+			Scopes:       strings.Fields(os.Getenv(prefix + "SCOPES")),
+		}
+		if provider.Issuer == "" || provider.ClientID == "" {
+			return nil, fmt.Errorf("invalid %s entry %q: %sISSUER and %sCLIENT_ID are required", key, name, prefix, prefix)
+		}
+		providers = append(providers, provider)
+	}
+	return providers, nil
+}
+
+func getTime(key string) (time.Time, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s %q: %w", key, value, err)
+	}
+	return t, nil
+}
+
+func getDuration(key string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", key, value, err)
+	}
+	return d, nil
+}
@@ -0,0 +1,258 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const (
+	backupPrefix     = "livenone-"
+	backupSuffix     = ".db"
+	backupTimeLayout = "20060102T150405.000Z"
+)
+
+// ErrServerRunning is returned by Restore while a server has the database open.
+var ErrServerRunning = errors.New("a server is running against this database")
+
+// Backup writes a consistent snapshot of the database at dbURI into dir using
+// VACUUM INTO, checks the integrity of the produced file and then deletes all
+// but the newest keep backups. It uses its own connection, so it is safe to run
+// while the server is handling requests without holding up the writer. It
+// returns the path of the new backup.
+func Backup(dbURI, dir string, keep int) (string, error) {
+	if IsInMemory(dbURI) {
+		return "", fmt.Errorf("cannot back up in-memory database %q", dbURI)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+
+	params := url.Values{}
+	params.Set("_busy_timeout", fmt.Sprint(DefaultOptions().BusyTimeout.Milliseconds()))
+	db, err := gorm.Open(sqlite.Open(dsn(dbURI, params)), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		return "", fmt.Errorf("open %s: %w", dbURI, err)
+	}
+	if pool, err := db.DB(); err == nil {
+		defer pool.Close()
+	}
+
+	name := backupPrefix + time.Now().UTC().Format(backupTimeLayout) + backupSuffix
+	path := filepath.Join(dir, name)
+	if _, err := os.Stat(path); err == nil {
+		return "", fmt.Errorf("backup %s already exists", path)
+	}
+
+	if err := db.Exec("VACUUM INTO ?", path).Error; err != nil {
+		_ = os.Remove(path)
+		return "", fmt.Errorf("vacuum into %s: %w", path, err)
+	}
+
+	if err := CheckIntegrity(path); err != nil {
+		_ = os.Remove(path)
+		return "", err
+	}
+
+	if keep > 0 {
+		if err := rotateBackups(dir, keep); err != nil {
+			return path, fmt.Errorf("rotate backups: %w", err)
+		}
+	}
+
+	return path, nil
+}
+
+// Backups lists the backups in dir, oldest first.
+func Backups(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, backupPrefix) || !strings.HasSuffix(name, backupSuffix) {
+			continue
+		}
+		backups = append(backups, filepath.Join(dir, name))
+	}
+
+	// The timestamp format sorts lexically in chronological order.
+	sort.Strings(backups)
+	return backups, nil
+}
+
+func rotateBackups(dir string, keep int) error {
+	backups, err := Backups(dir)
+	if err != nil {
+		return err
+	}
+	for len(backups) > keep {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// CheckIntegrity runs PRAGMA integrity_check against the SQLite file at path.
+func CheckIntegrity(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+
+	db, err := gorm.Open(sqlite.Open(dsn(path, url.Values{"mode": {"ro"}})), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		return fmt.Errorf("open %s: %w", path, err)
+	}
+	if pool, err := db.DB(); err == nil {
+		defer pool.Close()
+	}
+
+	var results []string
+	if err := db.Raw("PRAGMA integrity_check").Scan(&results).Error; err != nil {
+		return fmt.Errorf("integrity check %s: %w", path, err)
+	}
+	if len(results) != 1 || results[0] != "ok" {
+		return fmt.Errorf("integrity check %s failed: %s", path, strings.Join(results, "; "))
+	}
+	return nil
+}
+
+// Restore replaces the database at dbPath with the backup at backupPath. It
+// refuses to run while a server holds the lock on dbPath, because the server's
+// open connections would keep writing to the replaced file, and holds the
+// lock itself until it is done, so no server starts halfway through.
+func Restore(backupPath, dbPath string) error {
+	dbPath = FilePath(dbPath)
+	unlock, err := LockServer(dbPath)
+	if err != nil {
+		return fmt.Errorf("%w; stop it before restoring", err)
+	}
+	defer unlock()
+
+	if err := CheckIntegrity(backupPath); err != nil {
+		return err
+	}
+
+	src, err := os.Open(backupPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// Copy next to the target first so the final rename is atomic.
+	tmpPath := dbPath + ".restore"
+	dst, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	// Stale WAL and shared-memory files belong to the old database and would
+	// be replayed on top of the restored one.
+	for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+		if err := os.Remove(dbPath + suffix); err != nil && !os.IsNotExist(err) {
+			_ = os.Remove(tmpPath)
+			return err
+		}
+	}
+
+	return os.Rename(tmpPath, dbPath)
+}
+
+// LockServer takes the server lock on dbPath for the current process. The
+// lock is an flock on a file beside the database, which the kernel releases
+// when the process exits, even if it crashes, so a lock is never stale
+// whatever pid the next process gets. The file names the holder's pid for
+// error messages. The returned function releases the lock and should be
+// deferred by the caller.
+func LockServer(dbPath string) (func(), error) {
+	file, err := os.OpenFile(serverLockPath(dbPath), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%w (pid %d)", ErrServerRunning, lockHolder(dbPath))
+		}
+		return nil, fmt.Errorf("lock %s: %w", serverLockPath(dbPath), err)
+	}
+
+	// The file stays when the lock is released: removing it would let a
+	// process that opened it just before lock a file no one else can see.
+	if err := file.Truncate(0); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return func() { _ = file.Close() }, nil
+}
+
+// ServerRunning reports whether a process, this one included, holds the
+// server lock on dbPath, and the pid it recorded.
+func ServerRunning(dbPath string) (bool, int) {
+	file, err := os.Open(serverLockPath(dbPath))
+	if err != nil {
+		return false, 0
+	}
+	defer file.Close()
+	// Closing the file releases the probe's lock.
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err == nil {
+		return false, 0
+	}
+	return true, lockHolder(dbPath)
+}
+
+// lockHolder returns the pid recorded in the server lock on dbPath, or 0.
+func lockHolder(dbPath string) int {
+	contents, err := os.ReadFile(serverLockPath(dbPath))
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(contents)))
+	return pid
+}
+
+func serverLockPath(dbPath string) string {
+	return FilePath(dbPath) + ".server.pid"
+}
+
+// FilePath strips the "file:" scheme and any query parameters from a SQLite
+// URI, leaving the path of the database file.
+func FilePath(uri string) string {
+	path, _, _ := strings.Cut(strings.TrimPrefix(uri, "file:"), "?")
+	return path
+}
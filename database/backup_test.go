@@ -0,0 +1,155 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"gorm.io/gorm/logger"
+	"liven-one-go/models"
+	"liven-one-go/seed"
+)
+
+// seededDatabase creates a migrated database file holding demo data and
+// returns its path and the number of orders in it.
+func seededDatabase(t *testing.T) (string, int64) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "liven.db")
+	conns, err := Open(path, Options{Tuned: true, Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conns.Close()
+	if err := Migrate(conns.Write); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := seed.DefaultOptions()
+	opts.Merchants, opts.Diners, opts.Orders = 1, 2, 20
+	result, err := seed.Generate(conns.Write, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, int64(len(result.Orders))
+}
+
+func countOrders(t *testing.T, path string) int64 {
+	t.Helper()
+	conns, err := Open(path, Options{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conns.Close()
+	var count int64
+	if err := conns.Read.Model(&models.Order{}).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestBackup(t *testing.T) {
+	dbPath, orders := seededDatabase(t)
+	dir := filepath.Join(t.TempDir(), "backups")
+
+	path, err := Backup(dbPath, dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckIntegrity(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := countOrders(t, path); got != orders {
+		t.Errorf("backup holds %d orders, want %d", got, orders)
+	}
+
+	// Only the newest backups are kept.
+	var written []string
+	for range 3 {
+		// Backups are named to the millisecond.
+		time.Sleep(2 * time.Millisecond)
+		path, err := Backup(dbPath, dir, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		written = append(written, path)
+	}
+	backups, err := Backups(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 || backups[0] != written[1] || backups[1] != written[2] {
+		t.Errorf("backups = %v, want the last two of %v", backups, written)
+	}
+
+	if _, err := Backup(":memory:", dir, 2); err == nil {
+		t.Error("backing up an in-memory database succeeded")
+	}
+}
+
+func TestCheckIntegrityRejectsCorruptFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "corrupt.db")
+	if err := os.WriteFile(path, []byte("not a database"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckIntegrity(path); err == nil {
+		t.Error("corrupt file passed the integrity check")
+	}
+}
+
+func TestRestore(t *testing.T) {
+	dbPath, orders := seededDatabase(t)
+	backup, err := Backup(dbPath, filepath.Join(t.TempDir(), "backups"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Empty the database, then bring the orders back.
+	conns, err := Open(dbPath, Options{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conns.Write.Where("1 = 1").Delete(&models.OrderItem{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := conns.Write.Where("1 = 1").Delete(&models.Order{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	conns.Close()
+
+	// Refused while a server holds the lock, even one with this process's
+	// pid, as a one-off container running as pid 1 would have.
+	unlock, err := LockServer(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if running, pid := ServerRunning(dbPath); !running || pid != os.Getpid() {
+		t.Fatalf("ServerRunning = %v, %d; want true, %d", running, pid, os.Getpid())
+	}
+	if _, err := LockServer(dbPath); !errors.Is(err, ErrServerRunning) {
+		t.Fatalf("second lock: %v, want ErrServerRunning", err)
+	}
+	if err := Restore(backup, dbPath); !errors.Is(err, ErrServerRunning) {
+		t.Fatalf("restore while a server was running: %v, want ErrServerRunning", err)
+	}
+	if got := countOrders(t, dbPath); got != 0 {
+		t.Fatalf("refused restore changed the database: %d orders", got)
+	}
+	unlock()
+
+	// A lock file left behind by a process that exited doesn't count.
+	if err := os.WriteFile(serverLockPath(dbPath), []byte(strconv.Itoa(1)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if running, _ := ServerRunning(dbPath); running {
+		t.Fatal("ServerRunning reported a released lock")
+	}
+	if err := Restore(backup, dbPath); err != nil {
+		t.Fatal(err)
+	}
+	if got := countOrders(t, dbPath); got != orders {
+		t.Errorf("restored database holds %d orders, want %d", got, orders)
+	}
+}
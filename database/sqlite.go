@@ -0,0 +1,200 @@
+package database
+
+import (
+	"fmt"
+	"net/url"
+	"runtime"
+	"strings"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Options tunes how the SQLite database file is opened.
+type Options struct {
+	// Tuned enables WAL journaling, busy_timeout, foreign keys and the split
+	// between a single writer connection and a pool of read-only connections.
+	// When false the file is opened with driver defaults, as it used to be.
+	Tuned bool
+
+	// BusyTimeout is how long a connection waits on a locked database before
+	// giving up with "database is locked".
+	BusyTimeout time.Duration
+
+	// MaxReadConns caps the read pool. Defaults to the number of CPUs.
+	MaxReadConns int
+
+	// Logger overrides GORM's default logger when set.
+	Logger logger.Interface
+
+	// Plugins are installed on every connection pool, such as the metrics
+	// callbacks.
+	Plugins []gorm.Plugin
+}
+
+// DefaultOptions returns the production settings.
+func DefaultOptions() Options {
+	return Options{
+		Tuned:        true,
+		BusyTimeout:  5 * time.Second,
+		MaxReadConns: runtime.NumCPU(),
+	}
+}
+
+// Connections holds the handles to one SQLite database.
+//
+// SQLite allows a single writer at a time, so Write is capped at one open
+// connection: concurrent mutations queue inside database/sql instead of racing
+// for the file lock and failing with SQLITE_BUSY. Reads go through Read, a pool
+// of query-only connections that WAL lets run alongside the writer.
+type Connections struct {
+	Write *gorm.DB
+	Read  *gorm.DB
+}
+
+// Open opens the SQLite database at path with the given options.
+func Open(path string, opts Options) (*Connections, error) {
+	config := &gorm.Config{}
+	if opts.Logger != nil {
+		config.Logger = opts.Logger
+	}
+
+	if !opts.Tuned {
+		db, err := gorm.Open(sqlite.Open(path), config)
+		if err != nil {
+			return nil, err
+		}
+		if err := usePlugins(db, opts.Plugins); err != nil {
+			return nil, err
+		}
+		return &Connections{Write: db, Read: db}, nil
+	}
+
+	if opts.BusyTimeout <= 0 {
+		opts.BusyTimeout = DefaultOptions().BusyTimeout
+	}
+	if opts.MaxReadConns <= 0 {
+		opts.MaxReadConns = DefaultOptions().MaxReadConns
+	}
+
+	params := url.Values{}
+	params.Set("_journal_mode", "WAL")
+	params.Set("_busy_timeout", fmt.Sprint(opts.BusyTimeout.Milliseconds()))
+	params.Set("_foreign_keys", "on")
+	params.Set("_synchronous", "NORMAL")
+
+	writeParams := cloneValues(params)
+	// Take the write lock when the transaction starts rather than on its first
+	// write, so a read-then-write transaction can't deadlock on lock upgrade.
+	writeParams.Set("_txlock", "immediate")
+
+	writer, err := gorm.Open(sqlite.Open(dsn(path, writeParams)), config)
+	if err != nil {
+		return nil, fmt.Errorf("open writer: %w", err)
+	}
+	writerPool, err := writer.DB()
+	if err != nil {
+		return nil, err
+	}
+	writerPool.SetMaxOpenConns(1)
+	writerPool.SetMaxIdleConns(1)
+	writerPool.SetConnMaxLifetime(0)
+	if err := usePlugins(writer, opts.Plugins); err != nil {
+		_ = writerPool.Close()
+		return nil, err
+	}
+
+	// An in-memory database only exists on the connection that created it,
+	// so a separate read pool would see an empty schema.
+	if IsInMemory(path) {
+		return &Connections{Write: writer, Read: writer}, nil
+	}
+
+	readParams := cloneValues(params)
+	readParams.Set("_query_only", "true")
+
+	reader, err := gorm.Open(sqlite.Open(dsn(path, readParams)), config)
+	if err != nil {
+		_ = writerPool.Close()
+		return nil, fmt.Errorf("open reader: %w", err)
+	}
+	readerPool, err := reader.DB()
+	if err != nil {
+		_ = writerPool.Close()
+		return nil, err
+	}
+	readerPool.SetMaxOpenConns(opts.MaxReadConns)
+	readerPool.SetMaxIdleConns(opts.MaxReadConns)
+	if err := usePlugins(reader, opts.Plugins); err != nil {
+		_ = writerPool.Close()
+		_ = readerPool.Close()
+		return nil, err
+	}
+
+	return &Connections{Write: writer, Read: reader}, nil
+}
+
+// Close closes both pools.
+func (c *Connections) Close() error {
+	var firstErr error
+	for _, db := range []*gorm.DB{c.Write, c.Read} {
+		if db == nil {
+			continue
+		}
+		pool, err := db.DB()
+		if err == nil {
+			err = pool.Close()
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if c.Read == c.Write {
+			break
+		}
+	}
+	return firstErr
+}
+
+func usePlugins(db *gorm.DB, plugins []gorm.Plugin) error {
+	for _, plugin := range plugins {
+		if err := db.Use(plugin); err != nil {
+			return fmt.Errorf("install %s plugin: %w", plugin.Name(), err)
+		}
+	}
+	return nil
+}
+
+// IsInMemory reports whether path points at an in-memory database.
+func IsInMemory(path string) bool {
+	return path == ":memory:" ||
+		strings.HasPrefix(path, "file::memory:") ||
+		strings.Contains(path, "mode=memory")
+}
+
+// dsn appends the driver parameters to path, keeping any the caller already set.
+func dsn(path string, params url.Values) string {
+	base, query, _ := strings.Cut(path, "?")
+	existing, err := url.ParseQuery(query)
+	if err != nil {
+		existing = url.Values{}
+	}
+	for key, values := range params {
+		if _, set := existing[key]; !set {
+			existing[key] = values
+		}
+	}
+	if !strings.HasPrefix(base, "file:") {
+		base = "file:" + base
+	}
+	return base + "?" + existing.Encode()
+}
+
+func cloneValues(values url.Values) url.Values {
+	clone := url.Values{}
+	for key, value := range values {
+		clone[key] = append([]string(nil), value...)
+	}
+	return clone
+}
@@ -0,0 +1,107 @@
+package database
+
+import (
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"liven-one-go/models"
+)
+
+// BenchmarkConcurrentPlaceOrder places orders from many goroutines at once,
+// following the same transaction shape as handlers.PlaceOrderHandler. Compare
+// the two sub-benchmarks to see the effect of the tuned connection settings:
+//
+//	go test -run '^$' -bench ConcurrentPlaceOrder ./database
+//
+// "failed/op" counts transactions that errored, almost always with
+// "database is locked".
+func BenchmarkConcurrentPlaceOrder(b *testing.B) {
+	b.Run("default", func(b *testing.B) {
+		benchmarkPlaceOrder(b, Options{Tuned: false})
+	})
+	b.Run("tuned", func(b *testing.B) {
+		benchmarkPlaceOrder(b, DefaultOptions())
+	})
+}
+
+func benchmarkPlaceOrder(b *testing.B, opts Options) {
+	opts.Logger = logger.Discard
+	conns, err := Open(filepath.Join(b.TempDir(), "bench.db"), opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conns.Close()
+
+	if err := Migrate(conns.Write); err != nil {
+		b.Fatal(err)
+	}
+
+	merchant := models.User{Email: "merchant@example.com", Password: "x", UserType: models.UserTypeMerchant}
+	diner := models.User{Email: "diner@example.com", Password: "x", UserType: models.UserTypeDiner}
+	if err := conns.Write.Create(&[]*models.User{&merchant, &diner}).Error; err != nil {
+		b.Fatal(err)
+	}
+	venue := models.Venue{Name: "Bench Bistro", MerchantID: merchant.ID}
+	if err := conns.Write.Create(&venue).Error; err != nil {
+		b.Fatal(err)
+	}
+	menu := []models.MenuItem{
+		{Name: "Flat White", PriceInCents: 450, Category: "Coffee", VenueId: venue.ID},
+		{Name: "Banana Bread", PriceInCents: 600, Category: "Bakery", VenueId: venue.ID},
+	}
+	if err := conns.Write.Create(&menu).Error; err != nil {
+		b.Fatal(err)
+	}
+	menuIDs := []uint{menu[0].ID, menu[1].ID}
+
+	var failed atomic.Int64
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := placeOrder(conns.Write, diner.ID, venue.ID, menuIDs); err != nil {
+				failed.Add(1)
+			}
+		}
+	})
+	b.StopTimer()
+	b.ReportMetric(float64(failed.Load())/float64(b.N), "failed/op")
+}
+
+func placeOrder(db *gorm.DB, dinerID, venueID uint, menuIDs []uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var venue models.Venue
+		if err := tx.First(&venue, venueID).Error; err != nil {
+			return err
+		}
+
+		var items []models.MenuItem
+		if err := tx.Where("id IN ? AND venue_id = ?", menuIDs, venue.ID).Find(&items).Error; err != nil {
+			return err
+		}
+
+		var total int64
+		orderItems := make([]models.OrderItem, 0, len(items))
+		for _, item := range items {
+			orderItems = append(orderItems, models.OrderItem{
+				MenuItemID:          item.ID,
+				Quantity:            1,
+				PriceInCentsAtOrder: item.PriceInCents,
+			})
+			total += item.PriceInCents
+		}
+
+		return tx.Create(&models.Order{
+			DinerID:            dinerID,
+			VenueID:            venue.ID,
+			TotalAmountInCents: total,
+			Status:             models.OrderStatusPending,
+			OrderTimestamp:     time.Now(),
+			OrderItems:         orderItems,
+		}).Error
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"liven-one-go/audit"
+	"liven-one-go/config"
+	"liven-one-go/logging"
+	"liven-one-go/services"
+	"liven-one-go/worker"
+	"log/slog"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// runUserPurge implements `user purge`, running the account deletion job once.
+func runUserPurge(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("user purge", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	return withDatabase(cfg, func(db *gorm.DB) error {
+		anonymized, err := anonymizeDueAccounts(db, audit.ActorOperator, time.Now())
+		slog.Info("Deleted accounts anonymized", "count", anonymized)
+		return err
+	})
+}
+
+// startAccountDeletions anonymizes the accounts whose deletion is due when
+// the server starts and every ACCOUNT_DELETION_INTERVAL after. The job is
+// off when the interval is zero.
+func startAccountDeletions(cfg *config.Config, db *gorm.DB, workers *worker.Group) {
+	if cfg.AccountDeletionInterval <= 0 {
+		return
+	}
+
+	workers.Go("account-deletions", func(ctx context.Context) error {
+		ticker := time.NewTicker(cfg.AccountDeletionInterval)
+		defer ticker.Stop()
+		for {
+			anonymized, err := anonymizeDueAccounts(db.WithContext(ctx), audit.ActorSystem, time.Now())
+			if err != nil {
+				slog.Error("Account deletion job failed", "error", err)
+			} else if anonymized > 0 {
+				slog.Info("Deleted accounts anonymized", "count", anonymized)
+			}
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+			}
+		}
+	})
+}
+
+// anonymizeDueAccounts anonymizes every account whose deletion is due at now,
+// auditing it as done by actorType: the server's job or an operator's command.
+// Each account is anonymized and audited in its own transaction, so one
+// failure doesn't undo or hold up the others; the failures are logged and
+// returned together.
+func anonymizeDueAccounts(db *gorm.DB, actorType string, now time.Time) (int, error) {
+	users, err := services.DueDeletions(db, now)
+	if err != nil {
+		return 0, fmt.Errorf("get due deletions: %w", err)
+	}
+
+	anonymized := 0
+	var errs []error
+	for i := range users {
+		user := &users[i]
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := services.AnonymizeUser(tx, user, now); err != nil {
+				return err
+			}
+			_, err := audit.Record(tx, audit.Entry{
+				ActorType:  actorType,
+				Action:     audit.UserAnonymize,
+				EntityType: audit.EntityUser,
+				EntityID:   user.ID,
+			}, now)
+			return err
+		})
+		if err != nil {
+			slog.Error("Failed to anonymize account", logging.KeyUserID, user.ID, "error", err)
+			errs = append(errs, fmt.Errorf("anonymize user %d: %w", user.ID, err))
+			continue
+		}
+		anonymized++
+	}
+	return anonymized, errors.Join(errs...)
+}
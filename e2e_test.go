@@ -0,0 +1,1916 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"liven-one-go/apperror"
+	"liven-one-go/audit"
+	"liven-one-go/config"
+	"liven-one-go/handlers"
+	"liven-one-go/keystore"
+	"liven-one-go/models"
+	"liven-one-go/oidc"
+	"liven-one-go/oidc/oidctest"
+	"liven-one-go/ratelimit"
+	"liven-one-go/services"
+	"liven-one-go/totp"
+	"liven-one-go/utils"
+	"liven-one-go/worker"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestAuthFlow(t *testing.T) {
+	s := newTestServer(t)
+
+	diner := s.diner()
+	s.do(http.MethodGet, "/v1/diner", diner.Token, nil).ExpectStatus(http.StatusOK)
+
+	// Registering the same email again conflicts.
+	s.do(http.MethodPost, "/v1/auth/register", "", map[string]string{
+		"email": diner.Email, "password": "password123", "user_type": "diner",
+	}).ExpectStatus(http.StatusConflict)
+
+	s.do(http.MethodPost, "/v1/auth/login", "", map[string]string{
+		"email": diner.Email, "password": "wrong-password",
+	}).ExpectStatus(http.StatusUnauthorized)
+
+	s.do(http.MethodGet, "/v1/diner", "", nil).ExpectStatus(http.StatusUnauthorized)
+	s.do(http.MethodGet, "/v1/diner", "not-a-token", nil).ExpectStatus(http.StatusUnauthorized)
+
+	// A diner token can't be used on merchant account routes.
+	s.do(http.MethodGet, "/v1/merchant", diner.Token, nil).ExpectStatus(http.StatusForbidden)
+}
+
+func TestVenueCRUD(t *testing.T) {
+	s := newTestServer(t)
+	merchant := s.merchant()
+
+	venueID := s.createVenue(merchant, "Test Bistro")
+	venuePath := fmt.Sprintf("/v1/merchant/venues/%d", venueID)
+
+	var list struct {
+		Venues []struct {
+			ID   uint   `json:"id"`
+			Name string `json:"name"`
+		} `json:"venues"`
+	}
+	s.do(http.MethodGet, "/v1/merchant/venues", merchant.Token, nil).ExpectStatus(http.StatusOK).Decode(&list)
+	if len(list.Venues) != 1 || list.Venues[0].ID != venueID {
+		t.Fatalf("merchant venues = %+v, want only venue %d", list.Venues, venueID)
+	}
+
+	s.do(http.MethodPut, venuePath, merchant.Token, map[string]string{
+		"name": "Renamed Bistro",
+	}).ExpectStatus(http.StatusOK)
+
+	var got struct {
+		Venue struct {
+			Name        string `json:"name"`
+			CuisineType string `json:"cuisine_type"`
+		} `json:"venue"`
+	}
+	s.do(http.MethodGet, fmt.Sprintf("/v1/public/venues/%d", venueID), "", nil).ExpectStatus(http.StatusOK).Decode(&got)
+	if got.Venue.Name != "Renamed Bistro" || got.Venue.CuisineType != "Cafe" {
+		t.Fatalf("venue after update = %+v", got.Venue)
+	}
+
+	s.do(http.MethodGet, "/v1/public/venues?name=renamed&cuisine=cafe", "", nil).ExpectStatus(http.StatusOK).Decode(&list)
+	if len(list.Venues) != 1 {
+		t.Fatalf("search returned %d venues, want 1", len(list.Venues))
+	}
+
+	s.do(http.MethodDelete, venuePath, merchant.Token, nil).ExpectStatus(http.StatusOK)
+	s.do(http.MethodGet, venuePath, merchant.Token, nil).ExpectStatus(http.StatusNotFound)
+}
+
+func TestMenuCRUD(t *testing.T) {
+	s := newTestServer(t)
+	merchant := s.merchant()
+	venueID := s.createVenue(merchant, "Menu Bistro")
+	itemsPath := fmt.Sprintf("/v1/merchant/venues/%d/menuitems", venueID)
+
+	itemID := s.createMenuItem(merchant, venueID, "Parma", 2400)
+
+	s.do(http.MethodPost, itemsPath, merchant.Token, map[string]any{
+		"name": "Free Lunch", "description": "x", "price_in_cents": 0, "category": "Mains",
+	}).ExpectStatus(http.StatusBadRequest)
+
+	// Omitted fields are left unchanged.
+	var updated struct {
+		Name         string `json:"name"`
+		PriceInCents int64  `json:"price_in_cents"`
+	}
+	s.do(http.MethodPut, fmt.Sprintf("%s/%d", itemsPath, itemID), merchant.Token, map[string]any{
+		"price_in_cents": 2600,
+	}).ExpectStatus(http.StatusOK).Decode(&updated)
+	if updated.Name != "Parma" || updated.PriceInCents != 2600 {
+		t.Fatalf("item after update = %+v", updated)
+	}
+
+	var menu []struct {
+		ID uint `json:"id"`
+	}
+	s.do(http.MethodGet, fmt.Sprintf("/v1/public/venues/%d/menu", venueID), "", nil).ExpectStatus(http.StatusOK).Decode(&menu)
+	if len(menu) != 1 || menu[0].ID != itemID {
+		t.Fatalf("public menu = %+v, want item %d", menu, itemID)
+	}
+
+	s.do(http.MethodDelete, fmt.Sprintf("%s/%d", itemsPath, itemID), merchant.Token, nil).ExpectStatus(http.StatusOK)
+	s.do(http.MethodGet, itemsPath, merchant.Token, nil).ExpectStatus(http.StatusOK).Decode(&menu)
+	if len(menu) != 0 {
+		t.Fatalf("menu after delete = %+v, want empty", menu)
+	}
+}
+
+func TestOrderFlow(t *testing.T) {
+	s := newTestServer(t)
+	merchant := s.merchant()
+	diner := s.diner()
+	venueID := s.createVenue(merchant, "Order Bistro")
+	parmaID := s.createMenuItem(merchant, venueID, "Parma", 2400)
+	chipsID := s.createMenuItem(merchant, venueID, "Chips", 800)
+
+	var order struct {
+		ID                 uint   `json:"id"`
+		Status             string `json:"status"`
+		TotalAmountInCents int64  `json:"total_amount_in_cents"`
+	}
+	s.do(http.MethodPost, "/v1/diner/orders", diner.Token, map[string]any{
+		"venue_id": venueID,
+		"items": []map[string]any{
+			{"menu_item_id": parmaID, "quantity": 2},
+			{"menu_item_id": chipsID, "quantity": 1},
+		},
+	}).ExpectStatus(http.StatusOK).Decode(&order)
+	if order.TotalAmountInCents != 2*2400+800 || order.Status != "Pending" {
+		t.Fatalf("placed order = %+v", order)
+	}
+
+	// Merchants can't place orders, and items must belong to the venue.
+	s.do(http.MethodPost, "/v1/diner/orders", merchant.Token, map[string]any{
+		"venue_id": venueID, "items": []map[string]any{{"menu_item_id": parmaID, "quantity": 1}},
+	}).ExpectStatus(http.StatusForbidden)
+	s.do(http.MethodPost, "/v1/diner/orders", diner.Token, map[string]any{
+		"venue_id": venueID, "items": []map[string]any{{"menu_item_id": 9999, "quantity": 1}},
+	}).ExpectStatus(http.StatusBadRequest)
+	s.do(http.MethodPost, "/v1/diner/orders", diner.Token, map[string]any{
+		"venue_id": 9999, "items": []map[string]any{{"menu_item_id": parmaID, "quantity": 1}},
+	}).ExpectStatus(http.StatusNotFound)
+
+	var dinerOrders []struct {
+		ID uint `json:"id"`
+	}
+	s.do(http.MethodGet, "/v1/diner/orders", diner.Token, nil).ExpectStatus(http.StatusOK).Decode(&dinerOrders)
+	if len(dinerOrders) != 1 || dinerOrders[0].ID != order.ID {
+		t.Fatalf("diner orders = %+v", dinerOrders)
+	}
+	s.do(http.MethodGet, fmt.Sprintf("/v1/diner/orders/%d", order.ID), diner.Token, nil).ExpectStatus(http.StatusOK)
+
+	statusPath := fmt.Sprintf("/v1/merchant/orders/%d/status", order.ID)
+	s.do(http.MethodPut, statusPath, merchant.Token, map[string]string{"status": "Accepted"}).ExpectStatus(http.StatusOK)
+	s.do(http.MethodPut, statusPath, merchant.Token, map[string]string{"status": "Teleported"}).ExpectStatus(http.StatusBadRequest)
+
+	var venueOrders []struct {
+		Status string `json:"status"`
+	}
+	s.do(http.MethodGet, fmt.Sprintf("/v1/merchant/venues/%d/orders?status=Accepted", venueID), merchant.Token, nil).
+		ExpectStatus(http.StatusOK).Decode(&venueOrders)
+	if len(venueOrders) != 1 || venueOrders[0].Status != "Accepted" {
+		t.Fatalf("venue orders = %+v", venueOrders)
+	}
+}
+
+func TestOwnershipDenials(t *testing.T) {
+	s := newTestServer(t)
+	owner := s.merchant()
+	other := s.merchant()
+	diner := s.diner()
+	otherDiner := s.diner()
+
+	venueID := s.createVenue(owner, "Owned Bistro")
+	itemID := s.createMenuItem(owner, venueID, "Parma", 2400)
+	venuePath := fmt.Sprintf("/v1/merchant/venues/%d", venueID)
+
+	s.do(http.MethodPut, venuePath, other.Token, map[string]string{"name": "Stolen"}).ExpectStatus(http.StatusForbidden)
+	s.do(http.MethodDelete, venuePath, other.Token, nil).ExpectStatus(http.StatusForbidden)
+	s.do(http.MethodGet, venuePath+"/menuitems", other.Token, nil).ExpectStatus(http.StatusForbidden)
+	s.do(http.MethodPost, venuePath+"/menuitems", other.Token, map[string]any{
+		"name": "Fake", "description": "x", "price_in_cents": 100, "category": "Mains",
+	}).ExpectStatus(http.StatusForbidden)
+	s.do(http.MethodPut, fmt.Sprintf("%s/menuitems/%d", venuePath, itemID), other.Token, map[string]any{
+		"price_in_cents": 1,
+	}).ExpectStatus(http.StatusForbidden)
+	s.do(http.MethodDelete, fmt.Sprintf("%s/menuitems/%d", venuePath, itemID), other.Token, nil).ExpectStatus(http.StatusForbidden)
+	s.do(http.MethodGet, venuePath+"/orders", other.Token, nil).ExpectStatus(http.StatusForbidden)
+	s.do(http.MethodPost, "/v1/merchant/venues", diner.Token, map[string]string{
+		"name": "Diner Venue", "address": "x", "description": "x", "cuisine_type": "x",
+	}).ExpectStatus(http.StatusForbidden)
+
+	var order struct {
+		ID uint `json:"id"`
+	}
+	s.do(http.MethodPost, "/v1/diner/orders", diner.Token, map[string]any{
+		"venue_id": venueID, "items": []map[string]any{{"menu_item_id": itemID, "quantity": 1}},
+	}).ExpectStatus(http.StatusOK).Decode(&order)
+
+	// Another merchant can't see or change the order, and another diner can't read it.
+	s.do(http.MethodPut, fmt.Sprintf("/v1/merchant/orders/%d/status", order.ID), other.Token, map[string]string{
+		"status": "Cancelled",
+	}).ExpectStatus(http.StatusNotFound)
+	s.do(http.MethodGet, fmt.Sprintf("/v1/diner/orders/%d", order.ID), otherDiner.Token, nil).ExpectStatus(http.StatusNotFound)
+
+	// IDs that aren't numbers are never passed on to the database as SQL.
+	injected := url.PathEscape(fmt.Sprintf("%d OR 1=1", order.ID))
+	s.do(http.MethodGet, "/v1/merchant/orders/"+injected, other.Token, nil).ExpectStatus(http.StatusNotFound)
+	s.do(http.MethodPut, "/v1/merchant/orders/"+injected+"/status", other.Token, map[string]string{
+		"status": "Cancelled",
+	}).ExpectStatus(http.StatusNotFound)
+	s.do(http.MethodGet, "/v1/merchant/venues/"+url.PathEscape(fmt.Sprintf("0 OR id=%d", venueID))+"/orders", owner.Token, nil).
+		ExpectStatus(http.StatusNotFound)
+	if code := s.do(http.MethodGet, "/v1/diner/orders/"+injected, diner.Token, nil).ExpectStatus(http.StatusNotFound).JSON().(map[string]any)["code"]; code != "ORDER_NOT_FOUND" {
+		t.Errorf("diner order with an injected ID: code = %v", code)
+	}
+	injectedVenue := url.PathEscape(fmt.Sprintf("%d OR 1=1", venueID))
+	for _, path := range []string{"/v1/public/venues/" + injectedVenue, "/v1/public/venues/" + injectedVenue + "/menu"} {
+		if code := s.do(http.MethodGet, path, "", nil).ExpectStatus(http.StatusNotFound).JSON().(map[string]any)["code"]; code != "VENUE_NOT_FOUND" {
+			t.Errorf("%s: code = %v", path, code)
+		}
+	}
+}
+
+func TestLegacyRoutes(t *testing.T) {
+	s := newTestServer(t)
+	merchant := s.merchant()
+	venueID := s.createVenue(merchant, "Unversioned Bistro")
+
+	// The paths of the first release still answer, marked deprecated.
+	deprecated := func(res *testResponse, successor string) *testResponse {
+		t.Helper()
+		if res.Header.Get("Deprecation") != "true" || res.Header.Get("Sunset") == "" ||
+			res.Header.Get("Link") != "<"+successor+">; rel=\"successor-version\"" {
+			t.Errorf("%s headers = %v, want deprecation pointing at it", successor, res.Header)
+		}
+		return res
+	}
+	var loggedIn struct {
+		Token string `json:"token"`
+	}
+	deprecated(s.do(http.MethodPost, "/auth/login", "", map[string]string{
+		"email": merchant.Email, "password": "password123",
+	}), "/v1/auth/login").ExpectStatus(http.StatusOK).Decode(&loggedIn)
+	deprecated(s.do(http.MethodGet, "/merchant/venues", loggedIn.Token, nil), "/v1/merchant/venues").ExpectStatus(http.StatusOK)
+	menuPath := fmt.Sprintf("/public/venues/%d/menu", venueID)
+	deprecated(s.do(http.MethodGet, menuPath, "", nil), "/v1"+menuPath).ExpectStatus(http.StatusOK)
+	deprecated(s.do(http.MethodGet, "/diner", "", nil), "/v1/diner").ExpectStatus(http.StatusUnauthorized)
+
+	if res := s.do(http.MethodGet, "/v1/merchant/venues", loggedIn.Token, nil).ExpectStatus(http.StatusOK); res.Header.Get("Deprecation") != "" {
+		t.Error("a /v1 route answered as deprecated")
+	}
+	// Groups added with /v1 have no unversioned paths.
+	s.do(http.MethodGet, "/admin/users", loggedIn.Token, nil).ExpectStatus(http.StatusNotFound)
+	s.do(http.MethodGet, "/authority", "", nil).ExpectStatus(http.StatusNotFound)
+}
+
+func TestRequestID(t *testing.T) {
+	s := newTestServer(t)
+
+	generated := s.do(http.MethodGet, "/v1/public/venues", "", nil).ExpectStatus(http.StatusOK)
+	if id := generated.Header.Get("X-Request-ID"); len(id) != 32 {
+		t.Fatalf("generated request ID = %q, want 32 hex characters", id)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/public/venues", nil)
+	req.Header.Set("X-Request-ID", "from-the-load-balancer")
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, req)
+	if id := rec.Header().Get("X-Request-ID"); id != "from-the-load-balancer" {
+		t.Fatalf("propagated request ID = %q", id)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	s := newTestServer(t)
+	merchant := s.merchant()
+	diner := s.diner()
+	venueID := s.createVenue(merchant, "Metrics Bistro")
+	itemID := s.createMenuItem(merchant, venueID, "Parma", 2400)
+
+	var order struct {
+		ID uint `json:"id"`
+	}
+	s.do(http.MethodPost, "/v1/diner/orders", diner.Token, map[string]any{
+		"venue_id": venueID, "items": []map[string]any{{"menu_item_id": itemID, "quantity": 1}},
+	}).ExpectStatus(http.StatusOK).Decode(&order)
+	s.do(http.MethodPut, fmt.Sprintf("/v1/merchant/orders/%d/status", order.ID), merchant.Token, map[string]string{
+		"status": "Accepted",
+	}).ExpectStatus(http.StatusOK)
+	s.do(http.MethodPost, "/v1/auth/login", "", map[string]string{
+		"email": diner.Email, "password": "wrong-password",
+	}).ExpectStatus(http.StatusUnauthorized)
+
+	s.do(http.MethodGet, "/metrics", "", nil).ExpectStatus(http.StatusUnauthorized)
+	s.do(http.MethodGet, "/metrics", "wrong-token", nil).ExpectStatus(http.StatusUnauthorized)
+
+	body := string(s.do(http.MethodGet, "/metrics", testMetricsToken, nil).ExpectStatus(http.StatusOK).Body)
+	for _, want := range []string{
+		`liven_http_requests_total{method="POST",route="/v1/diner/orders",status="200"}`,
+		`liven_http_request_duration_seconds_count{method="PUT",route="/v1/merchant/orders/:order_id/status"}`,
+		`liven_db_query_duration_seconds_count{operation="create",table="orders"}`,
+		`liven_orders_placed_total`,
+		`liven_orders_value_cents_total`,
+		`liven_orders_status_transitions_total{from="Pending",to="Accepted"}`,
+		`liven_auth_login_failures_total{reason="wrong_password"}`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics output is missing %s", want)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	})
+
+	s := newTestServer(t)
+	merchant := s.merchant()
+	venueID := s.createVenue(merchant, "Traced Bistro")
+	exporter.Reset()
+
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/v1/public/venues/%d", venueID), nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d", rec.Code)
+	}
+
+	spans := exporter.GetSpans()
+	var server, query *tracetest.SpanStub
+	for i := range spans {
+		switch spans[i].Name {
+		case "GET /v1/public/venues/:venue_id":
+			server = &spans[i]
+		case "db.query venues":
+			query = &spans[i]
+		}
+	}
+	if server == nil || query == nil {
+		t.Fatalf("spans = %v, want a request span and a venues query span", spanNames(spans))
+	}
+	if got := server.SpanContext.TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("request span trace ID = %s, want the caller's", got)
+	}
+	if got := server.Parent.SpanID().String(); got != "00f067aa0ba902b7" {
+		t.Errorf("request span parent = %s, want the caller's span", got)
+	}
+	if query.Parent.SpanID() != server.SpanContext.SpanID() {
+		t.Error("query span is not a child of the request span")
+	}
+}
+
+func spanNames(spans tracetest.SpanStubs) []string {
+	names := make([]string, len(spans))
+	for i, span := range spans {
+		names[i] = span.Name
+	}
+	return names
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	s := newTestServer(t)
+
+	s.do(http.MethodGet, "/healthz", "", nil).ExpectStatus(http.StatusOK)
+
+	var ready struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}
+	s.do(http.MethodGet, "/readyz", "", nil).ExpectStatus(http.StatusOK).Decode(&ready)
+	if ready.Checks["database"] != "ok" || ready.Checks["migrations"] != "ok" {
+		t.Fatalf("readiness = %+v", ready)
+	}
+
+	workers := worker.NewGroup()
+	handlers.Workers = workers
+	t.Cleanup(func() {
+		workers.Stop(context.Background())
+		handlers.Workers = nil
+	})
+	crashed := make(chan struct{})
+	workers.Go("crashing", func(ctx context.Context) error {
+		defer close(crashed)
+		return errors.New("boom")
+	})
+	<-crashed
+	// The group records the failure right after the worker returns.
+	for i := 0; i < 100 && workers.Check() == nil; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	s.do(http.MethodGet, "/readyz", "", nil).ExpectStatus(http.StatusServiceUnavailable).Decode(&ready)
+	if ready.Checks["workers"] != "failed" {
+		t.Fatalf("readiness = %+v, want the crashed worker reported", ready)
+	}
+
+	if err := s.conns.Write.Migrator().DropTable("order_items"); err != nil {
+		t.Fatal(err)
+	}
+	s.do(http.MethodGet, "/readyz", "", nil).ExpectStatus(http.StatusServiceUnavailable).Decode(&ready)
+	// The unauthenticated probe names no tables.
+	if ready.Checks["migrations"] != "failed" {
+		t.Fatalf("readiness = %+v, want the migrations reported failed without details", ready)
+	}
+}
+
+func TestProblemResponses(t *testing.T) {
+	s := newTestServer(t)
+	diner := s.diner()
+	merchant := s.merchant()
+	venueID := s.createVenue(merchant, "Problem Cafe")
+
+	var problem apperror.Problem
+	res := s.do(http.MethodPost, "/v1/diner/orders", diner.Token, map[string]any{
+		"venue_id": venueID,
+		"items":    []map[string]any{{"menu_item_id": 1, "quantity": -1}},
+	}).ExpectStatus(http.StatusBadRequest)
+	if got := res.Header.Get("Content-Type"); !strings.HasPrefix(got, apperror.ContentType) {
+		t.Fatalf("Content-Type = %q, want %q", got, apperror.ContentType)
+	}
+	res.Decode(&problem)
+	if problem.Code != apperror.CodeValidationFailed || problem.Status != http.StatusBadRequest {
+		t.Fatalf("problem = %+v", problem)
+	}
+	if problem.RequestID != res.Header.Get("X-Request-ID") || problem.Instance != "/v1/diner/orders" {
+		t.Fatalf("problem = %+v, want the request ID and path", problem)
+	}
+	if len(problem.Errors) != 1 || problem.Errors[0].Field != "items[0].quantity" || problem.Errors[0].Rule != "gt" {
+		t.Fatalf("field errors = %+v, want items[0].quantity failing gt", problem.Errors)
+	}
+
+	problem = apperror.Problem{}
+	s.do(http.MethodPost, "/v1/auth/login", "", nil).ExpectStatus(http.StatusBadRequest).Decode(&problem)
+	if problem.Code != apperror.CodeInvalidRequest {
+		t.Fatalf("empty body code = %s, want %s", problem.Code, apperror.CodeInvalidRequest)
+	}
+
+	problem = apperror.Problem{}
+	s.do(http.MethodGet, "/no/such/route", "", nil).ExpectStatus(http.StatusNotFound).Decode(&problem)
+	if problem.Code != apperror.CodeRouteNotFound {
+		t.Fatalf("unknown route code = %s, want %s", problem.Code, apperror.CodeRouteNotFound)
+	}
+
+	problem = apperror.Problem{}
+	s.do(http.MethodGet, "/v1/merchant", diner.Token, nil).ExpectStatus(http.StatusForbidden).Decode(&problem)
+	if problem.Code != apperror.CodeWrongAccountType {
+		t.Fatalf("wrong account code = %s, want %s", problem.Code, apperror.CodeWrongAccountType)
+	}
+}
+
+func TestLoginRateLimit(t *testing.T) {
+	s := newTestServer(t, func(cfg *config.Config) {
+		cfg.RateLimits.Login = ratelimit.Limit{Requests: 2, Per: time.Minute}
+	})
+	diner := s.diner() // logs in once
+
+	login := func(forwardedFor string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/auth/login",
+			strings.NewReader(`{"email":"`+diner.Email+`","password":"password123"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		rec := httptest.NewRecorder()
+		s.router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := login("198.51.100.1"); rec.Code != http.StatusOK {
+		t.Fatalf("second login status = %d", rec.Code)
+	}
+	// No proxy is trusted, so a forged X-Forwarded-For doesn't reset the count.
+	rec := login("198.51.100.2")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("third login status = %d, want 429\n%s", rec.Code, rec.Body)
+	}
+	if rec.Header().Get("Retry-After") != "30" {
+		t.Errorf("Retry-After = %q, want 30", rec.Header().Get("Retry-After"))
+	}
+	if !strings.Contains(rec.Body.String(), string(apperror.CodeRateLimited)) {
+		t.Errorf("body = %s, want %s", rec.Body, apperror.CodeRateLimited)
+	}
+
+	// Other routes have their own buckets.
+	s.do(http.MethodGet, "/v1/public/venues", "", nil).ExpectStatus(http.StatusOK)
+}
+
+func TestLoginLockout(t *testing.T) {
+	s := newTestServer(t, func(cfg *config.Config) {
+		cfg.LoginLockout = services.LockoutPolicy{Threshold: 3, Duration: time.Minute, MaxDuration: time.Hour}
+	})
+	diner := s.diner()
+	wrong := map[string]string{"email": diner.Email, "password": "wrong-password"}
+	right := map[string]string{"email": diner.Email, "password": "password123"}
+
+	// A successful login resets the count.
+	s.do(http.MethodPost, "/v1/auth/login", "", wrong).ExpectStatus(http.StatusUnauthorized)
+	s.do(http.MethodPost, "/v1/auth/login", "", wrong).ExpectStatus(http.StatusUnauthorized)
+	s.login(diner.Email, "password123")
+
+	for i := 0; i < 3; i++ {
+		s.do(http.MethodPost, "/v1/auth/login", "", wrong).ExpectStatus(http.StatusUnauthorized)
+	}
+	var problem apperror.Problem
+	res := s.do(http.MethodPost, "/v1/auth/login", "", right).ExpectStatus(http.StatusTooManyRequests)
+	res.Decode(&problem)
+	if problem.Code != apperror.CodeAccountLocked {
+		t.Fatalf("code = %s, want %s", problem.Code, apperror.CodeAccountLocked)
+	}
+	if retry, _ := strconv.Atoi(res.Header.Get("Retry-After")); retry < 1 || retry > 60 {
+		t.Errorf("Retry-After = %q, want up to a minute", res.Header.Get("Retry-After"))
+	}
+
+	if _, err := services.UnlockUser(s.conns.Write, diner.Email); err != nil {
+		t.Fatal(err)
+	}
+	s.login(diner.Email, "password123")
+}
+
+func TestPasswordReset(t *testing.T) {
+	s := newTestServer(t, func(cfg *config.Config) {
+		cfg.LoginLockout = services.LockoutPolicy{Threshold: 1, Duration: time.Hour, MaxDuration: time.Hour}
+	})
+	diner := s.diner()
+
+	// Unknown addresses get the same answer and no email.
+	s.do(http.MethodPost, "/v1/auth/password/forgot", "", map[string]string{"email": "nobody@example.com"}).ExpectStatus(http.StatusAccepted)
+	if len(s.mailer.messages) != 1 {
+		t.Fatalf("mailed %d messages, want only the verification email", len(s.mailer.messages))
+	}
+
+	// Lock the account; a reset lifts the lockout.
+	s.do(http.MethodPost, "/v1/auth/login", "", map[string]string{"email": diner.Email, "password": "wrong-password"}).ExpectStatus(http.StatusUnauthorized)
+
+	s.do(http.MethodPost, "/v1/auth/password/forgot", "", map[string]string{"email": diner.Email}).ExpectStatus(http.StatusAccepted)
+	stale := s.mailedToken(diner.Email, "reset-password")
+	s.do(http.MethodPost, "/v1/auth/password/forgot", "", map[string]string{"email": diner.Email}).ExpectStatus(http.StatusAccepted)
+	token := s.mailedToken(diner.Email, "reset-password")
+
+	reset := func(token string) *testResponse {
+		return s.do(http.MethodPost, "/v1/auth/password/reset", "", map[string]string{"token": token, "password": "new-password"})
+	}
+	var problem apperror.Problem
+	reset(stale).ExpectStatus(http.StatusBadRequest).Decode(&problem)
+	if problem.Code != apperror.CodeInvalidToken {
+		t.Fatalf("code = %s, want %s", problem.Code, apperror.CodeInvalidToken)
+	}
+	reset(token).ExpectStatus(http.StatusOK)
+	reset(token).ExpectStatus(http.StatusBadRequest)
+	if entries := s.userChanges(diner.ID, audit.UserPasswordReset); len(entries) != 1 || entries[0].ActorID == nil || *entries[0].ActorID != diner.ID {
+		t.Errorf("password reset audit entries = %+v, want one by the diner", entries)
+	}
+
+	s.login(diner.Email, "new-password")
+	s.do(http.MethodPost, "/v1/auth/login", "", map[string]string{"email": diner.Email, "password": "password123"}).ExpectStatus(http.StatusUnauthorized)
+}
+
+func TestEmailVerification(t *testing.T) {
+	s := newTestServer(t)
+	const email = "unverified@example.com"
+	s.do(http.MethodPost, "/v1/auth/register", "", map[string]string{
+		"email": email, "password": "password123", "user_type": "merchant",
+	}).ExpectStatus(http.StatusCreated)
+	token := s.login(email, "password123")
+	venue := map[string]string{"name": "Cafe", "address": "1 Main Street", "description": "Coffee", "cuisine_type": "Cafe"}
+
+	var problem apperror.Problem
+	s.do(http.MethodPost, "/v1/merchant/venues", token, venue).ExpectStatus(http.StatusForbidden).Decode(&problem)
+	if problem.Code != apperror.CodeEmailNotVerified {
+		t.Fatalf("code = %s, want %s", problem.Code, apperror.CodeEmailNotVerified)
+	}
+
+	// Resending revokes the first link.
+	first := s.mailedToken(email, "verify-email")
+	s.do(http.MethodPost, "/v1/auth/verify-email/resend", token, nil).ExpectStatus(http.StatusAccepted)
+	s.do(http.MethodPost, "/v1/auth/verify-email", "", map[string]string{"token": first}).ExpectStatus(http.StatusBadRequest)
+	s.do(http.MethodPost, "/v1/auth/verify-email", "", map[string]string{"token": s.mailedToken(email, "verify-email")}).ExpectStatus(http.StatusOK)
+
+	s.do(http.MethodPost, "/v1/auth/verify-email/resend", token, nil).ExpectStatus(http.StatusConflict)
+	s.do(http.MethodPost, "/v1/merchant/venues", token, venue).ExpectStatus(http.StatusCreated)
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	s := newTestServer(t)
+	merchant := s.merchant()
+
+	var setup struct {
+		Secret          string `json:"secret"`
+		ProvisioningURI string `json:"provisioning_uri"`
+	}
+	s.do(http.MethodPost, "/v1/auth/2fa/setup", merchant.Token, nil).ExpectStatus(http.StatusOK).Decode(&setup)
+	if !strings.HasPrefix(setup.ProvisioningURI, "otpauth://totp/") {
+		t.Fatalf("provisioning_uri = %q", setup.ProvisioningURI)
+	}
+	code := func(at time.Time) string {
+		code, err := totp.Code(setup.Secret, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	var problem apperror.Problem
+	s.do(http.MethodPost, "/v1/auth/2fa/enable", merchant.Token, map[string]string{"code": "000000"}).ExpectStatus(http.StatusBadRequest).Decode(&problem)
+	if problem.Code != apperror.CodeInvalidTwoFactor {
+		t.Fatalf("code = %s, want %s", problem.Code, apperror.CodeInvalidTwoFactor)
+	}
+	now := time.Now()
+	var enabled struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	s.do(http.MethodPost, "/v1/auth/2fa/enable", merchant.Token, map[string]string{"code": code(now)}).ExpectStatus(http.StatusOK).Decode(&enabled)
+	if len(enabled.RecoveryCodes) != services.RecoveryCodeCount {
+		t.Fatalf("got %d recovery codes", len(enabled.RecoveryCodes))
+	}
+
+	var challenge struct {
+		TwoFactorRequired bool   `json:"two_factor_required"`
+		ChallengeToken    string `json:"challenge_token"`
+	}
+	loginChallenge := func() string {
+		s.do(http.MethodPost, "/v1/auth/login", "", map[string]string{"email": merchant.Email, "password": "password123"}).
+			ExpectStatus(http.StatusOK).Decode(&challenge)
+		if !challenge.TwoFactorRequired || challenge.ChallengeToken == "" {
+			t.Fatalf("login didn't ask for a second factor: %+v", challenge)
+		}
+		return challenge.ChallengeToken
+	}
+	secondFactor := func(challenge, code string) *testResponse {
+		return s.do(http.MethodPost, "/v1/auth/login/2fa", "", map[string]string{"challenge_token": challenge, "code": code})
+	}
+
+	// A challenge is not an access token.
+	pending := loginChallenge()
+	s.do(http.MethodGet, "/v1/merchant", pending, nil).ExpectStatus(http.StatusUnauthorized)
+
+	// The code that enabled 2FA can't be replayed; the next one works.
+	secondFactor(pending, code(now)).ExpectStatus(http.StatusUnauthorized)
+	var loggedIn struct {
+		Token string `json:"token"`
+	}
+	secondFactor(pending, code(now.Add(totp.Period))).ExpectStatus(http.StatusOK).Decode(&loggedIn)
+	var account struct {
+		TwoFactorEnabled bool `json:"two_factor_enabled"`
+	}
+	s.do(http.MethodGet, "/v1/merchant", loggedIn.Token, nil).ExpectStatus(http.StatusOK).Decode(&account)
+	if !account.TwoFactorEnabled {
+		t.Error("account doesn't show two_factor_enabled")
+	}
+
+	// Recovery codes work once, in any case.
+	recovery := strings.ToUpper(enabled.RecoveryCodes[0])
+	secondFactor(loginChallenge(), recovery).ExpectStatus(http.StatusOK)
+	secondFactor(loginChallenge(), recovery).ExpectStatus(http.StatusUnauthorized)
+
+	// Disabling needs the password and a code again.
+	disable := func(password, code string) *testResponse {
+		return s.do(http.MethodPost, "/v1/auth/2fa/disable", loggedIn.Token, map[string]string{"password": password, "code": code})
+	}
+	disable("wrong-password", enabled.RecoveryCodes[1]).ExpectStatus(http.StatusUnauthorized)
+	disable("password123", enabled.RecoveryCodes[1]).ExpectStatus(http.StatusOK)
+	s.login(merchant.Email, "password123")
+
+	if entries := s.userChanges(merchant.ID, audit.UserTwoFactorEnable); len(entries) != 1 {
+		t.Errorf("two-factor enable audit entries = %+v, want one", entries)
+	}
+	if entries := s.userChanges(merchant.ID, audit.UserTwoFactorDisable); len(entries) != 1 {
+		t.Errorf("two-factor disable audit entries = %+v, want one", entries)
+	}
+}
+
+func TestTwoFactorRequiredForMerchants(t *testing.T) {
+	s := newTestServer(t, func(cfg *config.Config) {
+		cfg.TwoFactor.RequireMerchants = true
+	})
+	merchant, diner := s.merchant(), s.diner()
+
+	var problem apperror.Problem
+	s.do(http.MethodGet, "/v1/merchant/venues", merchant.Token, nil).ExpectStatus(http.StatusForbidden).Decode(&problem)
+	if problem.Code != apperror.CodeTwoFactorRequired {
+		t.Fatalf("code = %s, want %s", problem.Code, apperror.CodeTwoFactorRequired)
+	}
+	s.do(http.MethodGet, "/v1/diner", diner.Token, nil).ExpectStatus(http.StatusOK)
+
+	var setup struct {
+		Secret string `json:"secret"`
+	}
+	s.do(http.MethodPost, "/v1/auth/2fa/setup", merchant.Token, nil).ExpectStatus(http.StatusOK).Decode(&setup)
+	code, err := totp.Code(setup.Secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var enabled struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+		Token         string   `json:"token"`
+	}
+	s.do(http.MethodPost, "/v1/auth/2fa/enable", merchant.Token, map[string]string{"code": code}).ExpectStatus(http.StatusOK).Decode(&enabled)
+	s.do(http.MethodGet, "/v1/merchant/venues", enabled.Token, nil).ExpectStatus(http.StatusOK)
+
+	s.do(http.MethodPost, "/v1/auth/2fa/disable", enabled.Token, map[string]string{
+		"password": "password123", "code": enabled.RecoveryCodes[0],
+	}).ExpectStatus(http.StatusForbidden)
+}
+
+func TestJWTKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	writeKey := func(kid, algorithm string) {
+		t.Helper()
+		key, err := keystore.GenerateKey(algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, kid+".pem"), key, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keyID := func(token string) any {
+		t.Helper()
+		parsed, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed.Header["kid"]
+	}
+	reload := func(s *testServer) {
+		t.Helper()
+		if err := setupTokens(s.cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Tokens signed with the shared secret before keys were configured.
+	s := newTestServer(t)
+	diner := s.diner()
+	secretSigned := diner.Token
+
+	// Tokens issued before this API had keys, issuers, audiences or
+	// sessions, signed the way the first release signed them.
+	signIssued := func(issuer string, issued time.Time, ttl time.Duration) string {
+		t.Helper()
+		signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"user_id": diner.ID, "user_type": "diner", "iss": issuer,
+			"exp": issued.Add(ttl).Unix(), "iat": issued.Unix(), "nbf": issued.Unix(),
+		}).SignedString([]byte(testJWTSecret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	signBaseline := func(issuer string) string {
+		t.Helper()
+		return signIssued(issuer, time.Now(), 24*time.Hour)
+	}
+	baseline := signBaseline("GaruruCannonIssuer")
+	s.do(http.MethodGet, "/v1/diner", baseline, nil).ExpectStatus(http.StatusOK)
+	// Only tokens shaped exactly like those go without an audience.
+	s.do(http.MethodGet, "/v1/diner", signBaseline(utils.DefaultIssuer), nil).ExpectStatus(http.StatusUnauthorized)
+	// Whoever holds the secret can't mint lasting ones: they have no session,
+	// so their lifetime is all that limits them.
+	s.do(http.MethodGet, "/v1/diner", signIssued("GaruruCannonIssuer", time.Now(), 365*24*time.Hour), nil).ExpectStatus(http.StatusUnauthorized)
+	s.do(http.MethodGet, "/v1/diner", signIssued("GaruruCannonIssuer", time.Now().Add(30*time.Minute), time.Hour), nil).ExpectStatus(http.StatusUnauthorized)
+	// Once the cutoff has passed, new ones aren't accepted either.
+	cutoff := s.cfg.JWTLegacyCutoff
+	s.cfg.JWTLegacyCutoff = time.Now().Add(-time.Minute)
+	reload(s)
+	s.do(http.MethodGet, "/v1/diner", baseline, nil).ExpectStatus(http.StatusUnauthorized)
+	s.cfg.JWTLegacyCutoff = cutoff
+	reload(s)
+
+	writeKey("first", keystore.AlgorithmRS256)
+	s.cfg.JWTKeysDir = dir
+	reload(s)
+	first := s.login(diner.Email, "password123")
+	if kid := keyID(first); kid != "first" {
+		t.Fatalf("kid = %v, want first", kid)
+	}
+	s.do(http.MethodGet, "/v1/diner", secretSigned, nil).ExpectStatus(http.StatusOK)
+	s.do(http.MethodGet, "/v1/diner", baseline, nil).ExpectStatus(http.StatusOK)
+
+	var jwks keystore.JWKS
+	s.do(http.MethodGet, "/.well-known/jwks.json", "", nil).ExpectStatus(http.StatusOK).Decode(&jwks)
+	if len(jwks.Keys) != 1 || jwks.Keys[0].KeyID != "first" || jwks.Keys[0].N == "" {
+		t.Fatalf("jwks = %+v, want the public half of the first key", jwks)
+	}
+
+	// Stage a second key, then switch signing to it.
+	writeKey("second", keystore.AlgorithmEdDSA)
+	s.cfg.JWTSigningKey = "first"
+	reload(s)
+	s.do(http.MethodGet, "/.well-known/jwks.json", "", nil).ExpectStatus(http.StatusOK).Decode(&jwks)
+	if len(jwks.Keys) != 2 {
+		t.Fatalf("jwks has %d keys, want 2", len(jwks.Keys))
+	}
+	s.cfg.JWTSigningKey = "second"
+	reload(s)
+	second := s.login(diner.Email, "password123")
+	if kid := keyID(second); kid != "second" {
+		t.Fatalf("kid = %v, want second", kid)
+	}
+	s.do(http.MethodGet, "/v1/diner", first, nil).ExpectStatus(http.StatusOK)
+
+	// Retiring the first key retires its tokens.
+	if err := os.Remove(filepath.Join(dir, "first.pem")); err != nil {
+		t.Fatal(err)
+	}
+	reload(s)
+	s.do(http.MethodGet, "/v1/diner", first, nil).ExpectStatus(http.StatusUnauthorized)
+	s.do(http.MethodGet, "/v1/diner", second, nil).ExpectStatus(http.StatusOK)
+
+	// Tokens for another audience are refused.
+	s.cfg.JWTAudience = "another-api"
+	reload(s)
+	elsewhere := s.login(diner.Email, "password123")
+	s.cfg.JWTAudience = utils.DefaultAudience
+	reload(s)
+	s.do(http.MethodGet, "/v1/diner", elsewhere, nil).ExpectStatus(http.StatusUnauthorized)
+}
+
+func TestStaffAccess(t *testing.T) {
+	s := newTestServer(t)
+	owner := s.merchant()
+	other := s.merchant()
+	diner := s.diner()
+	venueID := s.createVenue(owner, "Staffed Bistro")
+	otherVenueID := s.createVenue(owner, "Unstaffed Bistro")
+	foreignVenueID := s.createVenue(other, "Foreign Bistro")
+	itemID := s.createMenuItem(owner, venueID, "Parma", 2400)
+
+	// Staff can only be given venues of their merchant.
+	s.do(http.MethodPost, "/v1/merchant/staff", owner.Token, map[string]any{
+		"email":  "waiter@example.com",
+		"venues": []map[string]any{{"venue_id": foreignVenueID, "permissions": []string{"manage_orders"}}},
+	}).ExpectStatus(http.StatusForbidden)
+
+	var invited struct {
+		Staff struct {
+			ID      uint `json:"id"`
+			Pending bool `json:"pending"`
+		} `json:"staff"`
+	}
+	s.do(http.MethodPost, "/v1/merchant/staff", owner.Token, map[string]any{
+		"email":  "waiter@example.com",
+		"venues": []map[string]any{{"venue_id": venueID, "permissions": []string{"manage_orders"}}},
+	}).ExpectStatus(http.StatusCreated).Decode(&invited)
+	if !invited.Staff.Pending {
+		t.Fatalf("invited staff = %+v, want pending", invited.Staff)
+	}
+
+	// The account has no password until the invitation is accepted.
+	s.do(http.MethodPost, "/v1/auth/login", "", map[string]string{
+		"email": "waiter@example.com", "password": "waiter123",
+	}).ExpectStatus(http.StatusUnauthorized)
+	s.do(http.MethodPost, "/v1/auth/staff/accept", "", map[string]string{
+		"token": s.mailedToken("waiter@example.com", "accept-invite"), "password": "waiter123",
+	}).ExpectStatus(http.StatusOK)
+	staff := s.login("waiter@example.com", "waiter123")
+	if entries := s.userChanges(invited.Staff.ID, audit.StaffAccept); len(entries) != 1 ||
+		entries[0].ActorID == nil || *entries[0].ActorID != invited.Staff.ID || entries[0].MerchantID == nil || *entries[0].MerchantID != owner.ID {
+		t.Errorf("staff accept audit entries = %+v, want one by the staff member for the owner", entries)
+	}
+
+	var account struct {
+		UserType      string `json:"user_type"`
+		EmailVerified bool   `json:"email_verified"`
+		Venues        []struct {
+			VenueID     uint     `json:"venue_id"`
+			Permissions []string `json:"permissions"`
+		} `json:"venues"`
+	}
+	s.do(http.MethodGet, "/v1/staff", staff, nil).ExpectStatus(http.StatusOK).Decode(&account)
+	if account.UserType != "staff" || !account.EmailVerified || len(account.Venues) != 1 || account.Venues[0].VenueID != venueID {
+		t.Fatalf("staff account = %+v", account)
+	}
+
+	var listed struct {
+		Venues []struct {
+			ID uint `json:"id"`
+		} `json:"venues"`
+	}
+	s.do(http.MethodGet, "/v1/merchant/venues", staff, nil).ExpectStatus(http.StatusOK).Decode(&listed)
+	if len(listed.Venues) != 1 || listed.Venues[0].ID != venueID {
+		t.Fatalf("staff venues = %+v", listed.Venues)
+	}
+
+	var order struct {
+		ID uint `json:"id"`
+	}
+	s.do(http.MethodPost, "/v1/diner/orders", diner.Token, map[string]any{
+		"venue_id": venueID, "items": []map[string]any{{"menu_item_id": itemID, "quantity": 1}},
+	}).ExpectStatus(http.StatusOK).Decode(&order)
+
+	venuePath := fmt.Sprintf("/v1/merchant/venues/%d", venueID)
+	newItem := map[string]any{"name": "Chips", "description": "x", "price_in_cents": 800, "category": "Sides"}
+	s.do(http.MethodGet, venuePath+"/orders", staff, nil).ExpectStatus(http.StatusOK)
+	s.do(http.MethodPut, fmt.Sprintf("/v1/merchant/orders/%d/status", order.ID), staff, map[string]string{
+		"status": "Accepted",
+	}).ExpectStatus(http.StatusOK)
+	if code := s.do(http.MethodPost, venuePath+"/menuitems", staff, newItem).ExpectStatus(http.StatusForbidden).JSON().(map[string]any)["code"]; code != "MISSING_PERMISSION" {
+		t.Errorf("adding a menu item without manage_menu: code = %v", code)
+	}
+	s.do(http.MethodGet, fmt.Sprintf("/v1/merchant/venues/%d/orders", otherVenueID), staff, nil).ExpectStatus(http.StatusForbidden)
+	s.do(http.MethodPut, venuePath, staff, map[string]string{"name": "Renamed"}).ExpectStatus(http.StatusForbidden)
+	s.do(http.MethodPost, "/v1/merchant/staff", staff, map[string]any{
+		"email":  "friend@example.com",
+		"venues": []map[string]any{{"venue_id": venueID, "permissions": []string{"manage_menu"}}},
+	}).ExpectStatus(http.StatusForbidden)
+
+	// Only the owner manages the staff account, and changes apply at once.
+	staffPath := fmt.Sprintf("/v1/merchant/staff/%d", invited.Staff.ID)
+	update := map[string]any{"venues": []map[string]any{
+		{"venue_id": venueID, "permissions": []string{"manage_menu", "view_analytics"}},
+	}}
+	s.do(http.MethodPut, staffPath, other.Token, update).ExpectStatus(http.StatusNotFound)
+	s.do(http.MethodPut, staffPath, owner.Token, map[string]any{"venues": []map[string]any{
+		{"venue_id": venueID, "permissions": []string{"sweep_floors"}},
+	}}).ExpectStatus(http.StatusBadRequest)
+	s.do(http.MethodPut, staffPath, owner.Token, update).ExpectStatus(http.StatusOK)
+	s.do(http.MethodPost, venuePath+"/menuitems", staff, newItem).ExpectStatus(http.StatusCreated)
+	s.do(http.MethodGet, fmt.Sprintf("/v1/merchant/orders/%d", order.ID), staff, nil).ExpectStatus(http.StatusOK)
+	s.do(http.MethodPut, fmt.Sprintf("/v1/merchant/orders/%d/status", order.ID), staff, map[string]string{
+		"status": "Preparing",
+	}).ExpectStatus(http.StatusNotFound)
+
+	var members struct {
+		Staff []struct {
+			Email   string `json:"email"`
+			Pending bool   `json:"pending"`
+		} `json:"staff"`
+	}
+	s.do(http.MethodGet, "/v1/merchant/staff", owner.Token, nil).ExpectStatus(http.StatusOK).Decode(&members)
+	if len(members.Staff) != 1 || members.Staff[0].Email != "waiter@example.com" || members.Staff[0].Pending {
+		t.Fatalf("staff list = %+v", members.Staff)
+	}
+
+	s.do(http.MethodDelete, staffPath, owner.Token, nil).ExpectStatus(http.StatusOK)
+	s.do(http.MethodGet, venuePath+"/orders", staff, nil).ExpectStatus(http.StatusUnauthorized)
+	s.do(http.MethodGet, "/v1/staff", staff, nil).ExpectStatus(http.StatusUnauthorized)
+
+	// Removal erases the account, so its address can be invited again.
+	var removed models.User
+	if err := s.conns.Write.Unscoped().First(&removed, invited.Staff.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if removed.Email == "waiter@example.com" || removed.Password != "" || !removed.DeletedAt.Valid {
+		t.Fatalf("removed staff = %+v, want anonymized", removed)
+	}
+	var sessions int64
+	s.conns.Write.Model(&models.Session{}).Where("user_id = ?", invited.Staff.ID).Count(&sessions)
+	if sessions != 0 {
+		t.Errorf("removed staff has %d sessions", sessions)
+	}
+	// The audit log outlives the account, so it never held the address.
+	var staffChanges []string
+	s.conns.Write.Model(&models.AuditEntry{}).Where("entity_type = ? AND entity_id = ?", "user", invited.Staff.ID).Pluck("changes", &staffChanges)
+	if len(staffChanges) == 0 || strings.Contains(strings.Join(staffChanges, ""), "waiter@example.com") {
+		t.Errorf("staff audit changes = %v, want some without the address", staffChanges)
+	}
+	s.do(http.MethodPost, "/v1/merchant/staff", owner.Token, map[string]any{
+		"email":  "waiter@example.com",
+		"venues": []map[string]any{{"venue_id": venueID, "permissions": []string{"manage_orders"}}},
+	}).ExpectStatus(http.StatusCreated)
+}
+
+func TestAdmin(t *testing.T) {
+	s := newTestServer(t)
+	admin := s.admin()
+	merchant := s.merchant()
+	diner := s.diner()
+	venueID := s.createVenue(merchant, "Reported Bistro")
+	itemID := s.createMenuItem(merchant, venueID, "Parma", 2400)
+
+	var order struct {
+		ID uint `json:"id"`
+	}
+	placeOrder := map[string]any{"venue_id": venueID, "items": []map[string]any{{"menu_item_id": itemID, "quantity": 1}}}
+	s.do(http.MethodPost, "/v1/diner/orders", diner.Token, placeOrder).ExpectStatus(http.StatusOK).Decode(&order)
+
+	// Only admins reach the admin API, and admins can't be registered.
+	s.do(http.MethodGet, "/v1/admin/users", merchant.Token, nil).ExpectStatus(http.StatusForbidden)
+	s.do(http.MethodPost, "/v1/auth/register", "", map[string]string{
+		"email": "wannabe@example.com", "password": "password123", "user_type": "admin",
+	}).ExpectStatus(http.StatusBadRequest)
+
+	var found struct {
+		Users []struct {
+			ID       uint   `json:"id"`
+			UserType string `json:"user_type"`
+		} `json:"users"`
+	}
+	s.do(http.MethodGet, "/v1/admin/users?user_type=merchant&q="+merchant.Email, admin.Token, nil).
+		ExpectStatus(http.StatusOK).Decode(&found)
+	if len(found.Users) != 1 || found.Users[0].ID != merchant.ID {
+		t.Fatalf("user search = %+v", found.Users)
+	}
+
+	// Suspending a merchant locks them out and takes their venues down.
+	suspendPath := fmt.Sprintf("/v1/admin/users/%d/suspend", merchant.ID)
+	s.do(http.MethodPost, suspendPath, admin.Token, map[string]string{}).ExpectStatus(http.StatusBadRequest)
+	s.do(http.MethodPost, suspendPath, admin.Token, map[string]string{"reason": "Fake listings"}).ExpectStatus(http.StatusOK)
+	s.do(http.MethodPost, suspendPath, admin.Token, map[string]string{"reason": "Again"}).ExpectStatus(http.StatusConflict)
+	s.do(http.MethodPost, fmt.Sprintf("/v1/admin/users/%d/suspend", admin.ID), admin.Token, map[string]string{
+		"reason": "Oops",
+	}).ExpectStatus(http.StatusForbidden)
+
+	if code := s.do(http.MethodGet, "/v1/merchant/venues", merchant.Token, nil).ExpectStatus(http.StatusForbidden).JSON().(map[string]any)["code"]; code != "ACCOUNT_SUSPENDED" {
+		t.Errorf("suspended merchant's token: code = %v", code)
+	}
+	s.do(http.MethodPost, "/v1/auth/login", "", map[string]string{
+		"email": merchant.Email, "password": "password123",
+	}).ExpectStatus(http.StatusForbidden)
+	s.do(http.MethodGet, fmt.Sprintf("/v1/public/venues/%d", venueID), "", nil).ExpectStatus(http.StatusNotFound)
+	s.do(http.MethodGet, fmt.Sprintf("/v1/public/venues/%d/menu", venueID), "", nil).ExpectStatus(http.StatusNotFound)
+	s.do(http.MethodPost, "/v1/diner/orders", diner.Token, placeOrder).ExpectStatus(http.StatusNotFound)
+
+	var venues struct {
+		Venues []struct {
+			ID uint `json:"id"`
+		} `json:"venues"`
+	}
+	s.do(http.MethodGet, fmt.Sprintf("/v1/admin/venues?merchant_id=%d", merchant.ID), admin.Token, nil).
+		ExpectStatus(http.StatusOK).Decode(&venues)
+	if len(venues.Venues) != 1 || venues.Venues[0].ID != venueID {
+		t.Fatalf("venue search = %+v", venues.Venues)
+	}
+
+	s.do(http.MethodPost, fmt.Sprintf("/v1/admin/users/%d/reinstate", merchant.ID), admin.Token, nil).ExpectStatus(http.StatusOK)
+	s.do(http.MethodGet, "/v1/merchant/venues", merchant.Token, nil).ExpectStatus(http.StatusOK)
+	s.do(http.MethodGet, fmt.Sprintf("/v1/public/venues/%d", venueID), "", nil).ExpectStatus(http.StatusOK)
+
+	// Admins can unstick any order.
+	var forced struct {
+		Status       string `json:"status"`
+		StatusReason string `json:"status_reason"`
+	}
+	s.do(http.MethodPut, fmt.Sprintf("/v1/admin/orders/%d/status", order.ID), admin.Token, map[string]string{
+		"status": "Cancelled", "reason": "Venue closed early",
+	}).ExpectStatus(http.StatusOK).Decode(&forced)
+	if forced.Status != "Cancelled" || forced.StatusReason != "Venue closed early" {
+		t.Fatalf("forced order = %+v", forced)
+	}
+	var orders []struct {
+		ID uint `json:"id"`
+	}
+	s.do(http.MethodGet, fmt.Sprintf("/v1/admin/orders?diner_id=%d&status=Cancelled", diner.ID), admin.Token, nil).
+		ExpectStatus(http.StatusOK).Decode(&orders)
+	if len(orders) != 1 || orders[0].ID != order.ID {
+		t.Fatalf("order search = %+v", orders)
+	}
+	s.do(http.MethodGet, fmt.Sprintf("/v1/admin/orders/%d", order.ID), admin.Token, nil).ExpectStatus(http.StatusOK)
+	s.do(http.MethodGet, "/v1/admin/orders/"+url.PathEscape("0 OR 1=1"), admin.Token, nil).ExpectStatus(http.StatusNotFound)
+
+	// Impersonation sees what the diner sees but can't change anything.
+	var impersonation struct {
+		Token string `json:"token"`
+	}
+	s.do(http.MethodPost, fmt.Sprintf("/v1/admin/users/%d/impersonate", diner.ID), admin.Token, nil).
+		ExpectStatus(http.StatusOK).Decode(&impersonation)
+	s.do(http.MethodGet, fmt.Sprintf("/v1/diner/orders/%d", order.ID), impersonation.Token, nil).ExpectStatus(http.StatusOK)
+	if code := s.do(http.MethodPost, "/v1/diner/orders", impersonation.Token, placeOrder).ExpectStatus(http.StatusForbidden).JSON().(map[string]any)["code"]; code != "IMPERSONATION_READ_ONLY" {
+		t.Errorf("ordering while impersonating: code = %v", code)
+	}
+	s.do(http.MethodGet, "/v1/admin/users", impersonation.Token, nil).ExpectStatus(http.StatusForbidden)
+}
+
+func TestSuspendedMerchantStaff(t *testing.T) {
+	s := newTestServer(t)
+	admin := s.admin()
+	owner := s.merchant()
+	venueID := s.createVenue(owner, "Suspended Bistro")
+	itemID := s.createMenuItem(owner, venueID, "Parma", 2400)
+
+	s.do(http.MethodPost, "/v1/merchant/staff", owner.Token, map[string]any{
+		"email":  "waiter@example.com",
+		"venues": []map[string]any{{"venue_id": venueID, "permissions": []string{"manage_menu", "manage_orders"}}},
+	}).ExpectStatus(http.StatusCreated)
+	s.do(http.MethodPost, "/v1/auth/staff/accept", "", map[string]string{
+		"token": s.mailedToken("waiter@example.com", "accept-invite"), "password": "waiter123",
+	}).ExpectStatus(http.StatusOK)
+	staff := s.login("waiter@example.com", "waiter123")
+
+	itemPath := fmt.Sprintf("/v1/merchant/venues/%d/menuitems/%d", venueID, itemID)
+	ordersPath := fmt.Sprintf("/v1/merchant/venues/%d/orders", venueID)
+	s.do(http.MethodPut, itemPath, staff, map[string]any{"price_in_cents": 2500}).ExpectStatus(http.StatusOK)
+	s.do(http.MethodGet, ordersPath, staff, nil).ExpectStatus(http.StatusOK)
+
+	// Suspending the merchant stops its staff too.
+	s.do(http.MethodPost, fmt.Sprintf("/v1/admin/users/%d/suspend", owner.ID), admin.Token, map[string]string{
+		"reason": "Fake listings",
+	}).ExpectStatus(http.StatusOK)
+	if code := s.do(http.MethodPut, itemPath, staff, map[string]any{"price_in_cents": 2600}).ExpectStatus(http.StatusForbidden).JSON().(map[string]any)["code"]; code != "ACCOUNT_SUSPENDED" {
+		t.Errorf("editing a menu item for a suspended merchant: code = %v", code)
+	}
+	if code := s.do(http.MethodGet, ordersPath, staff, nil).ExpectStatus(http.StatusForbidden).JSON().(map[string]any)["code"]; code != "ACCOUNT_SUSPENDED" {
+		t.Errorf("listing orders for a suspended merchant: code = %v", code)
+	}
+
+	s.do(http.MethodPost, fmt.Sprintf("/v1/admin/users/%d/reinstate", owner.ID), admin.Token, nil).ExpectStatus(http.StatusOK)
+	s.do(http.MethodGet, ordersPath, staff, nil).ExpectStatus(http.StatusOK)
+}
+
+func TestAuditLog(t *testing.T) {
+	s := newTestServer(t)
+	admin := s.admin()
+	merchant := s.merchant()
+	other := s.merchant()
+	venueID := s.createVenue(merchant, "Audited Bistro")
+	itemID := s.createMenuItem(merchant, venueID, "Parma", 2400)
+	s.createVenue(other, "Elsewhere")
+
+	s.do(http.MethodPut, fmt.Sprintf("/v1/merchant/venues/%d/menuitems/%d", venueID, itemID), merchant.Token, map[string]any{
+		"name": "Parma", "description": "Parma description", "price_in_cents": 2600, "category": "Mains",
+	}).ExpectStatus(http.StatusOK)
+
+	type auditEntries struct {
+		Entries []struct {
+			ActorID   uint   `json:"actor_id"`
+			Action    string `json:"action"`
+			EntityID  uint   `json:"entity_id"`
+			VenueID   uint   `json:"venue_id"`
+			IP        string `json:"ip"`
+			RequestID string `json:"request_id"`
+			Changes   map[string]struct {
+				Before json.RawMessage `json:"before"`
+				After  json.RawMessage `json:"after"`
+			} `json:"changes"`
+		} `json:"entries"`
+	}
+	var log auditEntries
+	s.do(http.MethodGet, "/v1/merchant/audit?action=menu_item.update", merchant.Token, nil).ExpectStatus(http.StatusOK).Decode(&log)
+	if len(log.Entries) != 1 {
+		t.Fatalf("menu item updates = %+v", log.Entries)
+	}
+	entry := log.Entries[0]
+	if entry.ActorID != merchant.ID || entry.EntityID != itemID || entry.VenueID != venueID || entry.IP == "" || entry.RequestID == "" {
+		t.Errorf("entry = %+v", entry)
+	}
+	if price, ok := entry.Changes["price_in_cents"]; !ok || string(price.Before) != "2400" || string(price.After) != "2600" || len(entry.Changes) != 1 {
+		t.Errorf("changes = %+v, want only the price from 2400 to 2600", entry.Changes)
+	}
+
+	// Merchants only see their own venues' changes.
+	s.do(http.MethodGet, "/v1/merchant/audit", other.Token, nil).ExpectStatus(http.StatusOK).Decode(&log)
+	if len(log.Entries) != 1 || log.Entries[0].Action != "venue.create" {
+		t.Errorf("other merchant's log = %+v, want only their venue's creation", log.Entries)
+	}
+	s.do(http.MethodGet, "/v1/admin/audit", merchant.Token, nil).ExpectStatus(http.StatusForbidden)
+
+	s.do(http.MethodGet, fmt.Sprintf("/v1/admin/audit?actor_id=%d", merchant.ID), admin.Token, nil).ExpectStatus(http.StatusOK).Decode(&log)
+	if len(log.Entries) != 3 || log.Entries[0].Action != "menu_item.update" {
+		t.Errorf("admin's view of the merchant = %+v, want 3 entries, newest first", log.Entries)
+	}
+
+	var verified struct {
+		Valid  bool `json:"valid"`
+		Report struct {
+			Entries int `json:"entries"`
+		} `json:"report"`
+		Head string `json:"head"`
+	}
+	s.do(http.MethodGet, "/v1/admin/audit/verify", admin.Token, nil).ExpectStatus(http.StatusOK).Decode(&verified)
+	if !verified.Valid || verified.Report.Entries != 4 || verified.Head == "" {
+		t.Errorf("verify = %+v, want 4 intact entries", verified)
+	}
+}
+
+func TestAccountLifecycle(t *testing.T) {
+	s := newTestServer(t)
+	merchant := s.merchant()
+	diner := s.diner()
+	venueID := s.createVenue(merchant, "Lifecycle Cafe")
+	itemID := s.createMenuItem(merchant, venueID, "Toastie", 1200)
+	var order struct {
+		ID uint `json:"id"`
+	}
+	s.do(http.MethodPost, "/v1/diner/orders", diner.Token, map[string]any{
+		"venue_id": venueID, "items": []map[string]any{{"menu_item_id": itemID, "quantity": 1}},
+	}).ExpectStatus(http.StatusOK).Decode(&order)
+
+	// Profiles are replaced as a whole and validated.
+	s.do(http.MethodPut, "/v1/diner/profile", diner.Token, map[string]any{"phone": "0412 345 678"}).ExpectStatus(http.StatusBadRequest)
+	var profile struct {
+		Profile struct {
+			DisplayName      string `json:"display_name"`
+			Phone            string `json:"phone"`
+			Locale           string `json:"locale"`
+			MarketingConsent bool   `json:"marketing_consent"`
+		} `json:"profile"`
+	}
+	s.do(http.MethodPut, "/v1/diner/profile", diner.Token, map[string]any{
+		"display_name": "Sam", "phone": "+61412345678", "locale": "en-AU", "marketing_consent": true,
+	}).ExpectStatus(http.StatusOK)
+	s.do(http.MethodGet, "/v1/diner/profile", diner.Token, nil).ExpectStatus(http.StatusOK).Decode(&profile)
+	if p := profile.Profile; p.DisplayName != "Sam" || p.Phone != "+61412345678" || p.Locale != "en-AU" || !p.MarketingConsent {
+		t.Fatalf("profile = %+v", p)
+	}
+	s.do(http.MethodGet, "/v1/merchant/profile", diner.Token, nil).ExpectStatus(http.StatusForbidden)
+
+	// Changing the password signs out every other token.
+	s.do(http.MethodPut, "/v1/diner/password", diner.Token, map[string]string{
+		"current_password": "wrong-password", "new_password": "new-password",
+	}).ExpectStatus(http.StatusUnauthorized)
+	otherDevice := s.login(diner.Email, "password123")
+	var changed struct {
+		Token string `json:"token"`
+	}
+	s.do(http.MethodPut, "/v1/diner/password", diner.Token, map[string]string{
+		"current_password": "password123", "new_password": "new-password",
+	}).ExpectStatus(http.StatusOK).Decode(&changed)
+	s.do(http.MethodGet, "/v1/diner", diner.Token, nil).ExpectStatus(http.StatusUnauthorized)
+	s.do(http.MethodGet, "/v1/diner", otherDevice, nil).ExpectStatus(http.StatusUnauthorized)
+	s.do(http.MethodGet, "/v1/diner", changed.Token, nil).ExpectStatus(http.StatusOK)
+	diner.Token = s.login(diner.Email, "new-password")
+
+	// A new address takes over once the link mailed there is opened.
+	s.do(http.MethodPost, "/v1/diner/email", diner.Token, map[string]string{
+		"email": merchant.Email, "password": "new-password",
+	}).ExpectStatus(http.StatusConflict)
+	s.do(http.MethodPost, "/v1/diner/email", diner.Token, map[string]string{
+		"email": "sam@example.com", "password": "new-password",
+	}).ExpectStatus(http.StatusAccepted)
+	s.login(diner.Email, "new-password")
+	s.do(http.MethodPost, "/v1/auth/email/confirm", "", map[string]string{
+		"token": s.mailedToken("sam@example.com", "confirm-email"),
+	}).ExpectStatus(http.StatusOK)
+	s.do(http.MethodPost, "/v1/auth/login", "", map[string]string{
+		"email": diner.Email, "password": "new-password",
+	}).ExpectStatus(http.StatusUnauthorized)
+	diner.Email = "sam@example.com"
+	diner.Token = s.login(diner.Email, "new-password")
+
+	// Merchants hand over their venues before leaving; diners' orders stay.
+	if code := s.do(http.MethodDelete, "/v1/merchant", merchant.Token, map[string]string{
+		"password": "password123",
+	}).ExpectStatus(http.StatusConflict).JSON().(map[string]any)["code"]; code != "MERCHANT_HAS_VENUES" {
+		t.Errorf("deleting a merchant with venues: code = %v", code)
+	}
+	deleteDiner := func() {
+		s.do(http.MethodDelete, "/v1/diner", diner.Token, map[string]string{"password": "new-password"}).ExpectStatus(http.StatusAccepted)
+		s.do(http.MethodGet, "/v1/diner", diner.Token, nil).ExpectStatus(http.StatusUnauthorized)
+	}
+	deleteDiner()
+
+	// Logging in during the grace period keeps the account.
+	diner.Token = s.login(diner.Email, "new-password")
+	if anonymized, err := anonymizeDueAccounts(s.conns.Write, audit.ActorSystem, time.Now().Add(31*24*time.Hour)); err != nil || anonymized != 0 {
+		t.Fatalf("anonymized %d restored accounts, err = %v", anonymized, err)
+	}
+
+	// Once it is over, the personal data is gone but the order stays.
+	deleteDiner()
+	if anonymized, err := anonymizeDueAccounts(s.conns.Write, audit.ActorSystem, time.Now()); err != nil || anonymized != 0 {
+		t.Fatalf("anonymized %d accounts within the grace period, err = %v", anonymized, err)
+	}
+	if anonymized, err := anonymizeDueAccounts(s.conns.Write, audit.ActorSystem, time.Now().Add(31*24*time.Hour)); err != nil || anonymized != 1 {
+		t.Fatalf("anonymized %d accounts, want 1, err = %v", anonymized, err)
+	}
+	s.do(http.MethodPost, "/v1/auth/login", "", map[string]string{
+		"email": diner.Email, "password": "new-password",
+	}).ExpectStatus(http.StatusUnauthorized)
+	var merchantView struct {
+		DinerID uint `json:"diner_id"`
+	}
+	s.do(http.MethodGet, fmt.Sprintf("/v1/merchant/orders/%d", order.ID), merchant.Token, nil).ExpectStatus(http.StatusOK).Decode(&merchantView)
+	if merchantView.DinerID != diner.ID {
+		t.Errorf("order diner = %d, want %d", merchantView.DinerID, diner.ID)
+	}
+	var anonymous models.User
+	if err := s.conns.Write.Unscoped().First(&anonymous, diner.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if anonymous.Email == diner.Email || anonymous.Phone != "" || anonymous.DisplayName != "" || anonymous.Password != "" {
+		t.Errorf("anonymized account = %+v", anonymous)
+	}
+	// Its changes stay in the audit log, but not where it made them from.
+	var activity, ips int64
+	s.conns.Write.Model(&models.AuditEntry{}).Where("actor_id = ?", diner.ID).Count(&activity)
+	s.conns.Write.Model(&models.AuditIP{}).Where("actor_id = ?", diner.ID).Count(&ips)
+	if activity == 0 || ips != 0 {
+		t.Errorf("%d audit entries with %d IPs left, want some without IPs", activity, ips)
+	}
+	if _, err := audit.Verify(s.conns.Write); err != nil {
+		t.Errorf("audit log after anonymizing: %v", err)
+	}
+	// The address is free again.
+	s.register(diner.Email, "diner")
+}
+
+func TestDataExport(t *testing.T) {
+	s := newTestServer(t)
+	merchant := s.merchant()
+	diner := s.diner()
+	admin := s.admin()
+	venueID := s.createVenue(merchant, "Export Diner")
+	itemID := s.createMenuItem(merchant, venueID, "Pancakes", 1500)
+	s.do(http.MethodPost, "/v1/diner/orders", diner.Token, map[string]any{
+		"venue_id": venueID, "items": []map[string]any{{"menu_item_id": itemID, "quantity": 2}},
+	}).ExpectStatus(http.StatusOK)
+	s.do(http.MethodPut, "/v1/diner/profile", diner.Token, map[string]any{"display_name": "Alex"}).ExpectStatus(http.StatusOK)
+	if err := s.conns.Write.Create(&models.UserIdentity{UserID: diner.ID, Provider: "google", Subject: "alex-1"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	s.do(http.MethodPost, fmt.Sprintf("/v1/admin/users/%d/suspend", diner.ID), admin.Token, map[string]string{"reason": "Chargebacks"}).ExpectStatus(http.StatusOK)
+	s.do(http.MethodPost, fmt.Sprintf("/v1/admin/users/%d/reinstate", diner.ID), admin.Token, nil).ExpectStatus(http.StatusOK)
+	diner.Token = s.login(diner.Email, "password123")
+
+	type auditEntry struct {
+		ActorID uint   `json:"actor_id"`
+		Action  string `json:"action"`
+		IP      string `json:"ip"`
+	}
+	var export struct {
+		Account struct {
+			Email           string `json:"email"`
+			DisplayName     string `json:"display_name"`
+			EmailVerifiedAt string `json:"email_verified_at"`
+		} `json:"account"`
+		Orders []struct {
+			TotalAmountInCents int64 `json:"total_amount_in_cents"`
+		} `json:"orders"`
+		Sessions []struct {
+			IP      string `json:"ip"`
+			Current bool   `json:"current"`
+		} `json:"sessions"`
+		Identities []struct {
+			Provider string `json:"provider"`
+			Subject  string `json:"subject"`
+		} `json:"identities"`
+		Activity []auditEntry `json:"activity"`
+		History  []auditEntry `json:"history"`
+	}
+	res := s.do(http.MethodGet, "/v1/diner/data-export", diner.Token, nil).ExpectStatus(http.StatusOK)
+	res.Decode(&export)
+	if export.Account.Email != diner.Email || export.Account.DisplayName != "Alex" || export.Account.EmailVerifiedAt == "" {
+		t.Errorf("exported account = %+v", export.Account)
+	}
+	if len(export.Orders) != 1 || export.Orders[0].TotalAmountInCents != 3000 {
+		t.Errorf("exported orders = %+v", export.Orders)
+	}
+	current := 0
+	for _, session := range export.Sessions {
+		if session.IP == "" {
+			t.Errorf("exported session without its IP: %+v", session)
+		}
+		if session.Current {
+			current++
+		}
+	}
+	if len(export.Sessions) == 0 || current != 1 {
+		t.Errorf("exported sessions = %+v, want one current", export.Sessions)
+	}
+	if len(export.Identities) != 1 || export.Identities[0].Provider != "google" || export.Identities[0].Subject != "alex-1" {
+		t.Errorf("exported identities = %+v", export.Identities)
+	}
+	if len(export.Activity) != 2 || export.Activity[0].Action != "order.place" || export.Activity[0].IP == "" {
+		t.Errorf("exported activity = %+v", export.Activity)
+	}
+	// Changes the administrator made are included, but not where from.
+	if h := export.History; len(h) != 3 || h[0].Action != "user.profile_update" || h[0].IP == "" ||
+		h[1].Action != "user.suspend" || h[1].ActorID != admin.ID || h[1].IP != "" || h[2].Action != "user.reinstate" {
+		t.Errorf("exported history = %+v", export.History)
+	}
+	if disposition := res.Header.Get("Content-Disposition"); !strings.Contains(disposition, "attachment") {
+		t.Errorf("Content-Disposition = %q", disposition)
+	}
+
+	// The archive holds each part of the same export as its own file.
+	var parts map[string]json.RawMessage
+	res.Decode(&parts)
+	res = s.do(http.MethodGet, "/v1/diner/data-export?format=zip", diner.Token, nil).ExpectStatus(http.StatusOK)
+	archive, err := zip.NewReader(bytes.NewReader(res.Body), int64(len(res.Body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range archive.File {
+		names = append(names, file.Name)
+		reader, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got, want bytes.Buffer
+		if err := json.Compact(&got, content); err != nil {
+			t.Fatalf("%s: %v", file.Name, err)
+		}
+		json.Compact(&want, parts[strings.TrimSuffix(file.Name, ".json")])
+		if got.String() != want.String() {
+			t.Errorf("%s = %s, want %s", file.Name, got.String(), want.String())
+		}
+	}
+	if strings.Join(names, ",") != "account.json,orders.json,sessions.json,identities.json,activity.json,history.json" {
+		t.Errorf("archive files = %v", names)
+	}
+	s.do(http.MethodGet, "/v1/diner/data-export?format=csv", diner.Token, nil).ExpectStatus(http.StatusBadRequest)
+	s.do(http.MethodGet, "/v1/diner/data-export", merchant.Token, nil).ExpectStatus(http.StatusForbidden)
+}
+
+func TestAPIKeys(t *testing.T) {
+	s := newTestServer(t)
+	owner := s.merchant()
+	other := s.merchant()
+	diner := s.diner()
+	venueID := s.createVenue(owner, "Integrated Bistro")
+	otherVenueID := s.createVenue(owner, "Manual Bistro")
+	foreignVenueID := s.createVenue(other, "Foreign Bistro")
+	itemID := s.createMenuItem(owner, venueID, "Parma", 2400)
+
+	newKey := func(permissions []string, venue uint) map[string]any {
+		return map[string]any{"name": "POS", "permissions": permissions, "venue_id": venue}
+	}
+	s.do(http.MethodPost, "/v1/merchant/api-keys", owner.Token, newKey([]string{"manage_menu"}, foreignVenueID)).ExpectStatus(http.StatusForbidden)
+	s.do(http.MethodPost, "/v1/merchant/api-keys", owner.Token, newKey([]string{"sweep_floors"}, venueID)).ExpectStatus(http.StatusBadRequest)
+	s.do(http.MethodPost, "/v1/merchant/api-keys", owner.Token, map[string]any{
+		"name": "POS", "permissions": []string{"manage_menu"}, "expires_at": time.Now().Add(-time.Hour),
+	}).ExpectStatus(http.StatusBadRequest)
+
+	var created struct {
+		APIKey struct {
+			ID     uint   `json:"id"`
+			Prefix string `json:"prefix"`
+		} `json:"api_key"`
+		Key string `json:"key"`
+	}
+	s.do(http.MethodPost, "/v1/merchant/api-keys", owner.Token, newKey([]string{"manage_menu"}, venueID)).
+		ExpectStatus(http.StatusCreated).Decode(&created)
+	key := created.Key
+	if !strings.HasPrefix(key, models.APIKeyPrefix) || !strings.HasPrefix(key, created.APIKey.Prefix) || len(created.APIKey.Prefix) >= len(key) {
+		t.Fatalf("created key = %+v", created)
+	}
+
+	// The key works on the menu of its venue, and nowhere else.
+	var listed struct {
+		Venues []struct {
+			ID uint `json:"id"`
+		} `json:"venues"`
+	}
+	s.doWithKey(http.MethodGet, "/v1/merchant/venues", key, nil).ExpectStatus(http.StatusOK).Decode(&listed)
+	if len(listed.Venues) != 1 || listed.Venues[0].ID != venueID {
+		t.Fatalf("key venues = %+v", listed.Venues)
+	}
+	venuePath := fmt.Sprintf("/v1/merchant/venues/%d", venueID)
+	s.doWithKey(http.MethodPut, fmt.Sprintf("%s/menuitems/%d", venuePath, itemID), key, map[string]any{"price_in_cents": 2600}).
+		ExpectStatus(http.StatusOK)
+	s.doWithKey(http.MethodGet, fmt.Sprintf("/v1/merchant/venues/%d/menuitems", otherVenueID), key, nil).ExpectStatus(http.StatusForbidden)
+	s.doWithKey(http.MethodGet, fmt.Sprintf("/v1/merchant/venues/%d/menuitems", foreignVenueID), key, nil).ExpectStatus(http.StatusForbidden)
+	if code := s.doWithKey(http.MethodGet, venuePath+"/orders", key, nil).ExpectStatus(http.StatusForbidden).JSON().(map[string]any)["code"]; code != "MISSING_PERMISSION" {
+		t.Errorf("listing orders without view permission: code = %v", code)
+	}
+	for _, denied := range []struct{ method, path string }{
+		{http.MethodPut, venuePath},
+		{http.MethodGet, "/v1/merchant"},
+		{http.MethodGet, "/v1/merchant/audit"},
+		{http.MethodPost, "/v1/merchant/api-keys"},
+		{http.MethodPost, "/v1/auth/2fa/setup"},
+		{http.MethodGet, "/v1/diner/orders"},
+	} {
+		res := s.doWithKey(denied.method, denied.path, key, newKey([]string{"manage_menu"}, venueID))
+		if res.Status != http.StatusForbidden || res.JSON().(map[string]any)["code"] != "API_KEY_NOT_ALLOWED" {
+			t.Errorf("%s %s with an API key: %d %s", denied.method, denied.path, res.Status, res.Body)
+		}
+	}
+
+	// Order keys see orders at every venue of the merchant.
+	var orders struct {
+		APIKey struct {
+			ID uint `json:"id"`
+		} `json:"api_key"`
+		Key string `json:"key"`
+	}
+	s.do(http.MethodPost, "/v1/merchant/api-keys", owner.Token, map[string]any{
+		"name": "Kitchen display", "permissions": []string{"manage_orders"}, "expires_at": time.Now().Add(time.Hour),
+	}).ExpectStatus(http.StatusCreated).Decode(&orders)
+	var order struct {
+		ID uint `json:"id"`
+	}
+	s.do(http.MethodPost, "/v1/diner/orders", diner.Token, map[string]any{
+		"venue_id": venueID, "items": []map[string]any{{"menu_item_id": itemID, "quantity": 1}},
+	}).ExpectStatus(http.StatusOK).Decode(&order)
+	orderPath := fmt.Sprintf("/v1/merchant/orders/%d", order.ID)
+	s.doWithKey(http.MethodPut, orderPath+"/status", key, map[string]string{"status": "Accepted"}).ExpectStatus(http.StatusForbidden)
+	s.doWithKey(http.MethodPut, orderPath+"/status", orders.Key, map[string]string{"status": "Accepted"}).ExpectStatus(http.StatusOK)
+
+	// Changes made with a key are audited as the key's merchant, naming the key.
+	var log struct {
+		Entries []struct {
+			ActorID    uint   `json:"actor_id"`
+			ActorType  string `json:"actor_type"`
+			ActorKeyID uint   `json:"actor_key_id"`
+			Action     string `json:"action"`
+		} `json:"entries"`
+	}
+	s.do(http.MethodGet, "/v1/merchant/audit?action=order.status", owner.Token, nil).ExpectStatus(http.StatusOK).Decode(&log)
+	if len(log.Entries) != 1 || log.Entries[0].ActorType != models.UserTypeAPIKey || log.Entries[0].ActorID != owner.ID ||
+		log.Entries[0].ActorKeyID != orders.APIKey.ID {
+		t.Errorf("order status entries = %+v", log.Entries)
+	}
+
+	var keys struct {
+		APIKeys []map[string]any `json:"api_keys"`
+	}
+	s.do(http.MethodGet, "/v1/merchant/api-keys", owner.Token, nil).ExpectStatus(http.StatusOK).Decode(&keys)
+	if len(keys.APIKeys) != 2 || keys.APIKeys[0]["last_used_at"] == nil || keys.APIKeys[0]["key"] != nil {
+		t.Fatalf("keys = %+v, want 2 without secrets, the first used", keys.APIKeys)
+	}
+	s.do(http.MethodGet, "/v1/merchant/api-keys", other.Token, nil).ExpectStatus(http.StatusOK).Decode(&keys)
+	if len(keys.APIKeys) != 0 {
+		t.Errorf("other merchant's keys = %+v", keys.APIKeys)
+	}
+
+	// Revoked and expired keys stop working.
+	keyPath := fmt.Sprintf("/v1/merchant/api-keys/%d", created.APIKey.ID)
+	s.do(http.MethodDelete, keyPath, other.Token, nil).ExpectStatus(http.StatusNotFound)
+	s.do(http.MethodDelete, keyPath, owner.Token, nil).ExpectStatus(http.StatusOK)
+	s.do(http.MethodDelete, keyPath, owner.Token, nil).ExpectStatus(http.StatusConflict)
+	s.doWithKey(http.MethodGet, "/v1/merchant/venues", key, nil).ExpectStatus(http.StatusUnauthorized)
+
+	// What a revoked key did stays on record.
+	s.do(http.MethodGet, fmt.Sprintf("/v1/merchant/audit?actor_key_id=%d", created.APIKey.ID), owner.Token, nil).ExpectStatus(http.StatusOK).Decode(&log)
+	if len(log.Entries) != 1 || log.Entries[0].Action != "menu_item.update" || log.Entries[0].ActorKeyID != created.APIKey.ID {
+		t.Errorf("entries of the revoked key = %+v", log.Entries)
+	}
+
+	if err := s.conns.Write.Model(&models.APIKey{}).Where("name = ?", "Kitchen display").Update("expires_at", time.Now().Add(-time.Minute)).Error; err != nil {
+		t.Fatal(err)
+	}
+	s.doWithKey(http.MethodGet, orderPath, orders.Key, nil).ExpectStatus(http.StatusUnauthorized)
+	s.doWithKey(http.MethodGet, "/v1/merchant/venues", "lo_not-a-key", nil).ExpectStatus(http.StatusUnauthorized)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	provider := oidctest.NewProvider("liven-one", "client-secret")
+	defer provider.Close()
+	s := newTestServer(t, func(cfg *config.Config) {
+		cfg.OIDC = []oidc.Config{provider.Config("stand-in", cfg.AppURL+"/oidc/stand-in/callback")}
+	})
+
+	// start begins a login and follows the authorization URL like the
+	// browser, returning the code and state sent back to the app.
+	start := func() (code, state string) {
+		t.Helper()
+		var started struct {
+			AuthorizationURL string `json:"authorization_url"`
+		}
+		s.do(http.MethodPost, "/v1/auth/oidc/stand-in", "", nil).ExpectStatus(http.StatusOK).Decode(&started)
+		browser := provider.Client()
+		browser.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+		resp, err := browser.Get(started.AuthorizationURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		back, err := url.Parse(resp.Header.Get("Location"))
+		if err != nil || !strings.HasPrefix(back.String(), s.cfg.AppURL+"/oidc/stand-in/callback?") {
+			t.Fatalf("sent back to %q", resp.Header.Get("Location"))
+		}
+		return back.Query().Get("code"), back.Query().Get("state")
+	}
+	callback := func(code, state string) *testResponse {
+		return s.do(http.MethodPost, "/v1/auth/oidc/stand-in/callback", "", map[string]string{"code": code, "state": state})
+	}
+	// loginAs logs in as user at the provider and returns the account the
+	// API logged in.
+	loginAs := func(user oidctest.User) (id uint, token string) {
+		t.Helper()
+		provider.SignIn(user)
+		var loggedIn struct {
+			Token string `json:"token"`
+		}
+		callback(start()).ExpectStatus(http.StatusOK).Decode(&loggedIn)
+		var account struct {
+			ID uint `json:"id"`
+		}
+		s.do(http.MethodGet, "/v1/diner", loggedIn.Token, nil).ExpectStatus(http.StatusOK).Decode(&account)
+		return account.ID, loggedIn.Token
+	}
+
+	// The first login creates a diner without a password; later ones find it
+	// by the provider's subject, even after the address changed there.
+	jane := oidctest.User{Subject: "jane-1", Email: "jane@example.com", EmailVerified: true, Name: "Jane"}
+	janeID, _ := loginAs(jane)
+	jane.Email = "jane@example.org"
+	if id, _ := loginAs(jane); id != janeID {
+		t.Errorf("second login as %d, want %d", id, janeID)
+	}
+	s.do(http.MethodPost, "/v1/auth/login", "", map[string]string{"email": "jane@example.com", "password": ""}).ExpectStatus(http.StatusBadRequest)
+	s.do(http.MethodPost, "/v1/auth/login", "", map[string]string{"email": "jane@example.com", "password": "password123"}).ExpectStatus(http.StatusUnauthorized)
+
+	// A verified address links the existing account, which keeps its password.
+	diner := s.diner()
+	if id, _ := loginAs(oidctest.User{Subject: "diner-1", Email: diner.Email, EmailVerified: true}); id != diner.ID {
+		t.Errorf("login as %d, want the existing diner %d", id, diner.ID)
+	}
+	s.login(diner.Email, "password123")
+	var linked int64
+	s.conns.Write.Model(&models.UserIdentity{}).Where("user_id = ?", diner.ID).Count(&linked)
+	if linked != 1 {
+		t.Errorf("diner has %d identities, want 1", linked)
+	}
+	// Addresses match whatever case the provider sends them in.
+	other := s.diner()
+	if id, _ := loginAs(oidctest.User{Subject: "other-1", Email: strings.ToUpper(other.Email), EmailVerified: true}); id != other.ID {
+		t.Errorf("mixed-case login as %d, want the existing diner %d", id, other.ID)
+	}
+	var created models.User
+	if err := s.conns.Write.Where("email = ?", "new.diner@example.com").First(&created).Error; err == nil {
+		t.Fatal("new.diner@example.com exists before logging in")
+	}
+	newID, _ := loginAs(oidctest.User{Subject: "new-1", Email: "New.Diner@Example.com", EmailVerified: true})
+	if err := s.conns.Write.Where("email = ?", "new.diner@example.com").First(&created).Error; err != nil || created.ID != newID {
+		t.Errorf("created account %d (%v), want %d with the address in lower case", created.ID, err, newID)
+	}
+	// The link is audited without the subject, which identifies the person.
+	var link models.AuditEntry
+	if err := s.conns.Write.Where("action = ? AND entity_id = ?", "user.identity_link", diner.ID).First(&link).Error; err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(link.Changes, "diner-1") {
+		t.Errorf("identity link changes = %s", link.Changes)
+	}
+
+	// A locked account can't get around the lock, or lift it, through the provider.
+	lockedUntil := time.Now().Add(time.Hour)
+	if err := s.conns.Write.Model(&models.User{}).Where("id = ?", diner.ID).Update("locked_until", lockedUntil).Error; err != nil {
+		t.Fatal(err)
+	}
+	provider.SignIn(oidctest.User{Subject: "diner-1", Email: diner.Email, EmailVerified: true})
+	if code := callback(start()).ExpectStatus(http.StatusTooManyRequests).JSON().(map[string]any)["code"]; code != "ACCOUNT_LOCKED" {
+		t.Errorf("provider login while locked: code = %v", code)
+	}
+	var locked models.User
+	if err := s.conns.Write.First(&locked, diner.ID).Error; err != nil || locked.LockedUntil == nil {
+		t.Fatalf("lock after the provider login = %v, %v; want it kept", locked.LockedUntil, err)
+	}
+	if err := s.conns.Write.Model(&models.User{}).Where("id = ?", diner.ID).Update("locked_until", nil).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// Whoever registered an address without verifying it loses the account
+	// to its owner.
+	s.do(http.MethodPost, "/v1/auth/register", "", map[string]string{
+		"email": "squatted@example.com", "password": "password123", "user_type": "diner",
+	}).ExpectStatus(http.StatusCreated)
+	squatter := s.login("squatted@example.com", "password123")
+	s.do(http.MethodGet, "/v1/diner", squatter, nil).ExpectStatus(http.StatusOK)
+	_, owner := loginAs(oidctest.User{Subject: "owner-1", Email: "squatted@example.com", EmailVerified: true})
+	s.do(http.MethodGet, "/v1/diner", squatter, nil).ExpectStatus(http.StatusUnauthorized)
+	s.do(http.MethodGet, "/v1/diner", owner, nil).ExpectStatus(http.StatusOK)
+	s.do(http.MethodPost, "/v1/auth/login", "", map[string]string{"email": "squatted@example.com", "password": "password123"}).ExpectStatus(http.StatusUnauthorized)
+
+	// Unverified addresses and admins can't be matched.
+	provider.SignIn(oidctest.User{Subject: "unverified-1", Email: "unverified@example.com"})
+	if code := callback(start()).ExpectStatus(http.StatusForbidden).JSON().(map[string]any)["code"]; code != "EMAIL_NOT_VERIFIED" {
+		t.Errorf("unverified address: code = %v", code)
+	}
+	admin := s.admin()
+	provider.SignIn(oidctest.User{Subject: "admin-1", Email: admin.Email, EmailVerified: true})
+	callback(start()).ExpectStatus(http.StatusForbidden)
+
+	// States work once, and only with the provider they were issued for.
+	provider.SignIn(jane)
+	code, state := start()
+	callback(code, "forged").ExpectStatus(http.StatusBadRequest)
+	callback(code, state).ExpectStatus(http.StatusOK)
+	callback(code, state).ExpectStatus(http.StatusBadRequest)
+	s.do(http.MethodPost, "/v1/auth/oidc/elsewhere", "", nil).ExpectStatus(http.StatusNotFound)
+}
+
+func TestPasswordlessLogin(t *testing.T) {
+	s := newTestServer(t)
+	diner := s.diner()
+	s.do(http.MethodPut, "/v1/diner/profile", diner.Token, map[string]any{"phone": "+61400000001"}).ExpectStatus(http.StatusOK)
+	loggedInAs := func(res *testResponse) uint {
+		t.Helper()
+		var loggedIn struct {
+			Token string `json:"token"`
+		}
+		res.ExpectStatus(http.StatusOK).Decode(&loggedIn)
+		var account struct {
+			ID uint `json:"id"`
+		}
+		s.do(http.MethodGet, "/v1/diner", loggedIn.Token, nil).ExpectStatus(http.StatusOK).Decode(&account)
+		return account.ID
+	}
+
+	// Mailed links log in once.
+	s.do(http.MethodPost, "/v1/auth/magic-link", "", map[string]string{"email": diner.Email}).ExpectStatus(http.StatusAccepted)
+	link := map[string]string{"token": s.mailedToken(diner.Email, "magic-link")}
+	if id := loggedInAs(s.do(http.MethodPost, "/v1/auth/magic-link/verify", "", link)); id != diner.ID {
+		t.Errorf("link logged in %d, want %d", id, diner.ID)
+	}
+	s.do(http.MethodPost, "/v1/auth/magic-link/verify", "", link).ExpectStatus(http.StatusBadRequest)
+
+	// A locked account can't get around the lock with a link.
+	s.do(http.MethodPost, "/v1/auth/magic-link", "", map[string]string{"email": diner.Email}).ExpectStatus(http.StatusAccepted)
+	link = map[string]string{"token": s.mailedToken(diner.Email, "magic-link")}
+	if err := s.conns.Write.Model(&models.User{}).Where("id = ?", diner.ID).Update("locked_until", time.Now().Add(time.Hour)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if code := s.do(http.MethodPost, "/v1/auth/magic-link/verify", "", link).ExpectStatus(http.StatusTooManyRequests).JSON().(map[string]any)["code"]; code != "ACCOUNT_LOCKED" {
+		t.Errorf("link login while locked: code = %v", code)
+	}
+	if err := s.conns.Write.Model(&models.User{}).Where("id = ?", diner.ID).Update("locked_until", nil).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// Codes are texted to the account's phone or mailed, and work once.
+	requestCode := func(email, channel string) {
+		t.Helper()
+		s.do(http.MethodPost, "/v1/auth/otp", "", map[string]string{"email": email, "channel": channel}).ExpectStatus(http.StatusAccepted)
+	}
+	loginWithCode := func(email, code string) *testResponse {
+		return s.do(http.MethodPost, "/v1/auth/otp/verify", "", map[string]string{"email": email, "code": code})
+	}
+	requestCode(diner.Email, "sms")
+	code := s.sentCode("+61400000001")
+	if len(code) != 6 {
+		t.Fatalf("texted code = %q", code)
+	}
+	loginWithCode(diner.Email, "not-it").ExpectStatus(http.StatusUnauthorized)
+	if id := loggedInAs(loginWithCode(diner.Email, code)); id != diner.ID {
+		t.Errorf("code logged in %d, want %d", id, diner.ID)
+	}
+	loginWithCode(diner.Email, code).ExpectStatus(http.StatusUnauthorized)
+
+	// A code ends after too many wrong tries, even before it expires.
+	requestCode(diner.Email, "email")
+	code = s.sentCode(diner.Email)
+	for range s.cfg.Passwordless.CodeAttempts {
+		loginWithCode(diner.Email, "000000x").ExpectStatus(http.StatusUnauthorized)
+	}
+	loginWithCode(diner.Email, code).ExpectStatus(http.StatusUnauthorized)
+
+	// Only the latest code works.
+	requestCode(diner.Email, "email")
+	first := s.sentCode(diner.Email)
+	requestCode(diner.Email, "sms")
+	latest := s.sentCode("+61400000001")
+	// One in a million times both codes are the same.
+	if first != latest {
+		loginWithCode(diner.Email, first).ExpectStatus(http.StatusUnauthorized)
+	}
+	loggedInAs(loginWithCode(diner.Email, latest))
+
+	// Mailed links and codes prove the address.
+	s.do(http.MethodPost, "/v1/auth/register", "", map[string]string{
+		"email": "unverified@example.com", "password": "password123", "user_type": "diner",
+	}).ExpectStatus(http.StatusCreated)
+	requestCode("unverified@example.com", "email")
+	loggedInAs(loginWithCode("unverified@example.com", s.sentCode("unverified@example.com")))
+	var unverified models.User
+	s.conns.Write.Where("email = ?", "unverified@example.com").First(&unverified)
+	if unverified.EmailVerifiedAt == nil {
+		t.Error("logging in with a mailed code didn't verify the address")
+	}
+
+	// Nothing is sent for unknown addresses, accounts without a phone or
+	// admins, and the answer doesn't tell.
+	other := s.diner()
+	requestCode(other.Email, "sms")
+	requestCode("nobody@example.com", "email")
+	admin := s.admin()
+	requestCode(admin.Email, "email")
+	s.do(http.MethodPost, "/v1/auth/magic-link", "", map[string]string{"email": admin.Email}).ExpectStatus(http.StatusAccepted)
+	for _, to := range []string{"nobody@example.com", admin.Email} {
+		if code := s.sentCode(to); code != "" {
+			t.Errorf("code sent to %s", to)
+		}
+	}
+	if len(s.sms.messages) != 2 {
+		t.Errorf("%d texts sent, want 2", len(s.sms.messages))
+	}
+	loginWithCode("nobody@example.com", "123456").ExpectStatus(http.StatusUnauthorized)
+}
+
+func TestSessions(t *testing.T) {
+	s := newTestServer(t)
+	diner := s.diner()
+	other := s.diner()
+	loginOn := func(device string) string {
+		t.Helper()
+		header := http.Header{}
+		header.Set(handlers.DeviceNameHeader, device)
+		header.Set("User-Agent", device+" browser")
+		var loggedIn struct {
+			Token string `json:"token"`
+		}
+		s.send(http.MethodPost, "/v1/auth/login", header, map[string]string{
+			"email": diner.Email, "password": "password123",
+		}).ExpectStatus(http.StatusOK).Decode(&loggedIn)
+		return loggedIn.Token
+	}
+	type session struct {
+		ID         uint   `json:"id"`
+		DeviceName string `json:"device_name"`
+		UserAgent  string `json:"user_agent"`
+		Current    bool   `json:"current"`
+	}
+	sessions := func(token string) map[string]session {
+		t.Helper()
+		var listed struct {
+			Sessions []session `json:"sessions"`
+		}
+		s.do(http.MethodGet, "/v1/me/sessions", token, nil).ExpectStatus(http.StatusOK).Decode(&listed)
+		byDevice := map[string]session{}
+		for _, session := range listed.Sessions {
+			byDevice[session.DeviceName] = session
+		}
+		return byDevice
+	}
+
+	laptop := loginOn("Laptop")
+	phone := loginOn("Phone")
+	listed := sessions(laptop)
+	if len(listed) != 3 || !listed["Laptop"].Current || listed["Phone"].Current || listed["Phone"].UserAgent != "Phone browser" {
+		t.Fatalf("sessions = %+v", listed)
+	}
+
+	// Only the owner can sign a session out, which stops its token at once.
+	phonePath := fmt.Sprintf("/v1/me/sessions/%d", listed["Phone"].ID)
+	s.do(http.MethodDelete, phonePath, other.Token, nil).ExpectStatus(http.StatusNotFound)
+	s.do(http.MethodGet, "/v1/diner", phone, nil).ExpectStatus(http.StatusOK)
+	s.do(http.MethodDelete, phonePath, laptop, nil).ExpectStatus(http.StatusOK)
+	s.do(http.MethodGet, "/v1/diner", phone, nil).ExpectStatus(http.StatusUnauthorized)
+	s.do(http.MethodDelete, phonePath, laptop, nil).ExpectStatus(http.StatusNotFound)
+	s.do(http.MethodGet, "/v1/diner", laptop, nil).ExpectStatus(http.StatusOK)
+	if entries := s.userChanges(diner.ID, audit.UserSessionEnd); len(entries) != 1 || !strings.Contains(entries[0].Changes, fmt.Sprint(listed["Phone"].ID)) {
+		t.Errorf("session end audit entries = %+v, want one naming the phone's session", entries)
+	}
+
+	// Changing the password ends every other session.
+	var changed struct {
+		Token string `json:"token"`
+	}
+	s.do(http.MethodPut, "/v1/diner/password", laptop, map[string]string{
+		"current_password": "password123", "new_password": "password456",
+	}).ExpectStatus(http.StatusOK).Decode(&changed)
+	if listed := sessions(changed.Token); len(listed) != 1 || !listed["Laptop"].Current {
+		t.Fatalf("sessions after password change = %+v", listed)
+	}
+	s.do(http.MethodGet, "/v1/diner", diner.Token, nil).ExpectStatus(http.StatusUnauthorized)
+
+	// Signing out the current session logs out.
+	s.do(http.MethodDelete, fmt.Sprintf("/v1/me/sessions/%d", listed["Laptop"].ID), changed.Token, nil).ExpectStatus(http.StatusOK)
+	s.do(http.MethodGet, "/v1/me/sessions", changed.Token, nil).ExpectStatus(http.StatusUnauthorized)
+}
+
+func TestPasswordChangeWithLegacyToken(t *testing.T) {
+	s := newTestServer(t)
+	diner := s.diner()
+
+	// A token signed the way the first release signed them, without a session.
+	issued := time.Now().Add(-time.Minute)
+	legacy, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"user_id": diner.ID, "user_type": "diner", "iss": "GaruruCannonIssuer",
+		"exp": issued.Add(24 * time.Hour).Unix(), "iat": issued.Unix(), "nbf": issued.Unix(),
+	}).SignedString([]byte(testJWTSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The replacement starts a session, so it keeps working.
+	var changed struct {
+		Token string `json:"token"`
+	}
+	s.do(http.MethodPut, "/v1/diner/password", legacy, map[string]string{
+		"current_password": "password123", "new_password": "password456",
+	}).ExpectStatus(http.StatusOK).Decode(&changed)
+	s.do(http.MethodGet, "/v1/diner", changed.Token, nil).ExpectStatus(http.StatusOK)
+	s.do(http.MethodGet, "/v1/me/sessions", changed.Token, nil).ExpectStatus(http.StatusOK)
+	s.do(http.MethodGet, "/v1/diner", legacy, nil).ExpectStatus(http.StatusUnauthorized)
+}
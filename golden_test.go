@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	cryptorand "crypto/rand"
+	"encoding/json"
+	"flag"
+	"liven-one-go/models"
+	"liven-one-go/services"
+	"liven-one-go/utils"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Regenerate the golden file after an intentional API change with:
+//
+//	go test -run TestGolden -record .
+var recordGolden = flag.Bool("record", false, "re-record "+goldenPath+" from goldenScenario")
+
+var goldenPath = filepath.Join("testdata", "requests.jsonl")
+
+// volatileKeys are JSON keys whose values change between runs. They are
+// masked before responses are stored or compared.
+var volatileKeys = map[string]bool{
+	"token":      true,
+	"created_at": true,
+	"updated_at": true,
+	"placed_at":  true,
+	"request_id": true,
+}
+
+// goldenEntry is one line of the golden file: a request and the response it produced.
+type goldenEntry struct {
+	Name string `json:"name"`
+	// As is the email of the account whose token is sent with the request.
+	As       string          `json:"as,omitempty"`
+	Method   string          `json:"method"`
+	Path     string          `json:"path"`
+	Body     json.RawMessage `json:"body,omitempty"`
+	Status   int             `json:"status"`
+	Response json.RawMessage `json:"response"`
+}
+
+// goldenScenario is the sequence of requests captured in the golden file.
+func goldenScenario(g *goldenRecorder) {
+	const merchant, other, diner = "golden-merchant@example.com", "golden-other@example.com", "golden-diner@example.com"
+
+	g.do("register merchant", "", http.MethodPost, "/v1/auth/register", map[string]any{"email": merchant, "password": "password123", "user_type": "merchant"})
+	g.do("register other merchant", "", http.MethodPost, "/v1/auth/register", map[string]any{"email": other, "password": "password123", "user_type": "merchant"})
+	g.do("register diner", "", http.MethodPost, "/v1/auth/register", map[string]any{"email": diner, "password": "password123", "user_type": "diner"})
+	g.do("register duplicate", "", http.MethodPost, "/v1/auth/register", map[string]any{"email": diner, "password": "password123", "user_type": "diner"})
+	g.do("login", "", http.MethodPost, "/v1/auth/login", map[string]any{"email": diner, "password": "password123"})
+	g.do("login wrong password", "", http.MethodPost, "/v1/auth/login", map[string]any{"email": diner, "password": "nope"})
+
+	goldenVenue := map[string]any{
+		"name": "Golden Cafe", "address": "1 Collins Street", "description": "Golden", "cuisine_type": "Cafe",
+	}
+	g.do("create venue unverified", merchant, http.MethodPost, "/v1/merchant/venues", goldenVenue)
+	g.do("verify email bad token", "", http.MethodPost, "/v1/auth/verify-email", map[string]any{"token": "not-a-token"})
+	g.do("verify email", "", http.MethodPost, "/v1/auth/verify-email", map[string]any{"token": g.s.mailedToken(merchant, "verify-email")})
+	g.do("create venue", merchant, http.MethodPost, "/v1/merchant/venues", goldenVenue)
+	g.do("update venue", merchant, http.MethodPut, "/v1/merchant/venues/1", map[string]any{"description": "Still golden"})
+	g.do("update venue not owner", other, http.MethodPut, "/v1/merchant/venues/1", map[string]any{"name": "Stolen"})
+	g.do("create menu item", merchant, http.MethodPost, "/v1/merchant/venues/1/menuitems", map[string]any{
+		"name": "Flat White", "description": "Coffee", "price_in_cents": 450, "category": "Coffee",
+	})
+	g.do("create second menu item", merchant, http.MethodPost, "/v1/merchant/venues/1/menuitems", map[string]any{
+		"name": "Toastie", "description": "Ham and cheese", "price_in_cents": 1200, "category": "Food",
+	})
+	g.do("update menu item", merchant, http.MethodPut, "/v1/merchant/venues/1/menuitems/2", map[string]any{"price_in_cents": 1300})
+	g.do("list public venues", "", http.MethodGet, "/v1/public/venues", nil)
+	g.do("public venue menu", "", http.MethodGet, "/v1/public/venues/1/menu", nil)
+
+	g.do("place order", diner, http.MethodPost, "/v1/diner/orders", map[string]any{
+		"venue_id": 1, "items": []map[string]any{{"menu_item_id": 1, "quantity": 2}, {"menu_item_id": 2, "quantity": 1}},
+	})
+	g.do("place order unknown item", diner, http.MethodPost, "/v1/diner/orders", map[string]any{
+		"venue_id": 1, "items": []map[string]any{{"menu_item_id": 99, "quantity": 1}},
+	})
+	g.do("accept order", merchant, http.MethodPut, "/v1/merchant/orders/1/status", map[string]any{"status": "Accepted"})
+	g.do("accept order not owner", other, http.MethodPut, "/v1/merchant/orders/1/status", map[string]any{"status": "Accepted"})
+	g.do("merchant venue orders", merchant, http.MethodGet, "/v1/merchant/venues/1/orders", nil)
+	g.do("diner orders", diner, http.MethodGet, "/v1/diner/orders", nil)
+	g.do("merchant order", merchant, http.MethodGet, "/v1/merchant/orders/1", nil)
+	g.do("merchant order not owner", other, http.MethodGet, "/v1/merchant/orders/1", nil)
+	g.do("delete menu item", merchant, http.MethodDelete, "/v1/merchant/venues/1/menuitems/2", nil)
+	g.do("diner order after menu change", diner, http.MethodGet, "/v1/diner/orders/1", nil)
+	g.do("delete venue", merchant, http.MethodDelete, "/v1/merchant/venues/1", nil)
+}
+
+// goldenRecorder runs requests against a test server and collects the entries.
+type goldenRecorder struct {
+	s       *testServer
+	entries []goldenEntry
+}
+
+func (g *goldenRecorder) do(name, as, method, path string, body any) {
+	g.s.t.Helper()
+
+	var encoded json.RawMessage
+	if body != nil {
+		var err error
+		if encoded, err = json.Marshal(body); err != nil {
+			g.s.t.Fatal(err)
+		}
+	}
+
+	entry := goldenEntry{Name: name, As: as, Method: method, Path: path, Body: encoded}
+	entry.Status, entry.Response = g.s.replay(entry)
+	g.entries = append(g.entries, entry)
+}
+
+// replay sends the request of a golden entry and returns the status and the
+// normalized response body.
+func (s *testServer) replay(entry goldenEntry) (int, json.RawMessage) {
+	s.t.Helper()
+
+	req := httptest.NewRequest(entry.Method, entry.Path, bytes.NewReader(entry.Body))
+	if len(entry.Body) > 0 {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if entry.As != "" {
+		req.Header.Set("Authorization", "Bearer "+s.tokenFor(entry.As))
+	}
+
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, req)
+	return rec.Code, normalizeJSON(s.t, rec.Body.Bytes())
+}
+
+// tokenFor issues a token for an existing account without going through login.
+func (s *testServer) tokenFor(email string) string {
+	s.t.Helper()
+
+	var user models.User
+	if err := s.conns.Read.Where("email = ?", email).First(&user).Error; err != nil {
+		s.t.Fatalf("golden user %s: %v", email, err)
+	}
+	session, err := services.StartSession(s.conns.Write, user.ID, services.SessionDetails{DeviceName: "golden"}, time.Now())
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	token, err := utils.GenerateToken(user.ID, user.UserType, session.ID)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return token
+}
+
+// normalizeJSON masks volatile values and re-encodes the body with sorted keys.
+func normalizeJSON(t *testing.T, body []byte) json.RawMessage {
+	t.Helper()
+	if len(body) == 0 {
+		return json.RawMessage("null")
+	}
+
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		t.Fatalf("response is not JSON: %v\n%s", err, body)
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(maskVolatile(v)); err != nil {
+		t.Fatal(err)
+	}
+	return bytes.TrimSpace(buf.Bytes())
+}
+
+func maskVolatile(v any) any {
+	switch value := v.(type) {
+	case map[string]any:
+		for key, inner := range value {
+			if volatileKeys[key] && inner != nil {
+				value[key] = "<volatile>"
+			} else {
+				value[key] = maskVolatile(inner)
+			}
+		}
+	case []any:
+		for i, inner := range value {
+			value[i] = maskVolatile(inner)
+		}
+	}
+	return v
+}
+
+// reproducibleTokens makes mailed tokens the same on every run, so tokens
+// recorded in request bodies are valid when they are replayed.
+func reproducibleTokens(t *testing.T) {
+	services.TokenSource = rand.New(rand.NewSource(1))
+	t.Cleanup(func() { services.TokenSource = cryptorand.Reader })
+}
+
+func TestGolden(t *testing.T) {
+	reproducibleTokens(t)
+	if *recordGolden {
+		recorder := &goldenRecorder{s: newTestServer(t)}
+		goldenScenario(recorder)
+		writeGolden(t, recorder.entries)
+		t.Logf("recorded %d requests to %s", len(recorder.entries), goldenPath)
+		return
+	}
+
+	entries := readGolden(t)
+	s := newTestServer(t)
+	for i, entry := range entries {
+		status, response := s.replay(entry)
+		if status != entry.Status {
+			t.Errorf("%d %q: %s %s returned status %d, golden has %d\n%s", i+1, entry.Name, entry.Method, entry.Path, status, entry.Status, response)
+			continue
+		}
+		if !bytes.Equal(response, entry.Response) {
+			t.Errorf("%d %q: %s %s response differs\n got: %s\nwant: %s", i+1, entry.Name, entry.Method, entry.Path, response, entry.Response)
+		}
+	}
+}
+
+func writeGolden(t *testing.T, entries []goldenEntry) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(goldenPath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(goldenPath, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readGolden(t *testing.T) []goldenEntry {
+	t.Helper()
+
+	file, err := os.Open(goldenPath)
+	if err != nil {
+		t.Fatalf("%v; record it with: go test -run TestGolden -record .", err)
+	}
+	defer file.Close()
+
+	var entries []goldenEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry goldenEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("%s line %d: %v", goldenPath, len(entries)+1, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
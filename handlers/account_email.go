@@ -0,0 +1,230 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	apiv1 "liven-one-go/api/v1"
+	"liven-one-go/apperror"
+	"liven-one-go/audit"
+	"liven-one-go/mail"
+	"liven-one-go/models"
+	"liven-one-go/services"
+)
+
+// Mailer sends the account emails. serve sets it from MAILER.
+var Mailer mail.Mailer = mail.Discard{}
+
+// AccountEmails configures the emails of the account flows.
+type AccountEmails struct {
+	// AppURL is the base URL of the web app. Mailed links open its
+	// /verify-email, /confirm-email, /reset-password and /accept-invite
+	// pages, which post the token back to the API.
+	AppURL           string
+	VerificationTTL  time.Duration
+	PasswordResetTTL time.Duration
+	StaffInviteTTL   time.Duration
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required,min=8,max=20"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// sendVerification mails the user a link to verify their address.
+func (e AccountEmails) sendVerification(c *gin.Context, user *models.User) error {
+	token, err := services.IssueToken(DB.WithContext(c.Request.Context()), user.ID, models.TokenPurposeEmailVerification, e.VerificationTTL, time.Now())
+	if err != nil {
+		return fmt.Errorf("issue verification token: %w", err)
+	}
+	return Mailer.Send(c.Request.Context(), mail.Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Open this link to verify your email address:\n\n%s\n\nThe link expires in %s.\n",
+			e.link("/verify-email", token), e.VerificationTTL),
+	})
+}
+
+// sendPasswordReset mails the user a link to choose a new password.
+func (e AccountEmails) sendPasswordReset(c *gin.Context, user *models.User) error {
+	token, err := services.IssueToken(DB.WithContext(c.Request.Context()), user.ID, models.TokenPurposePasswordReset, e.PasswordResetTTL, time.Now())
+	if err != nil {
+		return fmt.Errorf("issue password reset token: %w", err)
+	}
+	return Mailer.Send(c.Request.Context(), mail.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Open this link to choose a new password:\n\n%s\n\nThe link expires in %s. "+
+			"If you didn't ask to reset your password, ignore this email.\n",
+			e.link("/reset-password", token), e.PasswordResetTTL),
+	})
+}
+
+// sendEmailChange mails the address a user is changing to a link to confirm
+// it, and tells the current address about the change.
+func (e AccountEmails) sendEmailChange(c *gin.Context, user *models.User, token string) error {
+	err := Mailer.Send(c.Request.Context(), mail.Message{
+		To:      user.PendingEmail,
+		Subject: "Confirm your new email address",
+		Body: fmt.Sprintf("Open this link to use this address for your account:\n\n%s\n\nThe link expires in %s.\n",
+			e.link("/confirm-email", token), e.VerificationTTL),
+	})
+	if err != nil {
+		return err
+	}
+	return Mailer.Send(c.Request.Context(), mail.Message{
+		To:      user.Email,
+		Subject: "Your email address is being changed",
+		Body: fmt.Sprintf("Someone asked to change the email address of your account to %s. "+
+			"If it wasn't you, reset your password now.\n", user.PendingEmail),
+	})
+}
+
+// sendStaffInvite mails a new staff account the link to accept its
+// invitation with.
+func (e AccountEmails) sendStaffInvite(c *gin.Context, staff *models.User, token, merchantEmail string) error {
+	return Mailer.Send(c.Request.Context(), mail.Message{
+		To:      staff.Email,
+		Subject: "You've been invited to Liven One",
+		Body: fmt.Sprintf("%s invited you to help run their venues. Open this link to choose a password:\n\n%s\n\nThe link expires in %s.\n",
+			merchantEmail, e.link("/accept-invite", token), e.StaffInviteTTL),
+	})
+}
+
+func (e AccountEmails) link(page, token string) string {
+	return strings.TrimRight(e.AppURL, "/") + page + "?token=" + url.QueryEscape(token)
+}
+
+// ForgotPasswordHandler mails a password reset link. It answers the same
+// whether or not the email has an account.
+func ForgotPasswordHandler(emails AccountEmails) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req ForgotPasswordRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			abort(c, apperror.Binding(err))
+			return
+		}
+
+		user, err := services.FindUserByEmail(ReadDB.WithContext(c.Request.Context()), req.Email)
+		switch {
+		case errors.Is(err, services.ErrUserNotFound):
+		case err != nil:
+			abort(c, apperror.Internalf("get user: %w", err))
+			return
+		default:
+			if err := emails.sendPasswordReset(c, user); err != nil {
+				slog.ErrorContext(c.Request.Context(), "Failed to send password reset email", "error", err)
+			}
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{"message": "If the email has an account, a reset link is on its way"})
+	}
+}
+
+// ResetPasswordHandler sets a new password with a token from a reset email.
+func ResetPasswordHandler(c *gin.Context) {
+	var req ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abort(c, apperror.Binding(err))
+		return
+	}
+
+	// Hash before the transaction: bcrypt is slow and would hold the writer.
+	var hashed models.User
+	if err := hashed.HashPassword(req.Password); err != nil {
+		abort(c, apperror.Internalf("hash password: %w", err))
+		return
+	}
+	err := audited(c, func(tx *gorm.DB) (audit.Entry, error) {
+		user, err := services.ResetPasswordWithToken(tx, req.Token, hashed.Password, time.Now())
+		if err != nil {
+			return audit.Entry{}, err
+		}
+		entry := auditEntry(c, audit.UserPasswordReset, audit.EntityUser, user.ID, 0)
+		entry.ActorID, entry.ActorType = user.ID, user.UserType
+		return entry, nil
+	})
+	if err != nil {
+		abort(c, tokenError(err, "reset password"))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password updated"})
+}
+
+// VerifyEmailHandler marks an address as verified with a token from a
+// verification email.
+func VerifyEmailHandler(c *gin.Context) {
+	var req VerifyEmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abort(c, apperror.Binding(err))
+		return
+	}
+
+	user, err := services.VerifyEmail(DB.WithContext(c.Request.Context()), req.Token, time.Now())
+	if err != nil {
+		abort(c, tokenError(err, "verify email"))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email verified", "user": apiv1.NewUser(user)})
+}
+
+// ResendVerificationHandler mails the authenticated user a new verification link.
+func ResendVerificationHandler(emails AccountEmails) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentUser(c)
+		if !ok {
+			return
+		}
+		if user.EmailVerifiedAt != nil {
+			abort(c, apperror.New(apperror.CodeEmailVerified, "The email is already verified"))
+			return
+		}
+
+		if err := emails.sendVerification(c, user); err != nil {
+			abort(c, apperror.Internalf("send verification email: %w", err))
+			return
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{"message": "A verification link is on its way"})
+	}
+}
+
+// requireVerifiedEmail checks that the account has verified its address. On
+// failure it aborts the request and returns false.
+func requireVerifiedEmail(c *gin.Context, userID uint) bool {
+	var user models.User
+	if err := ReadDB.WithContext(c.Request.Context()).Select("id", "email_verified_at").First(&user, userID).Error; err != nil {
+		abort(c, accountLookupError(err))
+		return false
+	}
+	if user.EmailVerifiedAt == nil {
+		abort(c, apperror.New(apperror.CodeEmailNotVerified, "Verify your email address first"))
+		return false
+	}
+	return true
+}
+
+// tokenError maps the error of consuming a mailed token.
+func tokenError(err error, action string) error {
+	if errors.Is(err, services.ErrInvalidToken) {
+		return apperror.New(apperror.CodeInvalidToken, "The link is invalid, expired or was already used")
+	}
+	return apperror.Internalf("%s: %w", action, err)
+}
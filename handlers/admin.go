@@ -0,0 +1,348 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	apiv1 "liven-one-go/api/v1"
+	"liven-one-go/apperror"
+	"liven-one-go/audit"
+	"liven-one-go/logging"
+	"liven-one-go/metrics"
+	"liven-one-go/models"
+	"liven-one-go/services"
+	"liven-one-go/utils"
+)
+
+// adminSearchLimit caps the results of the admin search endpoints. They list
+// the newest matches first, so narrowing the search finds older ones.
+const adminSearchLimit = 100
+
+// impersonationTTL is how long a support token lasts.
+const impersonationTTL = 15 * time.Minute
+
+type SuspendUserRequest struct {
+	Reason string `json:"reason" binding:"required,max=500"`
+}
+
+type ForceOrderStatusRequest struct {
+	Status models.OrderStatus `json:"status" binding:"required"`
+	Reason string             `json:"reason" binding:"required,max=500"`
+}
+
+// RequireAdmin lets only admin accounts through. It must run after
+// AuthMiddleware.
+func RequireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := accountClaims(c, models.UserTypeAdmin); !ok {
+			return
+		}
+		c.Next()
+	}
+}
+
+// AdminSearchUsersHandler finds accounts by email, type and suspension.
+func AdminSearchUsersHandler(c *gin.Context) {
+	query := ReadDB.WithContext(c.Request.Context()).Model(&models.User{})
+	if email := c.Query("q"); email != "" {
+		query = query.Where("LOWER(email) LIKE LOWER(?)", "%"+email+"%")
+	}
+	if userType := c.Query("user_type"); userType != "" {
+		query = query.Where("user_type = ?", userType)
+	}
+	if suspended := c.Query("suspended"); suspended != "" {
+		only, err := strconv.ParseBool(suspended)
+		if err != nil {
+			abort(c, apperror.Validation("suspended", "boolean", "must be true or false"))
+			return
+		}
+		if only {
+			query = query.Where("suspended_at IS NOT NULL")
+		} else {
+			query = query.Where("suspended_at IS NULL")
+		}
+	}
+
+	var users []models.User
+	if err := query.Order("id DESC").Limit(adminSearchLimit).Find(&users).Error; err != nil {
+		abort(c, apperror.Internalf("search users: %w", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"users": apiv1.NewAdminUsers(users)})
+}
+
+// AdminGetUserHandler shows any account.
+func AdminGetUserHandler(c *gin.Context) {
+	user, ok := adminTarget(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user": apiv1.NewAdminUser(user)})
+}
+
+// AdminSuspendUserHandler stops an account from logging in or using the
+// tokens it holds. The venues of a suspended merchant disappear from the
+// public API until it is reinstated.
+func AdminSuspendUserHandler(c *gin.Context) {
+	var req SuspendUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abort(c, apperror.Binding(err))
+		return
+	}
+	userID, ok := userIDParam(c)
+	if !ok {
+		return
+	}
+
+	var user *models.User
+	err := audited(c, func(tx *gorm.DB) (entry audit.Entry, err error) {
+		if user, err = services.SuspendUser(tx, userID, req.Reason, time.Now()); err != nil {
+			return entry, err
+		}
+		entry = auditEntry(c, audit.UserSuspend, audit.EntityUser, user.ID, 0)
+		entry.Before = gin.H{"suspended": false}
+		entry.After = gin.H{"suspended": true, "suspension_reason": req.Reason}
+		return entry, nil
+	})
+	if err != nil {
+		abort(c, adminError(err, "suspend user"))
+		return
+	}
+	slog.WarnContext(c.Request.Context(), "User suspended", "target_user_id", user.ID, "reason", req.Reason)
+
+	c.JSON(http.StatusOK, gin.H{"user": apiv1.NewAdminUser(user)})
+}
+
+// AdminReinstateUserHandler lifts the suspension of an account.
+func AdminReinstateUserHandler(c *gin.Context) {
+	userID, ok := userIDParam(c)
+	if !ok {
+		return
+	}
+
+	var user *models.User
+	err := audited(c, func(tx *gorm.DB) (entry audit.Entry, err error) {
+		if user, err = services.ReinstateUser(tx, userID); err != nil {
+			return entry, err
+		}
+		entry = auditEntry(c, audit.UserReinstate, audit.EntityUser, user.ID, 0)
+		entry.Before, entry.After = gin.H{"suspended": true}, gin.H{"suspended": false}
+		return entry, nil
+	})
+	if err != nil {
+		abort(c, adminError(err, "reinstate user"))
+		return
+	}
+	slog.WarnContext(c.Request.Context(), "User reinstated", "target_user_id", user.ID)
+
+	c.JSON(http.StatusOK, gin.H{"user": apiv1.NewAdminUser(user)})
+}
+
+// AdminImpersonateHandler issues a short-lived, read-only token that acts as
+// the account, so support can see what its owner sees. Requests made with
+// it are logged with the admin's ID.
+func AdminImpersonateHandler(c *gin.Context) {
+	admin, ok := requestClaims(c)
+	if !ok {
+		return
+	}
+	user, ok := adminTarget(c)
+	if !ok {
+		return
+	}
+	if user.UserType == models.UserTypeAdmin {
+		abort(c, adminError(services.ErrAdminAccount, "impersonate user"))
+		return
+	}
+
+	token, err := utils.GenerateImpersonationToken(user.ID, user.UserType, admin.UserID, admin.MFA, impersonationTTL)
+	if err != nil {
+		abort(c, apperror.Internalf("generate impersonation token: %w", err))
+		return
+	}
+	// Nothing changes, but who looked at which account matters as much.
+	err = audited(c, func(*gorm.DB) (audit.Entry, error) {
+		return auditEntry(c, audit.UserImpersonate, audit.EntityUser, user.ID, 0), nil
+	})
+	if err != nil {
+		abort(c, apperror.Internalf("record impersonation: %w", err))
+		return
+	}
+	slog.WarnContext(c.Request.Context(), "Impersonation token issued", "target_user_id", user.ID)
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":      token,
+		"expires_in": int(impersonationTTL / time.Second),
+		"user":       apiv1.NewAdminUser(user),
+	})
+}
+
+// AdminSearchVenuesHandler finds venues by name and merchant, including
+// those of suspended merchants.
+func AdminSearchVenuesHandler(c *gin.Context) {
+	query := ReadDB.WithContext(c.Request.Context()).Model(&models.Venue{})
+	if name := c.Query("q"); name != "" {
+		query = query.Where("LOWER(name) LIKE LOWER(?)", "%"+name+"%")
+	}
+	query, ok := filterByID(c, query, "merchant_id")
+	if !ok {
+		return
+	}
+
+	var venues []models.Venue
+	if err := query.Order("id DESC").Limit(adminSearchLimit).Find(&venues).Error; err != nil {
+		abort(c, apperror.Internalf("search venues: %w", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"venues": apiv1.NewMerchantVenues(venues)})
+}
+
+// AdminSearchOrdersHandler finds orders by venue, diner and status.
+func AdminSearchOrdersHandler(c *gin.Context) {
+	query, ok := filterByID(c, ReadDB.WithContext(c.Request.Context()), "venue_id")
+	if !ok {
+		return
+	}
+	if query, ok = filterByID(c, query, "diner_id"); !ok {
+		return
+	}
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", models.OrderStatus(status))
+	}
+
+	var orders []models.Order
+	if err := withOrderSummaries(query).Order("id DESC").Limit(adminSearchLimit).Find(&orders).Error; err != nil {
+		abort(c, apperror.Internalf("search orders: %w", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, apiv1.NewOrderSummaries(orders))
+}
+
+// AdminGetOrderHandler shows any order.
+func AdminGetOrderHandler(c *gin.Context) {
+	orderID, err := strconv.ParseUint(c.Param("order_id"), 10, 0)
+	if err != nil {
+		abort(c, apperror.New(apperror.CodeOrderNotFound, "Order not found"))
+		return
+	}
+
+	var order models.Order
+	if err := withOrderDetails(ReadDB.WithContext(c.Request.Context())).First(&order, orderID).Error; err != nil {
+		abort(c, orderLookupError(err))
+		return
+	}
+
+	c.JSON(http.StatusOK, apiv1.NewAdminOrder(&order))
+}
+
+// AdminForceOrderStatusHandler sets the status of any order, such as one its
+// merchant left stuck, and records the reason on the order.
+func AdminForceOrderStatusHandler(c *gin.Context) {
+	var req ForceOrderStatusRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abort(c, apperror.Binding(err))
+		return
+	}
+	if !req.Status.Valid() {
+		abort(c, invalidOrderStatus(req.Status))
+		return
+	}
+	orderID, err := strconv.ParseUint(c.Param("order_id"), 10, 0)
+	if err != nil {
+		abort(c, apperror.New(apperror.CodeOrderNotFound, "Order not found"))
+		return
+	}
+
+	db := DB.WithContext(c.Request.Context())
+	var previousStatus models.OrderStatus
+	err = audited(c, func(tx *gorm.DB) (entry audit.Entry, err error) {
+		var venueID uint
+		if previousStatus, venueID, err = services.ForceOrderStatus(tx, uint(orderID), req.Status, req.Reason); err != nil {
+			return entry, err
+		}
+		entry = auditEntry(c, audit.OrderForceStatus, audit.EntityOrder, uint(orderID), venueID)
+		entry.Before = gin.H{"status": previousStatus}
+		entry.After = gin.H{"status": req.Status, "status_reason": req.Reason}
+		return entry, nil
+	})
+	if err != nil {
+		abort(c, adminError(err, "force order status"))
+		return
+	}
+	metrics.OrderStatusTransitions.WithLabelValues(string(previousStatus), string(req.Status)).Inc()
+	addLogAttrs(c, slog.Uint64(logging.KeyOrderID, orderID))
+	slog.WarnContext(c.Request.Context(), "Order status forced", "from", previousStatus, "to", req.Status, "reason", req.Reason)
+
+	var order models.Order
+	if err := withOrderDetails(db).First(&order, orderID).Error; err != nil {
+		abort(c, apperror.Internalf("reload order: %w", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, apiv1.NewAdminOrder(&order))
+}
+
+// adminTarget loads the account named by the user_id parameter. On failure
+// it aborts the request and returns false.
+func adminTarget(c *gin.Context) (*models.User, bool) {
+	userID, ok := userIDParam(c)
+	if !ok {
+		return nil, false
+	}
+	user, err := services.FindUser(ReadDB.WithContext(c.Request.Context()), userID)
+	if err != nil {
+		abort(c, adminError(err, "get user"))
+		return nil, false
+	}
+	return user, true
+}
+
+func userIDParam(c *gin.Context) (uint, bool) {
+	userID, err := strconv.ParseUint(c.Param("user_id"), 10, 0)
+	if err != nil {
+		abort(c, apperror.New(apperror.CodeUserNotFound, "User not found"))
+		return 0, false
+	}
+	return uint(userID), true
+}
+
+// filterByID narrows query to rows whose column equals the query parameter
+// of the same name, if it is present. On failure it aborts the request and
+// returns false.
+func filterByID(c *gin.Context, query *gorm.DB, column string) (*gorm.DB, bool) {
+	value := c.Query(column)
+	if value == "" {
+		return query, true
+	}
+	id, err := strconv.ParseUint(value, 10, 0)
+	if err != nil {
+		abort(c, apperror.Validation(column, "number", "must be a positive integer"))
+		return nil, false
+	}
+	return query.Where(column+" = ?", id), true
+}
+
+// adminError maps the errors of the admin services.
+func adminError(err error, action string) error {
+	switch {
+	case errors.Is(err, services.ErrUserNotFound):
+		return apperror.New(apperror.CodeUserNotFound, "User not found")
+	case errors.Is(err, services.ErrOrderNotFound):
+		return apperror.New(apperror.CodeOrderNotFound, "Order not found")
+	case errors.Is(err, services.ErrAdminAccount):
+		return apperror.New(apperror.CodeWrongAccountType, "Admin accounts can't be suspended or impersonated")
+	case errors.Is(err, services.ErrSuspended):
+		return apperror.New(apperror.CodeAlreadySuspended, "The account is already suspended")
+	case errors.Is(err, services.ErrNotSuspended):
+		return apperror.New(apperror.CodeNotSuspended, "The account is not suspended")
+	}
+	return apperror.Internalf("%s: %w", action, err)
+}
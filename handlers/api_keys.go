@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	apiv1 "liven-one-go/api/v1"
+	"liven-one-go/apperror"
+	"liven-one-go/audit"
+	"liven-one-go/models"
+	"liven-one-go/services"
+)
+
+type CreateAPIKeyRequest struct {
+	Name        string                   `json:"name" binding:"required,max=100"`
+	Permissions []models.StaffPermission `json:"permissions" binding:"required,min=1"`
+	// VenueID restricts the key to one venue. Omit it for every venue.
+	VenueID *uint `json:"venue_id"`
+	// ExpiresAt is when the key stops working. Omit it for a key that works
+	// until revoked.
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// CreateAPIKeyHandler creates an API key for the authenticated merchant. The
+// response is the only time the key is shown.
+func CreateAPIKeyHandler(c *gin.Context) {
+	var req CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abort(c, apperror.Binding(err))
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		abort(c, apperror.Validation("expires_at", "gt", "must be in the future"))
+		return
+	}
+
+	userClaims, ok := accountClaims(c, models.UserTypeMerchant)
+	if !ok {
+		return
+	}
+	if !requireVerifiedEmail(c, userClaims.UserID) {
+		return
+	}
+
+	var key *models.APIKey
+	var raw string
+	err := audited(c, func(tx *gorm.DB) (entry audit.Entry, err error) {
+		key, raw, err = services.CreateAPIKey(tx, userClaims.UserID, services.APIKeySpec{
+			Name:        req.Name,
+			Permissions: req.Permissions,
+			VenueID:     req.VenueID,
+			ExpiresAt:   req.ExpiresAt,
+		})
+		if err != nil {
+			return entry, err
+		}
+		entry = auditEntry(c, audit.APIKeyCreate, audit.EntityAPIKey, key.ID, 0)
+		entry.MerchantID = key.MerchantID
+		entry.After = apiv1.NewAPIKey(key)
+		return entry, nil
+	})
+	if err != nil {
+		abort(c, apiKeyError(err))
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"api_key": apiv1.NewAPIKey(key), "key": raw})
+}
+
+// ListAPIKeysHandler lists the API keys of the authenticated merchant,
+// revoked ones included.
+func ListAPIKeysHandler(c *gin.Context) {
+	userClaims, ok := accountClaims(c, models.UserTypeMerchant)
+	if !ok {
+		return
+	}
+
+	keys, err := services.APIKeys(ReadDB.WithContext(c.Request.Context()), userClaims.UserID)
+	if err != nil {
+		abort(c, apperror.Internalf("get API keys: %w", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"api_keys": apiv1.NewAPIKeys(keys)})
+}
+
+// RevokeAPIKeyHandler stops an API key of the authenticated merchant from
+// working. Requests already made with it are kept in the audit log.
+func RevokeAPIKeyHandler(c *gin.Context) {
+	userClaims, ok := accountClaims(c, models.UserTypeMerchant)
+	if !ok {
+		return
+	}
+	keyID, err := strconv.ParseUint(c.Param("key_id"), 10, 0)
+	if err != nil {
+		abort(c, apperror.New(apperror.CodeAPIKeyNotFound, "API key not found"))
+		return
+	}
+
+	var key *models.APIKey
+	err = audited(c, func(tx *gorm.DB) (entry audit.Entry, err error) {
+		if key, err = services.RevokeAPIKey(tx, userClaims.UserID, uint(keyID), time.Now()); err != nil {
+			return entry, err
+		}
+		entry = auditEntry(c, audit.APIKeyRevoke, audit.EntityAPIKey, key.ID, 0)
+		entry.MerchantID = key.MerchantID
+		entry.Before = gin.H{"revoked_at": nil}
+		entry.After = gin.H{"revoked_at": key.RevokedAt}
+		return entry, nil
+	})
+	if err != nil {
+		abort(c, apiKeyError(err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"api_key": apiv1.NewAPIKey(key)})
+}
+
+// apiKeyError maps the errors of managing API keys.
+func apiKeyError(err error) error {
+	switch {
+	case errors.Is(err, services.ErrAPIKeyNotFound):
+		return apperror.New(apperror.CodeAPIKeyNotFound, "API key not found")
+	case errors.Is(err, services.ErrAPIKeyRevoked):
+		return apperror.New(apperror.CodeAPIKeyRevoked, "The API key is already revoked")
+	case errors.Is(err, services.ErrVenueNotFound), errors.Is(err, services.ErrNotVenueOwner),
+		errors.Is(err, services.ErrUnknownPermission):
+		return staffError(err)
+	}
+	return apperror.Internalf("manage API keys: %w", err)
+}
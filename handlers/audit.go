@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	apiv1 "liven-one-go/api/v1"
+	"liven-one-go/apperror"
+	"liven-one-go/audit"
+	"liven-one-go/models"
+	"liven-one-go/utils"
+)
+
+// auditPageSize is how many entries the audit endpoints return at once.
+// Older ones are fetched with the before_id of the last entry.
+const auditPageSize = 100
+
+// auditEntry starts the audit entry of a change the authenticated account
+// makes in this request. venueID is zero for changes outside any venue.
+func auditEntry(c *gin.Context, action, entityType string, entityID, venueID uint) audit.Entry {
+	entry := audit.Entry{
+		Action:     action,
+		EntityType: entityType,
+		EntityID:   entityID,
+		VenueID:    venueID,
+		IP:         c.ClientIP(),
+		RequestID:  c.GetString(RequestIDHandlerKey),
+	}
+	value, _ := c.Get(UserClaimsHandlerKey)
+	if claims, _ := value.(*utils.Claims); claims != nil {
+		entry.ActorID, entry.ActorType, entry.ActorKeyID = claims.UserID, claims.UserType, claims.APIKeyID
+	}
+	return entry
+}
+
+// audited makes a change and records its audit entry in one transaction, so
+// neither is kept without the other. change returns the entry to record.
+func audited(c *gin.Context, change func(tx *gorm.DB) (audit.Entry, error)) error {
+	return DB.WithContext(c.Request.Context()).Transaction(func(tx *gorm.DB) error {
+		entry, err := change(tx)
+		if err != nil {
+			return err
+		}
+		_, err = audit.Record(tx, entry, time.Now())
+		return err
+	})
+}
+
+// MerchantAuditHandler lists the changes made to the authenticated
+// merchant's venues, menus, orders and staff, newest first.
+func MerchantAuditHandler(c *gin.Context) {
+	userClaims, ok := accountClaims(c, models.UserTypeMerchant)
+	if !ok {
+		return
+	}
+	listAudit(c, ReadDB.WithContext(c.Request.Context()).Where("merchant_id = ?", userClaims.UserID), "venue_id", "actor_key_id")
+}
+
+// AdminAuditHandler lists every change, newest first.
+func AdminAuditHandler(c *gin.Context) {
+	listAudit(c, ReadDB.WithContext(c.Request.Context()), "actor_id", "actor_key_id", "merchant_id", "venue_id")
+}
+
+// AdminVerifyAuditHandler checks the hash chain of the whole audit log.
+func AdminVerifyAuditHandler(c *gin.Context) {
+	db := ReadDB.WithContext(c.Request.Context())
+	report, err := audit.Verify(db)
+	if err != nil && !errors.Is(err, audit.ErrBrokenChain) {
+		abort(c, apperror.Internalf("verify audit log: %w", err))
+		return
+	}
+	head, headErr := audit.Head(db)
+	if headErr != nil {
+		abort(c, apperror.Internalf("get audit log head: %w", headErr))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"valid": err == nil, "report": report, "head": head})
+}
+
+// listAudit responds with a page of the entries matching query and the
+// filters in the query string. idFilters are the ID columns the caller may
+// filter on besides entity_id.
+func listAudit(c *gin.Context, query *gorm.DB, idFilters ...string) {
+	var ok bool
+	for _, column := range append(idFilters, "entity_id") {
+		if query, ok = filterByID(c, query, column); !ok {
+			return
+		}
+	}
+	if entityType := c.Query("entity_type"); entityType != "" {
+		query = query.Where("entity_type = ?", entityType)
+	}
+	if action := c.Query("action"); action != "" {
+		query = query.Where("action = ?", action)
+	}
+	if beforeID := c.Query("before_id"); beforeID != "" {
+		id, err := strconv.ParseUint(beforeID, 10, 0)
+		if err != nil {
+			abort(c, apperror.Validation("before_id", "number", "must be a positive integer"))
+			return
+		}
+		query = query.Where("id < ?", id)
+	}
+
+	var entries []models.AuditEntry
+	if err := query.Preload("ClientIP").Order("id DESC").Limit(auditPageSize).Find(&entries).Error; err != nil {
+		abort(c, apperror.Internalf("list audit entries: %w", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"entries": apiv1.NewAuditEntries(entries)})
+}
@@ -1,20 +1,36 @@
 package handlers
 
 import (
+	"errors"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
+	apiv1 "liven-one-go/api/v1"
+	"liven-one-go/apperror"
+	"liven-one-go/logging"
+	"liven-one-go/metrics"
 	"liven-one-go/models"
+	"liven-one-go/services"
 	"liven-one-go/utils"
+	"log/slog"
 	"net/http"
 	"strings"
+	"time"
 )
 
 const (
 	UserClaimsHandlerKey string = "user_claims"
+	APIKeyHandlerKey     string = "api_key"
 )
 
+// APIKeyHeader carries the API key of integrations, in place of a bearer token.
+const APIKeyHeader = "X-API-Key"
+
+// DB is the writer connection. Use it for inserts, updates, deletes and transactions.
 var DB *gorm.DB
 
+// ReadDB is the read-only pool. Use it for queries that don't modify data.
+var ReadDB *gorm.DB
+
 // RegisterRequest struct to bind registration data
 type RegisterRequest struct {
 	Email    string `json:"email" binding:"required,email"`
@@ -27,120 +43,178 @@ type LoginRequest struct {
 	Password string `json:"password" binding:"required"`
 }
 
-func AuthHandler(context *gin.Context) {
-	// Inject DB here
-	if DB == nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"error": "Database connection not initialized"})
-		return
-	}
-
-	switch context.Request.URL.Path {
-	case "/auth/register":
-		register(context)
-	case "/auth/login":
-		login(context)
-	default:
-		context.JSON(http.StatusNotFound, gin.H{"error": "Route not found"})
+// RegisterHandler creates a diner or merchant account and mails a link to
+// verify its address.
+func RegisterHandler(emails AccountEmails) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		register(c, emails)
 	}
 }
 
-func register(context *gin.Context) {
+func register(context *gin.Context, emails AccountEmails) {
 	var req RegisterRequest
 	if err := context.ShouldBindJSON(&req); err != nil {
-		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		abort(context, apperror.Binding(err))
 		return
 	}
 
-	// Validate UserType (handled by binding:"oneof=diner merchant" but better if explicit)
-	if req.UserType != "diner" && req.UserType != "merchant" {
-		context.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user type. Must be \"diner\" or \"merchant\""})
-	}
-
-	// Check if user with the email already exists
-	var existingUser models.User
-	queryResult := DB.Where("email = ?", req.Email).First(&existingUser)
-
-	if queryResult.Error == nil {
-		// No error means user was found. Email is already registered.
-		context.JSON(http.StatusConflict, gin.H{"error": "Email already registered"})
+	user, err := services.CreateUser(DB.WithContext(context.Request.Context()), req.Email, req.Password, req.UserType)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrEmailTaken):
+			abort(context, apperror.New(apperror.CodeEmailTaken, "Email already registered"))
+		case errors.Is(err, services.ErrInvalidUserType):
+			abort(context, apperror.Validation("user_type", "oneof", "must be one of: diner, merchant"))
+		default:
+			abort(context, apperror.Internalf("create user: %w", err))
+		}
 		return
 	}
 
-	// If there was an error, check if it was "record not found"
-	if queryResult.Error != gorm.ErrRecordNotFound {
-		context.JSON(http.StatusInternalServerError, gin.H{"error": queryResult.Error.Error()})
-		return
+	// The account exists either way; a lost email can be sent again.
+	if err := emails.sendVerification(context, user); err != nil {
+		slog.ErrorContext(context.Request.Context(), "Failed to send verification email", "error", err)
 	}
 
-	// Create a new user
-	user := models.User{
-		Email:    req.Email,
-		UserType: req.UserType,
+	context.JSON(http.StatusCreated, gin.H{"message": "User registered successfully", "user": apiv1.NewUser(user)})
+}
+
+// LoginHandler exchanges credentials for a token. Accounts are locked
+// according to lockout after repeated wrong passwords. Accounts with
+// two-factor authentication get a challenge token instead, to exchange with
+// TwoFactorLoginHandler.
+func LoginHandler(lockout services.LockoutPolicy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req LoginRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			abort(c, apperror.Binding(err))
+			return
+		}
+
+		invalidCredentials := apperror.New(apperror.CodeInvalidCredentials, "Invalid credentials")
+
+		// Find the user by email
+		var user models.User
+		if err := ReadDB.WithContext(c.Request.Context()).Where("email = ?", req.Email).First(&user).Error; err != nil {
+			if !errors.Is(err, gorm.ErrRecordNotFound) {
+				abort(c, apperror.Internalf("get user: %w", err))
+				return
+			}
+			metrics.LoginFailures.WithLabelValues(metrics.LoginUnknownUser).Inc()
+			abort(c, invalidCredentials)
+			return
+		}
+		addLogAttrs(c, slog.Uint64(logging.KeyUserID, uint64(user.ID)))
+
+		// A locked account is refused before the password is checked, so
+		// guessing can't continue during the lock.
+		if refuseLocked(c, &user) {
+			return
+		}
+
+		// Check the password
+		if err := user.CheckPassword(req.Password); err != nil {
+			failLogin(c, user.ID, lockout, metrics.LoginWrongPassword, invalidCredentials)
+			return
+		}
+		completeLogin(c, &user)
 	}
+}
 
-	// Try hashing password
-	if err := user.HashPassword(req.Password); err != nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+// completeLogin finishes logging in a user whose identity was proven, with
+// a password or otherwise. It responds with an access token, or a challenge
+// token to exchange with TwoFactorLoginHandler when the account has
+// two-factor authentication.
+func completeLogin(c *gin.Context, user *models.User) {
+	if refuseSuspended(c, user) {
 		return
 	}
 
-	// Insert into database
-	if err := DB.Create(&user).Error; err != nil {
-		context.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+	// With two-factor authentication the failure count is only reset once
+	// the code is right too, so a known password can't be used to keep
+	// guessing codes.
+	if user.TwoFactorEnabled() {
+		challenge, err := utils.GenerateChallengeToken(user.ID, user.UserType, twoFactorChallengeTTL)
+		if err != nil {
+			abort(c, apperror.Internalf("generate challenge token: %w", err))
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"two_factor_required": true,
+			"challenge_token":     challenge,
+			"expires_in":          int(twoFactorChallengeTTL / time.Second),
+		})
 		return
 	}
 
-	type RegisterResponse struct {
-		ID       uint   `json:"id"`
-		Email    string `json:"email"`
-		UserType string `json:"user_type"`
+	if err := services.ResetFailedLogins(DB.WithContext(c.Request.Context()), user); err != nil {
+		abort(c, apperror.Internalf("reset failed logins: %w", err))
+		return
+	}
+	if !restoreAccount(c, user) {
+		return
 	}
 
-	response := RegisterResponse{
-		ID:       user.ID,
-		Email:    user.Email,
-		UserType: req.UserType,
+	token, ok := loginToken(c, user, false)
+	if !ok {
+		return
 	}
 
-	context.JSON(http.StatusCreated, gin.H{"message": "User registered successfully", "user": response})
+	c.JSON(http.StatusOK, gin.H{"token": token})
 }
 
-func login(c *gin.Context) {
-	var req LoginRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
+// refuseLocked aborts the request when the account is locked.
+func refuseLocked(c *gin.Context, user *models.User) bool {
+	lockedFor := services.LockedFor(user, time.Now())
+	if lockedFor <= 0 {
+		return false
 	}
+	metrics.LoginFailures.WithLabelValues(metrics.LoginLocked).Inc()
+	setRetryAfter(c, lockedFor)
+	abort(c, apperror.New(apperror.CodeAccountLocked, "Too many failed logins. Try again later."))
+	return true
+}
 
-	// Find the user by email
-	var user models.User
-	if err := DB.Where("email = ?", req.Email).First(&user).Error; err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
-		return
+// refuseSuspended aborts the request when an admin suspended the account.
+// It runs after the password is checked, so it doesn't reveal suspensions
+// to whoever only knows the email.
+func refuseSuspended(c *gin.Context, user *models.User) bool {
+	if !user.Suspended() {
+		return false
 	}
+	metrics.LoginFailures.WithLabelValues(metrics.LoginSuspended).Inc()
+	abort(c, apperror.New(apperror.CodeAccountSuspended, "The account is suspended"))
+	return true
+}
 
-	// Check the password
-	if err := user.CheckPassword(req.Password); err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+// failLogin counts a wrong password or code towards the lockout of the
+// account and aborts the request with err.
+func failLogin(c *gin.Context, userID uint, lockout services.LockoutPolicy, reason string, err error) {
+	metrics.LoginFailures.WithLabelValues(reason).Inc()
+	lockedFor, recordErr := services.RecordFailedLogin(DB.WithContext(c.Request.Context()), userID, lockout, time.Now())
+	if recordErr != nil {
+		abort(c, apperror.Internalf("record failed login: %w", recordErr))
 		return
 	}
-
-	// Generate JWT token
-	token, err := utils.GenerateToken(user.ID, user.UserType)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
-		return
+	if lockedFor > 0 {
+		slog.WarnContext(c.Request.Context(), "Account locked after failed logins", "locked_for", lockedFor)
 	}
-
-	c.JSON(http.StatusOK, gin.H{"token": token})
+	abort(c, err)
 }
 
-// AuthMiddleware checks authorization and token status, ensuring it's still valid and not tampered.
+// AuthMiddleware checks authorization and token status, ensuring it's still valid and not tampered
+// and that its session wasn't signed out. Requests may authenticate with an API key in the X-API-Key
+// header instead.
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if key := c.GetHeader(APIKeyHeader); key != "" {
+			authenticateAPIKey(c, key)
+			return
+		}
+
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authorization header is missing"})
+			abort(c, apperror.New(apperror.CodeUnauthenticated, "Authorization header is missing"))
 			return
 		}
 
@@ -151,66 +225,206 @@ func AuthMiddleware() gin.HandlerFunc {
 		if strings.HasPrefix(authHeader, bearerPrefix) {
 			tokenString = strings.TrimPrefix(authHeader, bearerPrefix)
 		} else {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authorization header is invalid. Ensure it starts with bearer prefix."})
+			abort(c, apperror.New(apperror.CodeUnauthenticated, "Authorization header is invalid. Ensure it starts with bearer prefix."))
+			return
 		}
 
 		// Check if token string empty after stripping
 		if tokenString == "" {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Token is missing"})
+			abort(c, apperror.New(apperror.CodeUnauthenticated, "Token is missing"))
 			return
 		}
 
 		claims, err := utils.ValidateToken(tokenString)
 		if err != nil {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token: " + err.Error()})
+			abort(c, apperror.New(apperror.CodeUnauthenticated, "Token is invalid or expired"))
 			return
 		}
 
 		c.Set(UserClaimsHandlerKey, claims)
+		addLogAttrs(c, slog.Uint64(logging.KeyUserID, uint64(claims.UserID)))
+		if claims.ImpersonatorID != 0 {
+			addLogAttrs(c, slog.Uint64(logging.KeyImpersonatorID, uint64(claims.ImpersonatorID)))
+			if !readOnlyMethod(c.Request.Method) {
+				abort(c, apperror.New(apperror.CodeReadOnly, "Impersonation tokens can only read"))
+				return
+			}
+		}
+
+		// Tokens outlive suspensions, deletions and password changes, so the
+		// account is checked on every request. Admins impersonating a
+		// suspended account still see it.
+		var user models.User
+		if err := ReadDB.WithContext(c.Request.Context()).Select("id", "merchant_id", "suspended_at", "tokens_revoked_at").First(&user, claims.UserID).Error; err != nil {
+			abort(c, accountLookupError(err))
+			return
+		}
+		if user.TokenRevoked(claims.Issued()) {
+			abort(c, apperror.New(apperror.CodeUnauthenticated, "The token was revoked. Log in again."))
+			return
+		}
+		if user.Suspended() && claims.ImpersonatorID == 0 {
+			abort(c, apperror.New(apperror.CodeAccountSuspended, "The account is suspended"))
+			return
+		}
+		// Suspending a merchant also stops its staff.
+		if user.MerchantID != nil && claims.ImpersonatorID == 0 {
+			var merchant models.User
+			if err := ReadDB.WithContext(c.Request.Context()).Select("id", "suspended_at").First(&merchant, *user.MerchantID).Error; err != nil {
+				abort(c, accountLookupError(err))
+				return
+			}
+			if merchant.Suspended() {
+				abort(c, apperror.New(apperror.CodeAccountSuspended, "The merchant you work for is suspended"))
+				return
+			}
+		}
+		// Impersonation tokens are short-lived and belong to no session.
+		if claims.ImpersonatorID == 0 && !checkSession(c, claims) {
+			return
+		}
+
 		c.Next()
 	}
 }
 
-// MerchantAccountHandler Example protected route
-func MerchantAccountHandler(c *gin.Context) {
-	claimsInterface, userExists := c.Get(UserClaimsHandlerKey)
-
-	if !userExists {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "User identification not found"})
+// authenticateAPIKey sets the claims of a request made with an API key. They
+// act for the key's merchant with the UserType models.UserTypeAPIKey, which
+// accountClaims refuses, so keys only work where handlers allow them.
+// Changing the merchant's password doesn't revoke keys; suspending it stops
+// them.
+func authenticateAPIKey(c *gin.Context, raw string) {
+	now := time.Now()
+	key, err := services.AuthenticateAPIKey(ReadDB.WithContext(c.Request.Context()), raw, now)
+	if errors.Is(err, services.ErrInvalidAPIKey) {
+		abort(c, apperror.New(apperror.CodeUnauthenticated, "The API key is invalid, expired or revoked"))
 		return
 	}
-
-	userClaims, ok := claimsInterface.(*utils.Claims)
-	if !ok {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid claims type in context"})
+	if err != nil {
+		abort(c, apperror.Internalf("get API key: %w", err))
 		return
 	}
 
-	if userClaims.UserType != models.UserTypeMerchant {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid user type. Must be \"" + models.UserTypeMerchant + "\""})
+	claims := &utils.Claims{UserID: key.MerchantID, UserType: models.UserTypeAPIKey, APIKeyID: key.ID}
+	c.Set(UserClaimsHandlerKey, claims)
+	c.Set(APIKeyHandlerKey, key)
+	addLogAttrs(c, slog.Uint64(logging.KeyUserID, uint64(key.MerchantID)), slog.Uint64(logging.KeyAPIKeyID, uint64(key.ID)))
+
+	var merchant models.User
+	if err := ReadDB.WithContext(c.Request.Context()).Select("id", "suspended_at").First(&merchant, key.MerchantID).Error; err != nil {
+		abort(c, accountLookupError(err))
 		return
 	}
+	if merchant.Suspended() {
+		abort(c, apperror.New(apperror.CodeAccountSuspended, "The account is suspended"))
+		return
+	}
+	if err := services.TouchAPIKey(DB.WithContext(c.Request.Context()), key, now); err != nil {
+		abort(c, apperror.Internalf("record API key use: %w", err))
+	}
+}
 
-	c.JSON(http.StatusOK, userClaims)
+func readOnlyMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
 }
 
-func DinerAccountHandler(c *gin.Context) {
-	claimsInterface, userExists := c.Get(UserClaimsHandlerKey)
+// requestClaims returns the claims AuthMiddleware stored for the request. On
+// failure it aborts the request and returns false.
+func requestClaims(c *gin.Context) (*utils.Claims, bool) {
+	value, _ := c.Get(UserClaimsHandlerKey)
+	claims, _ := value.(*utils.Claims)
+	if claims == nil {
+		abort(c, apperror.New(apperror.CodeUnauthenticated, "User authentication details not found"))
+		return nil, false
+	}
+	return claims, true
+}
 
-	if !userExists {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "User identification not found"})
-		return
+// requestAPIKey returns the API key AuthMiddleware authenticated the
+// request with. On failure it aborts the request and returns false.
+func requestAPIKey(c *gin.Context) (*models.APIKey, bool) {
+	value, _ := c.Get(APIKeyHandlerKey)
+	key, _ := value.(*models.APIKey)
+	if key == nil {
+		abort(c, apperror.New(apperror.CodeUnauthenticated, "API key details not found"))
+		return nil, false
 	}
+	return key, true
+}
 
-	userClaims, ok := claimsInterface.(*utils.Claims)
-	if !ok {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid claims type in context"})
-		return
+// accountClaims returns the claims AuthMiddleware stored for the request and
+// checks the account is of userType. API keys are always refused. On failure
+// it aborts the request and returns false.
+func accountClaims(c *gin.Context, userType string) (*utils.Claims, bool) {
+	claims, ok := requestClaims(c)
+	if !ok || refuseAPIKey(c, claims) {
+		return nil, false
+	}
+	if claims.UserType != userType {
+		abort(c, apperror.New(apperror.CodeWrongAccountType, "Only "+userType+" accounts can do this"))
+		return nil, false
+	}
+	return claims, true
+}
+
+// currentUser loads the account of the authenticated user. API keys have
+// none. On failure it aborts the request and returns false.
+func currentUser(c *gin.Context) (*models.User, bool) {
+	claims, ok := requestClaims(c)
+	if !ok || refuseAPIKey(c, claims) {
+		return nil, false
+	}
+
+	var user models.User
+	if err := ReadDB.WithContext(c.Request.Context()).First(&user, claims.UserID).Error; err != nil {
+		abort(c, accountLookupError(err))
+		return nil, false
+	}
+	return &user, true
+}
+
+// refuseAPIKey aborts requests made with an API key.
+func refuseAPIKey(c *gin.Context, claims *utils.Claims) bool {
+	if claims.UserType != models.UserTypeAPIKey {
+		return false
+	}
+	abort(c, apperror.New(apperror.CodeAPIKeyNotAllowed, "API keys can't do this. Log in as the merchant."))
+	return true
+}
+
+// accountLookupError maps the error of loading the authenticated account. It
+// can only be missing if it was deleted after the token was issued.
+func accountLookupError(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return apperror.New(apperror.CodeUnauthenticated, "The account no longer exists")
 	}
-	if userClaims.UserType != models.UserTypeDiner {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid user type. Must be \"" + models.UserTypeDiner + "\""})
+	return apperror.Internalf("get user: %w", err)
+}
+
+// MerchantAccountHandler shows the authenticated merchant their account.
+func MerchantAccountHandler(c *gin.Context) {
+	showAccount(c, models.UserTypeMerchant)
+}
+
+// DinerAccountHandler shows the authenticated diner their account.
+func DinerAccountHandler(c *gin.Context) {
+	showAccount(c, models.UserTypeDiner)
+}
+
+func showAccount(c *gin.Context, userType string) {
+	user, ok := accountUser(c, userType)
+	if !ok {
 		return
 	}
 
-	c.JSON(http.StatusOK, userClaims)
+	c.JSON(http.StatusOK, apiv1.NewUser(user))
+}
+
+// accountUser loads the authenticated account and checks it is of
+// userType. On failure it aborts the request and returns false.
+func accountUser(c *gin.Context, userType string) (*models.User, bool) {
+	if _, ok := accountClaims(c, userType); !ok {
+		return nil, false
+	}
+	return currentUser(c)
 }
@@ -0,0 +1,23 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"liven-one-go/openapi"
+)
+
+// OpenAPIHandler serves the OpenAPI document of the API.
+func OpenAPIHandler(doc *openapi.Document) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, doc)
+	}
+}
+
+// DocsHandler serves the interactive documentation for the document at specURL.
+func DocsHandler(title, specURL string) gin.HandlerFunc {
+	page := []byte(openapi.DocsPage(title, specURL))
+	return func(c *gin.Context) {
+		c.Data(http.StatusOK, "text/html; charset=utf-8", page)
+	}
+}
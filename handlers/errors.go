@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	"liven-one-go/apperror"
+)
+
+func init() {
+	// Report validation failures with the JSON names clients send, not the Go field names.
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(func(field reflect.StructField) string {
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" {
+				return ""
+			}
+			if name == "" {
+				return field.Name
+			}
+			return name
+		})
+	}
+}
+
+// abort stops the handler chain with err. ErrorHandler renders it.
+func abort(c *gin.Context, err error) {
+	_ = c.Error(err)
+	c.Abort()
+}
+
+// ErrorHandler renders the last error a handler attached with abort as an
+// application/problem+json response. Internal errors are logged with their
+// cause; clients only see the error code and a generic message.
+func ErrorHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		if len(c.Errors) == 0 || c.Writer.Written() {
+			return
+		}
+		writeProblem(c, apperror.From(c.Errors.Last().Err))
+	}
+}
+
+func writeProblem(c *gin.Context, err *apperror.Error) {
+	if err.Status() >= http.StatusInternalServerError {
+		slog.ErrorContext(c.Request.Context(), "Request failed", "code", err.Code, "error", err.Err)
+	}
+
+	c.Header("Content-Type", apperror.ContentType)
+	c.AbortWithStatusJSON(err.Status(), err.Problem(c.Request.URL.Path, c.GetString(RequestIDHandlerKey)))
+}
+
+// RouteNotFoundHandler answers requests that match no route.
+func RouteNotFoundHandler(c *gin.Context) {
+	abort(c, apperror.New(apperror.CodeRouteNotFound, "No route for "+c.Request.Method+" "+c.Request.URL.Path))
+}
@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	apiv1 "liven-one-go/api/v1"
+	"liven-one-go/apperror"
+	"liven-one-go/audit"
+	"liven-one-go/models"
+)
+
+// Formats of DataExportHandler.
+const (
+	exportFormatJSON = "json"
+	exportFormatZIP  = "zip"
+)
+
+// DataExportHandler lets the authenticated diner download everything stored
+// about them: their account, orders, sessions and linked identities, the
+// changes they made and the changes made to their account. It is
+// a single JSON document, or with format=zip an archive of one JSON file per
+// part. Tokens, recovery codes and login codes are left out, as only their
+// hashes are stored.
+func DataExportHandler(c *gin.Context) {
+	format := c.DefaultQuery("format", exportFormatJSON)
+	if format != exportFormatJSON && format != exportFormatZIP {
+		abort(c, apperror.Validation("format", "oneof", "must be one of: json, zip"))
+		return
+	}
+	user, ok := accountUser(c, models.UserTypeDiner)
+	if !ok {
+		return
+	}
+
+	claims, _ := requestClaims(c)
+	sources := apiv1.ExportSources{User: user, CurrentSessionID: claims.SessionID}
+	db := ReadDB.WithContext(c.Request.Context())
+	if err := withOrderDetails(db).Where("diner_id = ?", user.ID).Order("id").Find(&sources.Orders).Error; err != nil {
+		abort(c, apperror.Internalf("get orders: %w", err))
+		return
+	}
+	if err := db.Where("user_id = ?", user.ID).Order("id").Find(&sources.Sessions).Error; err != nil {
+		abort(c, apperror.Internalf("get sessions: %w", err))
+		return
+	}
+	if err := db.Where("user_id = ?", user.ID).Order("id").Find(&sources.Identities).Error; err != nil {
+		abort(c, apperror.Internalf("get identities: %w", err))
+		return
+	}
+	if err := db.Preload("ClientIP").Where("actor_id = ?", user.ID).Order("id").Find(&sources.Activity).Error; err != nil {
+		abort(c, apperror.Internalf("get audit entries: %w", err))
+		return
+	}
+	// Others' changes to the account come without where they were made from.
+	if err := db.Preload("ClientIP", "actor_id = ?", user.ID).
+		Where("entity_type = ? AND entity_id = ?", audit.EntityUser, user.ID).Order("id").Find(&sources.History).Error; err != nil {
+		abort(c, apperror.Internalf("get account history: %w", err))
+		return
+	}
+	export := apiv1.NewDataExport(sources, time.Now().UTC())
+
+	filename := fmt.Sprintf("liven-one-export-%d.%s", user.ID, format)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	if format == exportFormatJSON {
+		c.JSON(http.StatusOK, export)
+		return
+	}
+
+	archive, err := zipExport(export)
+	if err != nil {
+		abort(c, apperror.Internalf("write export archive: %w", err))
+		return
+	}
+	c.Data(http.StatusOK, "application/zip", archive)
+}
+
+// zipExport writes each part of an export to its own file of a ZIP archive.
+func zipExport(export apiv1.DataExport) ([]byte, error) {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for _, part := range []struct {
+		name    string
+		content any
+	}{
+		{"account.json", export.Account},
+		{"orders.json", export.Orders},
+		{"sessions.json", export.Sessions},
+		{"identities.json", export.Identities},
+		{"activity.json", export.Activity},
+		{"history.json", export.History},
+	} {
+		file, err := archive.CreateHeader(&zip.FileHeader{Name: part.name, Method: zip.Deflate, Modified: export.ExportedAt})
+		if err != nil {
+			return nil, err
+		}
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(part.content); err != nil {
+			return nil, err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
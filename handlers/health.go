@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"liven-one-go/database"
+	"liven-one-go/worker"
+)
+
+// Workers are the background workers of the server, checked by ReadyzHandler.
+// Nil when the server runs none.
+var Workers *worker.Group
+
+// readinessTimeout bounds the checks so a wedged database fails the probe
+// instead of hanging it.
+const readinessTimeout = 2 * time.Second
+
+// HealthzHandler reports that the process is up and serving requests.
+func HealthzHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// ReadyzHandler reports whether the server can handle traffic: the database
+// answers, its migrations are applied and the background workers are running.
+func ReadyzHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), readinessTimeout)
+	defer cancel()
+
+	checks := gin.H{}
+	ready := true
+	check := func(name string, err error) {
+		// The error may name tables or files, so it is logged, not shown.
+		if err != nil {
+			slog.WarnContext(ctx, "Readiness check failed", "check", name, "error", err)
+			checks[name] = "failed"
+			ready = false
+			return
+		}
+		checks[name] = "ok"
+	}
+
+	pingErr := ping(ctx)
+	check("database", pingErr)
+	if pingErr == nil {
+		check("migrations", database.CheckMigrations(ReadDB.WithContext(ctx)))
+	}
+	if Workers != nil {
+		check("workers", Workers.Check())
+	}
+
+	if !ready {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "checks": checks})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ready", "checks": checks})
+}
+
+func ping(ctx context.Context) error {
+	for _, db := range []*gorm.DB{DB, ReadDB} {
+		if db == nil {
+			return errors.New("database is not configured")
+		}
+		pool, err := db.DB()
+		if err != nil {
+			return err
+		}
+		if err := pool.PingContext(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"liven-one-go/utils"
+)
+
+// JWKSHandler publishes the public keys that verify our tokens, so other
+// services can check them without holding a signing secret. Keys being
+// rotated in are listed before they sign anything, and caches only hold the
+// set for a few minutes.
+func JWKSHandler(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, utils.Keys().JWKS())
+}
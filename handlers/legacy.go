@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LegacyRoutes keeps serving the unversioned paths clients used before the
+// API moved under prefix, such as /auth/login for /v1/auth/login, until
+// sunset. Requests under one of groups that match no route are routed again
+// under prefix and answered with Deprecation, Sunset and successor Link
+// headers. It must be the first middleware of router, so the others run once,
+// for the versioned route.
+func LegacyRoutes(router *gin.Engine, prefix string, groups []string, sunset time.Time) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		path := c.Request.URL.Path
+		if c.FullPath() != "" || !underAny(path, groups) {
+			return
+		}
+
+		c.Header("Deprecation", "true")
+		c.Header("Sunset", sunset.UTC().Format(http.TimeFormat))
+		c.Header("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", prefix+path))
+
+		c.Request.URL.Path = prefix + path
+		if c.Request.URL.RawPath != "" {
+			c.Request.URL.RawPath = prefix + c.Request.URL.RawPath
+		}
+		router.HandleContext(c)
+		c.Abort()
+	}
+}
+
+func underAny(path string, groups []string) bool {
+	for _, group := range groups {
+		if path == group || strings.HasPrefix(path, group+"/") {
+			return true
+		}
+	}
+	return false
+}
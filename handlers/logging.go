@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"liven-one-go/apperror"
+	"liven-one-go/logging"
+)
+
+const (
+	RequestIDHeader     = "X-Request-ID"
+	RequestIDHandlerKey = "request_id"
+
+	// maxRequestIDLength bounds client-supplied IDs so they can't bloat the logs.
+	maxRequestIDLength = 128
+)
+
+// addLogAttrs attaches attrs to the request context, so they appear on every
+// later log line of the request, including the access log line.
+func addLogAttrs(c *gin.Context, attrs ...slog.Attr) {
+	c.Request = c.Request.WithContext(logging.WithAttrs(c.Request.Context(), attrs...))
+}
+
+// RequestLogger assigns every request an ID, taken from the X-Request-ID
+// header when the caller sent one, echoes it in the response and writes one
+// structured access log line when the request completes.
+func RequestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		requestID := c.GetHeader(RequestIDHeader)
+		if requestID == "" || len(requestID) > maxRequestIDLength {
+			requestID = newRequestID()
+		}
+		c.Set(RequestIDHandlerKey, requestID)
+		c.Header(RequestIDHeader, requestID)
+
+		attrs := []slog.Attr{slog.String(logging.KeyRequestID, requestID)}
+		if venueID := c.Param("venue_id"); venueID != "" {
+			attrs = append(attrs, slog.String(logging.KeyVenueID, venueID))
+		}
+		if orderID := c.Param("order_id"); orderID != "" {
+			attrs = append(attrs, slog.String(logging.KeyOrderID, orderID))
+		}
+		addLogAttrs(c, attrs...)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		switch {
+		case status >= http.StatusInternalServerError:
+			level = slog.LevelError
+		case status >= http.StatusBadRequest:
+			level = slog.LevelWarn
+		}
+
+		slog.LogAttrs(c.Request.Context(), level, "Request completed",
+			slog.String("method", c.Request.Method),
+			slog.String("route", c.FullPath()),
+			slog.String("path", c.Request.URL.Path),
+			slog.Int("status", status),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("client_ip", c.ClientIP()),
+			slog.Int("response_bytes", c.Writer.Size()),
+		)
+	}
+}
+
+// Recovery turns a panic into a 500 response and logs it with the request attributes.
+func Recovery() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				slog.ErrorContext(c.Request.Context(), "Panic while handling request",
+					"panic", recovered, "stack", string(debug.Stack()))
+				writeProblem(c, apperror.Internalf("panic: %v", recovered))
+			}
+		}()
+		c.Next()
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -1,11 +1,17 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
 	"gorm.io/gorm"
+	apiv1 "liven-one-go/api/v1"
+	"liven-one-go/apperror"
+	"liven-one-go/audit"
 	"liven-one-go/models"
-	"liven-one-go/utils"
-	"log"
+	"liven-one-go/services"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
@@ -17,58 +23,113 @@ type CreateMenuItemRequest struct {
 	Category     string `json:"category" binding:"required"`
 }
 
+// UpdateMenuItemRequest fields are pointers so that omitted fields are left unchanged.
 type UpdateMenuItemRequest struct {
-	Name         *string `json:"name" binding:"required"`
-	Description  *string `json:"description" binding:"required"`
-	PriceInCents *uint   `json:"price_in_cents" binding:"required,gt=0"`
-	Category     *string `json:"category" binding:"required"`
+	Name         *string `json:"name"`
+	Description  *string `json:"description"`
+	PriceInCents *uint   `json:"price_in_cents" binding:"omitempty,gt=0"`
+	Category     *string `json:"category"`
 }
 
-func CheckVenueOwnership(c *gin.Context, venueIdString string) (*models.Venue, bool) {
-
-	if DB == nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Database not initialized"})
+// CheckVenueOwnership loads the venue and checks that the authenticated
+// account may act on it. The merchant owning it always may. Staff assigned to
+// it, and API keys of the merchant covering it, may when they hold any of
+// permissions, so with none listed only the owner may. On failure it aborts
+// the request and returns false.
+func CheckVenueOwnership(c *gin.Context, venueIdString string, permissions ...models.StaffPermission) (*models.Venue, bool) {
+	userClaims, ok := requestClaims(c)
+	if !ok {
 		return nil, false
 	}
+	delegated := userClaims.UserType == models.UserTypeStaff || userClaims.UserType == models.UserTypeAPIKey
+	if !delegated || len(permissions) == 0 {
+		if _, ok := accountClaims(c, models.UserTypeMerchant); !ok {
+			return nil, false
+		}
+	}
 
-	userClaimsInterface, _ := c.Get(UserClaimsHandlerKey)
-	if userClaimsInterface == nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "User not recognized"})
+	venueID, err := strconv.ParseUint(venueIdString, 10, 0)
+	if err != nil {
+		abort(c, apperror.New(apperror.CodeVenueNotFound, "Venue not found"))
 		return nil, false
 	}
-	userClaims := userClaimsInterface.(*utils.Claims)
-
 	var venue models.Venue
-	if err := DB.First(&venue, venueIdString).Error; err != nil {
-
-		if err == gorm.ErrRecordNotFound {
-			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Venue not found"})
-			return nil, false
-		}
-
-		log.Println(err)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Venue not found"})
+	if err := ReadDB.WithContext(c.Request.Context()).First(&venue, venueID).Error; err != nil {
+		abort(c, venueLookupError(err))
 		return nil, false
 	}
 
+	switch userClaims.UserType {
+	case models.UserTypeStaff:
+		return &venue, checkStaffPermission(c, userClaims.UserID, venue.ID, permissions)
+	case models.UserTypeAPIKey:
+		return &venue, checkAPIKeyPermission(c, &venue, permissions)
+	}
 	if venue.MerchantID != userClaims.UserID {
-		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "You don't own this venue"})
+		abort(c, apperror.New(apperror.CodeNotVenueOwner, "You don't own this venue"))
 		return nil, false
 	}
 
 	return &venue, true
 }
 
+// checkStaffPermission checks that the staff account works at the venue with
+// any of permissions. On failure it aborts the request and returns false.
+func checkStaffPermission(c *gin.Context, staffID, venueID uint, permissions []models.StaffPermission) bool {
+	assignment, err := services.FindStaffAssignment(ReadDB.WithContext(c.Request.Context()), staffID, venueID)
+	if err != nil {
+		abort(c, apperror.Internalf("get staff assignment: %w", err))
+		return false
+	}
+	if assignment == nil {
+		abort(c, apperror.New(apperror.CodeNotVenueOwner, "You don't work at this venue"))
+		return false
+	}
+	if !assignment.HasAny(permissions) {
+		abort(c, missingPermission(permissions))
+		return false
+	}
+	return true
+}
+
+// checkAPIKeyPermission checks that the request's API key covers the venue
+// with any of permissions. On failure it aborts the request and returns
+// false.
+func checkAPIKeyPermission(c *gin.Context, venue *models.Venue, permissions []models.StaffPermission) bool {
+	key, ok := requestAPIKey(c)
+	if !ok {
+		return false
+	}
+	if venue.MerchantID != key.MerchantID || !key.CoversVenue(venue.ID) {
+		abort(c, apperror.New(apperror.CodeNotVenueOwner, "The API key doesn't cover this venue"))
+		return false
+	}
+	if !key.HasAny(permissions) {
+		abort(c, missingPermission(permissions))
+		return false
+	}
+	return true
+}
+
+// missingPermission is the error for lacking all of permissions at a venue.
+func missingPermission(permissions []models.StaffPermission) error {
+	names := make([]string, len(permissions))
+	for i, permission := range permissions {
+		names[i] = string(permission)
+	}
+	return apperror.New(apperror.CodeMissingPermission, fmt.Sprintf("This needs the %s permission at this venue", strings.Join(names, " or ")))
+}
+
 func CreateMenuItemHandler(c *gin.Context) {
 	venueIdString := c.Param("venue_id")
-	venue, owned := CheckVenueOwnership(c, venueIdString)
+	venue, owned := CheckVenueOwnership(c, venueIdString, models.PermissionManageMenu)
 	if !owned {
 		return // Error response already sent by CheckVenueOwnership
 	}
 
 	var request CreateMenuItemRequest
 	if err := c.ShouldBindJSON(&request); err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		abort(c, apperror.Binding(err))
 		return
 	}
 
@@ -82,34 +143,36 @@ func CreateMenuItemHandler(c *gin.Context) {
 		VenueId:      venue.ID,
 	}
 
-	if err := DB.Create(&menuItem).Error; err != nil {
-		log.Println(err)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	err := audited(c, func(tx *gorm.DB) (audit.Entry, error) {
+		if err := tx.Create(menuItem).Error; err != nil {
+			return audit.Entry{}, err
+		}
+		entry := auditEntry(c, audit.MenuItemCreate, audit.EntityMenuItem, menuItem.ID, venue.ID)
+		entry.After = apiv1.NewMenuItem(menuItem)
+		return entry, nil
+	})
+	if err != nil {
+		abort(c, apperror.Internalf("create menu item: %w", err))
 		return
 	}
 
-	c.JSON(http.StatusCreated, menuItem)
+	c.JSON(http.StatusCreated, apiv1.NewMenuItem(menuItem))
 }
 
 func GetMenuItemsForVenueHandler(c *gin.Context) {
 	venueIdString := c.Param("venue_id")
-	venue, owned := CheckVenueOwnership(c, venueIdString)
+	venue, owned := CheckVenueOwnership(c, venueIdString, models.StaffPermissions...)
 	if !owned {
 		return
 	}
 
 	var menuItems []models.MenuItem
-	if err := DB.Where("venue_id = ?", venue.ID).Find(&menuItems).Error; err != nil {
-		log.Println(err)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to get menu items: " + err.Error()})
+	if err := ReadDB.WithContext(c.Request.Context()).Where("venue_id = ?", venue.ID).Find(&menuItems).Error; err != nil {
+		abort(c, apperror.Internalf("get menu items: %w", err))
 		return
 	}
 
-	if menuItems == nil {
-		menuItems = []models.MenuItem{}
-	}
-
-	c.JSON(http.StatusOK, menuItems)
+	c.JSON(http.StatusOK, apiv1.NewMenuItems(menuItems))
 }
 
 // Path: merchant/venue/:venue_id/item/:item_id
@@ -118,7 +181,7 @@ func UpdateMenuItemHandler(c *gin.Context) {
 	venueIdString := c.Param("venue_id")
 	itemIdString := c.Param("item_id")
 
-	venue, owned := CheckVenueOwnership(c, venueIdString)
+	venue, owned := CheckVenueOwnership(c, venueIdString, models.PermissionManageMenu)
 
 	if !owned {
 		return
@@ -126,19 +189,13 @@ func UpdateMenuItemHandler(c *gin.Context) {
 
 	var request UpdateMenuItemRequest
 	if err := c.ShouldBindJSON(&request); err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		abort(c, apperror.Binding(err))
 		return
 	}
 
 	var menuItem models.MenuItem
-	if err := DB.Where("id = ? AND venue_id = ?", itemIdString, venue.ID).First(&menuItem).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Menu item not found"})
-			return
-		}
-
-		log.Println(err)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Menu item not found"})
+	if err := DB.WithContext(c.Request.Context()).Where("id = ? AND venue_id = ?", itemIdString, venue.ID).First(&menuItem).Error; err != nil {
+		abort(c, menuItemLookupError(err))
 		return
 	}
 
@@ -162,17 +219,25 @@ func UpdateMenuItemHandler(c *gin.Context) {
 	}
 
 	if len(updates) == 0 {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "No update fields provided"})
+		abort(c, apperror.New(apperror.CodeValidationFailed, "No update fields provided"))
 		return
 	}
 
-	if err := DB.Model(&menuItem).Updates(updates).Error; err != nil {
-		log.Println(err)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	err := audited(c, func(tx *gorm.DB) (audit.Entry, error) {
+		entry := auditEntry(c, audit.MenuItemUpdate, audit.EntityMenuItem, menuItem.ID, venue.ID)
+		entry.Before = apiv1.NewMenuItem(&menuItem)
+		if err := tx.Model(&menuItem).Updates(updates).Error; err != nil {
+			return entry, err
+		}
+		entry.After = apiv1.NewMenuItem(&menuItem)
+		return entry, nil
+	})
+	if err != nil {
+		abort(c, apperror.Internalf("update menu item: %w", err))
 		return
 	}
 
-	c.JSON(http.StatusOK, menuItem)
+	c.JSON(http.StatusOK, apiv1.NewMenuItem(&menuItem))
 }
 
 func DeleteMenuItemHandler(c *gin.Context) {
@@ -180,26 +245,24 @@ func DeleteMenuItemHandler(c *gin.Context) {
 	venueIdString := c.Param("venue_id")
 	itemIdString := c.Param("item_id")
 
-	venue, owned := CheckVenueOwnership(c, venueIdString)
+	venue, owned := CheckVenueOwnership(c, venueIdString, models.PermissionManageMenu)
 	if !owned {
 		return
 	}
 
 	var menuItem models.MenuItem
-	if err := DB.Where("id = ? AND venue_id = ?", itemIdString, venue.ID).First(&menuItem).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Menu item not found"})
-			return
-		}
-
-		log.Println(err)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Menu item not found"})
+	if err := DB.WithContext(c.Request.Context()).Where("id = ? AND venue_id = ?", itemIdString, venue.ID).First(&menuItem).Error; err != nil {
+		abort(c, menuItemLookupError(err))
 		return
 	}
 
-	if err := DB.Delete(&menuItem).Error; err != nil {
-		log.Println(err)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete menu item: " + err.Error()})
+	err := audited(c, func(tx *gorm.DB) (audit.Entry, error) {
+		entry := auditEntry(c, audit.MenuItemDelete, audit.EntityMenuItem, menuItem.ID, venue.ID)
+		entry.Before = apiv1.NewMenuItem(&menuItem)
+		return entry, tx.Delete(&menuItem).Error
+	})
+	if err != nil {
+		abort(c, apperror.Internalf("delete menu item: %w", err))
 		return
 	}
 
@@ -207,36 +270,32 @@ func DeleteMenuItemHandler(c *gin.Context) {
 }
 
 func GetSingleVenueMenuHandler(c *gin.Context) {
-	if DB == nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Database not initialized"})
+	venueID, err := strconv.ParseUint(c.Param("venue_id"), 10, 0)
+	if err != nil {
+		abort(c, apperror.New(apperror.CodeVenueNotFound, "Venue not found"))
 		return
 	}
 
-	venueIdString := c.Param("venue_id")
-
 	var venue models.Venue
-	if err := DB.Where("id = ?", venueIdString).First(&venue).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Venue not found"})
-			return
-		}
-		log.Println("Failed retrieving Venue from DB", err)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed retrieving Venue: " + err.Error()})
-
+	if err := ReadDB.WithContext(c.Request.Context()).Scopes(listedVenues).Where("id = ?", venueID).First(&venue).Error; err != nil {
+		abort(c, venueLookupError(err))
 		return
 	}
 
 	var menuItems []models.MenuItem
 
-	if err := DB.Where("venue_id = ?", venueIdString).Find(&menuItems).Error; err != nil {
-		log.Println(err)
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to get menu items"})
+	if err := ReadDB.WithContext(c.Request.Context()).Where("venue_id = ?", venue.ID).Find(&menuItems).Error; err != nil {
+		abort(c, apperror.Internalf("get menu items: %w", err))
 		return
 	}
 
-	if menuItems == nil {
-		menuItems = []models.MenuItem{}
-	}
+	c.JSON(http.StatusOK, apiv1.NewMenuItems(menuItems))
+}
 
-	c.JSON(http.StatusOK, menuItems)
+// menuItemLookupError maps the error of loading a menu item of a venue.
+func menuItemLookupError(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return apperror.New(apperror.CodeMenuItemNotFound, "Menu item not found")
+	}
+	return apperror.Internalf("get menu item: %w", err)
 }
@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"liven-one-go/apperror"
+	"liven-one-go/metrics"
+)
+
+// unmatchedRoute labels requests that hit no route, so scanners probing
+// random paths can't create a new time series per path.
+const unmatchedRoute = "unmatched"
+
+// Metrics records the count and latency of every request by route template.
+func Metrics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = unmatchedRoute
+		}
+		method := c.Request.Method
+		metrics.HTTPRequests.WithLabelValues(method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		metrics.HTTPRequestDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// MetricsHandler serves /metrics to callers presenting token as a bearer token.
+func MetricsHandler(token string) gin.HandlerFunc {
+	expected := []byte("Bearer " + token)
+	handler := metrics.Handler()
+	return func(c *gin.Context) {
+		got := []byte(c.GetHeader("Authorization"))
+		if subtle.ConstantTimeCompare(got, expected) != 1 {
+			abort(c, apperror.New(apperror.CodeUnauthenticated, "Invalid metrics token"))
+			return
+		}
+		handler.ServeHTTP(c.Writer, c.Request)
+	}
+}
@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"liven-one-go/apperror"
+	"liven-one-go/audit"
+	"liven-one-go/logging"
+	"liven-one-go/models"
+	"liven-one-go/oidc"
+	"liven-one-go/services"
+)
+
+// oidcLoginTTL is how long users have to log in at the provider and come
+// back.
+const oidcLoginTTL = 10 * time.Minute
+
+// oidcTimeout bounds each call to a provider.
+const oidcTimeout = 10 * time.Second
+
+// OIDCProviders are the OpenID Connect providers users can log in with, by
+// name.
+type OIDCProviders map[string]*oidc.Client
+
+// NewOIDCProviders returns clients of the configured providers.
+func NewOIDCProviders(configs []oidc.Config) OIDCProviders {
+	httpClient := &http.Client{Timeout: oidcTimeout}
+	providers := OIDCProviders{}
+	for _, config := range configs {
+		providers[config.Name] = oidc.New(config, httpClient)
+	}
+	return providers
+}
+
+// provider returns the provider named in the URL. On failure it aborts the
+// request and returns false.
+func (p OIDCProviders) provider(c *gin.Context) (*oidc.Client, bool) {
+	client := p[c.Param("provider")]
+	if client == nil {
+		abort(c, apperror.New(apperror.CodeProviderNotFound, "No identity provider is called "+c.Param("provider")))
+		return nil, false
+	}
+	return client, true
+}
+
+type OIDCCallbackRequest struct {
+	Code  string `json:"code" binding:"required"`
+	State string `json:"state" binding:"required"`
+}
+
+// StartOIDCLoginHandler starts logging in with a provider. The app sends
+// the browser to the returned URL; the provider sends it back to the app's
+// redirect URL with the code and state to post to OIDCCallbackHandler.
+func StartOIDCLoginHandler(providers OIDCProviders) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		provider, ok := providers.provider(c)
+		if !ok {
+			return
+		}
+
+		login, state, err := services.StartExternalLogin(DB.WithContext(c.Request.Context()), provider.Name(), oidcLoginTTL, time.Now())
+		if err != nil {
+			abort(c, apperror.Internalf("start external login: %w", err))
+			return
+		}
+		authURL, err := provider.AuthCodeURL(c.Request.Context(), state, login.Nonce, login.CodeVerifier)
+		if err != nil {
+			abort(c, providerError(c, err))
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"authorization_url": authURL, "expires_in": int(oidcLoginTTL / time.Second)})
+	}
+}
+
+// OIDCCallbackHandler finishes logging in with a provider and responds like
+// LoginHandler. The first login with an account at the provider links it to
+// the user with its verified address, or creates a diner.
+func OIDCCallbackHandler(providers OIDCProviders) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req OIDCCallbackRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			abort(c, apperror.Binding(err))
+			return
+		}
+		provider, ok := providers.provider(c)
+		if !ok {
+			return
+		}
+
+		expired := apperror.New(apperror.CodeInvalidToken, "The login is invalid or expired. Start again.")
+		login, err := services.FinishExternalLogin(DB.WithContext(c.Request.Context()), provider.Name(), req.State, time.Now())
+		if errors.Is(err, services.ErrInvalidToken) {
+			abort(c, expired)
+			return
+		}
+		if err != nil {
+			abort(c, apperror.Internalf("finish external login: %w", err))
+			return
+		}
+
+		identity, err := provider.Exchange(c.Request.Context(), req.Code, login.CodeVerifier, login.Nonce)
+		switch {
+		case errors.Is(err, oidc.ErrInvalidGrant):
+			abort(c, expired)
+			return
+		case errors.Is(err, oidc.ErrInvalidIDToken):
+			slog.WarnContext(c.Request.Context(), "Refused ID token", "provider", provider.Name(), "error", err)
+			abort(c, apperror.New(apperror.CodeUnauthenticated, "The identity provider's response is invalid"))
+			return
+		case err != nil:
+			abort(c, providerError(c, err))
+			return
+		}
+
+		var user *models.User
+		err = DB.WithContext(c.Request.Context()).Transaction(func(tx *gorm.DB) error {
+			var linked bool
+			var err error
+			user, linked, err = services.ExternalLoginUser(tx, services.ExternalIdentity{
+				Provider:      provider.Name(),
+				Subject:       identity.Subject,
+				Email:         identity.Email,
+				EmailVerified: identity.EmailVerified,
+			}, time.Now())
+			if err != nil || !linked {
+				return err
+			}
+			entry := auditEntry(c, audit.UserIdentityLink, audit.EntityUser, user.ID, 0)
+			entry.ActorID, entry.ActorType = user.ID, user.UserType
+			// The subject identifies the person at the provider, so it stays
+			// in the identity row, which goes when the account is anonymized.
+			entry.After = gin.H{"provider": provider.Name()}
+			_, err = audit.Record(tx, entry, time.Now())
+			return err
+		})
+		switch {
+		case errors.Is(err, services.ErrEmailUnverified):
+			abort(c, apperror.New(apperror.CodeEmailNotVerified, "The identity provider hasn't verified the email address"))
+			return
+		case errors.Is(err, services.ErrExternalLoginRefused):
+			abort(c, apperror.New(apperror.CodeWrongAccountType, "This account can only log in with a password"))
+			return
+		case errors.Is(err, services.ErrEmailTaken):
+			abort(c, apperror.New(apperror.CodeEmailTaken, "Email already registered"))
+			return
+		case err != nil:
+			abort(c, apperror.Internalf("log in with external identity: %w", err))
+			return
+		}
+		addLogAttrs(c, slog.Uint64(logging.KeyUserID, uint64(user.ID)))
+		if refuseLocked(c, user) {
+			return
+		}
+
+		completeLogin(c, user)
+	}
+}
+
+// providerError maps a failure to talk to a provider.
+func providerError(c *gin.Context, err error) error {
+	slog.ErrorContext(c.Request.Context(), "Identity provider failed", "error", err)
+	return apperror.New(apperror.CodeProviderFailed, "The identity provider could not be reached. Try again later.")
+}
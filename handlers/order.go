@@ -1,12 +1,20 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
+	apiv1 "liven-one-go/api/v1"
+	"liven-one-go/apperror"
+	"liven-one-go/audit"
+	"liven-one-go/logging"
+	"liven-one-go/metrics"
 	"liven-one-go/models"
-	"liven-one-go/utils"
-	"log"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -19,7 +27,7 @@ type OrderItemRequest struct {
 // PlaceOrderRequest defines the request body (JSON) for a diner placing an order
 type PlaceOrderRequest struct {
 	VenueID uint               `json:"venue_id" binding:"required"`
-	Items   []OrderItemRequest `json:"items" binding:"required,min=1"`
+	Items   []OrderItemRequest `json:"items" binding:"required,min=1,dive"`
 }
 
 // UpdateOrderStatusRequest defines the request body for a merchant updating an order request
@@ -27,39 +35,25 @@ type UpdateOrderStatusRequest struct {
 	Status models.OrderStatus `json:"status" binding:"required"`
 }
 
-type OrderResponse struct {
-	models.Order
-}
-
 // PlaceOrderHandler handles a diner placing a new order
 func PlaceOrderHandler(c *gin.Context) {
-	if DB == nil {
-		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Database connection failed"})
-		return
-	}
-
 	var req PlaceOrderRequest
-	if err := c.Bind(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abort(c, apperror.Binding(err))
 		return
 	}
 
-	userClaimsInterface, _ := c.Get(UserClaimsHandlerKey)
-	if userClaimsInterface == nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "User isn't authorized"})
+	userClaims, ok := accountClaims(c, models.UserTypeDiner)
+	if !ok {
 		return
 	}
 
-	userClaims := userClaimsInterface.(*utils.Claims)
-	if userClaims.UserType != models.UserTypeDiner {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only diners can place orders"})
-		return
-	}
+	addLogAttrs(c, slog.Uint64(logging.KeyVenueID, uint64(req.VenueID)))
 
 	// --- Transaction for order creation
-	tx := DB.Begin()
+	tx := DB.WithContext(c.Request.Context()).Begin()
 	if tx.Error != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": tx.Error.Error()})
+		abort(c, apperror.Internalf("begin order transaction: %w", tx.Error))
 		return
 	}
 
@@ -74,14 +68,9 @@ func PlaceOrderHandler(c *gin.Context) {
 
 	// 1. Validate Venue
 	var venue models.Venue
-	if err := tx.First(&venue, req.VenueID).Error; err != nil {
+	if err := tx.Scopes(listedVenues).First(&venue, req.VenueID).Error; err != nil {
 		tx.Rollback()
-		if err == gorm.ErrRecordNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Venue not found"})
-			return
-		}
-		log.Println(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": tx.Error.Error()})
+		abort(c, venueLookupError(err))
 		return
 	}
 
@@ -98,8 +87,7 @@ func PlaceOrderHandler(c *gin.Context) {
 	// Fetch all menu items at once to reduce DB calls and check they belong to the venue
 	if err := tx.Where("id IN ? AND venue_id = ?", menuItemIDs, venue.ID).Find(&menuItemsFromDB).Error; err != nil {
 		tx.Rollback()
-		log.Println(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": tx.Error.Error()})
+		abort(c, apperror.Internalf("get menu items: %w", err))
 		return
 	}
 
@@ -109,17 +97,18 @@ func PlaceOrderHandler(c *gin.Context) {
 		menuItemMap[menuItem.ID] = menuItem
 	}
 
-	for _, orderItem := range req.Items {
+	for i, orderItem := range req.Items {
 		menuItem, exists := menuItemMap[orderItem.MenuItemID]
 		if !exists {
 			tx.Rollback()
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid menu item ID, or item not found in this venue"})
-			return
-		}
-
-		if orderItem.Quantity <= 0 {
-			tx.Rollback()
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid quantity"})
+			appErr := apperror.New(apperror.CodeMenuItemUnavailable,
+				fmt.Sprintf("Menu item %d is not on the menu of this venue", orderItem.MenuItemID))
+			appErr.Fields = []apperror.FieldError{{
+				Field:   fmt.Sprintf("items[%d].menu_item_id", i),
+				Rule:    "available",
+				Message: "must be an item on the menu of the venue",
+			}}
+			abort(c, appErr)
 			return
 		}
 
@@ -144,31 +133,43 @@ func PlaceOrderHandler(c *gin.Context) {
 
 	if err := tx.Create(&order).Error; err != nil {
 		tx.Rollback()
-		log.Println(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": tx.Error.Error()})
+		abort(c, apperror.Internalf("create order: %w", err))
+		return
+	}
+
+	entry := auditEntry(c, audit.OrderPlace, audit.EntityOrder, order.ID, venue.ID)
+	entry.After = gin.H{"status": order.Status, "total_amount_in_cents": order.TotalAmountInCents, "items": len(order.OrderItems)}
+	if _, err := audit.Record(tx, entry, time.Now()); err != nil {
+		tx.Rollback()
+		abort(c, apperror.Internalf("record order: %w", err))
 		return
 	}
 
 	if err := tx.Commit().Error; err != nil {
-		log.Println(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": tx.Error.Error()})
+		abort(c, apperror.Internalf("commit order: %w", err))
 		return
 	}
 
+	metrics.OrdersPlaced.Inc()
+	metrics.OrderValueCents.Add(float64(order.TotalAmountInCents))
+	addLogAttrs(c, slog.Uint64(logging.KeyOrderID, uint64(order.ID)))
+	slog.InfoContext(c.Request.Context(), "Order placed", "total_amount_in_cents", order.TotalAmountInCents, "items", len(order.OrderItems))
+
 	var createdOrderWithDetails models.Order
-	if err := DB.Preload("OrderItems.MenuItem").Preload("Diner").Preload("Venue").First(&createdOrderWithDetails, order.ID).Error; err != nil {
-		log.Println(err)
-		c.JSON(http.StatusOK, order)
+	if err := withOrderDetails(DB.WithContext(c.Request.Context())).First(&createdOrderWithDetails, order.ID).Error; err != nil {
+		slog.ErrorContext(c.Request.Context(), "Failed to reload order", "error", err)
+		order.Venue = venue
+		c.JSON(http.StatusOK, apiv1.NewOrderDetail(&order))
 		return
 	}
 
-	c.JSON(http.StatusOK, createdOrderWithDetails)
+	c.JSON(http.StatusOK, apiv1.NewOrderDetail(&createdOrderWithDetails))
 
 }
 
 func GetMerchantOrdersHandler(c *gin.Context) {
 	venueIDStr := c.Param("venue_id")
-	venue, owned := CheckVenueOwnership(c, venueIDStr)
+	venue, owned := CheckVenueOwnership(c, venueIDStr, orderViewPermissions...)
 	if !owned {
 		return
 	}
@@ -176,171 +177,218 @@ func GetMerchantOrdersHandler(c *gin.Context) {
 	statusFilter := c.Query("status")
 
 	var orders []models.Order
-	query := DB.Where("venue_id = ?", venue.ID)
+	query := ReadDB.WithContext(c.Request.Context()).Where("venue_id = ?", venue.ID)
 	if statusFilter != "" {
 		query = query.Where("status = ?", models.OrderStatus(statusFilter))
 	}
 
-	// Preload related data for merchant view
-	if err := query.
-		Preload("OrderItems.MenuItem").Preload("Diner").
-		Order("created_at DESC").Find(&orders).Error; err != nil {
-		log.Printf("Failed to get orders from venue %d: %v\n", venue.ID, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if err := withOrderSummaries(query).Order("created_at DESC").Find(&orders).Error; err != nil {
+		abort(c, apperror.Internalf("get venue orders: %w", err))
 		return
 	}
 
-	if orders == nil {
-		orders = []models.Order{}
+	c.JSON(http.StatusOK, apiv1.NewOrderSummaries(orders))
+}
+
+// GetMerchantOrderHandler shows an order placed at one of the merchant's
+// venues, or at a venue where a staff account may see orders.
+func GetMerchantOrderHandler(c *gin.Context) {
+	orderID, err := strconv.ParseUint(c.Param("order_id"), 10, 0)
+	if err != nil {
+		abort(c, apperror.New(apperror.CodeOrderNotFound, "Order not found"))
+		return
+	}
+	scope, ok := venueOrders(c, orderViewPermissions...)
+	if !ok {
+		return
 	}
 
-	c.JSON(http.StatusOK, orders)
+	var order models.Order
+	if err := withOrderDetails(ReadDB.WithContext(c.Request.Context())).Scopes(scope).
+		First(&order, orderID).Error; err != nil {
+		abort(c, orderLookupError(err))
+		return
+	}
+
+	c.JSON(http.StatusOK, apiv1.NewOrderDetail(&order))
 }
 
 func UpdateOrderStatusHandler(c *gin.Context) {
-	orderIDStr := c.Param("order_id")
-
 	var request UpdateOrderStatusRequest
 	if err := c.ShouldBindJSON(&request); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		abort(c, apperror.Binding(err))
+		return
+	}
+	orderID, err := strconv.ParseUint(c.Param("order_id"), 10, 0)
+	if err != nil {
+		abort(c, apperror.New(apperror.CodeOrderNotFound, "Order not found"))
 		return
 	}
 
 	// Validate the status from the request
-	switch request.Status {
-
-	case
-		models.OrderStatusPending,
-		models.OrderStatusRejected,
-		models.OrderStatusAccepted,
-		models.OrderStatusCancelled,
-		models.OrderStatusPreparing,
-		models.OrderStatusReadyForDelivery,
-		models.OrderStatusCompleted:
-		// Do nothing. Go to the next blocks of code.
-	default:
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status value"})
+	if !request.Status.Valid() {
+		abort(c, invalidOrderStatus(request.Status))
 		return
 	}
 
-	userClaimsInterface, _ := c.Get(UserClaimsHandlerKey)
-	userClaims := userClaimsInterface.(*utils.Claims)
-	if userClaimsInterface == nil || userClaims.UserType != models.UserTypeMerchant {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Access forbidden: Only merchants can update order status."})
+	scope, ok := venueOrders(c, models.PermissionManageOrders)
+	if !ok {
 		return
 	}
 
 	var order models.Order
-	if err := DB.
-		Joins("JOIN venues ON venues.id = orders.venue_id AND venues.merchant_id = ?", userClaims.UserID).
-		Find(&order, orderIDStr).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
-			return
-		}
-
-		log.Printf("Failed to get order: %v\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if err := DB.WithContext(c.Request.Context()).Scopes(scope).First(&order, orderID).Error; err != nil {
+		abort(c, orderLookupError(err))
 		return
 	}
 
 	// Basic state transition validation (can be more complex)
 	// For MVP, we might allow most transitions.
 	// Example: if order.Status == models.OrderStatusCompleted && req.Status != models.OrderStatusCompleted {
-	//    c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot change status of a completed order"})
+	//    abort(c, apperror.New(apperror.CodeInvalidOrderStatus, "Cannot change status of a completed order"))
 	//    return
 	// }
 
-	if err := DB.Model(&order).Update("status", request.Status).Error; err != nil {
-		log.Printf("Failed to update order: %v\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	previousStatus := order.Status
+	err = audited(c, func(tx *gorm.DB) (audit.Entry, error) {
+		entry := auditEntry(c, audit.OrderStatus, audit.EntityOrder, order.ID, order.VenueID)
+		entry.Before = gin.H{"status": previousStatus}
+		entry.After = gin.H{"status": request.Status}
+		return entry, tx.Model(&order).Update("status", request.Status).Error
+	})
+	if err != nil {
+		abort(c, apperror.Internalf("update order status: %w", err))
 		return
 	}
+	metrics.OrderStatusTransitions.WithLabelValues(string(previousStatus), string(request.Status)).Inc()
+	slog.InfoContext(c.Request.Context(), "Order status updated", "from", previousStatus, "to", request.Status)
 
 	var updatedOrderWithDetails models.Order
-	if err := DB.Preload("OrderItems.MenuItem").
-		Preload("Diner").Preload("Venue").
-		First(&updatedOrderWithDetails, order.ID).Error; err != nil {
-		log.Printf("Failed to get order: %v\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if err := withOrderDetails(DB.WithContext(c.Request.Context())).First(&updatedOrderWithDetails, order.ID).Error; err != nil {
+		abort(c, apperror.Internalf("reload order: %w", err))
 		return
 	}
 
-	c.JSON(http.StatusOK, updatedOrderWithDetails)
+	c.JSON(http.StatusOK, apiv1.NewOrderDetail(&updatedOrderWithDetails))
 
 }
 
 func GetDinerOrdersHandler(c *gin.Context) {
-	if DB == nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database not initialized"})
-		return
-	}
-
-	userClaimsInterface, _ := c.Get(UserClaimsHandlerKey)
-	if userClaimsInterface == nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "User authentication details not found"})
-		return
-	}
-
-	userClaims := userClaimsInterface.(*utils.Claims)
-	if userClaims.UserType != models.UserTypeDiner {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only diners can view orders here."})
+	userClaims, ok := accountClaims(c, models.UserTypeDiner)
+	if !ok {
 		return
 	}
 
 	statusFilter := c.Query("status")
 
 	var orders []models.Order
-	query := DB.Where("diner_id = ?", userClaims.UserID)
+	query := ReadDB.WithContext(c.Request.Context()).Where("diner_id = ?", userClaims.UserID)
 	if statusFilter != "" {
 		query = query.Where("status = ?", models.OrderStatus(statusFilter))
 	}
 
-	if err := query.Preload("OrderItems.MenuItem").Preload("Venue").
-		Order("created_at DESC").Find(&orders).Error; err != nil {
-		log.Printf("Failed to get orders from venue %d: %v\n", userClaims.UserID, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if err := withOrderSummaries(query).Order("created_at DESC").Find(&orders).Error; err != nil {
+		abort(c, apperror.Internalf("get diner orders: %w", err))
 		return
 	}
 
-	if orders == nil {
-		orders = []models.Order{}
-	}
-
-	c.JSON(http.StatusOK, orders)
+	c.JSON(http.StatusOK, apiv1.NewOrderSummaries(orders))
 }
 
 func GetDinerSingleOrderHandler(c *gin.Context) {
-	if DB == nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database not initialized"})
+	userClaims, ok := accountClaims(c, models.UserTypeDiner)
+	if !ok {
 		return
 	}
-
-	orderIDStr := c.Param("order_id")
-	userClaimsInterface, _ := c.Get(UserClaimsHandlerKey)
-	if userClaimsInterface == nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "User authentication details not found"})
+	orderID, err := strconv.ParseUint(c.Param("order_id"), 10, 0)
+	if err != nil {
+		abort(c, apperror.New(apperror.CodeOrderNotFound, "Order not found"))
 		return
 	}
 
-	userClaims := userClaimsInterface.(*utils.Claims)
-	if userClaims.UserType != models.UserTypeDiner {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only diners can view order here."})
+	var order models.Order
+	if err := withOrderDetails(ReadDB.WithContext(c.Request.Context())).
+		Where("id = ? AND diner_id = ?", orderID, userClaims.UserID).First(&order).Error; err != nil {
+		abort(c, orderLookupError(err))
+		return
 	}
 
-	var order models.Order
-	if err := DB.Preload("OrderItems.MenuItem").Preload("Venue").
-		Where("id = ? AND diner_id", orderIDStr, userClaims.UserID).First(&order).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Order not found or you don't have permission to view this order."})
-			return
+	c.JSON(http.StatusOK, apiv1.NewOrderDetail(&order))
+
+}
+
+// orderViewPermissions are the staff permissions that show a venue's orders.
+var orderViewPermissions = []models.StaffPermission{models.PermissionManageOrders, models.PermissionViewAnalytics}
+
+// venueOrders returns a scope limiting a query to the orders of venues the
+// authenticated account may act on: those a merchant owns, those where a
+// staff account holds any of permissions, or those an API key holding any of
+// them covers. Other orders are reported as missing by orderLookupError. On
+// failure it aborts the request and returns false.
+func venueOrders(c *gin.Context, permissions ...models.StaffPermission) (func(*gorm.DB) *gorm.DB, bool) {
+	userClaims, ok := requestClaims(c)
+	if !ok {
+		return nil, false
+	}
+	if userClaims.UserType == models.UserTypeStaff {
+		granted := make([]string, len(permissions))
+		for i, permission := range permissions {
+			granted[i] = "staff_assignments." + permission.Column()
+		}
+		join := "JOIN staff_assignments ON staff_assignments.venue_id = orders.venue_id AND staff_assignments.user_id = ? AND (" +
+			strings.Join(granted, " OR ") + ")"
+		return func(db *gorm.DB) *gorm.DB { return db.Joins(join, userClaims.UserID) }, true
+	}
+	if userClaims.UserType == models.UserTypeAPIKey {
+		key, ok := requestAPIKey(c)
+		if !ok {
+			return nil, false
 		}
+		if !key.HasAny(permissions) {
+			abort(c, missingPermission(permissions))
+			return nil, false
+		}
+		return func(db *gorm.DB) *gorm.DB {
+			db = db.Joins("JOIN venues ON venues.id = orders.venue_id AND venues.merchant_id = ?", key.MerchantID)
+			if key.VenueID != nil {
+				db = db.Where("orders.venue_id = ?", *key.VenueID)
+			}
+			return db
+		}, true
+	}
+	if _, ok := accountClaims(c, models.UserTypeMerchant); !ok {
+		return nil, false
+	}
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Joins("JOIN venues ON venues.id = orders.venue_id AND venues.merchant_id = ?", userClaims.UserID)
+	}, true
+}
 
-		log.Printf("Failed to get order: %v\n", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
+// withOrderSummaries preloads what an order summary shows.
+func withOrderSummaries(db *gorm.DB) *gorm.DB {
+	return db.Preload("OrderItems").Preload("Venue", unscoped)
+}
+
+// withOrderDetails preloads what an order detail shows. Menu items and venues
+// deleted since the order was placed are still loaded, so the order keeps
+// showing their names.
+func withOrderDetails(db *gorm.DB) *gorm.DB {
+	return db.Preload("OrderItems.MenuItem", unscoped).Preload("Venue", unscoped)
+}
 
-	c.JSON(http.StatusOK, order)
+func unscoped(db *gorm.DB) *gorm.DB {
+	return db.Unscoped()
+}
 
+func invalidOrderStatus(status models.OrderStatus) error {
+	return apperror.New(apperror.CodeInvalidOrderStatus, fmt.Sprintf("%q is not an order status", status))
+}
+
+// orderLookupError maps the error of loading an order. Orders of other
+// accounts are reported as missing so their IDs can't be probed.
+func orderLookupError(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return apperror.New(apperror.CodeOrderNotFound, "Order not found")
+	}
+	return apperror.Internalf("get order: %w", err)
 }
@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"liven-one-go/apperror"
+	"liven-one-go/logging"
+	"liven-one-go/mail"
+	"liven-one-go/metrics"
+	"liven-one-go/models"
+	"liven-one-go/services"
+	"liven-one-go/sms"
+)
+
+// SMS sends the text messages of the account flows. serve sets it from
+// SMS_SENDER.
+var SMS sms.Sender = sms.Discard{}
+
+type MagicLinkRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type MagicLinkLoginRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+type LoginCodeRequest struct {
+	Email string `json:"email" binding:"required,email"`
+	// Channel is "sms" to text the code to the account's phone number or
+	// "email" to mail it.
+	Channel string `json:"channel" binding:"required,oneof=email sms"`
+}
+
+type LoginCodeLoginRequest struct {
+	Email string `json:"email" binding:"required,email"`
+	Code  string `json:"code" binding:"required"`
+}
+
+// RequestMagicLinkHandler mails a link that logs the account in without a
+// password. It answers the same whether or not the email has an account.
+func RequestMagicLinkHandler(emails AccountEmails, policy services.PasswordlessPolicy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req MagicLinkRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			abort(c, apperror.Binding(err))
+			return
+		}
+
+		user, ok := passwordlessUser(c, req.Email)
+		if !ok {
+			return
+		}
+		if user != nil {
+			if err := emails.sendMagicLink(c, user, policy.MagicLinkTTL); err != nil {
+				slog.ErrorContext(c.Request.Context(), "Failed to send login link", "error", err)
+			}
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{"message": "If the email has an account, a login link is on its way"})
+	}
+}
+
+// MagicLinkLoginHandler logs in with the token of a mailed login link and
+// responds like LoginHandler.
+func MagicLinkLoginHandler(c *gin.Context) {
+	var req MagicLinkLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abort(c, apperror.Binding(err))
+		return
+	}
+
+	user, err := services.LoginWithMagicLink(DB.WithContext(c.Request.Context()), req.Token, time.Now())
+	if err != nil {
+		abort(c, tokenError(err, "log in with link"))
+		return
+	}
+	addLogAttrs(c, slog.Uint64(logging.KeyUserID, uint64(user.ID)))
+	// The link is spent either way; a locked account asks for another later.
+	if refuseLocked(c, user) {
+		return
+	}
+
+	completeLogin(c, user)
+}
+
+// RequestLoginCodeHandler texts or mails a short code that logs the account
+// in without a password. It answers the same whether or not the email has an
+// account or a phone number.
+func RequestLoginCodeHandler(emails AccountEmails, policy services.PasswordlessPolicy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req LoginCodeRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			abort(c, apperror.Binding(err))
+			return
+		}
+
+		user, ok := passwordlessUser(c, req.Email)
+		if !ok {
+			return
+		}
+		if user != nil {
+			if err := emails.sendLoginCode(c, user, req.Channel, policy.CodeTTL); err != nil && !errors.Is(err, services.ErrNoPhone) {
+				slog.ErrorContext(c.Request.Context(), "Failed to send login code", "channel", req.Channel, "error", err)
+			}
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{"message": "If the account can receive it, a login code is on its way"})
+	}
+}
+
+// LoginCodeLoginHandler logs in with a code from RequestLoginCodeHandler
+// and responds like LoginHandler. Wrong codes count towards the lockout of
+// the account like wrong passwords, and end the code after
+// policy.CodeAttempts.
+func LoginCodeLoginHandler(policy services.PasswordlessPolicy, lockout services.LockoutPolicy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req LoginCodeLoginRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			abort(c, apperror.Binding(err))
+			return
+		}
+
+		invalidCode := apperror.New(apperror.CodeInvalidCredentials, "The login code is invalid or expired")
+		user, err := services.FindUserByEmail(ReadDB.WithContext(c.Request.Context()), req.Email)
+		if errors.Is(err, services.ErrUserNotFound) {
+			metrics.LoginFailures.WithLabelValues(metrics.LoginUnknownUser).Inc()
+			abort(c, invalidCode)
+			return
+		}
+		if err != nil {
+			abort(c, apperror.Internalf("get user: %w", err))
+			return
+		}
+		addLogAttrs(c, slog.Uint64(logging.KeyUserID, uint64(user.ID)))
+		if refuseLocked(c, user) {
+			return
+		}
+
+		err = services.VerifyLoginCode(DB.WithContext(c.Request.Context()), user, req.Code, policy.CodeAttempts, time.Now())
+		if errors.Is(err, services.ErrInvalidLoginCode) {
+			failLogin(c, user.ID, lockout, metrics.LoginWrongOTP, invalidCode)
+			return
+		}
+		if err != nil {
+			abort(c, apperror.Internalf("verify login code: %w", err))
+			return
+		}
+
+		completeLogin(c, user)
+	}
+}
+
+// passwordlessUser finds the account a passwordless login is asked for. It
+// returns nil without aborting when there is none, or it is an admin, whose
+// logins need the password. On failure it aborts the request and returns
+// false.
+func passwordlessUser(c *gin.Context, email string) (*models.User, bool) {
+	user, err := services.FindUserByEmail(ReadDB.WithContext(c.Request.Context()), email)
+	switch {
+	case errors.Is(err, services.ErrUserNotFound):
+		return nil, true
+	case err != nil:
+		abort(c, apperror.Internalf("get user: %w", err))
+		return nil, false
+	case user.UserType == models.UserTypeAdmin:
+		return nil, true
+	}
+	return user, true
+}
+
+// sendMagicLink mails the user a link that logs them in.
+func (e AccountEmails) sendMagicLink(c *gin.Context, user *models.User, ttl time.Duration) error {
+	token, err := services.IssueToken(DB.WithContext(c.Request.Context()), user.ID, models.TokenPurposeMagicLink, ttl, time.Now())
+	if err != nil {
+		return fmt.Errorf("issue login token: %w", err)
+	}
+	return Mailer.Send(c.Request.Context(), mail.Message{
+		To:      user.Email,
+		Subject: "Your login link",
+		Body: fmt.Sprintf("Open this link to log in:\n\n%s\n\nThe link expires in %s and works once. "+
+			"If you didn't ask to log in, ignore this email.\n",
+			e.link("/magic-link", token), ttl),
+	})
+}
+
+// sendLoginCode texts or mails the user a code that logs them in.
+func (e AccountEmails) sendLoginCode(c *gin.Context, user *models.User, channel string, ttl time.Duration) error {
+	code, err := services.IssueLoginCode(DB.WithContext(c.Request.Context()), user, channel, ttl, time.Now())
+	if err != nil {
+		return fmt.Errorf("issue login code: %w", err)
+	}
+	text := fmt.Sprintf("Your Liven One login code is %s. It expires in %s.", code, ttl)
+	if channel == models.LoginCodeChannelSMS {
+		return SMS.Send(c.Request.Context(), sms.Message{To: user.Phone, Body: text})
+	}
+	return Mailer.Send(c.Request.Context(), mail.Message{
+		To:      user.Email,
+		Subject: "Your login code",
+		Body:    text + " If you didn't ask to log in, ignore this email.\n",
+	})
+}
@@ -0,0 +1,275 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	apiv1 "liven-one-go/api/v1"
+	"liven-one-go/apperror"
+	"liven-one-go/audit"
+	"liven-one-go/metrics"
+	"liven-one-go/models"
+	"liven-one-go/services"
+)
+
+type UpdateProfileRequest struct {
+	DisplayName string `json:"display_name" binding:"max=100"`
+	Phone       string `json:"phone" binding:"omitempty,e164"`
+	AvatarURL   string `json:"avatar_url" binding:"omitempty,url,max=500"`
+	Locale      string `json:"locale" binding:"omitempty,bcp47_language_tag"`
+	// MarketingConsent is whether the owner agrees to receive marketing.
+	MarketingConsent bool `json:"marketing_consent"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required,min=8,max=20"`
+}
+
+type ChangeEmailRequest struct {
+	Email    string `json:"email" binding:"required,email"`
+	Password string `json:"password" binding:"required"`
+}
+
+type ConfirmEmailChangeRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+type DeleteAccountRequest struct {
+	Password string `json:"password" binding:"required"`
+}
+
+// GetProfileHandler shows the authenticated account of userType its profile.
+func GetProfileHandler(userType string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := accountUser(c, userType)
+		if !ok {
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"profile": apiv1.NewProfile(user)})
+	}
+}
+
+// UpdateProfileHandler replaces the profile of the authenticated account of
+// userType. Omitted fields are cleared.
+func UpdateProfileHandler(userType string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req UpdateProfileRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			abort(c, apperror.Binding(err))
+			return
+		}
+		user, ok := accountUser(c, userType)
+		if !ok {
+			return
+		}
+
+		// Only consent is diffed: the audit log can't be anonymized, so it
+		// keeps no personal details.
+		err := audited(c, func(tx *gorm.DB) (audit.Entry, error) {
+			entry := auditEntry(c, audit.UserProfileUpdate, audit.EntityUser, user.ID, 0)
+			entry.Before = gin.H{"marketing_consent": user.MarketingConsentAt != nil}
+			entry.After = gin.H{"marketing_consent": req.MarketingConsent}
+			return entry, services.UpdateProfile(tx, user, services.Profile{
+				DisplayName:      req.DisplayName,
+				Phone:            req.Phone,
+				AvatarURL:        req.AvatarURL,
+				Locale:           req.Locale,
+				MarketingConsent: req.MarketingConsent,
+			}, time.Now())
+		})
+		if err != nil {
+			abort(c, apperror.Internalf("update profile: %w", err))
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"profile": apiv1.NewProfile(user)})
+	}
+}
+
+// ChangePasswordHandler sets a new password for the authenticated account of
+// userType once the current one is confirmed. Every other token and session
+// of the account stops working; the response carries a new token for this
+// client.
+func ChangePasswordHandler(userType string, lockout services.LockoutPolicy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req ChangePasswordRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			abort(c, apperror.Binding(err))
+			return
+		}
+		user, ok := accountUser(c, userType)
+		if !ok || !confirmPassword(c, user, req.CurrentPassword, lockout) {
+			return
+		}
+
+		var hashed models.User
+		if err := hashed.HashPassword(req.NewPassword); err != nil {
+			abort(c, apperror.Internalf("hash password: %w", err))
+			return
+		}
+		claims, _ := requestClaims(c)
+		err := audited(c, func(tx *gorm.DB) (audit.Entry, error) {
+			return auditEntry(c, audit.UserPasswordChange, audit.EntityUser, user.ID, 0),
+				services.ChangePassword(tx, user, hashed.Password, claims.SessionID, time.Now())
+		})
+		if err != nil {
+			abort(c, apperror.Internalf("change password: %w", err))
+			return
+		}
+
+		// The replacement keeps the session and second factor of the token
+		// it replaces.
+		token, ok := replacementToken(c, user, claims, claims.MFA)
+		if !ok {
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Password changed", "token": token})
+	}
+}
+
+// ChangeEmailHandler starts moving the authenticated account of userType to
+// a new address once the password is confirmed. The new address gets a
+// link to ConfirmEmailChangeHandler; until it is opened, the old one stays
+// in use.
+func ChangeEmailHandler(userType string, emails AccountEmails, lockout services.LockoutPolicy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req ChangeEmailRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			abort(c, apperror.Binding(err))
+			return
+		}
+		user, ok := accountUser(c, userType)
+		if !ok || !confirmPassword(c, user, req.Password, lockout) {
+			return
+		}
+		if req.Email == user.Email {
+			abort(c, apperror.Validation("email", "ne", "must differ from the current address"))
+			return
+		}
+
+		token, err := services.RequestEmailChange(DB.WithContext(c.Request.Context()), user, req.Email, emails.VerificationTTL, time.Now())
+		if err != nil {
+			abort(c, emailChangeError(err, "request email change"))
+			return
+		}
+		if err := emails.sendEmailChange(c, user, token); err != nil {
+			abort(c, apperror.Internalf("send email change: %w", err))
+			return
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{"message": "A confirmation link is on its way to the new address", "user": apiv1.NewUser(user)})
+	}
+}
+
+// ConfirmEmailChangeHandler switches an account to its pending address with
+// a token from the email ChangeEmailHandler sent.
+func ConfirmEmailChangeHandler(c *gin.Context) {
+	var req ConfirmEmailChangeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abort(c, apperror.Binding(err))
+		return
+	}
+
+	var user *models.User
+	err := audited(c, func(tx *gorm.DB) (entry audit.Entry, err error) {
+		if user, err = services.ConfirmEmailChange(tx, req.Token, time.Now()); err != nil {
+			return entry, err
+		}
+		// The link is the proof of identity, so the account is the actor.
+		entry = auditEntry(c, audit.UserEmailChange, audit.EntityUser, user.ID, 0)
+		entry.ActorID, entry.ActorType = user.ID, user.UserType
+		return entry, nil
+	})
+	if err != nil {
+		abort(c, emailChangeError(err, "confirm email change"))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email changed", "user": apiv1.NewUser(user)})
+}
+
+// DeleteAccountHandler schedules the deletion of the authenticated account
+// of userType once the password is confirmed. The account is signed out and
+// anonymized after grace, unless its owner logs in again before. Merchants
+// must transfer or delete their venues first.
+func DeleteAccountHandler(userType string, lockout services.LockoutPolicy, grace time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req DeleteAccountRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			abort(c, apperror.Binding(err))
+			return
+		}
+		user, ok := accountUser(c, userType)
+		if !ok || !confirmPassword(c, user, req.Password, lockout) {
+			return
+		}
+
+		now := time.Now()
+		err := audited(c, func(tx *gorm.DB) (audit.Entry, error) {
+			entry := auditEntry(c, audit.UserDelete, audit.EntityUser, user.ID, 0)
+			return entry, services.RequestDeletion(tx, user, now.Add(grace), now)
+		})
+		if errors.Is(err, services.ErrMerchantHasVenues) {
+			abort(c, apperror.New(apperror.CodeMerchantHasVenues, "Transfer or delete your venues before deleting your account"))
+			return
+		}
+		if err != nil {
+			abort(c, apperror.Internalf("delete account: %w", err))
+			return
+		}
+		slog.InfoContext(c.Request.Context(), "Account deletion requested", "due_at", *user.DeletionDueAt)
+
+		c.JSON(http.StatusAccepted, gin.H{
+			"message":         "The account will be deleted. Log in before then to keep it.",
+			"deletion_due_at": *user.DeletionDueAt,
+		})
+	}
+}
+
+// restoreAccount cancels the pending deletion of an account its owner just
+// logged in to. On failure it aborts the request and returns false.
+func restoreAccount(c *gin.Context, user *models.User) bool {
+	if user.DeletionDueAt == nil {
+		return true
+	}
+	err := audited(c, func(tx *gorm.DB) (audit.Entry, error) {
+		entry := auditEntry(c, audit.UserRestore, audit.EntityUser, user.ID, 0)
+		entry.ActorID, entry.ActorType = user.ID, user.UserType
+		return entry, services.CancelDeletion(tx, user)
+	})
+	if err != nil {
+		abort(c, apperror.Internalf("restore account: %w", err))
+		return false
+	}
+	slog.InfoContext(c.Request.Context(), "Account deletion cancelled by logging in")
+	return true
+}
+
+// confirmPassword checks the password of the authenticated user before a
+// sensitive change, so a stolen token isn't enough. Wrong passwords count
+// towards lockout. On failure it aborts the request and returns false.
+func confirmPassword(c *gin.Context, user *models.User, password string, lockout services.LockoutPolicy) bool {
+	if refuseLocked(c, user) {
+		return false
+	}
+	if err := user.CheckPassword(password); err != nil {
+		failLogin(c, user.ID, lockout, metrics.LoginWrongPassword, apperror.New(apperror.CodeInvalidCredentials, "Invalid password"))
+		return false
+	}
+	return true
+}
+
+// emailChangeError maps the errors of changing an account's address.
+func emailChangeError(err error, action string) error {
+	if errors.Is(err, services.ErrEmailTaken) {
+		return apperror.New(apperror.CodeEmailTaken, "Email already registered")
+	}
+	return tokenError(err, action)
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"log/slog"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"liven-one-go/apperror"
+	"liven-one-go/metrics"
+	"liven-one-go/ratelimit"
+	"liven-one-go/utils"
+)
+
+// RateLimitStore holds the buckets of every RateLimit middleware. serve
+// replaces it with a SQLite store when RATE_LIMIT_STORE is sqlite.
+var RateLimitStore ratelimit.Store = ratelimit.NewMemoryStore()
+
+// RateKey picks the client a request is counted against.
+type RateKey func(c *gin.Context) string
+
+// ByIP counts requests per client IP.
+func ByIP(c *gin.Context) string {
+	return "ip:" + c.ClientIP()
+}
+
+// ByUser counts requests per authenticated account, or per API key, falling
+// back to the client IP. It must run after AuthMiddleware.
+func ByUser(c *gin.Context) string {
+	value, _ := c.Get(UserClaimsHandlerKey)
+	if claims, ok := value.(*utils.Claims); ok && claims.APIKeyID != 0 {
+		return "api_key:" + strconv.FormatUint(uint64(claims.APIKeyID), 10)
+	}
+	if claims, ok := value.(*utils.Claims); ok {
+		return "user:" + strconv.FormatUint(uint64(claims.UserID), 10)
+	}
+	return ByIP(c)
+}
+
+// RateLimit refuses requests beyond limit with 429 RATE_LIMITED and a
+// Retry-After header. Requests are counted per route and per key, so a client
+// exhausting one route can still use the others.
+func RateLimit(limit ratelimit.Limit, key RateKey) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !limit.Enabled() {
+			return
+		}
+
+		allowed, retryAfter, err := RateLimitStore.Take(c.Request.Context(), c.FullPath()+" "+key(c), limit)
+		if err != nil {
+			// Failing open keeps the API available when the store isn't.
+			slog.ErrorContext(c.Request.Context(), "Rate limit check failed", "error", err)
+			return
+		}
+		if !allowed {
+			metrics.RateLimited.WithLabelValues(c.FullPath()).Inc()
+			setRetryAfter(c, retryAfter)
+			abort(c, apperror.New(apperror.CodeRateLimited, "Too many requests. Retry later."))
+		}
+	}
+}
+
+// setRetryAfter tells the client how many whole seconds to wait.
+func setRetryAfter(c *gin.Context, d time.Duration) {
+	seconds := int(math.Ceil(d.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(seconds))
+}
@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	apiv1 "liven-one-go/api/v1"
+	"liven-one-go/apperror"
+	"liven-one-go/audit"
+	"liven-one-go/logging"
+	"liven-one-go/models"
+	"liven-one-go/services"
+	"liven-one-go/utils"
+)
+
+// DeviceNameHeader names the device a client logs in from, such as "Jane's
+// iPhone", to tell its session apart from the others.
+const DeviceNameHeader = "X-Device-Name"
+
+// How long and how many sessions AuthMiddleware keeps in memory. Sessions
+// ended through EndSessionHandler are forgotten at once.
+const (
+	sessionCacheTTL  = 30 * time.Second
+	sessionCacheSize = 10_000
+)
+
+// Longest device details kept with a session.
+const (
+	maxDeviceNameLength = 100
+	maxUserAgentLength  = 500
+)
+
+// Sessions caches the sessions AuthMiddleware checks tokens against.
+var Sessions = services.NewSessionCache(sessionCacheTTL, sessionCacheSize)
+
+// loginToken starts a session for the user on the requesting device and
+// issues its access token. mfa marks logins that passed a second factor.
+// On failure it aborts the request and returns false.
+func loginToken(c *gin.Context, user *models.User, mfa bool) (string, bool) {
+	session, err := services.StartSession(DB.WithContext(c.Request.Context()), user.ID, services.SessionDetails{
+		DeviceName: truncate(c.GetHeader(DeviceNameHeader), maxDeviceNameLength),
+		UserAgent:  truncate(c.Request.UserAgent(), maxUserAgentLength),
+		IP:         c.ClientIP(),
+	}, time.Now())
+	if err != nil {
+		abort(c, apperror.Internalf("start session: %w", err))
+		return "", false
+	}
+	addLogAttrs(c, slog.Uint64(logging.KeySessionID, uint64(session.ID)))
+
+	generate := utils.GenerateToken
+	if mfa {
+		generate = utils.GenerateMFAToken
+	}
+	token, err := generate(user.ID, user.UserType, session.ID)
+	if err != nil {
+		abort(c, apperror.Internalf("generate token: %w", err))
+		return "", false
+	}
+	return token, true
+}
+
+// replacementToken issues an access token to replace the one the request
+// was made with, in the same session. Legacy tokens have no session to
+// keep, so their replacement starts one. On failure it aborts the request
+// and returns false.
+func replacementToken(c *gin.Context, user *models.User, claims *utils.Claims, mfa bool) (string, bool) {
+	if claims.SessionID == 0 {
+		return loginToken(c, user, mfa)
+	}
+	if err := services.ExtendSession(DB.WithContext(c.Request.Context()), claims.SessionID, time.Now()); err != nil {
+		abort(c, apperror.Internalf("extend session: %w", err))
+		return "", false
+	}
+	generate := utils.GenerateToken
+	if mfa {
+		generate = utils.GenerateMFAToken
+	}
+	token, err := generate(user.ID, user.UserType, claims.SessionID)
+	if err != nil {
+		abort(c, apperror.Internalf("generate token: %w", err))
+		return "", false
+	}
+	return token, true
+}
+
+// checkSession refuses access tokens whose session was signed out, and
+// records that the session is in use. Legacy tokens, issued before sessions
+// existed, have none and work until they expire. On failure it aborts the
+// request and returns false.
+func checkSession(c *gin.Context, claims *utils.Claims) bool {
+	signedOut := apperror.New(apperror.CodeUnauthenticated, "The session was signed out. Log in again.")
+	if claims.SessionID == 0 {
+		if claims.Legacy {
+			return true
+		}
+		abort(c, signedOut)
+		return false
+	}
+	addLogAttrs(c, slog.Uint64(logging.KeySessionID, uint64(claims.SessionID)))
+
+	now := time.Now()
+	session, err := services.ActiveSession(ReadDB.WithContext(c.Request.Context()), Sessions, claims.SessionID, now)
+	if err == nil && session.UserID != claims.UserID {
+		err = services.ErrSessionNotFound
+	}
+	if err == nil {
+		err = services.TouchSession(DB.WithContext(c.Request.Context()), Sessions, session, now)
+	}
+	switch {
+	case errors.Is(err, services.ErrSessionNotFound):
+		abort(c, signedOut)
+		return false
+	case err != nil:
+		abort(c, apperror.Internalf("check session: %w", err))
+		return false
+	}
+	return true
+}
+
+// ListSessionsHandler lists the devices the authenticated account is logged
+// in on. The one the request was made from is marked current.
+func ListSessionsHandler(c *gin.Context) {
+	user, ok := currentUser(c)
+	if !ok {
+		return
+	}
+	claims, _ := requestClaims(c)
+
+	sessions, err := services.Sessions(ReadDB.WithContext(c.Request.Context()), user.ID, time.Now())
+	if err != nil {
+		abort(c, apperror.Internalf("get sessions: %w", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sessions": apiv1.NewSessions(sessions, claims.SessionID)})
+}
+
+// EndSessionHandler signs the authenticated account out of one of its
+// sessions, such as on a lost phone. Its tokens stop working at once.
+// Ending the current session logs out.
+func EndSessionHandler(c *gin.Context) {
+	user, ok := currentUser(c)
+	if !ok {
+		return
+	}
+	notFound := apperror.New(apperror.CodeSessionNotFound, "Session not found")
+	sessionID, err := strconv.ParseUint(c.Param("session_id"), 10, 0)
+	if err != nil {
+		abort(c, notFound)
+		return
+	}
+
+	err = audited(c, func(tx *gorm.DB) (audit.Entry, error) {
+		entry := auditEntry(c, audit.UserSessionEnd, audit.EntityUser, user.ID, 0)
+		entry.After = gin.H{"session_id": sessionID}
+		return entry, services.EndSession(tx, user.ID, uint(sessionID))
+	})
+	if errors.Is(err, services.ErrSessionNotFound) {
+		abort(c, notFound)
+		return
+	}
+	if err != nil {
+		abort(c, apperror.Internalf("end session: %w", err))
+		return
+	}
+	Sessions.Forget(uint(sessionID))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Signed out"})
+}
+
+// truncate shortens s to at most n characters.
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
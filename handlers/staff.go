@@ -0,0 +1,310 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	apiv1 "liven-one-go/api/v1"
+	"liven-one-go/apperror"
+	"liven-one-go/audit"
+	"liven-one-go/models"
+	"liven-one-go/services"
+)
+
+// StaffVenueRequest grants a staff account permissions at one venue.
+type StaffVenueRequest struct {
+	VenueID     uint                     `json:"venue_id" binding:"required"`
+	Permissions []models.StaffPermission `json:"permissions" binding:"required,min=1"`
+}
+
+type InviteStaffRequest struct {
+	Email  string              `json:"email" binding:"required,email"`
+	Venues []StaffVenueRequest `json:"venues" binding:"required,min=1,dive"`
+}
+
+// UpdateStaffRequest replaces every venue assignment of a staff account.
+type UpdateStaffRequest struct {
+	Venues []StaffVenueRequest `json:"venues" binding:"required,dive"`
+}
+
+type AcceptStaffInviteRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required,min=8,max=20"`
+}
+
+// InviteStaffHandler creates a staff account for the authenticated merchant
+// and mails it an invitation link.
+func InviteStaffHandler(emails AccountEmails) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req InviteStaffRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			abort(c, apperror.Binding(err))
+			return
+		}
+
+		if _, ok := accountClaims(c, models.UserTypeMerchant); !ok {
+			return
+		}
+		merchant, ok := currentUser(c)
+		if !ok {
+			return
+		}
+		if !requireVerifiedEmail(c, merchant.ID) {
+			return
+		}
+
+		var staff *models.User
+		var token string
+		err := audited(c, func(tx *gorm.DB) (entry audit.Entry, err error) {
+			staff, token, err = services.InviteStaff(tx, merchant.ID, req.Email, venueAccess(req.Venues), emails.StaffInviteTTL, time.Now())
+			if err != nil {
+				return entry, err
+			}
+			entry = auditEntry(c, audit.StaffInvite, audit.EntityUser, staff.ID, 0)
+			entry.MerchantID = merchant.ID
+			entry.After, err = staffAudit(tx, staff)
+			return entry, err
+		})
+		if err != nil {
+			abort(c, staffError(err))
+			return
+		}
+		if err := emails.sendStaffInvite(c, staff, token, merchant.Email); err != nil {
+			slog.ErrorContext(c.Request.Context(), "Failed to send staff invitation", "error", err)
+		}
+
+		showStaffMember(c, http.StatusCreated, staff)
+	}
+}
+
+// ListStaffHandler lists the staff accounts of the authenticated merchant.
+func ListStaffHandler(c *gin.Context) {
+	userClaims, ok := accountClaims(c, models.UserTypeMerchant)
+	if !ok {
+		return
+	}
+
+	db := ReadDB.WithContext(c.Request.Context())
+	var staff []models.User
+	if err := db.Where("user_type = ? AND merchant_id = ?", models.UserTypeStaff, userClaims.UserID).Order("id").Find(&staff).Error; err != nil {
+		abort(c, apperror.Internalf("list staff: %w", err))
+		return
+	}
+	ids := make([]uint, len(staff))
+	for i := range staff {
+		ids[i] = staff[i].ID
+	}
+	assignments, err := services.StaffAssignments(db, ids...)
+	if err != nil {
+		abort(c, apperror.Internalf("get staff assignments: %w", err))
+		return
+	}
+
+	members := make([]apiv1.StaffMember, len(staff))
+	for i := range staff {
+		members[i] = apiv1.NewStaffMember(&staff[i], assignments[staff[i].ID])
+	}
+	c.JSON(http.StatusOK, gin.H{"staff": members})
+}
+
+// GetStaffHandler shows a staff account of the authenticated merchant.
+func GetStaffHandler(c *gin.Context) {
+	staff, ok := merchantStaff(c)
+	if !ok {
+		return
+	}
+	showStaffMember(c, http.StatusOK, staff)
+}
+
+// UpdateStaffHandler replaces the venues a staff account works at and what
+// it may do there. Changes apply to tokens the account already holds.
+func UpdateStaffHandler(c *gin.Context) {
+	var req UpdateStaffRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abort(c, apperror.Binding(err))
+		return
+	}
+
+	staff, ok := merchantStaff(c)
+	if !ok {
+		return
+	}
+	err := audited(c, func(tx *gorm.DB) (entry audit.Entry, err error) {
+		entry = auditEntry(c, audit.StaffUpdate, audit.EntityUser, staff.ID, 0)
+		entry.MerchantID = *staff.MerchantID
+		if entry.Before, err = staffAudit(tx, staff); err != nil {
+			return entry, err
+		}
+		if err := services.SetStaffVenues(tx, *staff.MerchantID, staff.ID, venueAccess(req.Venues)); err != nil {
+			return entry, err
+		}
+		entry.After, err = staffAudit(tx, staff)
+		return entry, err
+	})
+	if err != nil {
+		abort(c, staffError(err))
+		return
+	}
+
+	showStaffMember(c, http.StatusOK, staff)
+}
+
+// RemoveStaffHandler revokes a staff account. Its tokens stop working at
+// once, as the account no longer exists.
+func RemoveStaffHandler(c *gin.Context) {
+	staff, ok := merchantStaff(c)
+	if !ok {
+		return
+	}
+	err := audited(c, func(tx *gorm.DB) (entry audit.Entry, err error) {
+		entry = auditEntry(c, audit.StaffRemove, audit.EntityUser, staff.ID, 0)
+		entry.MerchantID = *staff.MerchantID
+		if entry.Before, err = staffAudit(tx, staff); err != nil {
+			return entry, err
+		}
+		return entry, services.RemoveStaff(tx, *staff.MerchantID, staff.ID, time.Now())
+	})
+	if err != nil {
+		abort(c, staffError(err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Staff member removed"})
+}
+
+// AcceptStaffInviteHandler sets the password of a staff account with the
+// token from its invitation email.
+func AcceptStaffInviteHandler(c *gin.Context) {
+	var req AcceptStaffInviteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abort(c, apperror.Binding(err))
+		return
+	}
+
+	var hashed models.User
+	if err := hashed.HashPassword(req.Password); err != nil {
+		abort(c, apperror.Internalf("hash password: %w", err))
+		return
+	}
+	var user *models.User
+	err := audited(c, func(tx *gorm.DB) (entry audit.Entry, err error) {
+		if user, err = services.AcceptStaffInvite(tx, req.Token, hashed.Password, time.Now()); err != nil {
+			return entry, err
+		}
+		entry = auditEntry(c, audit.StaffAccept, audit.EntityUser, user.ID, 0)
+		entry.ActorID, entry.ActorType, entry.MerchantID = user.ID, user.UserType, *user.MerchantID
+		return entry, nil
+	})
+	if err != nil {
+		abort(c, tokenError(err, "accept staff invitation"))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Invitation accepted", "user": apiv1.NewUser(user)})
+}
+
+// StaffAccountHandler shows the authenticated staff account and the venues it
+// works at.
+func StaffAccountHandler(c *gin.Context) {
+	if _, ok := accountClaims(c, models.UserTypeStaff); !ok {
+		return
+	}
+	user, ok := currentUser(c)
+	if !ok {
+		return
+	}
+	assignments, err := services.StaffAssignments(ReadDB.WithContext(c.Request.Context()), user.ID)
+	if err != nil {
+		abort(c, apperror.Internalf("get staff assignments: %w", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, apiv1.NewStaffAccount(user, assignments[user.ID]))
+}
+
+// merchantStaff loads the staff account named by the staff_id parameter,
+// which must belong to the authenticated merchant. On failure it aborts the
+// request and returns false.
+func merchantStaff(c *gin.Context) (*models.User, bool) {
+	userClaims, ok := accountClaims(c, models.UserTypeMerchant)
+	if !ok {
+		return nil, false
+	}
+	staffID, err := strconv.ParseUint(c.Param("staff_id"), 10, 0)
+	if err != nil {
+		abort(c, apperror.New(apperror.CodeStaffNotFound, "Staff member not found"))
+		return nil, false
+	}
+
+	staff, err := services.FindStaff(ReadDB.WithContext(c.Request.Context()), userClaims.UserID, uint(staffID))
+	if err != nil {
+		abort(c, staffError(err))
+		return nil, false
+	}
+	return staff, true
+}
+
+// showStaffMember responds with a staff account and its current assignments.
+func showStaffMember(c *gin.Context, status int, staff *models.User) {
+	member, err := staffMember(DB.WithContext(c.Request.Context()), staff)
+	if err != nil {
+		abort(c, apperror.Internalf("get staff assignments: %w", err))
+		return
+	}
+	c.JSON(status, gin.H{"staff": member})
+}
+
+// staffMember loads the assignments of a staff account into its response.
+func staffMember(db *gorm.DB, staff *models.User) (apiv1.StaffMember, error) {
+	assignments, err := services.StaffAssignments(db, staff.ID)
+	if err != nil {
+		return apiv1.StaffMember{}, err
+	}
+	return apiv1.NewStaffMember(staff, assignments[staff.ID]), nil
+}
+
+// staffAudit is what the audit log keeps of a staff account: the venues it
+// works at and what it may do there. The address is left out, as the log
+// outlives the account when it is anonymized.
+func staffAudit(db *gorm.DB, staff *models.User) (gin.H, error) {
+	assignments, err := services.StaffAssignments(db, staff.ID)
+	if err != nil {
+		return nil, err
+	}
+	venues := make([]gin.H, len(assignments[staff.ID]))
+	for i, assignment := range assignments[staff.ID] {
+		venues[i] = gin.H{"venue_id": assignment.VenueID, "permissions": assignment.Permissions()}
+	}
+	return gin.H{"pending": staff.Password == "", "venues": venues}, nil
+}
+
+func venueAccess(venues []StaffVenueRequest) []services.VenueAccess {
+	access := make([]services.VenueAccess, len(venues))
+	for i, venue := range venues {
+		access[i] = services.VenueAccess{VenueID: venue.VenueID, Permissions: venue.Permissions}
+	}
+	return access
+}
+
+// staffError maps the errors of managing staff accounts.
+func staffError(err error) error {
+	switch {
+	case errors.Is(err, services.ErrStaffNotFound):
+		return apperror.New(apperror.CodeStaffNotFound, "Staff member not found")
+	case errors.Is(err, services.ErrEmailTaken):
+		return apperror.New(apperror.CodeEmailTaken, "Email already registered")
+	case errors.Is(err, services.ErrVenueNotFound):
+		return apperror.New(apperror.CodeVenueNotFound, "Venue not found")
+	case errors.Is(err, services.ErrNotVenueOwner):
+		return apperror.New(apperror.CodeNotVenueOwner, "You don't own this venue")
+	case errors.Is(err, services.ErrUnknownPermission):
+		return apperror.New(apperror.CodeValidationFailed, fmt.Sprintf("%v. Permissions are %v", err, models.StaffPermissions))
+	}
+	return apperror.Internalf("manage staff: %w", err)
+}
@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"liven-one-go/apperror"
+	"liven-one-go/audit"
+	"liven-one-go/metrics"
+	"liven-one-go/services"
+	"liven-one-go/utils"
+)
+
+// twoFactorChallengeTTL is how long a user has to enter their code after
+// their password was accepted.
+const twoFactorChallengeTTL = 5 * time.Minute
+
+type TwoFactorLoginRequest struct {
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+	// Code is the current code of the authenticator app or a recovery code.
+	Code string `json:"code" binding:"required"`
+}
+
+type EnableTwoFactorRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type DisableTwoFactorRequest struct {
+	Password string `json:"password" binding:"required"`
+	Code     string `json:"code" binding:"required"`
+}
+
+// TwoFactorLoginHandler completes a login that needs a second factor: it
+// exchanges the challenge token from LoginHandler and a code for an access
+// token. Wrong codes count towards lockout like wrong passwords.
+func TwoFactorLoginHandler(lockout services.LockoutPolicy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req TwoFactorLoginRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			abort(c, apperror.Binding(err))
+			return
+		}
+
+		expired := apperror.New(apperror.CodeInvalidToken, "The login challenge is invalid or expired. Log in again.")
+		claims, err := utils.ValidateChallengeToken(req.ChallengeToken)
+		if err != nil {
+			abort(c, expired)
+			return
+		}
+		c.Set(UserClaimsHandlerKey, claims)
+		user, ok := currentUser(c)
+		if !ok {
+			return
+		}
+		if refuseLocked(c, user) || refuseSuspended(c, user) {
+			return
+		}
+
+		err = services.VerifySecondFactor(DB.WithContext(c.Request.Context()), user, req.Code, time.Now())
+		switch {
+		case errors.Is(err, services.ErrInvalidCode):
+			failLogin(c, user.ID, lockout, metrics.LoginWrongCode, apperror.New(apperror.CodeInvalidCredentials, "Invalid two-factor code"))
+			return
+		case errors.Is(err, services.ErrTwoFactorNotEnabled):
+			// Two-factor authentication was turned off since the password step.
+			abort(c, expired)
+			return
+		case err != nil:
+			abort(c, apperror.Internalf("verify second factor: %w", err))
+			return
+		}
+
+		if err := services.ResetFailedLogins(DB.WithContext(c.Request.Context()), user); err != nil {
+			abort(c, apperror.Internalf("reset failed logins: %w", err))
+			return
+		}
+		if !restoreAccount(c, user) {
+			return
+		}
+		token, ok := loginToken(c, user, true)
+		if !ok {
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"token": token})
+	}
+}
+
+// TwoFactorSetupHandler starts enrolling the authenticated user: it returns
+// a new secret and its otpauth:// URI for the authenticator app. Enrolling
+// again before enabling replaces the secret.
+func TwoFactorSetupHandler(policy services.TwoFactorPolicy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentUser(c)
+		if !ok {
+			return
+		}
+
+		secret, uri, err := services.BeginTwoFactor(DB.WithContext(c.Request.Context()), user, policy.Issuer)
+		if err != nil {
+			abort(c, twoFactorError(err, "begin two-factor setup"))
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"secret": secret, "provisioning_uri": uri})
+	}
+}
+
+// EnableTwoFactorHandler finishes enrolling with a code from the
+// authenticator app. It returns the recovery codes and an access token that
+// counts as two-factor authenticated, so merchants required to use 2FA
+// needn't log in again.
+func EnableTwoFactorHandler(c *gin.Context) {
+	var req EnableTwoFactorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abort(c, apperror.Binding(err))
+		return
+	}
+	user, ok := currentUser(c)
+	if !ok {
+		return
+	}
+
+	var codes []string
+	err := audited(c, func(tx *gorm.DB) (audit.Entry, error) {
+		var err error
+		codes, err = services.EnableTwoFactor(tx, user, req.Code, time.Now())
+		return auditEntry(c, audit.UserTwoFactorEnable, audit.EntityUser, user.ID, 0), err
+	})
+	if err != nil {
+		abort(c, twoFactorError(err, "enable two-factor authentication"))
+		return
+	}
+	claims, _ := requestClaims(c)
+	token, ok := replacementToken(c, user, claims, true)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes, "token": token})
+}
+
+// DisableTwoFactorHandler turns off two-factor authentication. A stolen
+// token isn't enough: the user must present their password and a current or
+// recovery code again.
+func DisableTwoFactorHandler(policy services.TwoFactorPolicy, lockout services.LockoutPolicy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req DisableTwoFactorRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			abort(c, apperror.Binding(err))
+			return
+		}
+		user, ok := currentUser(c)
+		if !ok {
+			return
+		}
+		if policy.Required(user.UserType) {
+			abort(c, apperror.New(apperror.CodeTwoFactorRequired, "Two-factor authentication can't be turned off for "+user.UserType+" accounts"))
+			return
+		}
+		if !user.TwoFactorEnabled() {
+			abort(c, apperror.New(apperror.CodeTwoFactorDisabled, "Two-factor authentication is not enabled"))
+			return
+		}
+		if refuseLocked(c, user) {
+			return
+		}
+
+		invalidCredentials := apperror.New(apperror.CodeInvalidCredentials, "Invalid password or two-factor code")
+		if err := user.CheckPassword(req.Password); err != nil {
+			failLogin(c, user.ID, lockout, metrics.LoginWrongPassword, invalidCredentials)
+			return
+		}
+		err := services.VerifySecondFactor(DB.WithContext(c.Request.Context()), user, req.Code, time.Now())
+		if errors.Is(err, services.ErrInvalidCode) {
+			failLogin(c, user.ID, lockout, metrics.LoginWrongCode, invalidCredentials)
+			return
+		}
+		if err != nil {
+			abort(c, apperror.Internalf("verify second factor: %w", err))
+			return
+		}
+
+		err = audited(c, func(tx *gorm.DB) (audit.Entry, error) {
+			return auditEntry(c, audit.UserTwoFactorDisable, audit.EntityUser, user.ID, 0),
+				services.DisableTwoFactor(tx, user)
+		})
+		if err != nil {
+			abort(c, apperror.Internalf("disable two-factor authentication: %w", err))
+			return
+		}
+		if err := services.ResetFailedLogins(DB.WithContext(c.Request.Context()), user); err != nil {
+			abort(c, apperror.Internalf("reset failed logins: %w", err))
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+	}
+}
+
+// RequireTwoFactor refuses tokens of accounts that policy requires to use
+// two-factor authentication unless the login passed a second factor. It
+// must run after AuthMiddleware.
+func RequireTwoFactor(policy services.TwoFactorPolicy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		value, _ := c.Get(UserClaimsHandlerKey)
+		claims, _ := value.(*utils.Claims)
+		if claims != nil && policy.Required(claims.UserType) && !claims.MFA {
+			abort(c, apperror.New(apperror.CodeTwoFactorRequired,
+				"Enable two-factor authentication with /v1/auth/2fa/setup and /v1/auth/2fa/enable, or log in with your code"))
+			return
+		}
+		c.Next()
+	}
+}
+
+// twoFactorError maps the errors of enrolling.
+func twoFactorError(err error, action string) error {
+	switch {
+	case errors.Is(err, services.ErrTwoFactorEnabled):
+		return apperror.New(apperror.CodeTwoFactorEnabled, "Two-factor authentication is already enabled")
+	case errors.Is(err, services.ErrTwoFactorNotStarted):
+		return apperror.New(apperror.CodeTwoFactorDisabled, "Start with /v1/auth/2fa/setup")
+	case errors.Is(err, services.ErrInvalidCode):
+		return apperror.New(apperror.CodeInvalidTwoFactor, "The code doesn't match the authenticator app")
+	default:
+		return apperror.Internalf("%s: %w", action, err)
+	}
+}
@@ -1,12 +1,15 @@
 package handlers
 
 import (
+	"errors"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
+	apiv1 "liven-one-go/api/v1"
+	"liven-one-go/apperror"
+	"liven-one-go/audit"
 	"liven-one-go/models"
-	"liven-one-go/utils"
-	"log"
 	"net/http"
+	"strconv"
 )
 
 // CreateVenueRequest defines the request body (JSON) for creating a new venue
@@ -26,28 +29,17 @@ type UpdateVenueRequest struct {
 }
 
 func CreateVenueHandler(c *gin.Context) {
-	// DB is already a global value inside this module. Extract?
-	if DB == nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database connection not initialized"})
-		return
-	}
-
 	var request CreateVenueRequest
 	if err := c.ShouldBindJSON(&request); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		abort(c, apperror.Binding(err))
 		return
 	}
 
-	// Get authenticated user details from context
-	userClaimsInterface, _ := c.Get(UserClaimsHandlerKey)
-	if userClaimsInterface == nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "User authentication details not found"})
+	userClaims, ok := accountClaims(c, models.UserTypeMerchant)
+	if !ok {
 		return
 	}
-
-	userClaims := userClaimsInterface.(*utils.Claims)
-	if userClaims.UserType != models.UserTypeMerchant {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only a Merchant can add a venue"})
+	if !requireVerifiedEmail(c, userClaims.UserID) {
 		return
 	}
 
@@ -59,168 +51,136 @@ func CreateVenueHandler(c *gin.Context) {
 		MerchantID:  userClaims.UserID,
 	}
 
-	if err := DB.Create(&venue).Error; err != nil {
-		log.Printf("Failed to create venue %v: %v", venue, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create venue: " + err.Error()})
+	err := audited(c, func(tx *gorm.DB) (audit.Entry, error) {
+		if err := tx.Create(&venue).Error; err != nil {
+			return audit.Entry{}, err
+		}
+		entry := auditEntry(c, audit.VenueCreate, audit.EntityVenue, venue.ID, venue.ID)
+		entry.After = apiv1.NewMerchantVenue(&venue)
+		return entry, nil
+	})
+	if err != nil {
+		abort(c, apperror.Internalf("create venue: %w", err))
 		return
 	}
 
-	c.JSON(http.StatusCreated, gin.H{"venue": venue})
+	c.JSON(http.StatusCreated, gin.H{"venue": apiv1.NewMerchantVenue(&venue)})
 }
 
+// GetSingleMerchantVenuesHandler lists the venues of the merchant, the
+// venues a staff account works at, or those an API key covers.
 func GetSingleMerchantVenuesHandler(c *gin.Context) {
-	if DB == nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database connection not initialized"})
-		return
-	}
-
-	userClaimsInterface, _ := c.Get(UserClaimsHandlerKey)
-	if userClaimsInterface == nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "User authentication details not found"})
+	userClaims, ok := requestClaims(c)
+	if !ok {
 		return
 	}
 
-	userClaims := userClaimsInterface.(*utils.Claims)
-	if userClaims.UserType != models.UserTypeMerchant {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Access forbidden. Only a Merchant can get venues."})
-		return
+	query := ReadDB.WithContext(c.Request.Context())
+	switch userClaims.UserType {
+	case models.UserTypeStaff:
+		query = query.Joins("JOIN staff_assignments ON staff_assignments.venue_id = venues.id AND staff_assignments.user_id = ?", userClaims.UserID)
+	case models.UserTypeAPIKey:
+		key, ok := requestAPIKey(c)
+		if !ok {
+			return
+		}
+		query = query.Where("merchant_id = ?", key.MerchantID)
+		if key.VenueID != nil {
+			query = query.Where("id = ?", *key.VenueID)
+		}
+	default:
+		if _, ok := accountClaims(c, models.UserTypeMerchant); !ok {
+			return
+		}
+		query = query.Where("merchant_id = ?", userClaims.UserID)
 	}
 
 	var venues []models.Venue
-	if err := DB.Where("merchant_id = ?", userClaims.UserID).Find(&venues).Error; err != nil {
-		log.Printf("Failed to get venues for user %v: %v", userClaims.UserID, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get venues: " + err.Error()})
+	if err := query.Find(&venues).Error; err != nil {
+		abort(c, apperror.Internalf("get merchant venues: %w", err))
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"venues": venues})
+	c.JSON(http.StatusOK, gin.H{"venues": apiv1.NewMerchantVenues(venues)})
 }
 
 func GetVenueHandler(c *gin.Context) {
-
-	if DB == nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database connection not initialized"})
-		return
-	}
-
-	venueId := c.Param("venue_id")
-
-	userClaimsInterface, _ := c.Get(UserClaimsHandlerKey)
-	if userClaimsInterface == nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "User authentication details not found"})
+	venueID, err := strconv.ParseUint(c.Param("venue_id"), 10, 0)
+	if err != nil {
+		abort(c, apperror.New(apperror.CodeVenueNotFound, "Venue not found"))
 		return
 	}
 
 	var venue models.Venue
-	if err := DB.Where("id = ?", venueId).First(&venue).Error; err != nil {
-
-		if err == gorm.ErrRecordNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Venue not found"})
-			return
-		}
-
-		log.Printf("Failed to get venue %v: %v", venueId, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get venue: " + err.Error()})
+	if err := ReadDB.WithContext(c.Request.Context()).Scopes(listedVenues).Where("id = ?", venueID).First(&venue).Error; err != nil {
+		abort(c, venueLookupError(err))
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"venue": venue})
+	c.JSON(http.StatusOK, gin.H{"venue": apiv1.NewPublicVenue(&venue)})
 
 }
 
-func UpdateVenueHandler(c *gin.Context) {
-	if DB == nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database connection not initialized"})
+// GetMerchantVenueHandler shows a venue to its owner and its staff.
+func GetMerchantVenueHandler(c *gin.Context) {
+	venue, owned := CheckVenueOwnership(c, c.Param("venue_id"), models.StaffPermissions...)
+	if !owned {
 		return
 	}
 
-	venueId := c.Param("venue_id")
+	c.JSON(http.StatusOK, gin.H{"venue": apiv1.NewMerchantVenue(venue)})
+}
 
+func UpdateVenueHandler(c *gin.Context) {
 	var request UpdateVenueRequest
 	if err := c.ShouldBindJSON(&request); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "JSON error: " + err.Error()})
+		abort(c, apperror.Binding(err))
 		return
 	}
 
-	userClaimsInterface, _ := c.Get(UserClaimsHandlerKey)
-	if userClaimsInterface == nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "User authentication details not found"})
-		return
-	}
-
-	userClaims := userClaimsInterface.(*utils.Claims)
-	if userClaims.UserType != models.UserTypeMerchant {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only merchant can update venues."})
-		return
-	}
-
-	var venue models.Venue
-	if err := DB.First(&venue, venueId).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Venue not found"})
-			return
-		}
-		log.Printf("Failed to get venue %v: %v", venueId, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get venue: " + err.Error()})
-		return
-	}
-	if venue.MerchantID != userClaims.UserID {
-		c.JSON(http.StatusForbidden, gin.H{"error": "You don't own this venue"})
+	venue, owned := CheckVenueOwnership(c, c.Param("venue_id"))
+	if !owned {
 		return
 	}
 
 	updateData := models.Venue{
 		Name:        request.Name,
 		Address:     request.Address,
+		LatLong:     request.LatLong,
 		Description: request.Description,
 		CuisineType: request.CuisineType,
 	}
 
-	if err := DB.Model(&venue).Updates(updateData).Error; err != nil {
-		log.Printf("Failed to update venue %v: %v", venueId, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update venue: " + err.Error()})
+	err := audited(c, func(tx *gorm.DB) (audit.Entry, error) {
+		entry := auditEntry(c, audit.VenueUpdate, audit.EntityVenue, venue.ID, venue.ID)
+		entry.Before = apiv1.NewMerchantVenue(venue)
+		if err := tx.Model(venue).Updates(updateData).Error; err != nil {
+			return entry, err
+		}
+		entry.After = apiv1.NewMerchantVenue(venue)
+		return entry, nil
+	})
+	if err != nil {
+		abort(c, apperror.Internalf("update venue: %w", err))
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"venue": venue})
+	c.JSON(http.StatusOK, gin.H{"venue": apiv1.NewMerchantVenue(venue)})
 }
 
 func DeleteVenueHandler(c *gin.Context) {
-	if DB == nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database connection not initialized"})
-		return
-	}
-
-	venueId := c.Param("venue_id")
-	userClaimsInterface, _ := c.Get(UserClaimsHandlerKey)
-	if userClaimsInterface == nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "User authentication details not found"})
-		return
-	}
-
-	userClaims := userClaimsInterface.(*utils.Claims)
-	if userClaims.UserType != models.UserTypeMerchant {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only merchant can delete venues."})
-		return
-	}
-
-	var venue models.Venue
-	if err := DB.Where("id = ?", venueId).First(&venue).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Venue not found"})
-			return
-		}
-		log.Printf("Failed to get venue %v: %v", venueId, err)
-	}
-
-	if venue.MerchantID != userClaims.UserID {
-		c.JSON(http.StatusForbidden, gin.H{"error": "You don't own this venue"})
+	venue, owned := CheckVenueOwnership(c, c.Param("venue_id"))
+	if !owned {
 		return
 	}
 
-	if err := DB.Delete(&venue).Error; err != nil {
-		log.Printf("Failed to delete venue %v: %v", venueId, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete venue: " + err.Error()})
+	err := audited(c, func(tx *gorm.DB) (audit.Entry, error) {
+		entry := auditEntry(c, audit.VenueDelete, audit.EntityVenue, venue.ID, venue.ID)
+		entry.Before = apiv1.NewMerchantVenue(venue)
+		return entry, tx.Delete(venue).Error
+	})
+	if err != nil {
+		abort(c, apperror.Internalf("delete venue: %w", err))
 		return
 	}
 
@@ -228,13 +188,8 @@ func DeleteVenueHandler(c *gin.Context) {
 }
 
 func ListVenuesHandler(c *gin.Context) {
-	if DB == nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database connection not initialized"})
-		return
-	}
-
 	var venues []models.Venue
-	query := DB.Model(&models.Venue{})
+	query := ReadDB.WithContext(c.Request.Context()).Model(&models.Venue{}).Scopes(listedVenues)
 
 	// Simple search by name, case-insensitive partial match
 	if nameQuery := c.Query("name"); nameQuery != "" {
@@ -242,18 +197,26 @@ func ListVenuesHandler(c *gin.Context) {
 	}
 
 	if cuisineQuery := c.Query("cuisine"); cuisineQuery != "" {
-		query = query.Where("LOWER(cuisine) LIKE LOWER(?)", "%"+cuisineQuery+"%")
+		query = query.Where("LOWER(cuisine_type) LIKE LOWER(?)", "%"+cuisineQuery+"%")
 	}
 
 	if err := query.Find(&venues).Error; err != nil {
-		log.Printf("Failed to list venues: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list venues: " + err.Error()})
+		abort(c, apperror.Internalf("list venues: %w", err))
 		return
 	}
 
-	if venues == nil {
-		venues = []models.Venue{}
-	}
+	c.JSON(http.StatusOK, gin.H{"venues": apiv1.NewPublicVenues(venues)})
+}
 
-	c.JSON(http.StatusOK, gin.H{"venues": venues})
+// listedVenues hides the venues of suspended merchants from diners.
+func listedVenues(db *gorm.DB) *gorm.DB {
+	return db.Where("venues.merchant_id NOT IN (SELECT id FROM users WHERE suspended_at IS NOT NULL)")
+}
+
+// venueLookupError maps the error of loading a venue by ID.
+func venueLookupError(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return apperror.New(apperror.CodeVenueNotFound, "Venue not found")
+	}
+	return apperror.Internalf("get venue: %w", err)
 }
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"liven-one-go/audit"
+	"liven-one-go/config"
+	"liven-one-go/database"
+	"liven-one-go/handlers"
+	"liven-one-go/mail"
+	"liven-one-go/metrics"
+	"liven-one-go/models"
+	"liven-one-go/ratelimit"
+	"liven-one-go/services"
+	"liven-one-go/sms"
+	"liven-one-go/tracing"
+	"liven-one-go/utils"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const (
+	testJWTSecret    = "test-secret"
+	testMetricsToken = "test-metrics-token"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	slog.SetDefault(slog.New(slog.DiscardHandler))
+	os.Exit(m.Run())
+}
+
+// testServer is the full router from setupRouter backed by a fresh in-memory database.
+type testServer struct {
+	t      *testing.T
+	cfg    *config.Config
+	router *gin.Engine
+	conns  *database.Connections
+	mailer *testMailer
+	sms    *testSMS
+}
+
+// newTestServer boots the API against an empty in-memory SQLite database.
+// configure adjusts the configuration before the router is built. The
+// handlers read the database from package globals, so tests using it must
+// not run in parallel.
+func newTestServer(t *testing.T, configure ...func(*config.Config)) *testServer {
+	t.Helper()
+
+	cfg := &config.Config{
+		Env:         "test",
+		DatabaseURI: ":memory:",
+		Database: database.Options{
+			Tuned:   true,
+			Logger:  logger.Discard,
+			Plugins: []gorm.Plugin{metrics.GormPlugin{}, tracing.GormPlugin{}},
+		},
+		JWTSecret:            testJWTSecret,
+		JWTIssuer:            utils.DefaultIssuer,
+		JWTAudience:          utils.DefaultAudience,
+		JWTLegacyCutoff:      time.Now().Add(time.Hour),
+		MetricsToken:         testMetricsToken,
+		AppURL:               "https://app.example.com",
+		EmailVerificationTTL: time.Hour,
+		PasswordResetTTL:     time.Hour,
+		StaffInviteTTL:       time.Hour,
+		AccountDeletionGrace: 30 * 24 * time.Hour,
+		Passwordless:         services.PasswordlessPolicy{MagicLinkTTL: time.Hour, CodeTTL: time.Hour, CodeAttempts: 3},
+	}
+	for _, fn := range configure {
+		fn(cfg)
+	}
+	if err := setupTokens(cfg); err != nil {
+		t.Fatal(err)
+	}
+	handlers.RateLimitStore = ratelimit.NewMemoryStore()
+	// Session IDs start over with every database.
+	handlers.Sessions = services.NewSessionCache(time.Minute, 100)
+	mailer := &testMailer{}
+	handlers.Mailer = mailer
+	texts := &testSMS{}
+	handlers.SMS = texts
+
+	conns, err := openDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conns.Close()
+		handlers.DB, handlers.ReadDB = nil, nil
+	})
+
+	if err := database.Migrate(conns.Write); err != nil {
+		t.Fatal(err)
+	}
+
+	return &testServer{t: t, cfg: cfg, router: setupRouter(cfg), conns: conns, mailer: mailer, sms: texts}
+}
+
+// testMailer keeps the emails the server sends.
+type testMailer struct {
+	mu       sync.Mutex
+	messages []mail.Message
+}
+
+func (m *testMailer) Send(_ context.Context, msg mail.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+var mailedToken = regexp.MustCompile(`/([a-z-]+)\?token=([A-Za-z0-9_-]+)`)
+
+// mailedToken returns the token of the latest link to page ("verify-email",
+// "confirm-email", "reset-password" or "accept-invite") mailed to the address.
+func (s *testServer) mailedToken(to, page string) string {
+	s.t.Helper()
+
+	s.mailer.mu.Lock()
+	defer s.mailer.mu.Unlock()
+	for i := len(s.mailer.messages) - 1; i >= 0; i-- {
+		msg := s.mailer.messages[i]
+		if match := mailedToken.FindStringSubmatch(msg.Body); msg.To == to && match != nil && match[1] == page {
+			return match[2]
+		}
+	}
+	s.t.Fatalf("no %s link was mailed to %s", page, to)
+	return ""
+}
+
+// testSMS keeps the text messages the server sends.
+type testSMS struct {
+	mu       sync.Mutex
+	messages []sms.Message
+}
+
+func (m *testSMS) Send(_ context.Context, msg sms.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+var sentCode = regexp.MustCompile(`login code is (\d+)`)
+
+// sentCode returns the latest login code texted or mailed to the phone
+// number or address, or "" when there is none.
+func (s *testServer) sentCode(to string) string {
+	s.t.Helper()
+
+	var bodies []string
+	s.mailer.mu.Lock()
+	for _, msg := range s.mailer.messages {
+		if msg.To == to {
+			bodies = append(bodies, msg.Body)
+		}
+	}
+	s.mailer.mu.Unlock()
+	s.sms.mu.Lock()
+	for _, msg := range s.sms.messages {
+		if msg.To == to {
+			bodies = append(bodies, msg.Body)
+		}
+	}
+	s.sms.mu.Unlock()
+
+	for i := len(bodies) - 1; i >= 0; i-- {
+		if match := sentCode.FindStringSubmatch(bodies[i]); match != nil {
+			return match[1]
+		}
+	}
+	return ""
+}
+
+// testResponse is a recorded response with helpers for decoding the body.
+type testResponse struct {
+	t      *testing.T
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// JSON decodes the body into a generic value.
+func (r *testResponse) JSON() any {
+	r.t.Helper()
+	var v any
+	if err := json.Unmarshal(r.Body, &v); err != nil {
+		r.t.Fatalf("response is not JSON: %v\n%s", err, r.Body)
+	}
+	return v
+}
+
+// Decode decodes the body into dst.
+func (r *testResponse) Decode(dst any) {
+	r.t.Helper()
+	if err := json.Unmarshal(r.Body, dst); err != nil {
+		r.t.Fatalf("decode response: %v\n%s", err, r.Body)
+	}
+}
+
+// ExpectStatus fails the test unless the response has the given status.
+func (r *testResponse) ExpectStatus(status int) *testResponse {
+	r.t.Helper()
+	if r.Status != status {
+		r.t.Fatalf("got status %d, want %d\n%s", r.Status, status, r.Body)
+	}
+	return r
+}
+
+// do sends a request through the router. body is encoded as JSON unless it
+// is nil, and token is sent as a bearer token unless it is empty.
+func (s *testServer) do(method, path, token string, body any) *testResponse {
+	s.t.Helper()
+	header := http.Header{}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	return s.send(method, path, header, body)
+}
+
+// doWithKey sends a request authenticated with an API key.
+func (s *testServer) doWithKey(method, path, key string, body any) *testResponse {
+	s.t.Helper()
+	header := http.Header{}
+	header.Set(handlers.APIKeyHeader, key)
+	return s.send(method, path, header, body)
+}
+
+// send sends a request with header through the router. body is encoded as
+// JSON unless it is nil.
+func (s *testServer) send(method, path string, header http.Header, body any) *testResponse {
+	s.t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req := httptest.NewRequest(method, path, reader)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, req)
+	return &testResponse{t: s.t, Status: rec.Code, Header: rec.Header(), Body: rec.Body.Bytes()}
+}
+
+// testUser is an account created through the API.
+type testUser struct {
+	ID    uint
+	Email string
+	Token string
+}
+
+// register creates an account of the given type, verifies its email and logs it in.
+func (s *testServer) register(email, userType string) testUser {
+	s.t.Helper()
+
+	const password = "password123"
+	var registered struct {
+		User struct {
+			ID uint `json:"id"`
+		} `json:"user"`
+	}
+	s.do(http.MethodPost, "/v1/auth/register", "", map[string]string{
+		"email":     email,
+		"password":  password,
+		"user_type": userType,
+	}).ExpectStatus(http.StatusCreated).Decode(&registered)
+	s.do(http.MethodPost, "/v1/auth/verify-email", "", map[string]string{
+		"token": s.mailedToken(email, "verify-email"),
+	}).ExpectStatus(http.StatusOK)
+
+	return testUser{ID: registered.User.ID, Email: email, Token: s.login(email, password)}
+}
+
+// login returns a token for the given credentials.
+func (s *testServer) login(email, password string) string {
+	s.t.Helper()
+
+	var loggedIn struct {
+		Token string `json:"token"`
+	}
+	s.do(http.MethodPost, "/v1/auth/login", "", map[string]string{
+		"email":    email,
+		"password": password,
+	}).ExpectStatus(http.StatusOK).Decode(&loggedIn)
+	return loggedIn.Token
+}
+
+var userCounter int
+
+// merchant registers a new merchant account with a unique email.
+func (s *testServer) merchant() testUser {
+	s.t.Helper()
+	userCounter++
+	return s.register(fmt.Sprintf("merchant%d@example.com", userCounter), "merchant")
+}
+
+// diner registers a new diner account with a unique email.
+func (s *testServer) diner() testUser {
+	s.t.Helper()
+	userCounter++
+	return s.register(fmt.Sprintf("diner%d@example.com", userCounter), "diner")
+}
+
+// admin creates an admin account, which only the command line can, and logs
+// it in.
+func (s *testServer) admin() testUser {
+	s.t.Helper()
+	userCounter++
+	const password = "password123"
+	admin, err := services.CreateAdmin(s.conns.Write, fmt.Sprintf("admin%d@example.com", userCounter), password)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return testUser{ID: admin.ID, Email: admin.Email, Token: s.login(admin.Email, password)}
+}
+
+// createVenue creates a venue owned by merchant and returns its ID.
+func (s *testServer) createVenue(merchant testUser, name string) uint {
+	s.t.Helper()
+
+	var created struct {
+		Venue struct {
+			ID uint `json:"id"`
+		} `json:"venue"`
+	}
+	s.do(http.MethodPost, "/v1/merchant/venues", merchant.Token, map[string]string{
+		"name":         name,
+		"address":      "1 Collins Street, Melbourne VIC 3000",
+		"description":  "Test venue",
+		"cuisine_type": "Cafe",
+	}).ExpectStatus(http.StatusCreated).Decode(&created)
+	return created.Venue.ID
+}
+
+// createMenuItem adds an item to a venue and returns its ID.
+func (s *testServer) createMenuItem(merchant testUser, venueID uint, name string, priceInCents int64) uint {
+	s.t.Helper()
+
+	var created struct {
+		ID uint `json:"id"`
+	}
+	s.do(http.MethodPost, fmt.Sprintf("/v1/merchant/venues/%d/menuitems", venueID), merchant.Token, map[string]any{
+		"name":           name,
+		"description":    name + " description",
+		"price_in_cents": priceInCents,
+		"category":       "Mains",
+	}).ExpectStatus(http.StatusCreated).Decode(&created)
+	return created.ID
+}
+
+// userChanges returns the audit entries of action about the account, oldest
+// first.
+func (s *testServer) userChanges(userID uint, action string) []models.AuditEntry {
+	s.t.Helper()
+	var entries []models.AuditEntry
+	if err := s.conns.Write.Where("entity_type = ? AND entity_id = ? AND action = ?", audit.EntityUser, userID, action).Order("id").Find(&entries).Error; err != nil {
+		s.t.Fatal(err)
+	}
+	return entries
+}
@@ -0,0 +1,219 @@
+// Package keystore holds the keys that sign and verify JWTs. Asymmetric keys
+// (RS256 or EdDSA) are loaded from a directory of PEM files named after
+// their key IDs, so other services can verify tokens with the public halves
+// published as a JWKS. Rotation is staged: a new key is added to every
+// instance first and only verifies, then it is made the signing key, and the
+// old file is removed once the tokens it signed have expired.
+//
+// A shared HS256 secret can also be configured. It has the empty key ID,
+// which matches tokens signed before key IDs existed.
+package keystore
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Algorithms of asymmetric keys.
+const (
+	AlgorithmRS256 = "RS256"
+	AlgorithmEdDSA = "EdDSA"
+	AlgorithmHS256 = "HS256"
+)
+
+// keyExt is the extension of key files in a key directory.
+const keyExt = ".pem"
+
+// Key is one signing key.
+type Key struct {
+	// ID is the "kid" header of the tokens the key signs.
+	ID        string
+	Algorithm string
+
+	private any
+	public  any
+}
+
+// Method returns the JWT signing method of the key.
+func (k *Key) Method() jwt.SigningMethod {
+	return jwt.GetSigningMethod(k.Algorithm)
+}
+
+// Sign signs token with the key.
+func (k *Key) Sign(token *jwt.Token) (string, error) {
+	return token.SignedString(k.private)
+}
+
+// NewSecretKey returns an HS256 key for a shared secret.
+func NewSecretKey(secret []byte) *Key {
+	return &Key{Algorithm: AlgorithmHS256, private: secret, public: secret}
+}
+
+// ParsePrivateKey parses a PKCS#8 PEM private key, RSA or Ed25519.
+func ParsePrivateKey(id string, data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch private := parsed.(type) {
+	case *rsa.PrivateKey:
+		if private.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA key has %d bits, at least 2048 are required", private.N.BitLen())
+		}
+		return &Key{ID: id, Algorithm: AlgorithmRS256, private: private, public: &private.PublicKey}, nil
+	case ed25519.PrivateKey:
+		return &Key{ID: id, Algorithm: AlgorithmEdDSA, private: private, public: private.Public()}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+}
+
+// GenerateKey returns a new PKCS#8 PEM private key for algorithm.
+func GenerateKey(algorithm string) ([]byte, error) {
+	var private crypto.PrivateKey
+	var err error
+	switch algorithm {
+	case AlgorithmRS256:
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case AlgorithmEdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q: must be %s or %s", algorithm, AlgorithmRS256, AlgorithmEdDSA)
+	}
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// Store holds the signing key and every key accepted for verification.
+type Store struct {
+	signing *Key
+	keys    map[string]*Key
+}
+
+// New returns a store that signs with signing, which may be nil, and
+// verifies with it and the other keys.
+func New(signing *Key, others ...*Key) (*Store, error) {
+	s := &Store{signing: signing, keys: make(map[string]*Key)}
+	for _, key := range append([]*Key{signing}, others...) {
+		if key == nil {
+			continue
+		}
+		if _, ok := s.keys[key.ID]; ok {
+			return nil, fmt.Errorf("duplicate key ID %q", key.ID)
+		}
+		s.keys[key.ID] = key
+	}
+	return s, nil
+}
+
+// Load builds a store from the PEM files in dir and a shared secret, either
+// of which may be empty. The file named signingID signs. It may only be
+// omitted when dir holds a single key, so adding a key never changes which
+// one signs. Without files the secret signs.
+func Load(dir, signingID string, secret []byte) (*Store, error) {
+	var keys []*Key
+	if dir != "" {
+		paths, err := filepath.Glob(filepath.Join(dir, "*"+keyExt))
+		if err != nil {
+			return nil, err
+		}
+		slices.Sort(paths)
+		for _, path := range paths {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			key, err := ParsePrivateKey(strings.TrimSuffix(filepath.Base(path), keyExt), data)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %w", path, err)
+			}
+			keys = append(keys, key)
+		}
+		if len(keys) == 0 {
+			return nil, fmt.Errorf("no %s keys in %s", keyExt, dir)
+		}
+	}
+	if len(secret) > 0 {
+		keys = append(keys, NewSecretKey(secret))
+	}
+
+	var signing *Key
+	switch {
+	case signingID != "":
+		i := slices.IndexFunc(keys, func(k *Key) bool { return k.ID == signingID && k.Algorithm != AlgorithmHS256 })
+		if i < 0 {
+			return nil, fmt.Errorf("signing key %q is not in %s", signingID, dir)
+		}
+		signing = keys[i]
+	case dir != "":
+		if len(keys) > 1 && keys[1].Algorithm != AlgorithmHS256 {
+			return nil, fmt.Errorf("%s holds several keys, so the signing key must be chosen", dir)
+		}
+		signing = keys[0]
+	case len(keys) > 0:
+		signing = keys[0]
+	}
+
+	others := slices.DeleteFunc(keys, func(k *Key) bool { return k == signing })
+	return New(signing, others...)
+}
+
+// SigningKey returns the key new tokens are signed with, or nil.
+func (s *Store) SigningKey() *Key {
+	return s.signing
+}
+
+// Lookup returns the verification key with the given ID.
+func (s *Store) Lookup(id string) (*Key, bool) {
+	key, ok := s.keys[id]
+	return key, ok
+}
+
+// VerificationKey returns the key for verifying token, as a jwt.Keyfunc. It
+// refuses tokens whose algorithm doesn't match the key, so a public key can
+// never be used as an HMAC secret.
+func (s *Store) VerificationKey(token *jwt.Token) (any, error) {
+	id, _ := token.Header["kid"].(string)
+	key, ok := s.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID %q", id)
+	}
+	if token.Method.Alg() != key.Algorithm {
+		return nil, jwt.ErrTokenSignatureInvalid
+	}
+	return key.public, nil
+}
+
+// Algorithms lists the algorithms of the verification keys.
+func (s *Store) Algorithms() []string {
+	var algorithms []string
+	for _, key := range s.keys {
+		if !slices.Contains(algorithms, key.Algorithm) {
+			algorithms = append(algorithms, key.Algorithm)
+		}
+	}
+	slices.Sort(algorithms)
+	return algorithms
+}
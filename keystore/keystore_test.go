@@ -0,0 +1,84 @@
+package keystore
+
+import (
+	"crypto"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func writeKey(t *testing.T, dir, id, algorithm string) {
+	t.Helper()
+	data, err := GenerateKey(algorithm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, id+keyExt), data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	writeKey(t, dir, "old", AlgorithmRS256)
+
+	store, err := Load(dir, "", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := store.SigningKey(); key.ID != "old" || key.Algorithm != AlgorithmRS256 {
+		t.Fatalf("signing key = %s %s, want the only file", key.ID, key.Algorithm)
+	}
+
+	// A second key must be chosen explicitly.
+	writeKey(t, dir, "new", AlgorithmEdDSA)
+	if _, err := Load(dir, "", nil); err == nil {
+		t.Fatal("Load picked a signing key among several")
+	}
+	if _, err := Load(dir, "missing", nil); err == nil {
+		t.Fatal("Load accepted an unknown signing key")
+	}
+	store, err = Load(dir, "new", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.SigningKey().ID != "new" {
+		t.Fatalf("signing key = %s, want new", store.SigningKey().ID)
+	}
+	for _, id := range []string{"old", "new", ""} {
+		if _, ok := store.Lookup(id); !ok {
+			t.Errorf("key %q can't verify", id)
+		}
+	}
+
+	set := store.JWKS()
+	if len(set.Keys) != 2 || set.Keys[0].KeyID != "new" || set.Keys[0].KeyType != "OKP" || set.Keys[1].KeyType != "RSA" {
+		t.Errorf("JWKS = %+v, want the two public keys without the secret", set)
+	}
+	for _, jwk := range set.Keys {
+		public, err := jwk.PublicKey()
+		key, _ := store.Lookup(jwk.KeyID)
+		if err != nil || !key.public.(interface{ Equal(crypto.PublicKey) bool }).Equal(public) {
+			t.Errorf("JWK %q decodes to %v, %v", jwk.KeyID, public, err)
+		}
+	}
+}
+
+func TestVerificationKeyRefusesAlgorithmConfusion(t *testing.T) {
+	dir := t.TempDir()
+	writeKey(t, dir, "rsa", AlgorithmRS256)
+	store, err := Load(dir, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := store.Lookup("rsa")
+
+	// An HS256 token "signed" with the public key as the secret.
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "1"})
+	forged.Header["kid"] = "rsa"
+	if _, err := store.VerificationKey(forged); err == nil {
+		t.Fatalf("an HS256 token was given the %s key", key.Algorithm)
+	}
+}
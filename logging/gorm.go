@@ -0,0 +1,76 @@
+package logging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// SlowQueryThreshold is the duration above which GORM statements are logged as warnings.
+const SlowQueryThreshold = 200 * time.Millisecond
+
+// GormLogger sends GORM's logs to slog so they share the format and the
+// request attributes of the rest of the application.
+type GormLogger struct {
+	Logger *slog.Logger
+	Level  logger.LogLevel
+}
+
+// NewGormLogger logs failed and slow statements, and every statement when
+// the slog logger has debug enabled.
+func NewGormLogger(l *slog.Logger) *GormLogger {
+	level := logger.Warn
+	if l.Enabled(context.Background(), slog.LevelDebug) {
+		level = logger.Info
+	}
+	return &GormLogger{Logger: l, Level: level}
+}
+
+func (g *GormLogger) LogMode(level logger.LogLevel) logger.Interface {
+	clone := *g
+	clone.Level = level
+	return &clone
+}
+
+func (g *GormLogger) Info(ctx context.Context, msg string, args ...interface{}) {
+	if g.Level >= logger.Info {
+		g.Logger.InfoContext(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+func (g *GormLogger) Warn(ctx context.Context, msg string, args ...interface{}) {
+	if g.Level >= logger.Warn {
+		g.Logger.WarnContext(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+func (g *GormLogger) Error(ctx context.Context, msg string, args ...interface{}) {
+	if g.Level >= logger.Error {
+		g.Logger.ErrorContext(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+func (g *GormLogger) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	if g.Level <= logger.Silent {
+		return
+	}
+
+	elapsed := time.Since(begin)
+	switch {
+	// Missing rows are an expected outcome that handlers turn into 404s.
+	case err != nil && !errors.Is(err, gorm.ErrRecordNotFound) && g.Level >= logger.Error:
+		sql, rows := fc()
+		g.Logger.ErrorContext(ctx, "Database query failed", "error", err, "sql", sql, "rows", rows, "duration", elapsed)
+	case elapsed > SlowQueryThreshold && g.Level >= logger.Warn:
+		sql, rows := fc()
+		g.Logger.WarnContext(ctx, "Slow database query", "sql", sql, "rows", rows, "duration", elapsed)
+	case g.Level >= logger.Info:
+		sql, rows := fc()
+		g.Logger.DebugContext(ctx, "Database query", "sql", sql, "rows", rows, "duration", elapsed)
+	}
+}
@@ -0,0 +1,94 @@
+// Package logging configures the structured slog logger and carries
+// request-scoped attributes, such as the request and user IDs, through the
+// context so that every log line of a request can be correlated.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Attribute keys shared by handlers, middleware and the GORM logger.
+const (
+	KeyRequestID      = "request_id"
+	KeyUserID         = "user_id"
+	KeyImpersonatorID = "impersonator_id"
+	KeyAPIKeyID       = "api_key_id"
+	KeySessionID      = "session_id"
+	KeyVenueID        = "venue_id"
+	KeyOrderID        = "order_id"
+	KeyTraceID        = "trace_id"
+	KeySpanID         = "span_id"
+)
+
+// New builds a logger writing to w. format is "json" or "text"; level is one
+// of "debug", "info", "warn" or "error".
+func New(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "", "json":
+		handler = slog.NewJSONHandler(w, opts)
+	case "text":
+		handler = slog.NewTextHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+
+	return slog.New(contextHandler{handler}), nil
+}
+
+type attrsKey struct{}
+
+// WithAttrs returns a copy of ctx carrying attrs in addition to any already
+// attached. They are added to every record logged with that context.
+func WithAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	existing, _ := ctx.Value(attrsKey{}).([]slog.Attr)
+	merged := make([]slog.Attr, 0, len(existing)+len(attrs))
+	merged = append(merged, existing...)
+	merged = append(merged, attrs...)
+	return context.WithValue(ctx, attrsKey{}, merged)
+}
+
+// Attrs returns the attributes attached to ctx.
+func Attrs(ctx context.Context) []slog.Attr {
+	attrs, _ := ctx.Value(attrsKey{}).([]slog.Attr)
+	return attrs
+}
+
+// contextHandler adds the attributes stored in the context, and the IDs of
+// the current trace span, to each record.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if attrs := Attrs(ctx); len(attrs) > 0 {
+		record.AddAttrs(attrs...)
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		record.AddAttrs(
+			slog.String(KeyTraceID, span.TraceID().String()),
+			slog.String(KeySpanID, span.SpanID().String()),
+		)
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
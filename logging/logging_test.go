@@ -0,0 +1,68 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestContextAttrsAreLogged(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "json", "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := WithAttrs(context.Background(), slog.String(KeyRequestID, "abc"))
+	ctx = WithAttrs(ctx, slog.Uint64(KeyUserID, 7))
+	logger.DebugContext(ctx, "hidden below the configured level")
+	logger.InfoContext(ctx, "Order placed", KeyOrderID, 42)
+
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("expected exactly one JSON line, got %q: %v", buf.String(), err)
+	}
+	want := map[string]any{"msg": "Order placed", KeyRequestID: "abc", KeyUserID: float64(7), KeyOrderID: float64(42)}
+	for key, value := range want {
+		if line[key] != value {
+			t.Errorf("%s = %v, want %v", key, line[key], value)
+		}
+	}
+}
+
+func TestNewRejectsUnknownSettings(t *testing.T) {
+	if _, err := New(&bytes.Buffer{}, "json", "loud"); err == nil {
+		t.Error("expected an error for an unknown level")
+	}
+	if _, err := New(&bytes.Buffer{}, "xml", "info"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
+
+func TestTraceIDsAreLogged(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "json", "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: traceID,
+		SpanID:  spanID,
+	}))
+	logger.InfoContext(ctx, "Order placed")
+
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	if line[KeyTraceID] != traceID.String() || line[KeySpanID] != spanID.String() {
+		t.Errorf("trace_id = %v, span_id = %v", line[KeyTraceID], line[KeySpanID])
+	}
+}
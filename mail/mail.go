@@ -0,0 +1,174 @@
+// Package mail sends the emails of the account flows. The transport is
+// chosen by MAILER: SMTP in production, or a console or file sink during
+// development so links can be followed without a mail server.
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	netmail "net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transport names for MAILER.
+const (
+	TransportNone    = "none"
+	TransportConsole = "console"
+	TransportFile    = "file"
+	TransportSMTP    = "smtp"
+)
+
+// Message is a plain-text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// Options configures New.
+type Options struct {
+	Transport string
+	// From is the sender address of every message.
+	From string
+	// File is the file the file transport appends messages to.
+	File string
+
+	SMTPAddr     string
+	SMTPUsername string
+	SMTPPassword string
+}
+
+// New returns the mailer for opts.Transport.
+func New(opts Options) (Mailer, error) {
+	switch opts.Transport {
+	case TransportNone:
+		return Discard{}, nil
+	case TransportConsole:
+		return &WriterMailer{W: os.Stdout, From: opts.From}, nil
+	case TransportFile:
+		return &FileMailer{Path: opts.File, From: opts.From}, nil
+	case TransportSMTP:
+		if opts.SMTPAddr == "" {
+			return nil, errors.New("SMTP_ADDR is required by the smtp mailer")
+		}
+		return NewSMTPMailer(opts.SMTPAddr, opts.SMTPUsername, opts.SMTPPassword, opts.From), nil
+	default:
+		return nil, fmt.Errorf("unknown mailer %q", opts.Transport)
+	}
+}
+
+// Discard drops every message.
+type Discard struct{}
+
+func (Discard) Send(context.Context, Message) error { return nil }
+
+// WriterMailer prints messages to W, separated by blank lines.
+type WriterMailer struct {
+	W    io.Writer
+	From string
+
+	mu sync.Mutex
+}
+
+func (m *WriterMailer) Send(_ context.Context, msg Message) error {
+	data, err := format(m.From, msg, time.Now())
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err = fmt.Fprintf(m.W, "%s\r\n\r\n", data)
+	return err
+}
+
+// FileMailer appends messages to the file at Path.
+type FileMailer struct {
+	Path string
+	From string
+
+	mu sync.Mutex
+}
+
+func (m *FileMailer) Send(_ context.Context, msg Message) error {
+	data, err := format(m.From, msg, time.Now())
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := os.OpenFile(m.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(f, "%s\r\n\r\n", data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// SMTPMailer delivers messages through an SMTP relay. The connection is
+// upgraded with STARTTLS whenever the server offers it.
+type SMTPMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+	// sender is the bare address of from, used in the SMTP envelope.
+	sender string
+}
+
+// NewSMTPMailer returns a mailer for the relay at addr ("host:port"). Without
+// a username it sends unauthenticated.
+func NewSMTPMailer(addr, username, password, from string) *SMTPMailer {
+	m := &SMTPMailer{addr: addr, from: from, sender: from}
+	if parsed, err := netmail.ParseAddress(from); err == nil {
+		m.sender = parsed.Address
+	}
+	if username != "" {
+		host, _, _ := strings.Cut(addr, ":")
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	data, err := format(m.from, msg, time.Now())
+	if err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return smtp.SendMail(m.addr, m.auth, m.sender, []string{msg.To}, data)
+}
+
+// format renders msg with the headers of a plain-text email.
+func format(from string, msg Message, date time.Time) ([]byte, error) {
+	for _, header := range []string{from, msg.To, msg.Subject} {
+		if strings.ContainsAny(header, "\r\n") {
+			return nil, errors.New("mail headers must not contain line breaks")
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String()), nil
+}
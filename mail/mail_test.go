@@ -0,0 +1,37 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestWriterMailer(t *testing.T) {
+	var buf bytes.Buffer
+	m := &WriterMailer{W: &buf, From: "App <no-reply@example.com>"}
+	err := m.Send(context.Background(), Message{To: "a@example.com", Subject: "Hello", Body: "line one\nline two"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"From: App <no-reply@example.com>\r\n", "To: a@example.com\r\n", "Subject: Hello\r\n", "\r\n\r\nline one\r\nline two"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("message lacks %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestHeaderInjection(t *testing.T) {
+	m := &WriterMailer{W: &bytes.Buffer{}, From: "no-reply@example.com"}
+	err := m.Send(context.Background(), Message{To: "a@example.com\r\nBcc: b@example.com", Subject: "Hello"})
+	if err == nil {
+		t.Fatal("a recipient with a line break was accepted")
+	}
+}
+
+func TestNewSMTPMailerEnvelope(t *testing.T) {
+	m := NewSMTPMailer("smtp.example.com:587", "", "", "App <no-reply@example.com>")
+	if m.sender != "no-reply@example.com" {
+		t.Errorf("sender = %q, want the bare address", m.sender)
+	}
+}
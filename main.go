@@ -1,61 +1,195 @@
 package main
 
 import (
-	"github.com/joho/godotenv"
+	"context"
+	"errors"
+	"fmt"
+	"liven-one-go/config"
+	"liven-one-go/database"
 	"liven-one-go/handlers"
+	"liven-one-go/keystore"
+	"liven-one-go/logging"
+	"liven-one-go/mail"
+	"liven-one-go/metrics"
 	"liven-one-go/models"
+	"liven-one-go/ratelimit"
+	"liven-one-go/sms"
+	"liven-one-go/tracing"
+	"liven-one-go/utils"
+	"liven-one-go/worker"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
-	"gorm.io/driver/sqlite" // Or your preferred database driver
-	"gorm.io/gorm"
 )
 
 func main() {
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
 
-	/* DATABASE SETUP STARTS */
+	logger, err := logging.New(os.Stdout, cfg.LogFormat, cfg.LogLevel)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	// Also routes the standard library's log package through the structured logger.
+	slog.SetDefault(logger)
+	cfg.Database.Logger = logging.NewGormLogger(logger)
+	cfg.Database.Plugins = append(cfg.Database.Plugins, metrics.GormPlugin{}, tracing.GormPlugin{})
+
+	if err := runCLI(cfg, os.Args[1:]); err != nil {
+		slog.Error("Command failed", "error", err)
+		os.Exit(1)
+	}
+}
+
+// serve opens the database, applies migrations and runs the HTTP server
+// until SIGINT or SIGTERM. It then stops accepting connections, drains
+// in-flight requests, stops the background workers and closes the database,
+// all within SHUTDOWN_TIMEOUT.
+func serve(cfg *config.Config) error {
+	if err := setupTokens(cfg); err != nil {
+		return err
+	}
 
-	err := godotenv.Load()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := tracing.Setup(ctx, cfg.Tracing)
 	if err != nil {
-		log.Printf("Error loading .env file for database URI. Using environment variables.")
+		return fmt.Errorf("failed to set up tracing: %w", err)
 	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Error("Failed to flush traces", "error", err)
+		}
+	}()
 
-	dbURI := os.Getenv("DATABASE_URI")
-	if dbURI == "" {
-		dbURI = "test.db"
-		log.Println("Warning: DATABASE_URI not found in environment variables. Using default: " + dbURI)
+	/* DATABASE SETUP STARTS */
+	if !database.IsInMemory(cfg.DatabaseURI) {
+		unlock, lockErr := database.LockServer(cfg.DatabaseURI)
+		if lockErr != nil {
+			return lockErr
+		}
+		defer unlock()
 	}
 
-	// Initialize database (replace with your actual database setup)
-	db, openDbErr := gorm.Open(sqlite.Open(dbURI), &gorm.Config{})
-	if openDbErr != nil {
-		log.Fatalf("Failed to connect to database: %v", openDbErr)
-		os.Exit(1)
+	conns, err := openDatabase(cfg)
+	if err != nil {
+		return err
 	}
-	handlers.DB = db
+	defer func() {
+		if err := conns.Close(); err != nil {
+			slog.Error("Failed to close database", "error", err)
+		}
+	}()
 
-	migrateErr := db.AutoMigrate(&models.User{}, &models.Venue{}, &models.MenuItem{}, &models.Order{}, &models.OrderItem{})
-	if migrateErr != nil {
-		log.Fatalf("Failed to migrate database: %v", openDbErr)
+	if err := database.Migrate(conns.Write); err != nil {
+		return err
 	}
 	/* DATABASE SETUP ENDS */
 
+	mailer, err := mail.New(cfg.Mail)
+	if err != nil {
+		return fmt.Errorf("failed to set up mailer: %w", err)
+	}
+	if cfg.Mail.Transport == mail.TransportNone && !cfg.IsDevelopment() {
+		slog.Warn("MAILER is none: verification and password reset emails are not sent")
+	}
+	handlers.Mailer = mailer
+	smsSender, err := sms.New(cfg.SMS)
+	if err != nil {
+		return fmt.Errorf("failed to set up SMS sender: %w", err)
+	}
+	if cfg.SMS.Transport == sms.TransportNone && !cfg.IsDevelopment() {
+		slog.Warn("SMS_SENDER is none: login codes are not texted")
+	}
+	handlers.SMS = smsSender
+
+	workers := worker.NewGroup()
+	handlers.Workers = workers
+	startScheduledBackups(cfg, workers)
+	startMetricsServer(cfg, workers)
+	startRateLimiter(cfg, conns, workers)
+	startAccountDeletions(cfg, conns.Write, workers)
+
+	server := &http.Server{
+		Addr:              ":" + cfg.Port,
+		Handler:           setupRouter(cfg),
+		ReadHeaderTimeout: cfg.ReadTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+	slog.Info("Server listening", "port", cfg.Port, "env", cfg.Env)
+
+	select {
+	case err = <-serverErr:
+		slog.Error("Server stopped unexpectedly", "error", err)
+	case <-ctx.Done():
+		slog.Info("Shutting down", "timeout", cfg.ShutdownTimeout)
+	}
+	// A second signal kills the process without waiting for the drain.
+	stop()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if shutdownErr := server.Shutdown(shutdownCtx); shutdownErr != nil {
+		err = errors.Join(err, fmt.Errorf("failed to drain requests: %w", shutdownErr))
+	}
+	if stopErr := workers.Stop(shutdownCtx); stopErr != nil {
+		err = errors.Join(err, stopErr)
+	}
+	if err == nil {
+		slog.Info("Server stopped")
+	}
+	return err
+}
+
+// legacyGroups were served without a version prefix before /v1. Their paths
+// stay as deprecated aliases of the /v1 routes until legacySunset.
+var (
+	legacyGroups = []string{"/auth", "/public", "/diner", "/merchant"}
+	legacySunset = time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC)
+)
+
+// setupRouter builds the gin engine with every route of the API.
+func setupRouter(cfg *config.Config) *gin.Engine {
 	/* ROUTING STARTS */
-	router := gin.Default()
+	if !cfg.IsDevelopment() {
+		gin.SetMode(gin.ReleaseMode)
+	}
 
-	env := os.Getenv("APP_ENV")
+	router := gin.New()
+	if err := router.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		slog.Error("Invalid trusted proxies, trusting none", "error", err)
+		_ = router.SetTrustedProxies(nil)
+	}
+	router.Use(handlers.LegacyRoutes(router, "/v1", legacyGroups, legacySunset))
+	router.Use(handlers.Tracing(), handlers.RequestLogger(), handlers.Recovery(), handlers.Metrics(), handlers.ErrorHandler())
+	router.NoRoute(handlers.RouteNotFoundHandler)
 
 	var corsConfig cors.Config
-	if env == "debug" || os.Getenv("APP_ENV") == "development" {
+	if cfg.IsDevelopment() {
 		// Development: Allow all origins
 		corsConfig = cors.Config{
 			AllowOrigins:     []string{"*"}, // Allows all origins
 			AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
-			AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization"},
-			ExposeHeaders:    []string{"Content-Length"},
+			AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization", handlers.DeviceNameHeader, "traceparent", "tracestate"},
+			ExposeHeaders:    []string{"Content-Length", "Retry-After"},
 			AllowCredentials: true, // Be cautious with this in conjunction with AllowOrigins: "*"
 			MaxAge:           12 * time.Hour,
 		}
@@ -64,8 +198,8 @@ func main() {
 		corsConfig = cors.Config{
 			AllowOrigins:     []string{"https://your-production-frontend.com"}, // Replace with your actual frontend domain
 			AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-			AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization"},
-			ExposeHeaders:    []string{"Content-Length"},
+			AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization", handlers.DeviceNameHeader, "traceparent", "tracestate"},
+			ExposeHeaders:    []string{"Content-Length", "Retry-After"},
 			AllowCredentials: true,
 			MaxAge:           12 * time.Hour,
 		}
@@ -73,15 +207,77 @@ func main() {
 
 	router.Use(cors.New(corsConfig))
 
+	if cfg.MetricsAddr == "" && cfg.MetricsToken != "" {
+		router.GET("/metrics", handlers.MetricsHandler(cfg.MetricsToken))
+	}
+
+	router.GET(jwksPath, handlers.JWKSHandler)
+	router.GET("/healthz", handlers.HealthzHandler)
+	router.GET("/readyz", handlers.ReadyzHandler)
+
+	spec := apiSpec().Document()
+	router.GET(openAPIPath, handlers.OpenAPIHandler(spec))
+	router.GET(docsPath, handlers.DocsHandler(spec.Info.Title, openAPIPath))
+
+	// --- Version 1 of the API ---
+	// Every route of a version renders the response types of its own package
+	// (api/v1 here), so a /v2 can be mounted next to it without changing what
+	// /v1 clients receive.
+	v1 := router.Group("/v1")
+
 	// --- Authentication Routes ---
-	authGroup := router.Group("/auth")
+	emails := handlers.AccountEmails{
+		AppURL:           cfg.AppURL,
+		VerificationTTL:  cfg.EmailVerificationTTL,
+		PasswordResetTTL: cfg.PasswordResetTTL,
+		StaffInviteTTL:   cfg.StaffInviteTTL,
+	}
+	authGroup := v1.Group("/auth")
 	{
-		authGroup.POST("/register", handlers.AuthHandler)
-		authGroup.POST("/login", handlers.AuthHandler)
+		authGroup.POST("/register", handlers.RateLimit(cfg.RateLimits.Register, handlers.ByIP), handlers.RegisterHandler(emails))
+		authGroup.POST("/login", handlers.RateLimit(cfg.RateLimits.Login, handlers.ByIP), handlers.LoginHandler(cfg.LoginLockout))
+		// Sending mail is limited like registering; redeeming tokens like logging in.
+		authGroup.POST("/password/forgot", handlers.RateLimit(cfg.RateLimits.Register, handlers.ByIP), handlers.ForgotPasswordHandler(emails))
+		authGroup.POST("/password/reset", handlers.RateLimit(cfg.RateLimits.Login, handlers.ByIP), handlers.ResetPasswordHandler)
+		authGroup.POST("/verify-email", handlers.RateLimit(cfg.RateLimits.Login, handlers.ByIP), handlers.VerifyEmailHandler)
+		authGroup.POST("/verify-email/resend", handlers.AuthMiddleware(), handlers.RateLimit(cfg.RateLimits.Register, handlers.ByUser), handlers.ResendVerificationHandler(emails))
+		authGroup.POST("/email/confirm", handlers.RateLimit(cfg.RateLimits.Login, handlers.ByIP), handlers.ConfirmEmailChangeHandler)
+		authGroup.POST("/staff/accept", handlers.RateLimit(cfg.RateLimits.Login, handlers.ByIP), handlers.AcceptStaffInviteHandler)
+		authGroup.POST("/login/2fa", handlers.RateLimit(cfg.RateLimits.Login, handlers.ByIP), handlers.TwoFactorLoginHandler(cfg.LoginLockout))
+
+		// Logging in without a password, with a mailed link or a texted or
+		// mailed code. Sending is limited like registering.
+		authGroup.POST("/magic-link", handlers.RateLimit(cfg.RateLimits.Register, handlers.ByIP), handlers.RequestMagicLinkHandler(emails, cfg.Passwordless))
+		authGroup.POST("/magic-link/verify", handlers.RateLimit(cfg.RateLimits.Login, handlers.ByIP), handlers.MagicLinkLoginHandler)
+		authGroup.POST("/otp", handlers.RateLimit(cfg.RateLimits.Register, handlers.ByIP), handlers.RequestLoginCodeHandler(emails, cfg.Passwordless))
+		authGroup.POST("/otp/verify", handlers.RateLimit(cfg.RateLimits.Login, handlers.ByIP), handlers.LoginCodeLoginHandler(cfg.Passwordless, cfg.LoginLockout))
+
+		// Logging in with an external OpenID Connect provider.
+		oidcProviders := handlers.NewOIDCProviders(cfg.OIDC)
+		authGroup.POST("/oidc/:provider", handlers.RateLimit(cfg.RateLimits.Login, handlers.ByIP), handlers.StartOIDCLoginHandler(oidcProviders))
+		authGroup.POST("/oidc/:provider/callback", handlers.RateLimit(cfg.RateLimits.Login, handlers.ByIP), handlers.OIDCCallbackHandler(oidcProviders))
+
+		// Two-factor enrollment works with any token, so merchants required
+		// to use it can still get there.
+		twoFactorRoutes := authGroup.Group("/2fa", handlers.AuthMiddleware(), handlers.RateLimit(cfg.RateLimits.Login, handlers.ByUser))
+		{
+			twoFactorRoutes.POST("/setup", handlers.TwoFactorSetupHandler(cfg.TwoFactor))
+			twoFactorRoutes.POST("/enable", handlers.EnableTwoFactorHandler)
+			twoFactorRoutes.POST("/disable", handlers.DisableTwoFactorHandler(cfg.TwoFactor, cfg.LoginLockout))
+		}
+	}
+
+	// --- Account Routes ---
+	// Shared by every kind of account; two-factor enrollment isn't required so
+	// a lost device can always be signed out.
+	meRoutes := v1.Group("/me", handlers.AuthMiddleware(), handlers.RateLimit(cfg.RateLimits.API, handlers.ByUser))
+	{
+		meRoutes.GET("/sessions", handlers.ListSessionsHandler)
+		meRoutes.DELETE("/sessions/:session_id", handlers.EndSessionHandler)
 	}
 
 	// --- Public/Diner Venue and Menu Routes --- (Auth token not needed)
-	publicGroup := router.Group("/public")
+	publicGroup := v1.Group("/public", handlers.RateLimit(cfg.RateLimits.API, handlers.ByIP))
 	{
 		publicGroup.GET("/venues", handlers.ListVenuesHandler)
 		publicGroup.GET("/venues/:venue_id", handlers.GetVenueHandler)
@@ -89,9 +285,15 @@ func main() {
 	}
 
 	// --- Diner Protected Routes ---
-	dinerRoutes := router.Group("/diner", handlers.AuthMiddleware())
+	dinerRoutes := v1.Group("/diner", handlers.AuthMiddleware(), handlers.RateLimit(cfg.RateLimits.API, handlers.ByUser))
 	{
 		dinerRoutes.GET("", handlers.DinerAccountHandler)
+		dinerRoutes.DELETE("", handlers.DeleteAccountHandler(models.UserTypeDiner, cfg.LoginLockout, cfg.AccountDeletionGrace))
+		dinerRoutes.GET("/profile", handlers.GetProfileHandler(models.UserTypeDiner))
+		dinerRoutes.PUT("/profile", handlers.UpdateProfileHandler(models.UserTypeDiner))
+		dinerRoutes.PUT("/password", handlers.ChangePasswordHandler(models.UserTypeDiner, cfg.LoginLockout))
+		dinerRoutes.POST("/email", handlers.ChangeEmailHandler(models.UserTypeDiner, emails, cfg.LoginLockout))
+		dinerRoutes.GET("/data-export", handlers.DataExportHandler)
 		orderRoutes := dinerRoutes.Group("/orders")
 		{
 			orderRoutes.POST("", handlers.PlaceOrderHandler)
@@ -100,12 +302,44 @@ func main() {
 		}
 	}
 
+	// --- Staff Protected Routes ---
+	// Staff work through the merchant routes of their venues; this group only
+	// shows them their own account.
+	staffRoutes := v1.Group("/staff", handlers.AuthMiddleware(), handlers.RequireTwoFactor(cfg.TwoFactor), handlers.RateLimit(cfg.RateLimits.API, handlers.ByUser))
+	{
+		staffRoutes.GET("", handlers.StaffAccountHandler)
+	}
+
 	// --- Merchant Protected Routes ---
-	merchantRoutes := router.Group("/merchant", handlers.AuthMiddleware())
+	merchantRoutes := v1.Group("/merchant", handlers.AuthMiddleware(), handlers.RequireTwoFactor(cfg.TwoFactor), handlers.RateLimit(cfg.RateLimits.API, handlers.ByUser))
 	{
 
 		// Account Management
 		merchantRoutes.GET("", handlers.MerchantAccountHandler)
+		merchantRoutes.DELETE("", handlers.DeleteAccountHandler(models.UserTypeMerchant, cfg.LoginLockout, cfg.AccountDeletionGrace))
+		merchantRoutes.GET("/profile", handlers.GetProfileHandler(models.UserTypeMerchant))
+		merchantRoutes.PUT("/profile", handlers.UpdateProfileHandler(models.UserTypeMerchant))
+		merchantRoutes.PUT("/password", handlers.ChangePasswordHandler(models.UserTypeMerchant, cfg.LoginLockout))
+		merchantRoutes.POST("/email", handlers.ChangeEmailHandler(models.UserTypeMerchant, emails, cfg.LoginLockout))
+		merchantRoutes.GET("/audit", handlers.MerchantAuditHandler)
+
+		// Staff Management
+		staffRoutes := merchantRoutes.Group("/staff")
+		{
+			staffRoutes.POST("", handlers.InviteStaffHandler(emails))
+			staffRoutes.GET("", handlers.ListStaffHandler)
+			staffRoutes.GET("/:staff_id", handlers.GetStaffHandler)
+			staffRoutes.PUT("/:staff_id", handlers.UpdateStaffHandler)
+			staffRoutes.DELETE("/:staff_id", handlers.RemoveStaffHandler)
+		}
+
+		// API Keys for integrations
+		apiKeyRoutes := merchantRoutes.Group("/api-keys")
+		{
+			apiKeyRoutes.POST("", handlers.CreateAPIKeyHandler)
+			apiKeyRoutes.GET("", handlers.ListAPIKeysHandler)
+			apiKeyRoutes.DELETE("/:key_id", handlers.RevokeAPIKeyHandler)
+		}
 
 		// Merchant Venue Management
 		venueRoutes := merchantRoutes.Group("/venues")
@@ -113,7 +347,7 @@ func main() {
 			venueRoutes.POST("", handlers.CreateVenueHandler)
 			venueRoutes.GET("", handlers.GetSingleMerchantVenuesHandler) // Gets venues for the authenticated Merchant
 
-			venueRoutes.GET("/:venue_id", handlers.GetVenueHandler)
+			venueRoutes.GET("/:venue_id", handlers.GetMerchantVenueHandler)
 			venueRoutes.PUT("/:venue_id", handlers.UpdateVenueHandler)
 			venueRoutes.DELETE("/:venue_id", handlers.DeleteVenueHandler)
 
@@ -136,16 +370,99 @@ func main() {
 		// Merchant Order Management (venue-agnostic)
 		merchantOrderManagementRoutes := merchantRoutes.Group("/orders")
 		{
+			merchantOrderManagementRoutes.GET("/:order_id", handlers.GetMerchantOrderHandler)
 			merchantOrderManagementRoutes.PUT("/:order_id/status", handlers.UpdateOrderStatusHandler)
 		}
 	}
 
+	// --- Admin Routes ---
+	adminRoutes := v1.Group("/admin", handlers.AuthMiddleware(), handlers.RequireTwoFactor(cfg.TwoFactor), handlers.RequireAdmin(), handlers.RateLimit(cfg.RateLimits.API, handlers.ByUser))
+	{
+		adminRoutes.GET("/users", handlers.AdminSearchUsersHandler)
+		adminRoutes.GET("/users/:user_id", handlers.AdminGetUserHandler)
+		adminRoutes.POST("/users/:user_id/suspend", handlers.AdminSuspendUserHandler)
+		adminRoutes.POST("/users/:user_id/reinstate", handlers.AdminReinstateUserHandler)
+		adminRoutes.POST("/users/:user_id/impersonate", handlers.AdminImpersonateHandler)
+		adminRoutes.GET("/venues", handlers.AdminSearchVenuesHandler)
+		adminRoutes.GET("/orders", handlers.AdminSearchOrdersHandler)
+		adminRoutes.GET("/orders/:order_id", handlers.AdminGetOrderHandler)
+		adminRoutes.PUT("/orders/:order_id/status", handlers.AdminForceOrderStatusHandler)
+		adminRoutes.GET("/audit", handlers.AdminAuditHandler)
+		adminRoutes.GET("/audit/verify", handlers.AdminVerifyAuditHandler)
+	}
+
 	/* ROUTING ENDS */
 
-	port := ":8080"
-	log.Printf("Server listening on port %s", port)
-	if err := router.Run(port); err != nil {
-		log.Fatalf("Failed to run server: %v", err)
-		os.Exit(1)
+	return router
+}
+
+// startMetricsServer serves /metrics on the admin address when one is
+// configured. The admin port is meant to stay inside the private network, so
+// it needs no token.
+func startMetricsServer(cfg *config.Config, workers *worker.Group) {
+	if cfg.MetricsAddr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	server := &http.Server{
+		Addr:              cfg.MetricsAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: cfg.ReadTimeout,
+	}
+
+	slog.Info("Metrics listening", "addr", cfg.MetricsAddr)
+	workers.Go("metrics-server", func(ctx context.Context) error {
+		go func() {
+			<-ctx.Done()
+			server.Close()
+		}()
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	})
+}
+
+// setupTokens loads the keys that sign and verify tokens. Only the commands
+// that issue or verify tokens call it, so `key generate` can write the first
+// key into an empty JWT_KEYS_DIR.
+func setupTokens(cfg *config.Config) error {
+	if err := cfg.RequireJWTKeys(); err != nil {
+		return err
+	}
+	keys, err := keystore.Load(cfg.JWTKeysDir, cfg.JWTSigningKey, []byte(cfg.JWTSecret))
+	if err != nil {
+		return fmt.Errorf("load JWT keys: %w", err)
+	}
+	utils.SetKeys(keys, cfg.JWTIssuer, cfg.JWTAudience)
+	utils.SetLegacyCutoff(cfg.JWTLegacyCutoff)
+	if key := keys.SigningKey(); key != nil {
+		slog.Debug("JWT signing key loaded", "kid", key.ID, "alg", key.Algorithm)
+	}
+	return nil
+}
+
+// startRateLimiter points the rate limits at the configured store and sweeps
+// idle buckets in the background.
+func startRateLimiter(cfg *config.Config, conns *database.Connections, workers *worker.Group) {
+	if cfg.RateLimits.Store == ratelimit.StoreSQLite {
+		handlers.RateLimitStore = ratelimit.NewSQLStore(conns.Write)
+	}
+	store := handlers.RateLimitStore
+	workers.Go("rate-limit-sweeper", func(ctx context.Context) error {
+		return ratelimit.RunSweeper(ctx, store, time.Minute)
+	})
+}
+
+// openDatabase opens the configured SQLite database and points the handlers at it.
+func openDatabase(cfg *config.Config) (*database.Connections, error) {
+	conns, err := database.Open(cfg.DatabaseURI, cfg.Database)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
 	}
+	handlers.DB = conns.Write
+	handlers.ReadDB = conns.Read
+	return conns, nil
 }
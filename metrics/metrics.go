@@ -0,0 +1,114 @@
+// Package metrics holds the Prometheus collectors of the application: HTTP
+// traffic, database statements and business events such as placed orders.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "liven"
+
+// Registry holds every collector of the application. A dedicated registry
+// keeps /metrics free of whatever third-party packages register globally.
+var Registry = prometheus.NewRegistry()
+
+var (
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "HTTP requests by method, route template and status code.",
+	}, []string{"method", "route", "status"})
+
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "HTTP request latency by method and route template.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	DBQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "db",
+		Name:      "query_duration_seconds",
+		Help:      "Database statement latency by operation and table.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"operation", "table"})
+
+	DBQueryErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "db",
+		Name:      "query_errors_total",
+		Help:      "Failed database statements by operation and table. Missing rows are not counted.",
+	}, []string{"operation", "table"})
+
+	OrdersPlaced = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "orders",
+		Name:      "placed_total",
+		Help:      "Orders placed by diners.",
+	})
+
+	OrderValueCents = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "orders",
+		Name:      "value_cents_total",
+		Help:      "Sum of the totals of placed orders, in cents.",
+	})
+
+	OrderStatusTransitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "orders",
+		Name:      "status_transitions_total",
+		Help:      "Order status changes made by merchants, by previous and new status.",
+	}, []string{"from", "to"})
+
+	LoginFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "auth",
+		Name:      "login_failures_total",
+		Help:      "Failed login attempts by reason.",
+	}, []string{"reason"})
+	RateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "rate_limited_total",
+		Help:      "Requests refused by a rate limit, by route template.",
+	}, []string{"route"})
+)
+
+// Login failure reasons.
+const (
+	LoginUnknownUser   = "unknown_user"
+	LoginWrongPassword = "wrong_password"
+	LoginLocked        = "locked"
+	LoginWrongCode     = "wrong_2fa_code"
+	LoginWrongOTP      = "wrong_login_code"
+	LoginSuspended     = "suspended"
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequests,
+		HTTPRequestDuration,
+		DBQueryDuration,
+		DBQueryErrors,
+		OrdersPlaced,
+		OrderValueCents,
+		OrderStatusTransitions,
+		LoginFailures,
+		RateLimited,
+	)
+}
+
+// Handler serves the registry in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
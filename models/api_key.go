@@ -0,0 +1,43 @@
+package models
+
+import "time"
+
+// UserTypeAPIKey is the UserType of the claims of requests authenticated with
+// an API key. They act for the key's merchant, but only on the venues, menus
+// and orders the key's permissions cover.
+const UserTypeAPIKey = "api_key"
+
+// APIKeyPrefix starts every API key, so a leaked key is easy to recognise.
+const APIKeyPrefix = "lo_"
+
+// APIKey lets an integration such as a POS act for a merchant without the
+// merchant's password. Only the SHA-256 hash of the key is stored; the key
+// itself is shown once, when it is created.
+type APIKey struct {
+	ID         uint   `gorm:"primaryKey"`
+	MerchantID uint   `gorm:"not null;index"`
+	Name       string `gorm:"not null"`
+	// Prefix is the start of the key, to tell keys apart in listings.
+	Prefix  string `gorm:"not null"`
+	KeyHash string `gorm:"not null;uniqueIndex"`
+	// VenueID restricts the key to one venue of the merchant. Keys without
+	// one work at all of them.
+	VenueID *uint
+
+	PermissionSet `gorm:"embedded"`
+
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+	CreatedAt  time.Time
+}
+
+// Active reports whether the key is accepted at now.
+func (k *APIKey) Active(now time.Time) bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || now.Before(*k.ExpiresAt))
+}
+
+// CoversVenue reports whether the key may be used at the venue.
+func (k *APIKey) CoversVenue(venueID uint) bool {
+	return k.VenueID == nil || *k.VenueID == venueID
+}
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrAuditAppendOnly is returned when something tries to change or remove an
+// audit entry through GORM.
+var ErrAuditAppendOnly = errors.New("audit entries are append-only")
+
+// AuditEntry records who changed what. Entries are chained: Hash covers the
+// entry and PrevHash, the hash of the entry before it, so editing or
+// removing one breaks every later hash; see audit.Verify.
+type AuditEntry struct {
+	ID        uint      `gorm:"primaryKey"`
+	CreatedAt time.Time `gorm:"not null;index"`
+
+	// ActorID is the account that made the change and ActorType its type.
+	// ActorKeyID is the API key that made it, for changes made with one.
+	ActorID    *uint  `gorm:"index"`
+	ActorType  string `gorm:"not null"`
+	ActorKeyID *uint  `gorm:"index"`
+
+	Action     string `gorm:"not null;index"`
+	EntityType string `gorm:"not null;index:idx_audit_entries_entity"`
+	EntityID   uint   `gorm:"not null;index:idx_audit_entries_entity"`
+	// MerchantID and VenueID scope the entry to the merchant whose data
+	// changed, so merchants can read the history of their own venues.
+	MerchantID *uint `gorm:"index"`
+	VenueID    *uint `gorm:"index"`
+
+	// Changes is a JSON object mapping each changed field to its before and
+	// after values.
+	Changes   string `gorm:"not null"`
+	RequestID string
+
+	PrevHash string `gorm:"not null"`
+	Hash     string `gorm:"not null;uniqueIndex"`
+
+	// ClientIP is where the change came from, if it came through the API.
+	ClientIP *AuditIP `gorm:"foreignKey:AuditEntryID"`
+}
+
+func (*AuditEntry) BeforeUpdate(*gorm.DB) error { return ErrAuditAppendOnly }
+
+func (*AuditEntry) BeforeDelete(*gorm.DB) error { return ErrAuditAppendOnly }
+
+// AuditIP is the client IP address of an audit entry. It is kept apart from
+// the entry and outside its hash, so it can be erased with the account that
+// made the change without breaking the chain.
+type AuditIP struct {
+	AuditEntryID uint   `gorm:"primaryKey;autoIncrement:false"`
+	ActorID      *uint  `gorm:"index"`
+	IP           string `gorm:"not null"`
+}
@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// UserIdentity links an account at an OpenID Connect provider to a user,
+// who can then log in there instead of with a password. Subject is the
+// provider's ID for the account, which stays the same when its address
+// changes.
+type UserIdentity struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"not null;index"`
+	Provider  string `gorm:"not null;uniqueIndex:idx_user_identities_provider_subject"`
+	Subject   string `gorm:"not null;uniqueIndex:idx_user_identities_provider_subject"`
+	CreatedAt time.Time
+}
+
+// OIDCLogin is a login started at an OpenID Connect provider and not yet
+// finished. The state sent through the provider finds it again; only its
+// SHA-256 hash is stored. Nonce and CodeVerifier tie the ID token to this
+// login.
+type OIDCLogin struct {
+	ID           uint      `gorm:"primaryKey"`
+	Provider     string    `gorm:"not null"`
+	StateHash    string    `gorm:"not null;uniqueIndex"`
+	Nonce        string    `gorm:"not null"`
+	CodeVerifier string    `gorm:"not null"`
+	ExpiresAt    time.Time `gorm:"not null;index"`
+	CreatedAt    time.Time
+}
@@ -0,0 +1,24 @@
+package models
+
+import "time"
+
+// Channels a LoginCode is sent through.
+const (
+	LoginCodeChannelEmail = "email"
+	LoginCodeChannelSMS   = "sms"
+)
+
+// LoginCode is a short single-use code sent to a user to log in without a
+// password. Being short, it is only tried against its own user and stops
+// working after a few wrong attempts. Only the SHA-256 hash of the code is
+// stored.
+type LoginCode struct {
+	ID        uint      `gorm:"primaryKey"`
+	UserID    uint      `gorm:"not null;index"`
+	Channel   string    `gorm:"not null"`
+	CodeHash  string    `gorm:"not null"`
+	Attempts  int       `gorm:"not null;default:0"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
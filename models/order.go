@@ -27,6 +27,24 @@ type Order struct {
 	TotalAmountInCents int64       `json:"total_amount_in_cents" gorm:"not null"`
 	Status             OrderStatus `json:"status" gorm:"not null;index"`
 	OrderTimestamp     time.Time   `json:"order_timestamp" gorm:"not null"`
+	// StatusReason is why an admin last forced the status, if they did.
+	StatusReason string `json:"-"`
+}
+
+// Valid reports whether s is one of the order statuses.
+func (s OrderStatus) Valid() bool {
+	switch s {
+	case
+		OrderStatusPending,
+		OrderStatusRejected,
+		OrderStatusAccepted,
+		OrderStatusCancelled,
+		OrderStatusPreparing,
+		OrderStatusReadyForDelivery,
+		OrderStatusCompleted:
+		return true
+	}
+	return false
 }
 
 type OrderItem struct {
@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// RateLimitBucket is the token bucket of one rate-limit key, kept in the
+// database when RATE_LIMIT_STORE is sqlite.
+type RateLimitBucket struct {
+	Key    string    `gorm:"primaryKey"`
+	Tokens float64   `gorm:"not null"`
+	At     time.Time `gorm:"not null"`
+	// FullAt is when the bucket will have refilled completely. Buckets past
+	// it are swept.
+	FullAt time.Time `gorm:"not null;index"`
+}
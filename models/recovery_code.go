@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// RecoveryCode is a single-use code that stands in for a TOTP code when the
+// user has lost their authenticator. Only the SHA-256 hash of the code is
+// stored.
+type RecoveryCode struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"not null;index"`
+	CodeHash  string `gorm:"not null;uniqueIndex"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// Session is a login of a user on one device. Its access tokens carry its
+// ID, and stop working once it is deleted, which signs the device out.
+// ExpiresAt is when its latest token expires.
+type Session struct {
+	ID         uint   `gorm:"primaryKey"`
+	UserID     uint   `gorm:"not null;index"`
+	DeviceName string `gorm:"not null"`
+	UserAgent  string `gorm:"not null"`
+	IP         string `gorm:"not null"`
+	CreatedAt  time.Time
+	LastSeenAt time.Time `gorm:"not null"`
+	ExpiresAt  time.Time `gorm:"not null;index"`
+}
@@ -0,0 +1,90 @@
+package models
+
+import "time"
+
+// StaffPermission is something a staff account may do at a venue.
+type StaffPermission string
+
+const (
+	PermissionManageMenu    StaffPermission = "manage_menu"
+	PermissionManageOrders  StaffPermission = "manage_orders"
+	PermissionViewAnalytics StaffPermission = "view_analytics"
+)
+
+// StaffPermissions lists every StaffPermission.
+var StaffPermissions = []StaffPermission{PermissionManageMenu, PermissionManageOrders, PermissionViewAnalytics}
+
+// StaffAssignment lets a staff account work at one venue of its merchant.
+type StaffAssignment struct {
+	ID      uint `gorm:"primaryKey"`
+	UserID  uint `gorm:"not null;uniqueIndex:idx_staff_assignments_user_venue"`
+	VenueID uint `gorm:"not null;uniqueIndex:idx_staff_assignments_user_venue;index"`
+
+	PermissionSet `gorm:"embedded"`
+
+	Venue     Venue `gorm:"foreignKey:VenueID"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// PermissionSet holds what a staff assignment or an API key grants. Each
+// permission is its own column so access checks are a single indexed query.
+type PermissionSet struct {
+	ManageMenu    bool `gorm:"not null;default:false"`
+	ManageOrders  bool `gorm:"not null;default:false"`
+	ViewAnalytics bool `gorm:"not null;default:false"`
+}
+
+// Permissions lists the permissions the set grants.
+func (s *PermissionSet) Permissions() []StaffPermission {
+	permissions := []StaffPermission{}
+	for _, p := range StaffPermissions {
+		if s.Has(p) {
+			permissions = append(permissions, p)
+		}
+	}
+	return permissions
+}
+
+// Has reports whether the set grants p.
+func (s *PermissionSet) Has(p StaffPermission) bool {
+	switch p {
+	case PermissionManageMenu:
+		return s.ManageMenu
+	case PermissionManageOrders:
+		return s.ManageOrders
+	case PermissionViewAnalytics:
+		return s.ViewAnalytics
+	}
+	return false
+}
+
+// HasAny reports whether the set grants any of permissions.
+func (s *PermissionSet) HasAny(permissions []StaffPermission) bool {
+	for _, p := range permissions {
+		if s.Has(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Grant adds p to the set. It reports false for unknown permissions.
+func (s *PermissionSet) Grant(p StaffPermission) bool {
+	switch p {
+	case PermissionManageMenu:
+		s.ManageMenu = true
+	case PermissionManageOrders:
+		s.ManageOrders = true
+	case PermissionViewAnalytics:
+		s.ViewAnalytics = true
+	default:
+		return false
+	}
+	return true
+}
+
+// Column returns the column of p in staff_assignments and api_keys.
+func (p StaffPermission) Column() string {
+	return string(p)
+}
@@ -1,10 +1,21 @@
 package models
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
 
 const (
 	UserTypeDiner    = "diner"
 	UserTypeMerchant = "merchant"
+	// UserTypeStaff accounts are invited by a merchant to work at some of
+	// their venues; see StaffAssignment.
+	UserTypeStaff = "staff"
+	// UserTypeAdmin accounts run the platform through the /admin API. They
+	// can only be created from the command line.
+	UserTypeAdmin = "admin"
 )
 
 type User struct {
@@ -12,6 +23,69 @@ type User struct {
 	Email    string `json:"email" gorm:"uniqueIndex;not null"`
 	Password string `json:"-" gorm:"not null"`
 	UserType string `json:"user_type" gorm:"not null"`
+	// MerchantID is the merchant a staff account works for.
+	MerchantID *uint `json:"-" gorm:"index"`
+
+	// EmailVerifiedAt is when the owner proved they receive mail at Email.
+	// Merchants can't create venues until it is set.
+	EmailVerifiedAt *time.Time `json:"-"`
+	// PendingEmail is the address the owner asked to change Email to. It
+	// replaces Email once verified.
+	PendingEmail string `json:"-"`
+
+	// Profile details the owner manages. MarketingConsentAt is when they
+	// agreed to receive marketing, and nil unless they currently do.
+	DisplayName        string     `json:"-"`
+	Phone              string     `json:"-"`
+	AvatarURL          string     `json:"-"`
+	Locale             string     `json:"-"`
+	MarketingConsentAt *time.Time `json:"-"`
+
+	// FailedLogins counts consecutive wrong passwords. LockedUntil is set
+	// once it reaches the lockout threshold; see services.LockoutPolicy.
+	FailedLogins int        `json:"-" gorm:"not null;default:0"`
+	LockedUntil  *time.Time `json:"-"`
+
+	// TOTPSecret is the base32 secret of the user's authenticator app. It is
+	// set while enrolling and only checked at login once TOTPEnabledAt is
+	// set. TOTPLastStep is the time step of the last accepted code, which
+	// can't be used again.
+	TOTPSecret    string     `json:"-"`
+	TOTPEnabledAt *time.Time `json:"-"`
+	TOTPLastStep  int64      `json:"-" gorm:"not null;default:0"`
+
+	// SuspendedAt is set when an admin suspends the account, which can't
+	// log in or use its tokens until reinstated. SuspensionReason says why.
+	SuspendedAt      *time.Time `json:"-"`
+	SuspensionReason string     `json:"-"`
+
+	// TokensRevokedAt invalidates the access tokens issued before it, to
+	// sign the account out everywhere. It is truncated to the precision
+	// tokens record their issue time with.
+	TokensRevokedAt *time.Time `json:"-"`
+
+	// DeletionDueAt is set when the owner asks to delete the account. Until
+	// then, logging in restores it; afterwards its personal data is
+	// anonymized and DeletedAt set. Deleted accounts are left out of every
+	// query, but their orders keep referring to them.
+	DeletionDueAt *time.Time     `json:"-" gorm:"index"`
+	DeletedAt     gorm.DeletedAt `json:"-" gorm:"index"`
+}
+
+// Suspended reports whether an admin suspended the account.
+func (u *User) Suspended() bool {
+	return u.SuspendedAt != nil
+}
+
+// TokenRevoked reports whether an access token issued at issuedAt was
+// revoked by TokensRevokedAt.
+func (u *User) TokenRevoked(issuedAt time.Time) bool {
+	return u.TokensRevokedAt != nil && issuedAt.Before(*u.TokensRevokedAt)
+}
+
+// TwoFactorEnabled reports whether logins need a second factor.
+func (u *User) TwoFactorEnabled() bool {
+	return u.TOTPEnabledAt != nil
 }
 
 // HashPassword hashes the user's password
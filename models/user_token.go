@@ -0,0 +1,24 @@
+package models
+
+import "time"
+
+// Purposes of a UserToken.
+const (
+	TokenPurposeEmailVerification = "email_verification"
+	TokenPurposePasswordReset     = "password_reset"
+	TokenPurposeStaffInvite       = "staff_invite"
+	TokenPurposeEmailChange       = "email_change"
+	TokenPurposeMagicLink         = "magic_link"
+)
+
+// UserToken is a single-use secret mailed to a user to prove they own the
+// address. Only the SHA-256 hash of the secret is stored.
+type UserToken struct {
+	ID        uint      `gorm:"primaryKey"`
+	UserID    uint      `gorm:"not null;index"`
+	Purpose   string    `gorm:"not null"`
+	TokenHash string    `gorm:"not null;uniqueIndex"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
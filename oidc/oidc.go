@@ -0,0 +1,368 @@
+// Package oidc logs users in with an external OpenID Connect provider such as
+// Google or Apple. It discovers the provider's endpoints, sends users there
+// with a PKCE challenge, exchanges the code they come back with for an ID
+// token and validates it against the provider's published keys.
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"liven-one-go/keystore"
+)
+
+var (
+	// ErrInvalidGrant is returned when the provider refuses an authorization
+	// code, because it is wrong, expired, already used or doesn't match the
+	// PKCE verifier.
+	ErrInvalidGrant = errors.New("the provider refused the authorization code")
+	// ErrInvalidIDToken is returned for ID tokens that fail validation.
+	ErrInvalidIDToken = errors.New("ID token is invalid")
+)
+
+// DefaultScopes are requested when a Config has none.
+var DefaultScopes = []string{"openid", "email", "profile"}
+
+// keyRefreshInterval limits how often the provider's keys are fetched again
+// for a token signed with an unknown key, so forged key IDs can't make every
+// login call the provider.
+const keyRefreshInterval = time.Minute
+
+// maxResponseSize caps what is read from the provider.
+const maxResponseSize = 1 << 20
+
+// supportedAlgorithms are the ID token signatures the client can check.
+var supportedAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "EdDSA"}
+
+// Config describes a provider and the client registered with it.
+type Config struct {
+	// Name identifies the provider in URLs, such as "google".
+	Name   string
+	Issuer string
+
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is where the provider sends users back with a code. It
+	// must be registered with the provider.
+	RedirectURL string
+	Scopes      []string
+}
+
+// Metadata is the part of the provider's discovery document the client uses.
+type Metadata struct {
+	Issuer                   string   `json:"issuer"`
+	AuthorizationEndpoint    string   `json:"authorization_endpoint"`
+	TokenEndpoint            string   `json:"token_endpoint"`
+	JWKSURI                  string   `json:"jwks_uri"`
+	IDTokenSigningAlgs       []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethods []string `json:"token_endpoint_auth_methods_supported"`
+}
+
+// Identity is the account a user logged in with at the provider.
+type Identity struct {
+	// Subject is the provider's stable ID for the account. Unlike the
+	// address, it never changes.
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// Client logs users in with one provider. Its discovery document and keys
+// are fetched on first use and cached, so the server starts while the
+// provider is unreachable.
+type Client struct {
+	config Config
+	http   *http.Client
+
+	mu          sync.Mutex
+	metadata    *Metadata
+	keys        map[string]any
+	keysFetched time.Time
+}
+
+// New returns a client for the provider of config, calling it with
+// httpClient.
+func New(config Config, httpClient *http.Client) *Client {
+	if len(config.Scopes) == 0 {
+		config.Scopes = DefaultScopes
+	}
+	return &Client{config: config, http: httpClient}
+}
+
+// Name returns the name of the provider.
+func (c *Client) Name() string {
+	return c.config.Name
+}
+
+// Metadata returns the provider's discovery document.
+func (c *Client) Metadata(ctx context.Context) (*Metadata, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.discover(ctx)
+}
+
+func (c *Client) discover(ctx context.Context) (*Metadata, error) {
+	if c.metadata != nil {
+		return c.metadata, nil
+	}
+
+	var metadata Metadata
+	discoveryURL := strings.TrimSuffix(c.config.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := c.getJSON(ctx, discoveryURL, &metadata); err != nil {
+		return nil, fmt.Errorf("discover %s: %w", c.config.Name, err)
+	}
+	// The document must describe the issuer it was fetched from, or its
+	// endpoints could be anyone's.
+	if metadata.Issuer != c.config.Issuer {
+		return nil, fmt.Errorf("discover %s: document is for issuer %q", c.config.Name, metadata.Issuer)
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, fmt.Errorf("discover %s: document lacks endpoints", c.config.Name)
+	}
+	c.metadata = &metadata
+	return c.metadata, nil
+}
+
+// AuthCodeURL returns the URL that sends users to the provider to log in.
+// state comes back with them; nonce comes back in the ID token; verifier is
+// kept secret until Exchange and only its challenge is sent.
+func (c *Client) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	metadata, err := c.Metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {c.config.ClientID},
+		"redirect_uri":          {c.config.RedirectURL},
+		"scope":                 {strings.Join(c.config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {Challenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(metadata.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return metadata.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Challenge returns the S256 PKCE challenge of verifier.
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Exchange trades the code a user came back with, and the verifier of the
+// challenge sent with them, for the user's identity.
+func (c *Client) Exchange(ctx context.Context, code, verifier, nonce string) (*Identity, error) {
+	metadata, err := c.Metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {c.config.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	basic := len(metadata.TokenEndpointAuthMethods) == 0 || slices.Contains(metadata.TokenEndpointAuthMethods, "client_secret_basic")
+	if !basic {
+		form.Set("client_id", c.config.ClientID)
+		form.Set("client_secret", c.config.ClientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if basic {
+		req.SetBasicAuth(url.QueryEscape(c.config.ClientID), url.QueryEscape(c.config.ClientSecret))
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("exchange code: %w", err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&body); err != nil {
+		return nil, fmt.Errorf("exchange code: %s: %w", resp.Status, err)
+	}
+	if body.Error == "invalid_grant" {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidGrant, body.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK || body.IDToken == "" {
+		return nil, fmt.Errorf("exchange code: %s %s %s", resp.Status, body.Error, body.ErrorDescription)
+	}
+	return c.Verify(ctx, body.IDToken, nonce)
+}
+
+// idTokenClaims are the claims of an ID token the client reads.
+type idTokenClaims struct {
+	Nonce           string   `json:"nonce"`
+	AuthorizedParty string   `json:"azp"`
+	Email           string   `json:"email"`
+	EmailVerified   flexBool `json:"email_verified"`
+	Name            string   `json:"name"`
+	jwt.RegisteredClaims
+}
+
+// flexBool decodes booleans some providers send as "true" or "false".
+type flexBool bool
+
+func (b *flexBool) UnmarshalJSON(data []byte) error {
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case bool:
+		*b = flexBool(v)
+	case string:
+		*b = v == "true"
+	}
+	return nil
+}
+
+// Verify validates an ID token issued to the client for the login that sent
+// nonce, and returns the identity it asserts.
+func (c *Client) Verify(ctx context.Context, rawIDToken, nonce string) (*Identity, error) {
+	metadata, err := c.Metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	algorithms := supportedAlgorithms
+	if len(metadata.IDTokenSigningAlgs) > 0 {
+		algorithms = slices.DeleteFunc(slices.Clone(metadata.IDTokenSigningAlgs), func(alg string) bool {
+			return !slices.Contains(supportedAlgorithms, alg)
+		})
+	}
+
+	var claims idTokenClaims
+	_, err = jwt.ParseWithClaims(rawIDToken, &claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		return c.key(ctx, kid)
+	},
+		jwt.WithValidMethods(algorithms),
+		jwt.WithIssuer(metadata.Issuer),
+		jwt.WithAudience(c.config.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidIDToken, err)
+	}
+	if claims.Nonce != nonce {
+		return nil, fmt.Errorf("%w: nonce doesn't match the login", ErrInvalidIDToken)
+	}
+	if claims.AuthorizedParty != "" && claims.AuthorizedParty != c.config.ClientID {
+		return nil, fmt.Errorf("%w: issued to %q", ErrInvalidIDToken, claims.AuthorizedParty)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: no subject", ErrInvalidIDToken)
+	}
+
+	return &Identity{
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: bool(claims.EmailVerified),
+		Name:          claims.Name,
+	}, nil
+}
+
+// key returns the provider's public key with the ID kid, fetching the keys
+// again when it is unknown, as the provider may have rotated them. Tokens
+// without a kid are accepted from providers with a single key.
+func (c *Client) key(ctx context.Context, kid string) (any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if key, ok := c.lookup(kid); ok {
+		return key, nil
+	}
+	if time.Since(c.keysFetched) < keyRefreshInterval {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	if err := c.fetchKeys(ctx); err != nil {
+		return nil, err
+	}
+	if key, ok := c.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+func (c *Client) lookup(kid string) (any, bool) {
+	if kid == "" && len(c.keys) == 1 {
+		for _, key := range c.keys {
+			return key, true
+		}
+	}
+	key, ok := c.keys[kid]
+	return key, ok
+}
+
+func (c *Client) fetchKeys(ctx context.Context) error {
+	metadata, err := c.discover(ctx)
+	if err != nil {
+		return err
+	}
+	var set keystore.JWKS
+	if err := c.getJSON(ctx, metadata.JWKSURI, &set); err != nil {
+		return fmt.Errorf("get keys of %s: %w", c.config.Name, err)
+	}
+
+	keys := make(map[string]any, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		// Keys of other types are skipped, so one the client can't use
+		// doesn't hide those it can.
+		if key, err := jwk.PublicKey(); err == nil {
+			keys[jwk.KeyID] = key
+		}
+	}
+	c.keys, c.keysFetched = keys, time.Now()
+	return nil
+}
+
+func (c *Client) getJSON(ctx context.Context, url string, dst any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(dst)
+}
@@ -0,0 +1,108 @@
+package oidc_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"liven-one-go/oidc"
+	"liven-one-go/oidc/oidctest"
+)
+
+const redirectURL = "https://app.example.com/oidc/stand-in/callback"
+
+// login follows the authorization URL like a browser and returns the code
+// and state the provider sent back.
+func login(t *testing.T, provider *oidctest.Provider, authURL string) (code, state string) {
+	t.Helper()
+	client := provider.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: %s, Location %q", resp.Status, resp.Header.Get("Location"))
+	}
+	return location.Query().Get("code"), location.Query().Get("state")
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	provider := oidctest.NewProvider("liven-one", "client-secret")
+	defer provider.Close()
+	provider.SignIn(oidctest.User{Subject: "248289761001", Email: "jane@example.com", EmailVerified: true, Name: "Jane"})
+	client := oidc.New(provider.Config("stand-in", redirectURL), provider.Client())
+	ctx := context.Background()
+
+	authURL, err := client.AuthCodeURL(ctx, "the-state", "the-nonce", "the-verifier-that-is-long-enough-for-pkce-43")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, state := login(t, provider, authURL)
+	if state != "the-state" {
+		t.Fatalf("state = %q", state)
+	}
+
+	identity, err := client.Exchange(ctx, code, "the-verifier-that-is-long-enough-for-pkce-43", "the-nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *identity != (oidc.Identity{Subject: "248289761001", Email: "jane@example.com", EmailVerified: true, Name: "Jane"}) {
+		t.Errorf("identity = %+v", identity)
+	}
+
+	// Codes work once.
+	if _, err := client.Exchange(ctx, code, "the-verifier-that-is-long-enough-for-pkce-43", "the-nonce"); !errors.Is(err, oidc.ErrInvalidGrant) {
+		t.Errorf("reused code: err = %v", err)
+	}
+
+	// A code intercepted on its way back is useless without the verifier.
+	code, _ = login(t, provider, authURL)
+	if _, err := client.Exchange(ctx, code, "a-guessed-verifier", "the-nonce"); !errors.Is(err, oidc.ErrInvalidGrant) {
+		t.Errorf("wrong verifier: err = %v", err)
+	}
+
+	// An ID token replayed into another login fails its nonce.
+	code, _ = login(t, provider, authURL)
+	if _, err := client.Exchange(ctx, code, "the-verifier-that-is-long-enough-for-pkce-43", "another-nonce"); !errors.Is(err, oidc.ErrInvalidIDToken) {
+		t.Errorf("wrong nonce: err = %v", err)
+	}
+}
+
+func TestVerifyRefusesOtherIssuers(t *testing.T) {
+	provider := oidctest.NewProvider("liven-one", "client-secret")
+	defer provider.Close()
+	impostor := oidctest.NewProvider("liven-one", "client-secret")
+	defer impostor.Close()
+	client := oidc.New(provider.Config("stand-in", redirectURL), provider.Client())
+	ctx := context.Background()
+
+	user := oidctest.User{Subject: "1", Email: "jane@example.com", EmailVerified: true}
+	genuine, err := provider.IDToken(user, "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Verify(ctx, genuine, "nonce"); err != nil {
+		t.Fatalf("genuine token: %v", err)
+	}
+
+	// The impostor signs a token for the same client with its own key.
+	forged, err := impostor.IDToken(user, "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Verify(ctx, forged, "nonce"); !errors.Is(err, oidc.ErrInvalidIDToken) {
+		t.Errorf("impostor's token: err = %v", err)
+	}
+
+	// A discovery document must be for the issuer configured.
+	config := provider.Config("stand-in", redirectURL)
+	config.Issuer = provider.Issuer + "/"
+	if _, err := oidc.New(config, provider.Client()).Metadata(ctx); err == nil {
+		t.Error("Metadata accepted a document for another issuer")
+	}
+}
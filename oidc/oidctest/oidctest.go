@@ -0,0 +1,201 @@
+// Package oidctest runs a stand-in OpenID Connect provider for tests. It
+// implements discovery, the authorization code flow with PKCE and a JWKS,
+// and logs in whichever user was last passed to SignIn without asking.
+package oidctest
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"liven-one-go/keystore"
+	"liven-one-go/oidc"
+)
+
+// User is an account at the stand-in provider.
+type User struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// Provider is a running stand-in provider.
+type Provider struct {
+	// Issuer is the base URL of the provider, its discovery document is
+	// under it.
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+
+	server *httptest.Server
+	key    *keystore.Key
+
+	mu    sync.Mutex
+	user  User
+	codes map[string]grant
+}
+
+// grant is an authorization code and the login it was issued for.
+type grant struct {
+	user        User
+	redirectURI string
+	nonce       string
+	challenge   string
+}
+
+// NewProvider starts a provider that accepts the client clientID with
+// clientSecret. Close it when done.
+func NewProvider(clientID, clientSecret string) *Provider {
+	pem, err := keystore.GenerateKey(keystore.AlgorithmRS256)
+	if err != nil {
+		panic(err)
+	}
+	key, err := keystore.ParsePrivateKey("stand-in", pem)
+	if err != nil {
+		panic(err)
+	}
+
+	p := &Provider{ClientID: clientID, ClientSecret: clientSecret, key: key, codes: map[string]grant{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("GET /authorize", p.authorize)
+	mux.HandleFunc("POST /token", p.token)
+	mux.HandleFunc("GET /jwks", p.jwks)
+	p.server = httptest.NewServer(mux)
+	p.Issuer = p.server.URL
+	return p
+}
+
+// Config returns the configuration of a client of the provider called name
+// that users are sent back from to redirectURL.
+func (p *Provider) Config(name, redirectURL string) oidc.Config {
+	return oidc.Config{Name: name, Issuer: p.Issuer, ClientID: p.ClientID, ClientSecret: p.ClientSecret, RedirectURL: redirectURL}
+}
+
+// Client returns an HTTP client that reaches the provider.
+func (p *Provider) Client() *http.Client {
+	return p.server.Client()
+}
+
+// Close stops the provider.
+func (p *Provider) Close() {
+	p.server.Close()
+}
+
+// SignIn makes user the account the next logins are for.
+func (p *Provider) SignIn(user User) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.user = user
+}
+
+func (p *Provider) discovery(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, oidc.Metadata{
+		Issuer:                   p.Issuer,
+		AuthorizationEndpoint:    p.Issuer + "/authorize",
+		TokenEndpoint:            p.Issuer + "/token",
+		JWKSURI:                  p.Issuer + "/jwks",
+		IDTokenSigningAlgs:       []string{keystore.AlgorithmRS256},
+		TokenEndpointAuthMethods: []string{"client_secret_basic"},
+	})
+}
+
+// authorize sends the browser back to the client with a code for the
+// signed-in user, as a provider does once its user agreed.
+func (p *Provider) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	redirectURI, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || query.Get("redirect_uri") == "" || query.Get("client_id") != p.ClientID ||
+		query.Get("response_type") != "code" || query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+
+	code := random()
+	p.mu.Lock()
+	p.codes[code] = grant{user: p.user, redirectURI: query.Get("redirect_uri"), nonce: query.Get("nonce"), challenge: query.Get("code_challenge")}
+	p.mu.Unlock()
+
+	back := redirectURI.Query()
+	back.Set("code", code)
+	back.Set("state", query.Get("state"))
+	redirectURI.RawQuery = back.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+// token exchanges a code for an ID token, once.
+func (p *Provider) token(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok || clientID != p.ClientID || clientSecret != p.ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+
+	p.mu.Lock()
+	code := r.PostForm.Get("code")
+	g, ok := p.codes[code]
+	delete(p.codes, code)
+	p.mu.Unlock()
+	if !ok || g.redirectURI != r.PostForm.Get("redirect_uri") || oidc.Challenge(r.PostForm.Get("code_verifier")) != g.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	idToken, err := p.IDToken(g.user, g.nonce)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"access_token": random(), "token_type": "Bearer", "expires_in": 3600, "id_token": idToken})
+}
+
+// IDToken signs an ID token for user issued to the client, as the token
+// endpoint returns for a login that sent nonce.
+func (p *Provider) IDToken(user User, nonce string) (string, error) {
+	now := time.Now()
+	token := jwt.NewWithClaims(p.key.Method(), jwt.MapClaims{
+		"iss":            p.Issuer,
+		"aud":            p.ClientID,
+		"sub":            user.Subject,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+		"nonce":          nonce,
+		"email":          user.Email,
+		"email_verified": user.EmailVerified,
+		"name":           user.Name,
+	})
+	token.Header["kid"] = p.key.ID
+	return p.key.Sign(token)
+}
+
+func (p *Provider) jwks(w http.ResponseWriter, _ *http.Request) {
+	store, err := keystore.New(p.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, store.JWKS())
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func random() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,32 @@
+package openapi
+
+import (
+	"fmt"
+	"html"
+)
+
+// swaggerUIVersion pins the Swagger UI assets loaded from the CDN.
+const swaggerUIVersion = "5.17.14"
+
+// DocsPage returns an HTML page rendering the document at specURL with Swagger UI.
+func DocsPage(title, specURL string) string {
+	return fmt.Sprintf(`<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>%[1]s</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@%[3]s/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@%[3]s/swagger-ui-bundle.js" crossorigin></script>
+  <script>
+    window.onload = () => {
+      window.ui = SwaggerUIBundle({ url: %[2]q, dom_id: "#swagger-ui" });
+    };
+  </script>
+</body>
+</html>
+`, html.EscapeString(title), specURL, swaggerUIVersion)
+}
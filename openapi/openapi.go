@@ -0,0 +1,454 @@
+// Package openapi builds an OpenAPI 3 document from the route table and the
+// Go request and response types, so the published contract can't drift from
+// the structs the handlers bind and render.
+package openapi
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Version is the OpenAPI version of the generated documents.
+const Version = "3.0.3"
+
+// Document is the subset of the OpenAPI 3 object model the API needs.
+type Document struct {
+	OpenAPI    string               `json:"openapi"`
+	Info       Info                 `json:"info"`
+	Paths      map[string]*PathItem `json:"paths"`
+	Components Components           `json:"components"`
+}
+
+type Info struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+// PathItem maps lower-case HTTP methods to operations.
+type PathItem map[string]*OperationObject
+
+type OperationObject struct {
+	OperationID string                     `json:"operationId"`
+	Summary     string                     `json:"summary,omitempty"`
+	Tags        []string                   `json:"tags,omitempty"`
+	Parameters  []Parameter                `json:"parameters,omitempty"`
+	RequestBody *RequestBody               `json:"requestBody,omitempty"`
+	Responses   map[string]*ResponseObject `json:"responses"`
+	Security    []map[string][]string      `json:"security,omitempty"`
+}
+
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+type ResponseObject struct {
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type Components struct {
+	Schemas         map[string]*Schema         `json:"schemas"`
+	SecuritySchemes map[string]*SecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+type SecurityScheme struct {
+	Type         string `json:"type"`
+	Scheme       string `json:"scheme,omitempty"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+	In           string `json:"in,omitempty"`
+	Name         string `json:"name,omitempty"`
+}
+
+// Schema is a JSON schema in the OpenAPI 3.0 dialect.
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Enum                 []any              `json:"enum,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	ExclusiveMinimum     bool               `json:"exclusiveMinimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+}
+
+// Fields describes an ad hoc JSON object, such as the {"venue": ...}
+// envelopes built with gin.H. Every field is required.
+type Fields map[string]any
+
+// Operation declares one route of the API.
+type Operation struct {
+	Method string
+	// Path uses gin syntax: /venues/:venue_id.
+	Path    string
+	Summary string
+	Tags    []string
+	// Auth marks routes that need a bearer token.
+	Auth bool
+	// APIKey marks authenticated routes that also accept the API key
+	// declared with Spec.APIKeyHeader.
+	APIKey bool
+	Query  []Parameter
+	// Request is a value of the JSON body type, nil for routes without a body.
+	Request any
+	// Responses maps status codes to a value of the body type, or to nil for
+	// an empty or error-only response.
+	Responses map[int]any
+}
+
+// Spec collects operations and the schemas of the types they reference.
+type Spec struct {
+	doc       Document
+	routes    map[string]bool
+	overrides map[reflect.Type]*Schema
+	names     map[string]reflect.Type
+
+	errorMediaType string
+	errorBody      any
+}
+
+// New starts an empty document. Every 4xx and 5xx response is documented
+// with errorBody, served as errorMediaType.
+func New(info Info, errorMediaType string, errorBody any) *Spec {
+	return &Spec{
+		doc: Document{
+			OpenAPI: Version,
+			Info:    info,
+			Paths:   map[string]*PathItem{},
+			Components: Components{
+				Schemas: map[string]*Schema{},
+				SecuritySchemes: map[string]*SecurityScheme{
+					"bearerAuth": {Type: "http", Scheme: "bearer", BearerFormat: "JWT"},
+				},
+			},
+		},
+		routes:    map[string]bool{},
+		overrides: map[reflect.Type]*Schema{},
+		names:     map[string]reflect.Type{},
+
+		errorMediaType: errorMediaType,
+		errorBody:      errorBody,
+	}
+}
+
+// APIKeyHeader declares that operations marked APIKey accept an API key in
+// the named header.
+func (s *Spec) APIKeyHeader(name string) {
+	s.doc.Components.SecuritySchemes["apiKeyAuth"] = &SecurityScheme{Type: "apiKey", In: "header", Name: name}
+}
+
+// Override documents values of v's type as schema instead of reflecting on
+// them, for types with custom JSON encodings.
+func (s *Spec) Override(v any, schema Schema) {
+	s.overrides[reflect.TypeOf(v)] = &schema
+}
+
+// Enum restricts a named string type to values.
+func (s *Spec) Enum(v any, values ...any) {
+	t := reflect.TypeOf(v)
+	s.overrides[t] = &Schema{Type: "string", Enum: values}
+}
+
+// Add registers an operation.
+func (s *Spec) Add(op Operation) {
+	method := strings.ToUpper(op.Method)
+	s.routes[routeKey(method, op.Path)] = true
+
+	path, params := convertPath(op.Path)
+	item, ok := s.doc.Paths[path]
+	if !ok {
+		item = &PathItem{}
+		s.doc.Paths[path] = item
+	}
+
+	operation := &OperationObject{
+		OperationID: operationID(method, op.Path),
+		Summary:     op.Summary,
+		Tags:        op.Tags,
+		Parameters:  append(params, op.Query...),
+		Responses:   map[string]*ResponseObject{},
+	}
+	if op.Auth {
+		operation.Security = []map[string][]string{{"bearerAuth": {}}}
+	}
+	if op.Auth && op.APIKey {
+		operation.Security = append(operation.Security, map[string][]string{"apiKeyAuth": {}})
+	}
+	if op.Request != nil {
+		operation.RequestBody = &RequestBody{
+			Required: true,
+			Content:  map[string]MediaType{"application/json": {Schema: s.schemaOf(op.Request)}},
+		}
+	}
+	for status, body := range op.Responses {
+		response := &ResponseObject{Description: http.StatusText(status)}
+		switch {
+		case body == nil && status >= http.StatusBadRequest:
+			response.Content = map[string]MediaType{s.errorMediaType: {Schema: s.schemaOf(s.errorBody)}}
+		case body != nil:
+			response.Content = map[string]MediaType{"application/json": {Schema: s.schemaOf(body)}}
+		}
+		operation.Responses[fmt.Sprint(status)] = response
+	}
+
+	(*item)[strings.ToLower(method)] = operation
+}
+
+// Has reports whether the route, in gin syntax, has been added.
+func (s *Spec) Has(method, path string) bool {
+	return s.routes[routeKey(strings.ToUpper(method), path)]
+}
+
+// Document returns the assembled document.
+func (s *Spec) Document() *Document {
+	return &s.doc
+}
+
+// QueryParam describes an optional string query parameter.
+func QueryParam(name, description string) Parameter {
+	return Parameter{Name: name, In: "query", Description: description, Schema: &Schema{Type: "string"}}
+}
+
+func routeKey(method, path string) string {
+	return method + " " + path
+}
+
+// convertPath turns /venues/:venue_id into /venues/{venue_id} and declares
+// each path segment parameter as an integer ID.
+func convertPath(path string) (string, []Parameter) {
+	var params []Parameter
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if name, ok := strings.CutPrefix(segment, ":"); ok {
+			segments[i] = "{" + name + "}"
+			params = append(params, Parameter{
+				Name: name, In: "path", Required: true,
+				Schema: &Schema{Type: "integer", Format: "int64", Minimum: ptr(1.0)},
+			})
+		}
+	}
+	return strings.Join(segments, "/"), params
+}
+
+// operationID derives a stable camelCase ID such as getPublicVenuesVenueId.
+func operationID(method, path string) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(method))
+	for _, part := range strings.FieldsFunc(path, func(r rune) bool {
+		return r == '/' || r == ':' || r == '_' || r == '-' || r == '.'
+	}) {
+		b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	return b.String()
+}
+
+func (s *Spec) schemaOf(v any) *Schema {
+	if fields, ok := v.(Fields); ok {
+		schema := &Schema{Type: "object", Properties: map[string]*Schema{}}
+		for name, field := range fields {
+			schema.Properties[name] = s.schemaOf(field)
+			schema.Required = append(schema.Required, name)
+		}
+		sort.Strings(schema.Required)
+		return schema
+	}
+	return s.schemaFor(reflect.TypeOf(v))
+}
+
+func (s *Spec) schemaFor(t reflect.Type) *Schema {
+	if override, ok := s.overrides[t]; ok {
+		clone := *override
+		return &clone
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := s.schemaFor(t.Elem())
+		if schema.Ref == "" {
+			schema.Nullable = true
+		}
+		return schema
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &Schema{Type: "integer", Format: intFormat(t)}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer", Format: intFormat(t), Minimum: ptr(0.0)}
+	case reflect.Float32:
+		return &Schema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &Schema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		return &Schema{Type: "array", Items: s.schemaFor(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: s.schemaFor(t.Elem())}
+	case reflect.Struct:
+		if t.PkgPath() == "time" && t.Name() == "Time" {
+			return &Schema{Type: "string", Format: "date-time"}
+		}
+		return s.structRef(t)
+	default:
+		return &Schema{}
+	}
+}
+
+// structRef adds t to the component schemas and returns a reference to it.
+func (s *Spec) structRef(t reflect.Type) *Schema {
+	if t.Name() == "" {
+		return s.structSchema(t)
+	}
+
+	name := t.Name()
+	if existing, ok := s.names[name]; ok && existing != t {
+		pkg := t.PkgPath()[strings.LastIndex(t.PkgPath(), "/")+1:]
+		name = strings.ToUpper(pkg[:1]) + pkg[1:] + name
+	}
+	ref := &Schema{Ref: "#/components/schemas/" + name}
+	if _, ok := s.names[name]; ok {
+		return ref
+	}
+
+	// Register the name before recursing so self-referencing types terminate.
+	s.names[name] = t
+	s.doc.Components.Schemas[name] = s.structSchema(t)
+	return ref
+}
+
+func (s *Spec) structSchema(t reflect.Type) *Schema {
+	schema := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	s.addFields(schema, t)
+	sort.Strings(schema.Required)
+	return schema
+}
+
+func (s *Spec) addFields(schema *Schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" || (!field.IsExported() && !field.Anonymous) {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+
+		// Embedded structs without a JSON name are flattened, as encoding/json does.
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				if _, overridden := s.overrides[embedded]; !overridden {
+					s.addFields(schema, embedded)
+					continue
+				}
+			}
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		property := s.schemaFor(field.Type)
+		if applyBinding(property, field.Tag.Get("binding"), field.Type) {
+			schema.Required = append(schema.Required, name)
+		}
+		schema.Properties[name] = property
+	}
+}
+
+// applyBinding copies the validator rules gin enforces into the schema and
+// reports whether the field is required.
+func applyBinding(schema *Schema, binding string, t reflect.Type) bool {
+	if binding == "" {
+		return false
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	required := false
+	for _, rule := range strings.Split(binding, ",") {
+		key, value, _ := strings.Cut(rule, "=")
+		switch key {
+		case "required":
+			required = true
+		case "email":
+			schema.Format = "email"
+		case "url":
+			schema.Format = "uri"
+		case "oneof":
+			for _, option := range strings.Fields(value) {
+				schema.Enum = append(schema.Enum, option)
+			}
+		case "gt", "gte", "min", "max", "lte":
+			var n float64
+			if _, err := fmt.Sscan(value, &n); err != nil {
+				continue
+			}
+			applyBound(schema, key, n, t.Kind())
+		}
+	}
+	return required
+}
+
+func applyBound(schema *Schema, rule string, n float64, kind reflect.Kind) {
+	lower := rule == "gt" || rule == "gte" || rule == "min"
+	switch kind {
+	case reflect.String:
+		if lower {
+			schema.MinLength = ptr(int(n))
+		} else {
+			schema.MaxLength = ptr(int(n))
+		}
+	case reflect.Slice, reflect.Array:
+		if lower {
+			schema.MinItems = ptr(int(n))
+		}
+	default:
+		if lower {
+			schema.Minimum = ptr(n)
+			schema.ExclusiveMinimum = rule == "gt"
+		} else {
+			schema.Maximum = ptr(n)
+		}
+	}
+}
+
+func intFormat(t reflect.Type) string {
+	if t.Bits() <= 32 && t.Kind() != reflect.Int && t.Kind() != reflect.Uint {
+		return "int32"
+	}
+	return "int64"
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
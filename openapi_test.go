@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// undocumentedRoutes serve the documentation itself or operators rather than API clients.
+var undocumentedRoutes = map[string]bool{
+	"GET " + openAPIPath: true,
+	"GET " + docsPath:    true,
+	"GET /metrics":       true,
+}
+
+func TestOpenAPICoversRoutes(t *testing.T) {
+	s := newTestServer(t)
+	spec := apiSpec()
+
+	registered := map[string]bool{}
+	for _, route := range s.router.Routes() {
+		key := route.Method + " " + route.Path
+		registered[key] = true
+		if undocumentedRoutes[key] {
+			continue
+		}
+		if !spec.Has(route.Method, route.Path) {
+			t.Errorf("%s has no entry in apiSpec", key)
+		}
+	}
+
+	for path, item := range spec.Document().Paths {
+		for method := range *item {
+			ginPath := strings.NewReplacer("{", ":", "}", "").Replace(path)
+			if key := strings.ToUpper(method) + " " + ginPath; !registered[key] {
+				t.Errorf("apiSpec documents %s, which setupRouter doesn't register", key)
+			}
+		}
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	s := newTestServer(t)
+
+	var doc struct {
+		OpenAPI    string                    `json:"openapi"`
+		Paths      map[string]map[string]any `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Required   []string       `json:"required"`
+				Properties map[string]any `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	s.do(http.MethodGet, openAPIPath, "", nil).ExpectStatus(http.StatusOK).Decode(&doc)
+
+	if doc.OpenAPI != "3.0.3" {
+		t.Errorf("openapi = %q", doc.OpenAPI)
+	}
+	if _, ok := doc.Paths["/v1/public/venues/{venue_id}/menu"]["get"]; !ok {
+		t.Error("missing GET /v1/public/venues/{venue_id}/menu")
+	}
+
+	// Binding rules become schema constraints.
+	placeOrder := doc.Components.Schemas["PlaceOrderRequest"]
+	if strings.Join(placeOrder.Required, ",") != "items,venue_id" {
+		t.Errorf("PlaceOrderRequest required = %v", placeOrder.Required)
+	}
+	if len(doc.Components.Schemas["UpdateMenuItemRequest"].Required) != 0 {
+		t.Error("UpdateMenuItemRequest fields are optional")
+	}
+	if _, ok := doc.Components.Schemas["OrderDetail"].Properties["items"]; !ok {
+		t.Error("OrderDetail schema is missing items")
+	}
+
+	docs := s.do(http.MethodGet, docsPath, "", nil).ExpectStatus(http.StatusOK)
+	if !strings.Contains(string(docs.Body), openAPIPath) {
+		t.Error("docs page doesn't load the OpenAPI document")
+	}
+}
@@ -0,0 +1,118 @@
+// Package ratelimit implements token-bucket rate limiting. Every key has a
+// bucket holding up to Limit.Requests tokens that refills at a steady rate
+// over Limit.Per; each request takes one token and is refused when the
+// bucket is empty. Buckets live in a Store, either in memory or in SQLite so
+// that several processes using the same database share their limits.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Store names for RATE_LIMIT_STORE.
+const (
+	StoreMemory = "memory"
+	StoreSQLite = "sqlite"
+)
+
+// Limit allows bursts of Requests requests and refills them over Per. The
+// zero Limit disables limiting.
+type Limit struct {
+	Requests int
+	Per      time.Duration
+}
+
+// Enabled reports whether the limit restricts anything.
+func (l Limit) Enabled() bool {
+	return l.Requests > 0 && l.Per > 0
+}
+
+func (l Limit) String() string {
+	if !l.Enabled() {
+		return "off"
+	}
+	return fmt.Sprintf("%d/%s", l.Requests, l.Per)
+}
+
+// ParseLimit parses a limit written as "<requests>/<duration>", such as
+// "10/1m" or "5/1h". "off" and "0" disable limiting.
+func ParseLimit(s string) (Limit, error) {
+	if s == "off" || s == "0" {
+		return Limit{}, nil
+	}
+	requests, per, ok := strings.Cut(s, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("rate limit %q is not of the form <requests>/<duration>", s)
+	}
+	n, err := strconv.Atoi(requests)
+	if err != nil || n < 0 {
+		return Limit{}, fmt.Errorf("rate limit %q has an invalid request count", s)
+	}
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return Limit{}, fmt.Errorf("rate limit %q has an invalid duration", s)
+	}
+	return Limit{Requests: n, Per: d}, nil
+}
+
+// Store keeps the buckets of every key.
+type Store interface {
+	// Take removes a token from the bucket of key. When the bucket is empty
+	// it returns false and the time until a token is available.
+	Take(ctx context.Context, key string, limit Limit) (allowed bool, retryAfter time.Duration, err error)
+	// Sweep forgets buckets that have refilled completely and are therefore
+	// equivalent to new ones.
+	Sweep(ctx context.Context) error
+}
+
+// bucket is the state of one key: the tokens left at the time of the last request.
+type bucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// take refills b for the time elapsed since its last request and removes a
+// token. It returns when the bucket will be full again, so idle buckets can
+// be swept.
+func (b *bucket) take(limit Limit, now time.Time) (allowed bool, retryAfter time.Duration, full time.Time) {
+	capacity := float64(limit.Requests)
+	perToken := limit.Per / time.Duration(limit.Requests)
+
+	elapsed := now.Sub(b.at)
+	if b.at.IsZero() || elapsed < 0 {
+		b.tokens, elapsed = capacity, 0
+	}
+	b.tokens = math.Min(capacity, b.tokens+float64(elapsed)/float64(perToken))
+	b.at = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		allowed = true
+	} else {
+		retryAfter = time.Duration((1 - b.tokens) * float64(perToken))
+	}
+	full = now.Add(time.Duration((capacity - b.tokens) * float64(perToken)))
+	return allowed, retryAfter, full
+}
+
+// RunSweeper sweeps store every interval until ctx is done. It is meant to
+// run as a background worker.
+func RunSweeper(ctx context.Context, store Store, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := store.Sweep(ctx); err != nil && ctx.Err() == nil {
+				return err
+			}
+		}
+	}
+}
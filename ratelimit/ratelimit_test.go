@@ -0,0 +1,88 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gorm.io/gorm/logger"
+	"liven-one-go/database"
+)
+
+func TestParseLimit(t *testing.T) {
+	limit, err := ParseLimit("10/1m")
+	if err != nil || limit != (Limit{Requests: 10, Per: time.Minute}) {
+		t.Fatalf("ParseLimit(10/1m) = %+v, %v", limit, err)
+	}
+	if limit, err := ParseLimit("off"); err != nil || limit.Enabled() {
+		t.Errorf("ParseLimit(off) = %+v, %v, want a disabled limit", limit, err)
+	}
+	for _, bad := range []string{"10", "ten/1m", "10/soon", "10/-1m"} {
+		if _, err := ParseLimit(bad); err == nil {
+			t.Errorf("ParseLimit(%q) succeeded", bad)
+		}
+	}
+}
+
+// testStores returns a store of each kind driven by the same fake clock.
+func testStores(t *testing.T, now *time.Time) map[string]Store {
+	t.Helper()
+
+	opts := database.DefaultOptions()
+	opts.Logger = logger.Discard
+	conns, err := database.Open(":memory:", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conns.Close() })
+	if err := database.Migrate(conns.Write); err != nil {
+		t.Fatal(err)
+	}
+
+	clock := func() time.Time { return *now }
+	memory := NewMemoryStore()
+	memory.now = clock
+	sql := NewSQLStore(conns.Write)
+	sql.now = clock
+	return map[string]Store{StoreMemory: memory, StoreSQLite: sql}
+}
+
+func TestTakeRefillsOverTime(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	limit := Limit{Requests: 2, Per: time.Minute}
+
+	for name, store := range testStores(t, &now) {
+		t.Run(name, func(t *testing.T) {
+			for i := 0; i < 2; i++ {
+				if allowed, _, err := store.Take(ctx, "ip:1", limit); err != nil || !allowed {
+					t.Fatalf("request %d refused: %v", i+1, err)
+				}
+			}
+			allowed, retryAfter, err := store.Take(ctx, "ip:1", limit)
+			if err != nil || allowed {
+				t.Fatalf("third request allowed = %v, %v", allowed, err)
+			}
+			if retryAfter != 30*time.Second {
+				t.Errorf("retry after = %s, want 30s", retryAfter)
+			}
+			if allowed, _, _ := store.Take(ctx, "ip:2", limit); !allowed {
+				t.Error("another key shares the bucket")
+			}
+
+			now = now.Add(30 * time.Second)
+			if allowed, _, _ := store.Take(ctx, "ip:1", limit); !allowed {
+				t.Error("no token after refilling for 30s")
+			}
+
+			// Buckets are swept once they have refilled completely.
+			now = now.Add(time.Minute)
+			if err := store.Sweep(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if allowed, _, _ := store.Take(ctx, "ip:1", limit); !allowed {
+				t.Error("swept bucket refused a request")
+			}
+		})
+	}
+}
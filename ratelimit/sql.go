@@ -0,0 +1,53 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"liven-one-go/models"
+)
+
+// SQLStore keeps buckets in the rate_limit_buckets table, so processes
+// sharing the database share their limits and limits survive restarts.
+type SQLStore struct {
+	db  *gorm.DB
+	now func() time.Time
+}
+
+// NewSQLStore returns a store backed by db, which must be the writer
+// connection.
+func NewSQLStore(db *gorm.DB) *SQLStore {
+	return &SQLStore{db: db, now: time.Now}
+}
+
+func (s *SQLStore) Take(ctx context.Context, key string, limit Limit) (bool, time.Duration, error) {
+	if !limit.Enabled() {
+		return true, 0, nil
+	}
+
+	var allowed bool
+	var retryAfter time.Duration
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var row models.RateLimitBucket
+		if err := tx.Where("key = ?", key).First(&row).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		b := bucket{tokens: row.Tokens, at: row.At}
+		var full time.Time
+		allowed, retryAfter, full = b.take(limit, s.now())
+
+		row = models.RateLimitBucket{Key: key, Tokens: b.tokens, At: b.at, FullAt: full}
+		return tx.Save(&row).Error
+	})
+	if err != nil {
+		return false, 0, err
+	}
+	return allowed, retryAfter, nil
+}
+
+func (s *SQLStore) Sweep(ctx context.Context) error {
+	return s.db.WithContext(ctx).Where("full_at <= ?", s.now()).Delete(&models.RateLimitBucket{}).Error
+}
@@ -0,0 +1,153 @@
+package seed
+
+// cuisine describes a kind of venue and the dishes it serves, grouped by menu category.
+type cuisine struct {
+	name       string
+	venueWords []string
+	categories map[string][]dish
+}
+
+type dish struct {
+	name         string
+	description  string
+	priceInCents int64
+}
+
+// categoryOrder fixes the iteration order of a cuisine's categories, since
+// map iteration order would make the generated menus nondeterministic.
+var categoryOrder = []string{"Breakfast", "Coffee", "Bakery", "Starters", "Mains", "Sides", "Desserts", "Drinks"}
+
+var cuisines = []cuisine{
+	{
+		name:       "Cafe",
+		venueWords: []string{"Bean", "Brew", "Grind", "Crema", "Roast"},
+		categories: map[string][]dish{
+			"Breakfast": {
+				{"Smashed Avo", "Avocado, feta and dukkah on sourdough", 1900},
+				{"Big Breakfast", "Eggs, bacon, mushrooms, hash brown and toast", 2400},
+				{"Bircher Muesli", "Oats soaked in apple juice with seasonal fruit", 1500},
+				{"Eggs Benedict", "Poached eggs, ham and hollandaise on muffins", 2100},
+			},
+			"Coffee": {
+				{"Flat White", "Double shot with steamed milk", 450},
+				{"Long Black", "Double shot over hot water", 420},
+				{"Cappuccino", "Espresso, milk and chocolate dusting", 450},
+				{"Iced Latte", "Espresso and cold milk over ice", 600},
+			},
+			"Bakery": {
+				{"Banana Bread", "Toasted, with butter", 650},
+				{"Almond Croissant", "Twice-baked with frangipane", 700},
+				{"Cinnamon Scroll", "With cream cheese icing", 650},
+			},
+		},
+	},
+	{
+		name:       "Italian",
+		venueWords: []string{"Trattoria", "Nonna", "Cucina", "Forno", "Osteria"},
+		categories: map[string][]dish{
+			"Starters": {
+				{"Bruschetta", "Tomato, basil and garlic on grilled bread", 1400},
+				{"Arancini", "Mushroom and parmesan rice balls", 1600},
+				{"Burrata", "With heirloom tomatoes and olive oil", 2200},
+			},
+			"Mains": {
+				{"Margherita Pizza", "San Marzano tomato, fior di latte, basil", 2300},
+				{"Spaghetti Carbonara", "Guanciale, pecorino and egg yolk", 2600},
+				{"Gnocchi Sorrentina", "Potato gnocchi baked in tomato and mozzarella", 2500},
+				{"Lasagne", "Beef ragu, bechamel and parmesan", 2800},
+			},
+			"Desserts": {
+				{"Tiramisu", "Savoiardi, mascarpone and espresso", 1400},
+				{"Cannoli", "Filled with ricotta and pistachio", 1200},
+			},
+		},
+	},
+	{
+		name:       "Japanese",
+		venueWords: []string{"Sakura", "Izakaya", "Ramen", "Umami", "Kaiten"},
+		categories: map[string][]dish{
+			"Starters": {
+				{"Edamame", "Steamed and salted", 800},
+				{"Gyoza", "Pan-fried pork dumplings", 1200},
+				{"Karaage", "Japanese fried chicken with kewpie", 1500},
+			},
+			"Mains": {
+				{"Tonkotsu Ramen", "Pork bone broth, chashu and egg", 2200},
+				{"Salmon Don", "Raw salmon on sushi rice", 2400},
+				{"Chicken Katsu Curry", "Crumbed chicken with curry sauce", 2300},
+			},
+			"Drinks": {
+				{"Matcha Latte", "Stone-ground green tea with milk", 600},
+				{"Ramune", "Japanese soda", 500},
+			},
+		},
+	},
+	{
+		name:       "Vietnamese",
+		venueWords: []string{"Pho", "Saigon", "Lotus", "Banh", "Hanoi"},
+		categories: map[string][]dish{
+			"Starters": {
+				{"Rice Paper Rolls", "Prawn, herbs and vermicelli", 1200},
+				{"Spring Rolls", "Crispy pork and vegetable rolls", 1100},
+			},
+			"Mains": {
+				{"Pho Bo", "Beef noodle soup", 1900},
+				{"Banh Mi", "Roast pork, pate, pickles and herbs", 1100},
+				{"Bun Cha", "Grilled pork with vermicelli", 2000},
+			},
+			"Drinks": {
+				{"Ca Phe Sua Da", "Iced coffee with condensed milk", 600},
+				{"Lemongrass Iced Tea", "House-brewed", 550},
+			},
+		},
+	},
+	{
+		name:       "Burgers",
+		venueWords: []string{"Grill", "Patty", "Smash", "Diner", "Stack"},
+		categories: map[string][]dish{
+			"Mains": {
+				{"Classic Cheeseburger", "Beef, cheese, pickles and mustard", 1700},
+				{"Fried Chicken Burger", "Buttermilk chicken and slaw", 1800},
+				{"Mushroom Burger", "Portobello, swiss and aioli", 1700},
+			},
+			"Sides": {
+				{"Fries", "Shoestring with chicken salt", 700},
+				{"Onion Rings", "Beer battered", 800},
+				{"Loaded Fries", "Cheese sauce, bacon and jalapenos", 1200},
+			},
+			"Drinks": {
+				{"Vanilla Thickshake", "Made with soft serve", 900},
+				{"Lemonade", "House-made", 600},
+			},
+		},
+	},
+}
+
+var firstNames = []string{
+	"olivia", "noah", "charlotte", "oliver", "amelia", "jack", "isla", "william",
+	"mia", "leo", "ava", "henry", "grace", "lucas", "chloe", "thomas", "zoe", "james",
+}
+
+var streets = []string{
+	"Collins Street", "Flinders Lane", "Chapel Street", "Brunswick Street", "Smith Street",
+	"Lygon Street", "Sydney Road", "Glenferrie Road", "Acland Street", "Degraves Street",
+}
+
+type suburb struct {
+	name      string
+	postcode  string
+	latitude  float64
+	longitude float64
+}
+
+var suburbs = []suburb{
+	{"Melbourne", "3000", -37.8136, 144.9631},
+	{"Fitzroy", "3065", -37.7983, 144.9780},
+	{"Collingwood", "3066", -37.8014, 144.9880},
+	{"Carlton", "3053", -37.8001, 144.9671},
+	{"Brunswick", "3056", -37.7670, 144.9620},
+	{"South Yarra", "3141", -37.8390, 144.9920},
+	{"St Kilda", "3182", -37.8676, 144.9809},
+	{"Richmond", "3121", -37.8230, 145.0010},
+	{"Hawthorn", "3122", -37.8220, 145.0340},
+}
@@ -0,0 +1,303 @@
+// Package seed generates realistic demo data: merchants with venues and menus,
+// diners, and a history of orders. The same options always produce the same
+// data, so it works for local development and as a test fixture.
+package seed
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"gorm.io/gorm"
+	"liven-one-go/models"
+)
+
+// ErrAlreadySeeded is returned when the generated accounts already exist.
+var ErrAlreadySeeded = errors.New("database already contains seeded accounts")
+
+// Options controls how much data is generated.
+type Options struct {
+	// Seed drives every random choice. Equal seeds give equal data.
+	Seed int64
+
+	Merchants         int
+	VenuesPerMerchant int
+	ItemsPerVenue     int
+	Diners            int
+	Orders            int
+
+	// Password is shared by every generated account.
+	Password string
+
+	// Now anchors the order history, which spans HistoryDays before it.
+	// Defaults to the current time; fix it to get identical timestamps.
+	Now         time.Time
+	HistoryDays int
+
+	// EmailDomain is appended to the generated email addresses.
+	EmailDomain string
+}
+
+// DefaultOptions returns a small but varied data set.
+func DefaultOptions() Options {
+	return Options{
+		Seed:              1,
+		Merchants:         3,
+		VenuesPerMerchant: 2,
+		ItemsPerVenue:     8,
+		Diners:            10,
+		Orders:            200,
+		Password:          "password123",
+		HistoryDays:       90,
+		EmailDomain:       "example.com",
+	}
+}
+
+// Result holds everything that was inserted.
+type Result struct {
+	Merchants []models.User
+	Diners    []models.User
+	Venues    []models.Venue
+	MenuItems []models.MenuItem
+	Orders    []models.Order
+}
+
+// allStatuses lists every OrderStatus so the first orders can cover them all.
+var allStatuses = []models.OrderStatus{
+	models.OrderStatusPending,
+	models.OrderStatusRejected,
+	models.OrderStatusAccepted,
+	models.OrderStatusCancelled,
+	models.OrderStatusPreparing,
+	models.OrderStatusReadyForDelivery,
+	models.OrderStatusCompleted,
+}
+
+// Generate inserts demo data into db in a single transaction.
+func Generate(db *gorm.DB, opts Options) (*Result, error) {
+	defaults := DefaultOptions()
+	if opts.Password == "" {
+		opts.Password = defaults.Password
+	}
+	if opts.HistoryDays <= 0 {
+		opts.HistoryDays = defaults.HistoryDays
+	}
+	if opts.EmailDomain == "" {
+		opts.EmailDomain = defaults.EmailDomain
+	}
+	if opts.Now.IsZero() {
+		opts.Now = time.Now()
+	}
+	if opts.Orders > 0 && (opts.Diners <= 0 || opts.Merchants <= 0 || opts.VenuesPerMerchant <= 0 || opts.ItemsPerVenue <= 0) {
+		return nil, errors.New("orders need at least one diner, venue and menu item")
+	}
+
+	g := &generator{
+		rand: rand.New(rand.NewSource(opts.Seed)),
+		opts: opts,
+	}
+
+	// Hashing with bcrypt is deliberately slow, so hash once and share it.
+	var template models.User
+	if err := template.HashPassword(opts.Password); err != nil {
+		return nil, fmt.Errorf("hash password: %w", err)
+	}
+	g.passwordHash = template.Password
+
+	result := &Result{}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var existing int64
+		if err := tx.Model(&models.User{}).Where("email = ?", g.email(models.UserTypeMerchant, 1)).Count(&existing).Error; err != nil {
+			return err
+		}
+		if existing > 0 {
+			return ErrAlreadySeeded
+		}
+
+		var err error
+		if result.Merchants, err = g.users(tx, models.UserTypeMerchant, opts.Merchants); err != nil {
+			return err
+		}
+		if result.Diners, err = g.users(tx, models.UserTypeDiner, opts.Diners); err != nil {
+			return err
+		}
+		if result.Venues, err = g.venues(tx, result.Merchants); err != nil {
+			return err
+		}
+		if result.MenuItems, err = g.menuItems(tx, result.Venues); err != nil {
+			return err
+		}
+		result.Orders, err = g.orders(tx, result.Diners, result.Venues, result.MenuItems)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+type generator struct {
+	rand         *rand.Rand
+	opts         Options
+	passwordHash string
+}
+
+func (g *generator) email(userType string, n int) string {
+	return fmt.Sprintf("%s%d@%s", userType, n, g.opts.EmailDomain)
+}
+
+func (g *generator) users(tx *gorm.DB, userType string, count int) ([]models.User, error) {
+	users := make([]models.User, 0, count)
+	for i := 1; i <= count; i++ {
+		users = append(users, models.User{
+			Email:    g.email(userType, i),
+			Password: g.passwordHash,
+			UserType: userType,
+			// Demo accounts have no mailbox to verify.
+			EmailVerifiedAt: &g.opts.Now,
+		})
+	}
+	if len(users) == 0 {
+		return users, nil
+	}
+	return users, tx.CreateInBatches(&users, 100).Error
+}
+
+func (g *generator) venues(tx *gorm.DB, merchants []models.User) ([]models.Venue, error) {
+	var venues []models.Venue
+	for _, merchant := range merchants {
+		for i := 0; i < g.opts.VenuesPerMerchant; i++ {
+			c := cuisines[g.rand.Intn(len(cuisines))]
+			area := suburbs[g.rand.Intn(len(suburbs))]
+			word := c.venueWords[g.rand.Intn(len(c.venueWords))]
+
+			// Venue names are unique, so the sequence number disambiguates repeats.
+			name := fmt.Sprintf("%s %s #%d", area.name, word, len(venues)+1)
+			address := fmt.Sprintf("%d %s, %s VIC %s", 1+g.rand.Intn(400), streets[g.rand.Intn(len(streets))], area.name, area.postcode)
+			// Scatter venues within roughly a kilometre of the suburb centre.
+			lat := area.latitude + (g.rand.Float64()-0.5)*0.02
+			long := area.longitude + (g.rand.Float64()-0.5)*0.02
+
+			venues = append(venues, models.Venue{
+				Name:        name,
+				Address:     address,
+				LatLong:     fmt.Sprintf("%.6f,%.6f", lat, long),
+				Description: fmt.Sprintf("%s food in the heart of %s", c.name, area.name),
+				CuisineType: c.name,
+				MerchantID:  merchant.ID,
+			})
+		}
+	}
+	if len(venues) == 0 {
+		return venues, nil
+	}
+	return venues, tx.CreateInBatches(&venues, 100).Error
+}
+
+func (g *generator) menuItems(tx *gorm.DB, venues []models.Venue) ([]models.MenuItem, error) {
+	var items []models.MenuItem
+	for _, venue := range venues {
+		var menu []models.MenuItem
+		for _, category := range categoryOrder {
+			for _, d := range cuisineByName(venue.CuisineType).categories[category] {
+				// Vary prices between venues by up to 15% either way, rounded to 10 cents.
+				factor := 0.85 + g.rand.Float64()*0.3
+				price := int64(float64(d.priceInCents)*factor/10) * 10
+				menu = append(menu, models.MenuItem{
+					Name:         d.name,
+					Description:  d.description,
+					PriceInCents: price,
+					Category:     category,
+					VenueId:      venue.ID,
+				})
+			}
+		}
+		g.rand.Shuffle(len(menu), func(i, j int) { menu[i], menu[j] = menu[j], menu[i] })
+		if len(menu) > g.opts.ItemsPerVenue {
+			menu = menu[:g.opts.ItemsPerVenue]
+		}
+		items = append(items, menu...)
+	}
+	if len(items) == 0 {
+		return items, nil
+	}
+	return items, tx.CreateInBatches(&items, 200).Error
+}
+
+func (g *generator) orders(tx *gorm.DB, diners []models.User, venues []models.Venue, items []models.MenuItem) ([]models.Order, error) {
+	menus := make(map[uint][]models.MenuItem)
+	for _, item := range items {
+		menus[item.VenueId] = append(menus[item.VenueId], item)
+	}
+
+	history := time.Duration(g.opts.HistoryDays) * 24 * time.Hour
+	orders := make([]models.Order, 0, g.opts.Orders)
+	for i := 0; i < g.opts.Orders; i++ {
+		venue := venues[g.rand.Intn(len(venues))]
+		menu := menus[venue.ID]
+		if len(menu) == 0 {
+			continue
+		}
+
+		placedAt := g.opts.Now.Add(-time.Duration(g.rand.Int63n(int64(history)))).Truncate(time.Second)
+
+		var orderItems []models.OrderItem
+		var total int64
+		for _, idx := range g.rand.Perm(len(menu))[:1+g.rand.Intn(min(4, len(menu)))] {
+			quantity := int64(1 + g.rand.Intn(3))
+			orderItems = append(orderItems, models.OrderItem{
+				MenuItemID:          menu[idx].ID,
+				Quantity:            quantity,
+				PriceInCentsAtOrder: menu[idx].PriceInCents,
+			})
+			total += menu[idx].PriceInCents * quantity
+		}
+
+		order := models.Order{
+			DinerID:            diners[g.rand.Intn(len(diners))].ID,
+			VenueID:            venue.ID,
+			OrderItems:         orderItems,
+			TotalAmountInCents: total,
+			Status:             g.status(i, g.opts.Now.Sub(placedAt)),
+			OrderTimestamp:     placedAt,
+		}
+		order.CreatedAt = placedAt
+		order.UpdatedAt = placedAt
+		orders = append(orders, order)
+	}
+	if len(orders) == 0 {
+		return orders, nil
+	}
+	return orders, tx.CreateInBatches(&orders, 100).Error
+}
+
+// status picks a plausible status for an order of the given age. The first
+// orders cycle through every status so each one is always represented.
+func (g *generator) status(i int, age time.Duration) models.OrderStatus {
+	if i < len(allStatuses) {
+		return allStatuses[i]
+	}
+
+	// Orders older than a day have settled into a final state.
+	if age > 24*time.Hour {
+		switch n := g.rand.Intn(100); {
+		case n < 85:
+			return models.OrderStatusCompleted
+		case n < 95:
+			return models.OrderStatusCancelled
+		default:
+			return models.OrderStatusRejected
+		}
+	}
+	return allStatuses[g.rand.Intn(len(allStatuses))]
+}
+
+func cuisineByName(name string) cuisine {
+	for _, c := range cuisines {
+		if c.name == name {
+			return c
+		}
+	}
+	return cuisines[0]
+}
@@ -0,0 +1,99 @@
+package seed
+
+import (
+	"testing"
+	"time"
+
+	"gorm.io/gorm/logger"
+	"liven-one-go/database"
+	"liven-one-go/models"
+)
+
+func generate(t *testing.T, opts Options) *Result {
+	t.Helper()
+
+	conns, err := database.Open(":memory:", database.Options{Tuned: true, Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conns.Close() })
+
+	if err := database.Migrate(conns.Write); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := Generate(conns.Write, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func testOptions() Options {
+	opts := DefaultOptions()
+	opts.Orders = 50
+	opts.Now = time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	return opts
+}
+
+func TestGenerateIsDeterministic(t *testing.T) {
+	first := generate(t, testOptions())
+	second := generate(t, testOptions())
+
+	if len(first.Orders) != len(second.Orders) {
+		t.Fatalf("order count differs: %d vs %d", len(first.Orders), len(second.Orders))
+	}
+	for i := range first.Venues {
+		if first.Venues[i].Name != second.Venues[i].Name || first.Venues[i].LatLong != second.Venues[i].LatLong {
+			t.Errorf("venue %d differs: %+v vs %+v", i, first.Venues[i], second.Venues[i])
+		}
+	}
+	for i := range first.Orders {
+		a, b := first.Orders[i], second.Orders[i]
+		if a.TotalAmountInCents != b.TotalAmountInCents || a.Status != b.Status || !a.OrderTimestamp.Equal(b.OrderTimestamp) {
+			t.Errorf("order %d differs: %+v vs %+v", i, a, b)
+		}
+	}
+}
+
+func TestGenerateCoversEveryStatus(t *testing.T) {
+	result := generate(t, testOptions())
+
+	seen := make(map[models.OrderStatus]bool)
+	for _, order := range result.Orders {
+		seen[order.Status] = true
+
+		var total int64
+		for _, item := range order.OrderItems {
+			total += item.PriceInCentsAtOrder * item.Quantity
+		}
+		if total != order.TotalAmountInCents {
+			t.Errorf("order %d total is %d, items add up to %d", order.ID, order.TotalAmountInCents, total)
+		}
+	}
+	for _, status := range allStatuses {
+		if !seen[status] {
+			t.Errorf("no order with status %s", status)
+		}
+	}
+}
+
+func TestGenerateRefusesToRunTwice(t *testing.T) {
+	conns, err := database.Open(":memory:", database.Options{Tuned: true, Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conns.Close()
+	if err := database.Migrate(conns.Write); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := testOptions()
+	opts.Orders = 0
+	if _, err := Generate(conns.Write, opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Generate(conns.Write, opts); err != ErrAlreadySeeded {
+		t.Fatalf("second run returned %v, want ErrAlreadySeeded", err)
+	}
+}
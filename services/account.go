@@ -0,0 +1,233 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"liven-one-go/models"
+	"liven-one-go/utils"
+)
+
+// ErrMerchantHasVenues is returned when a merchant who still owns venues
+// tries to delete their account.
+var ErrMerchantHasVenues = errors.New("merchant still owns venues")
+
+// Profile holds the details an account owner manages themselves.
+type Profile struct {
+	DisplayName      string
+	Phone            string
+	AvatarURL        string
+	Locale           string
+	MarketingConsent bool
+}
+
+// UpdateProfile replaces the profile of the user. Consent keeps the time it
+// was first given until it is withdrawn.
+func UpdateProfile(db *gorm.DB, user *models.User, profile Profile, now time.Time) error {
+	consentAt := user.MarketingConsentAt
+	switch {
+	case profile.MarketingConsent && consentAt == nil:
+		consentAt = &now
+	case !profile.MarketingConsent:
+		consentAt = nil
+	}
+
+	updates := map[string]any{
+		"display_name":         profile.DisplayName,
+		"phone":                profile.Phone,
+		"avatar_url":           profile.AvatarURL,
+		"locale":               profile.Locale,
+		"marketing_consent_at": consentAt,
+	}
+	if err := db.Model(user).Updates(updates).Error; err != nil {
+		return err
+	}
+	user.DisplayName, user.Phone, user.AvatarURL, user.Locale = profile.DisplayName, profile.Phone, profile.AvatarURL, profile.Locale
+	user.MarketingConsentAt = consentAt
+	return nil
+}
+
+// ChangePassword sets a new password for the user and revokes every access
+// token issued before now, signing the account out everywhere. Every
+// session but keepSession ends and any login lockout is lifted. hashed is
+// the Password of a models.User after HashPassword; bcrypt is slow, so hash
+// before starting the transaction this runs in.
+func ChangePassword(db *gorm.DB, user *models.User, hashed string, keepSession uint, now time.Time) error {
+	revokedAt := tokensRevokedAt(now)
+	updates := map[string]any{"password": hashed, "failed_logins": 0, "locked_until": nil, "tokens_revoked_at": revokedAt}
+	if err := db.Model(user).Updates(updates).Error; err != nil {
+		return err
+	}
+	if err := endSessions(db, user.ID, keepSession); err != nil {
+		return fmt.Errorf("end sessions: %w", err)
+	}
+	user.Password, user.FailedLogins, user.LockedUntil, user.TokensRevokedAt = hashed, 0, nil, &revokedAt
+	return nil
+}
+
+// tokensRevokedAt truncates now to the precision of the issue time of
+// tokens, so a token issued right after the revocation stays valid.
+func tokensRevokedAt(now time.Time) time.Time {
+	return now.Truncate(utils.IssuedAtPrecision)
+}
+
+// RequestEmailChange records the address the user wants to switch to and
+// returns the token to mail there. Email keeps the old address until
+// ConfirmEmailChange.
+func RequestEmailChange(db *gorm.DB, user *models.User, email string, ttl time.Duration, now time.Time) (string, error) {
+	var token string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := checkEmailFree(tx, email, user.ID); err != nil {
+			return err
+		}
+		if err := tx.Model(user).Update("pending_email", email).Error; err != nil {
+			return err
+		}
+		var err error
+		token, err = IssueToken(tx, user.ID, models.TokenPurposeEmailChange, ttl, now)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	user.PendingEmail = email
+	return token, nil
+}
+
+// ConfirmEmailChange consumes an email change token and moves its user to
+// the pending address, which is verified by receiving the token.
+func ConfirmEmailChange(db *gorm.DB, raw string, now time.Time) (*models.User, error) {
+	var user *models.User
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if user, err = consumeToken(tx, raw, models.TokenPurposeEmailChange, now); err != nil {
+			return err
+		}
+		if user.PendingEmail == "" {
+			return ErrInvalidToken
+		}
+		// Someone may have registered the address since it was requested.
+		if err := checkEmailFree(tx, user.PendingEmail, user.ID); err != nil {
+			return err
+		}
+		updates := map[string]any{"email": user.PendingEmail, "pending_email": "", "email_verified_at": now}
+		if err := tx.Model(user).Updates(updates).Error; err != nil {
+			return err
+		}
+		user.Email, user.PendingEmail, user.EmailVerifiedAt = user.PendingEmail, "", &now
+		return nil
+	})
+	return user, err
+}
+
+// checkEmailFree returns ErrEmailTaken when an account other than userID
+// uses the address. Accounts awaiting deletion count, as they keep their
+// address until anonymized.
+func checkEmailFree(db *gorm.DB, email string, userID uint) error {
+	var count int64
+	if err := db.Unscoped().Model(&models.User{}).Where("email = ? AND id <> ?", email, userID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrEmailTaken
+	}
+	return nil
+}
+
+// RequestDeletion schedules the user's account to be anonymized at due and
+// signs it out everywhere. Merchants must transfer or delete their venues
+// first.
+func RequestDeletion(db *gorm.DB, user *models.User, due, now time.Time) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if user.UserType == models.UserTypeMerchant {
+			var venues int64
+			if err := tx.Model(&models.Venue{}).Where("merchant_id = ?", user.ID).Count(&venues).Error; err != nil {
+				return err
+			}
+			if venues > 0 {
+				return ErrMerchantHasVenues
+			}
+		}
+		if err := tx.Model(&models.UserToken{}).Where("user_id = ? AND used_at IS NULL", user.ID).Update("used_at", now).Error; err != nil {
+			return fmt.Errorf("revoke tokens: %w", err)
+		}
+		if err := endSessions(tx, user.ID, 0); err != nil {
+			return fmt.Errorf("end sessions: %w", err)
+		}
+		revokedAt := tokensRevokedAt(now)
+		updates := map[string]any{"deletion_due_at": due, "tokens_revoked_at": revokedAt}
+		if err := tx.Model(user).Updates(updates).Error; err != nil {
+			return err
+		}
+		user.DeletionDueAt, user.TokensRevokedAt = &due, &revokedAt
+		return nil
+	})
+}
+
+// CancelDeletion keeps an account whose deletion was requested.
+func CancelDeletion(db *gorm.DB, user *models.User) error {
+	if err := db.Model(user).Update("deletion_due_at", nil).Error; err != nil {
+		return err
+	}
+	user.DeletionDueAt = nil
+	return nil
+}
+
+// DueDeletions returns the accounts whose deletion is due at now.
+func DueDeletions(db *gorm.DB, now time.Time) ([]models.User, error) {
+	var users []models.User
+	err := db.Where("deletion_due_at <= ?", now).Order("id").Find(&users).Error
+	return users, err
+}
+
+// AnonymizeUser erases the personal data of an account and deletes it. The
+// row stays, under an address that can't receive mail, so the orders of a
+// diner still add up in their merchants' accounts. A merchant's staff
+// accounts are anonymized with it and its API keys deleted. It must run inside a transaction.
+func AnonymizeUser(tx *gorm.DB, user *models.User, now time.Time) error {
+	if user.UserType == models.UserTypeMerchant {
+		var staff []models.User
+		if err := tx.Where("merchant_id = ? AND user_type = ?", user.ID, models.UserTypeStaff).Find(&staff).Error; err != nil {
+			return fmt.Errorf("get staff: %w", err)
+		}
+		for i := range staff {
+			if err := AnonymizeUser(tx, &staff[i], now); err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("merchant_id = ?", user.ID).Delete(&models.APIKey{}).Error; err != nil {
+			return fmt.Errorf("delete API keys: %w", err)
+		}
+	}
+
+	for _, owned := range []any{&models.UserToken{}, &models.RecoveryCode{}, &models.StaffAssignment{}, &models.UserIdentity{}, &models.LoginCode{}, &models.Session{}} {
+		if err := tx.Where("user_id = ?", user.ID).Delete(owned).Error; err != nil {
+			return fmt.Errorf("delete %T: %w", owned, err)
+		}
+	}
+	// The audit entries stay, as they are chained, but not where the
+	// account made its changes from.
+	if err := tx.Where("actor_id = ?", user.ID).Delete(&models.AuditIP{}).Error; err != nil {
+		return fmt.Errorf("delete audit IPs: %w", err)
+	}
+
+	updates := map[string]any{
+		"email":                fmt.Sprintf("deleted-%d@deleted.invalid", user.ID),
+		"pending_email":        "",
+		"password":             "",
+		"display_name":         "",
+		"phone":                "",
+		"avatar_url":           "",
+		"locale":               "",
+		"marketing_consent_at": nil,
+		"email_verified_at":    nil,
+		"totp_secret":          "",
+		"totp_enabled_at":      nil,
+		"suspension_reason":    "",
+		"deletion_due_at":      nil,
+		"deleted_at":           now,
+	}
+	return tx.Model(user).Updates(updates).Error
+}
@@ -0,0 +1,142 @@
+package services
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"gorm.io/gorm"
+	"liven-one-go/models"
+)
+
+var (
+	ErrAPIKeyNotFound = errors.New("API key not found")
+	ErrInvalidAPIKey  = errors.New("API key is invalid, expired or revoked")
+	ErrAPIKeyRevoked  = errors.New("API key is already revoked")
+)
+
+// APIKeyUsageResolution is how often the last use of an API key is
+// recorded. Integrations call often, and writing each use would make every
+// request wait for the writer.
+const APIKeyUsageResolution = time.Minute
+
+// apiKeyPrefixLength is how much of a key past APIKeyPrefix is kept to tell
+// keys apart.
+const apiKeyPrefixLength = 8
+
+// APIKeySpec describes an API key to create.
+type APIKeySpec struct {
+	Name        string
+	Permissions []models.StaffPermission
+	// VenueID restricts the key to one venue. It is nil for every venue.
+	VenueID   *uint
+	ExpiresAt *time.Time
+}
+
+// CreateAPIKey creates an API key for the merchant and returns it with the
+// secret key to show them. Only its hash is stored, so it can't be shown
+// again.
+func CreateAPIKey(db *gorm.DB, merchantID uint, spec APIKeySpec) (*models.APIKey, string, error) {
+	secret := make([]byte, 32)
+	if _, err := io.ReadFull(TokenSource, secret); err != nil {
+		return nil, "", fmt.Errorf("generate API key: %w", err)
+	}
+	raw := models.APIKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	key := &models.APIKey{
+		MerchantID: merchantID,
+		Name:       spec.Name,
+		Prefix:     raw[:len(models.APIKeyPrefix)+apiKeyPrefixLength],
+		KeyHash:    hashToken(raw),
+		VenueID:    spec.VenueID,
+		ExpiresAt:  spec.ExpiresAt,
+	}
+	for _, permission := range spec.Permissions {
+		if !key.Grant(permission) {
+			return nil, "", fmt.Errorf("%w: %q", ErrUnknownPermission, permission)
+		}
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if spec.VenueID != nil {
+			if _, err := merchantVenue(tx, merchantID, *spec.VenueID); err != nil {
+				return err
+			}
+		}
+		return tx.Create(key).Error
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return key, raw, nil
+}
+
+// APIKeys lists the API keys of the merchant, revoked ones included, oldest
+// first.
+func APIKeys(db *gorm.DB, merchantID uint) ([]models.APIKey, error) {
+	var keys []models.APIKey
+	err := db.Where("merchant_id = ?", merchantID).Order("id").Find(&keys).Error
+	return keys, err
+}
+
+// FindAPIKey loads an API key of the merchant.
+func FindAPIKey(db *gorm.DB, merchantID, keyID uint) (*models.APIKey, error) {
+	var key models.APIKey
+	err := db.Where("merchant_id = ?", merchantID).First(&key, keyID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// RevokeAPIKey stops an API key of the merchant from working. The key stays
+// listed, with when it was revoked.
+func RevokeAPIKey(db *gorm.DB, merchantID, keyID uint, now time.Time) (*models.APIKey, error) {
+	key, err := FindAPIKey(db, merchantID, keyID)
+	if err != nil {
+		return nil, err
+	}
+	if key.RevokedAt != nil {
+		return nil, ErrAPIKeyRevoked
+	}
+	if err := db.Model(key).Update("revoked_at", now).Error; err != nil {
+		return nil, err
+	}
+	key.RevokedAt = &now
+	return key, nil
+}
+
+// AuthenticateAPIKey returns the API key with the secret raw when it is
+// active at now.
+func AuthenticateAPIKey(db *gorm.DB, raw string, now time.Time) (*models.APIKey, error) {
+	var key models.APIKey
+	err := db.Where("key_hash = ?", hashToken(raw)).First(&key).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !key.Active(now) {
+		return nil, ErrInvalidAPIKey
+	}
+	return &key, nil
+}
+
+// TouchAPIKey records that the key was used at now, to
+// APIKeyUsageResolution.
+func TouchAPIKey(db *gorm.DB, key *models.APIKey, now time.Time) error {
+	if key.LastUsedAt != nil && now.Sub(*key.LastUsedAt) < APIKeyUsageResolution {
+		return nil
+	}
+	if err := db.Model(key).Update("last_used_at", now).Error; err != nil {
+		return err
+	}
+	key.LastUsedAt = &now
+	return nil
+}
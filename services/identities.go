@@ -0,0 +1,178 @@
+package services
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"liven-one-go/models"
+)
+
+var (
+	// ErrEmailUnverified is returned when a provider hasn't verified the
+	// address of an account that isn't linked yet, so it can't be matched
+	// to a user.
+	ErrEmailUnverified = errors.New("the provider has not verified the email address")
+	// ErrExternalLoginRefused is returned for accounts that can only log in
+	// with a password, such as admins.
+	ErrExternalLoginRefused = errors.New("the account can't log in with an external provider")
+)
+
+// ExternalIdentity is an account at an OpenID Connect provider that a user
+// logged in with.
+type ExternalIdentity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+// StartExternalLogin records a login at provider that must finish within
+// ttl, and returns it with the state to send through the provider.
+func StartExternalLogin(db *gorm.DB, provider string, ttl time.Duration, now time.Time) (*models.OIDCLogin, string, error) {
+	var secrets [3]string
+	for i := range secrets {
+		secret := make([]byte, 32)
+		if _, err := io.ReadFull(TokenSource, secret); err != nil {
+			return nil, "", fmt.Errorf("generate login secrets: %w", err)
+		}
+		secrets[i] = base64.RawURLEncoding.EncodeToString(secret)
+	}
+	state := secrets[0]
+
+	login := models.OIDCLogin{
+		Provider:     provider,
+		StateHash:    hashToken(state),
+		Nonce:        secrets[1],
+		CodeVerifier: secrets[2],
+		ExpiresAt:    now.Add(ttl),
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Abandoned logins are useless, so starting one is a good time to
+		// drop them.
+		if err := tx.Where("expires_at < ?", now).Delete(&models.OIDCLogin{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&login).Error
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return &login, state, nil
+}
+
+// FinishExternalLogin consumes the login at provider that state was sent
+// with. It returns ErrInvalidToken when there is none, it expired or it was
+// already finished.
+func FinishExternalLogin(db *gorm.DB, provider, state string, now time.Time) (*models.OIDCLogin, error) {
+	var login models.OIDCLogin
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("state_hash = ? AND provider = ? AND expires_at > ?", hashToken(state), provider, now).First(&login).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidToken
+		}
+		if err != nil {
+			return err
+		}
+		// Deleting it makes a concurrent second use find nothing.
+		result := tx.Delete(&login)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrInvalidToken
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &login, nil
+}
+
+// ExternalLoginUser returns the user an external identity logs in as, and
+// whether it was linked to them just now. An identity seen for the first
+// time is linked to the account with its address, which the provider must
+// have verified; without one a diner account is created. Accounts created
+// this way have no password until their owner resets it.
+//
+// An account whose address was never verified may have been registered by
+// someone else, so linking it clears its password and signs it out
+// everywhere. It must run inside a transaction.
+func ExternalLoginUser(tx *gorm.DB, identity ExternalIdentity, now time.Time) (*models.User, bool, error) {
+	var link models.UserIdentity
+	err := tx.Where("provider = ? AND subject = ?", identity.Provider, identity.Subject).First(&link).Error
+	if err == nil {
+		var user models.User
+		if err := tx.First(&user, link.UserID).Error; err != nil {
+			return nil, false, err
+		}
+		return &user, false, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, false, err
+	}
+
+	if !identity.EmailVerified || identity.Email == "" {
+		return nil, false, ErrEmailUnverified
+	}
+	// Providers don't keep the case the address was registered with.
+	email := strings.ToLower(identity.Email)
+	user, err := findUserByEmailFold(tx, email)
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		if user, err = createExternalUser(tx, email, now); err != nil {
+			return nil, false, err
+		}
+	case err != nil:
+		return nil, false, err
+	case user.UserType == models.UserTypeAdmin:
+		return nil, false, ErrExternalLoginRefused
+	case user.EmailVerifiedAt == nil:
+		revokedAt := tokensRevokedAt(now)
+		updates := map[string]any{"password": "", "email_verified_at": now, "tokens_revoked_at": revokedAt}
+		if err := tx.Model(user).Updates(updates).Error; err != nil {
+			return nil, false, err
+		}
+		if err := endSessions(tx, user.ID, 0); err != nil {
+			return nil, false, fmt.Errorf("end sessions: %w", err)
+		}
+		user.Password, user.EmailVerifiedAt, user.TokensRevokedAt = "", &now, &revokedAt
+	}
+
+	link = models.UserIdentity{UserID: user.ID, Provider: identity.Provider, Subject: identity.Subject}
+	if err := tx.Create(&link).Error; err != nil {
+		return nil, false, fmt.Errorf("link identity: %w", err)
+	}
+	return user, true, nil
+}
+
+// findUserByEmailFold looks a user up by email, ignoring case. email must
+// be in lower case.
+func findUserByEmailFold(db *gorm.DB, email string) (*models.User, error) {
+	var user models.User
+	if err := db.Where("LOWER(email) = ?", email).Order("id").First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+// createExternalUser creates a diner with a verified address and no
+// password, which CheckPassword never accepts.
+func createExternalUser(tx *gorm.DB, email string, now time.Time) (*models.User, error) {
+	if err := checkEmailFree(tx, email, 0); err != nil {
+		return nil, err
+	}
+	user := models.User{Email: email, UserType: models.UserTypeDiner, EmailVerifiedAt: &now}
+	if err := tx.Create(&user).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
@@ -0,0 +1,81 @@
+package services
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"liven-one-go/models"
+)
+
+// LockoutPolicy locks an account after Threshold consecutive failed logins.
+// The first lock lasts Duration and every further failure doubles it, up to
+// MaxDuration. A zero Threshold disables lockouts.
+type LockoutPolicy struct {
+	Threshold   int
+	Duration    time.Duration
+	MaxDuration time.Duration
+}
+
+// lockFor is how long an account with the given number of consecutive
+// failures stays locked.
+func (p LockoutPolicy) lockFor(failures int) time.Duration {
+	if p.Threshold <= 0 || failures < p.Threshold {
+		return 0
+	}
+	d := p.Duration
+	for i := p.Threshold; i < failures && d < p.MaxDuration; i++ {
+		d *= 2
+	}
+	if p.MaxDuration > 0 && d > p.MaxDuration {
+		d = p.MaxDuration
+	}
+	return d
+}
+
+// LockedFor returns how long the account stays locked, or zero when it isn't.
+func LockedFor(user *models.User, now time.Time) time.Duration {
+	if user.LockedUntil == nil || !user.LockedUntil.After(now) {
+		return 0
+	}
+	return user.LockedUntil.Sub(now)
+}
+
+// RecordFailedLogin counts a wrong password for the user and locks the
+// account when the policy says so. It returns how long the account is now
+// locked for.
+func RecordFailedLogin(db *gorm.DB, userID uint, policy LockoutPolicy, now time.Time) (time.Duration, error) {
+	var lockedFor time.Duration
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		if err := tx.First(&user, userID).Error; err != nil {
+			return err
+		}
+
+		updates := map[string]any{"failed_logins": user.FailedLogins + 1}
+		if lockedFor = policy.lockFor(user.FailedLogins + 1); lockedFor > 0 {
+			updates["locked_until"] = now.Add(lockedFor)
+		}
+		return tx.Model(&user).Updates(updates).Error
+	})
+	return lockedFor, err
+}
+
+// ResetFailedLogins clears the failure count and any lock after a successful login.
+func ResetFailedLogins(db *gorm.DB, user *models.User) error {
+	if user.FailedLogins == 0 && user.LockedUntil == nil {
+		return nil
+	}
+	return db.Model(user).Updates(map[string]any{"failed_logins": 0, "locked_until": nil}).Error
+}
+
+// UnlockUser clears the lock of the user with the given email.
+func UnlockUser(db *gorm.DB, email string) (*models.User, error) {
+	user, err := FindUserByEmail(db, email)
+	if err != nil {
+		return nil, err
+	}
+	if err := ResetFailedLogins(db, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
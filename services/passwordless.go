@@ -0,0 +1,130 @@
+package services
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"gorm.io/gorm"
+	"liven-one-go/models"
+)
+
+var (
+	// ErrInvalidLoginCode is returned for login codes that are wrong, have
+	// expired, were already used or were tried too often.
+	ErrInvalidLoginCode = errors.New("login code is invalid, expired or already used")
+	// ErrNoPhone is returned when a code is to be texted to an account
+	// without a phone number.
+	ErrNoPhone = errors.New("the account has no phone number")
+)
+
+// loginCodeDigits is the length of login codes.
+const loginCodeDigits = 6
+
+// PasswordlessPolicy configures logging in with a mailed link or a code
+// instead of a password.
+type PasswordlessPolicy struct {
+	// MagicLinkTTL is how long a mailed login link works.
+	MagicLinkTTL time.Duration
+	// CodeTTL is how long a login code works, and CodeAttempts how many
+	// wrong codes end it early.
+	CodeTTL      time.Duration
+	CodeAttempts int
+}
+
+// LoginWithMagicLink consumes a mailed login link and returns its user. It
+// proves the user receives mail at the address, so it is marked verified.
+func LoginWithMagicLink(db *gorm.DB, raw string, now time.Time) (*models.User, error) {
+	var user *models.User
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if user, err = consumeToken(tx, raw, models.TokenPurposeMagicLink, now); err != nil {
+			return err
+		}
+		return MarkEmailVerified(tx, user, now)
+	})
+	return user, err
+}
+
+// IssueLoginCode creates a login code for the user to be sent through
+// channel and returns it. Outstanding codes of the user stop working, so
+// only the latest one does.
+func IssueLoginCode(db *gorm.DB, user *models.User, channel string, ttl time.Duration, now time.Time) (string, error) {
+	if channel == models.LoginCodeChannelSMS && user.Phone == "" {
+		return "", ErrNoPhone
+	}
+	var random [8]byte
+	if _, err := io.ReadFull(TokenSource, random[:]); err != nil {
+		return "", fmt.Errorf("generate login code: %w", err)
+	}
+	code := fmt.Sprintf("%0*d", loginCodeDigits, binary.BigEndian.Uint64(random[:])%1_000_000)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.LoginCode{}).Where("user_id = ? AND used_at IS NULL", user.ID).Update("used_at", now).Error; err != nil {
+			return err
+		}
+		// Expired codes are useless, so issuing is a good time to drop them.
+		if err := tx.Where("expires_at < ?", now).Delete(&models.LoginCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.LoginCode{
+			UserID:    user.ID,
+			Channel:   channel,
+			CodeHash:  hashToken(code),
+			ExpiresAt: now.Add(ttl),
+		}).Error
+	})
+	if err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// VerifyLoginCode checks a login code of the user and uses it up. A wrong
+// code counts as an attempt at the user's latest code, which stops working
+// after maxAttempts. A mailed code proves the user receives mail at the
+// address, so it is marked verified.
+func VerifyLoginCode(db *gorm.DB, user *models.User, code string, maxAttempts int, now time.Time) error {
+	wrong := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var login models.LoginCode
+		err := tx.Where("user_id = ? AND used_at IS NULL AND expires_at > ?", user.ID, now).Order("id DESC").First(&login).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidLoginCode
+		}
+		if err != nil {
+			return err
+		}
+
+		if subtle.ConstantTimeCompare([]byte(hashToken(code)), []byte(login.CodeHash)) != 1 {
+			// The attempt must be kept, so this commits and reports the
+			// wrong code afterwards.
+			wrong = true
+			updates := map[string]any{"attempts": login.Attempts + 1}
+			if login.Attempts+1 >= maxAttempts {
+				updates["used_at"] = now
+			}
+			return tx.Model(&login).Updates(updates).Error
+		}
+
+		// The used_at condition makes a concurrent second use update nothing.
+		result := tx.Model(&login).Where("used_at IS NULL").Update("used_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrInvalidLoginCode
+		}
+		if login.Channel == models.LoginCodeChannelEmail {
+			return MarkEmailVerified(tx, user, now)
+		}
+		return nil
+	})
+	if err == nil && wrong {
+		return ErrInvalidLoginCode
+	}
+	return err
+}
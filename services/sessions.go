@@ -0,0 +1,196 @@
+package services
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"liven-one-go/models"
+	"liven-one-go/utils"
+)
+
+// ErrSessionNotFound is returned for sessions that don't exist, have
+// expired or belong to another user.
+var ErrSessionNotFound = errors.New("session not found")
+
+// SessionUsageResolution is how often the last use of a session is
+// recorded, so most requests don't wait for the writer.
+const SessionUsageResolution = time.Minute
+
+// SessionDetails describes the device a session is started on.
+type SessionDetails struct {
+	DeviceName string
+	UserAgent  string
+	IP         string
+}
+
+// StartSession records a login of the user on a device. It lasts as long
+// as an access token; ExtendSession keeps it for the tokens that replace
+// it.
+func StartSession(db *gorm.DB, userID uint, details SessionDetails, now time.Time) (*models.Session, error) {
+	session := models.Session{
+		UserID:     userID,
+		DeviceName: details.DeviceName,
+		UserAgent:  details.UserAgent,
+		IP:         details.IP,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(utils.AccessTokenTTL),
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Expired sessions can't be used, so starting one is a good time to
+		// drop them.
+		if err := tx.Where("expires_at < ?", now).Delete(&models.Session{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&session).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// ExtendSession keeps the session for an access token issued at now to
+// replace its current one.
+func ExtendSession(db *gorm.DB, sessionID uint, now time.Time) error {
+	return db.Model(&models.Session{}).Where("id = ?", sessionID).
+		Updates(map[string]any{"expires_at": now.Add(utils.AccessTokenTTL), "last_seen_at": now}).Error
+}
+
+// Sessions lists the sessions of the user that haven't expired, the most
+// recently used first.
+func Sessions(db *gorm.DB, userID uint, now time.Time) ([]models.Session, error) {
+	var sessions []models.Session
+	err := db.Where("user_id = ? AND expires_at > ?", userID, now).Order("last_seen_at DESC, id DESC").Find(&sessions).Error
+	return sessions, err
+}
+
+// EndSession deletes a session of the user, which signs its device out.
+func EndSession(db *gorm.DB, userID, sessionID uint) error {
+	result := db.Where("id = ? AND user_id = ?", sessionID, userID).Delete(&models.Session{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// endSessions deletes the sessions of the user except keep, for changes
+// that revoke the user's tokens.
+func endSessions(db *gorm.DB, userID, keep uint) error {
+	return db.Where("user_id = ? AND id <> ?", userID, keep).Delete(&models.Session{}).Error
+}
+
+// ActiveSession returns the session of an access token, from cache when it
+// was looked up recently. It returns ErrSessionNotFound when the session
+// was signed out or has expired. Callers of EndSession forget the session
+// from cache at once; sessions ended otherwise, such as by a password
+// change, stay cached for its TTL, but their tokens are also revoked
+// through the user.
+func ActiveSession(db *gorm.DB, cache *SessionCache, sessionID uint, now time.Time) (*models.Session, error) {
+	if session, ok := cache.Get(sessionID, now); ok {
+		return checkSession(session, now)
+	}
+
+	var session models.Session
+	err := db.First(&session, sessionID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	cache.Put(&session, now)
+	return checkSession(&session, now)
+}
+
+func checkSession(session *models.Session, now time.Time) (*models.Session, error) {
+	if !session.ExpiresAt.After(now) {
+		return nil, ErrSessionNotFound
+	}
+	return session, nil
+}
+
+// TouchSession records that the session was used at now, to
+// SessionUsageResolution. It returns ErrSessionNotFound when the session
+// ended since it was cached.
+func TouchSession(db *gorm.DB, cache *SessionCache, session *models.Session, now time.Time) error {
+	if now.Sub(session.LastSeenAt) < SessionUsageResolution {
+		return nil
+	}
+	result := db.Model(&models.Session{}).Where("id = ?", session.ID).Update("last_seen_at", now)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		cache.Forget(session.ID)
+		return ErrSessionNotFound
+	}
+	touched := *session
+	touched.LastSeenAt = now
+	cache.Put(&touched, now)
+	return nil
+}
+
+// SessionCache keeps recently looked up sessions in memory, so checking
+// the session of every request rarely reads the database. Entries are kept
+// for TTL and at most Size of them.
+type SessionCache struct {
+	ttl  time.Duration
+	size int
+
+	mu      sync.Mutex
+	entries map[uint]cachedSession
+}
+
+type cachedSession struct {
+	session  models.Session
+	cachedAt time.Time
+}
+
+// NewSessionCache returns an empty cache keeping up to size sessions for
+// ttl each.
+func NewSessionCache(ttl time.Duration, size int) *SessionCache {
+	return &SessionCache{ttl: ttl, size: size, entries: map[uint]cachedSession{}}
+}
+
+// Get returns the cached session, unless it is missing or older than the
+// TTL.
+func (c *SessionCache) Get(id uint, now time.Time) (*models.Session, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[id]
+	if !ok || now.Sub(entry.cachedAt) >= c.ttl {
+		return nil, false
+	}
+	session := entry.session
+	return &session, true
+}
+
+// Put caches a session looked up at now.
+func (c *SessionCache) Put(session *models.Session, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[session.ID]; !ok && len(c.entries) >= c.size {
+		for id, entry := range c.entries {
+			if now.Sub(entry.cachedAt) >= c.ttl {
+				delete(c.entries, id)
+			}
+		}
+		// Still full of fresh entries: start over rather than track age.
+		if len(c.entries) >= c.size {
+			clear(c.entries)
+		}
+	}
+	c.entries[session.ID] = cachedSession{session: *session, cachedAt: now}
+}
+
+// Forget drops a session from the cache, so its end takes effect at once.
+func (c *SessionCache) Forget(id uint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, id)
+}
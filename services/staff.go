@@ -0,0 +1,173 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"liven-one-go/models"
+)
+
+var (
+	ErrStaffNotFound     = errors.New("staff member not found")
+	ErrUnknownPermission = errors.New("unknown staff permission")
+	ErrNotVenueOwner     = errors.New("venue belongs to another merchant")
+)
+
+// VenueAccess is what a staff account may do at one venue.
+type VenueAccess struct {
+	VenueID     uint
+	Permissions []models.StaffPermission
+}
+
+// InviteStaff creates a staff account for the merchant, assigns it to venues
+// and returns a token for the invitee to choose a password with
+// AcceptStaffInvite. The account can't log in until then.
+func InviteStaff(db *gorm.DB, merchantID uint, email string, venues []VenueAccess, ttl time.Duration, now time.Time) (*models.User, string, error) {
+	var staff models.User
+	var token string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := checkEmailFree(tx, email, 0); err != nil {
+			return err
+		}
+
+		staff = models.User{Email: email, UserType: models.UserTypeStaff, MerchantID: &merchantID}
+		if err := tx.Create(&staff).Error; err != nil {
+			return err
+		}
+		if err := assignVenues(tx, merchantID, staff.ID, venues); err != nil {
+			return err
+		}
+		var err error
+		token, err = IssueToken(tx, staff.ID, models.TokenPurposeStaffInvite, ttl, now)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return &staff, token, nil
+}
+
+// AcceptStaffInvite consumes an invitation token and sets the password of
+// the staff account. Receiving the invitation also verifies the address.
+// hashed is the Password of a models.User after HashPassword.
+func AcceptStaffInvite(db *gorm.DB, raw, hashed string, now time.Time) (*models.User, error) {
+	var user *models.User
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if user, err = consumeToken(tx, raw, models.TokenPurposeStaffInvite, now); err != nil {
+			return err
+		}
+		if err := tx.Model(user).Update("password", hashed).Error; err != nil {
+			return err
+		}
+		return MarkEmailVerified(tx, user, now)
+	})
+	return user, err
+}
+
+// FindStaff loads a staff account of the merchant.
+func FindStaff(db *gorm.DB, merchantID, staffID uint) (*models.User, error) {
+	var staff models.User
+	err := db.Where("user_type = ? AND merchant_id = ?", models.UserTypeStaff, merchantID).First(&staff, staffID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrStaffNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &staff, nil
+}
+
+// StaffAssignments loads the venue assignments of staff accounts, with
+// their venues, grouped by account.
+func StaffAssignments(db *gorm.DB, staffIDs ...uint) (map[uint][]models.StaffAssignment, error) {
+	var assignments []models.StaffAssignment
+	if err := db.Preload("Venue").Where("user_id IN ?", staffIDs).Order("venue_id").Find(&assignments).Error; err != nil {
+		return nil, err
+	}
+	byStaff := make(map[uint][]models.StaffAssignment, len(staffIDs))
+	for _, assignment := range assignments {
+		byStaff[assignment.UserID] = append(byStaff[assignment.UserID], assignment)
+	}
+	return byStaff, nil
+}
+
+// SetStaffVenues replaces the venue assignments of a staff account.
+func SetStaffVenues(db *gorm.DB, merchantID, staffID uint, venues []VenueAccess) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if _, err := FindStaff(tx, merchantID, staffID); err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", staffID).Delete(&models.StaffAssignment{}).Error; err != nil {
+			return err
+		}
+		return assignVenues(tx, merchantID, staffID, venues)
+	})
+}
+
+// RemoveStaff anonymizes a staff account of the merchant with AnonymizeUser,
+// which deletes its assignments, tokens and sessions and frees its address
+// for a new invitation. Tokens it already holds stop working, as the
+// account is gone.
+func RemoveStaff(db *gorm.DB, merchantID, staffID uint, now time.Time) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		staff, err := FindStaff(tx, merchantID, staffID)
+		if err != nil {
+			return err
+		}
+		return AnonymizeUser(tx, staff, now)
+	})
+}
+
+// FindStaffAssignment returns the assignment of a staff account at a venue,
+// or nil when it doesn't work there.
+func FindStaffAssignment(db *gorm.DB, staffID, venueID uint) (*models.StaffAssignment, error) {
+	var assignment models.StaffAssignment
+	err := db.Where("user_id = ? AND venue_id = ?", staffID, venueID).First(&assignment).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &assignment, nil
+}
+
+// assignVenues stores assignments after checking that the merchant owns
+// every venue. It must run inside a transaction.
+func assignVenues(tx *gorm.DB, merchantID, staffID uint, venues []VenueAccess) error {
+	for _, access := range venues {
+		venue, err := merchantVenue(tx, merchantID, access.VenueID)
+		if err != nil {
+			return err
+		}
+
+		assignment := models.StaffAssignment{UserID: staffID, VenueID: venue.ID}
+		for _, permission := range access.Permissions {
+			if !assignment.Grant(permission) {
+				return fmt.Errorf("%w: %q", ErrUnknownPermission, permission)
+			}
+		}
+		if err := tx.Create(&assignment).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// merchantVenue loads a venue and checks that the merchant owns it.
+func merchantVenue(db *gorm.DB, merchantID, venueID uint) (*models.Venue, error) {
+	var venue models.Venue
+	if err := db.First(&venue, venueID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("%w: %d", ErrVenueNotFound, venueID)
+		}
+		return nil, err
+	}
+	if venue.MerchantID != merchantID {
+		return nil, fmt.Errorf("%w: %d", ErrNotVenueOwner, venueID)
+	}
+	return &venue, nil
+}
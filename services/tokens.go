@@ -0,0 +1,155 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"gorm.io/gorm"
+	"liven-one-go/models"
+)
+
+// ErrInvalidToken is returned for mailed tokens that don't exist, have
+// expired or were already used.
+var ErrInvalidToken = errors.New("token is invalid, expired or already used")
+
+// TokenSource supplies the randomness of mailed tokens, TOTP secrets,
+// recovery codes and API keys. Tests replace it to make them reproducible.
+var TokenSource io.Reader = rand.Reader
+
+// IssueToken creates a single-use token for the user and returns the secret
+// to mail them. Outstanding tokens of the same purpose are revoked, so only
+// the latest email works.
+func IssueToken(db *gorm.DB, userID uint, purpose string, ttl time.Duration, now time.Time) (string, error) {
+	secret := make([]byte, 32)
+	if _, err := io.ReadFull(TokenSource, secret); err != nil {
+		return "", fmt.Errorf("generate token: %w", err)
+	}
+	raw := base64.RawURLEncoding.EncodeToString(secret)
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := revokeTokens(tx, userID, purpose, now); err != nil {
+			return err
+		}
+		// Expired tokens are useless, so issuing is a good time to drop them.
+		if err := tx.Where("expires_at < ?", now).Delete(&models.UserToken{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&models.UserToken{
+			UserID:    userID,
+			Purpose:   purpose,
+			TokenHash: hashToken(raw),
+			ExpiresAt: now.Add(ttl),
+		}).Error
+	})
+	if err != nil {
+		return "", err
+	}
+	return raw, nil
+}
+
+// consumeToken marks a valid token as used and returns its user. It must run
+// inside a transaction.
+func consumeToken(tx *gorm.DB, raw, purpose string, now time.Time) (*models.User, error) {
+	var token models.UserToken
+	err := tx.Where("token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?", hashToken(raw), purpose, now).
+		First(&token).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The used_at condition makes a concurrent second use update nothing.
+	result := tx.Model(&token).Where("used_at IS NULL").Update("used_at", now)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrInvalidToken
+	}
+
+	var user models.User
+	if err := tx.First(&user, token.UserID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidToken
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+func revokeTokens(tx *gorm.DB, userID uint, purpose string, now time.Time) error {
+	return tx.Model(&models.UserToken{}).
+		Where("user_id = ? AND purpose = ? AND used_at IS NULL", userID, purpose).
+		Update("used_at", now).Error
+}
+
+func hashToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifyEmail consumes an email verification token and marks the address of
+// its user as verified.
+func VerifyEmail(db *gorm.DB, raw string, now time.Time) (*models.User, error) {
+	var user *models.User
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if user, err = consumeToken(tx, raw, models.TokenPurposeEmailVerification, now); err != nil {
+			return err
+		}
+		return MarkEmailVerified(tx, user, now)
+	})
+	return user, err
+}
+
+// MarkEmailVerified records that the user's address is verified, unless it
+// already was.
+func MarkEmailVerified(db *gorm.DB, user *models.User, now time.Time) error {
+	if user.EmailVerifiedAt != nil {
+		return nil
+	}
+	if err := db.Model(user).Update("email_verified_at", now).Error; err != nil {
+		return err
+	}
+	user.EmailVerifiedAt = &now
+	return nil
+}
+
+// ResetPasswordWithToken consumes a password reset token and sets a new
+// password for its user. Any login lockout is lifted, the user's other
+// reset tokens and access tokens are revoked and their sessions ended.
+// hashed is the Password of a models.User after HashPassword; bcrypt is
+// slow, so hash before starting the transaction this runs in.
+func ResetPasswordWithToken(db *gorm.DB, raw, hashed string, now time.Time) (*models.User, error) {
+	var user *models.User
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if user, err = consumeToken(tx, raw, models.TokenPurposePasswordReset, now); err != nil {
+			return err
+		}
+		updates := map[string]any{
+			"password": hashed, "failed_logins": 0, "locked_until": nil,
+			"tokens_revoked_at": tokensRevokedAt(now),
+		}
+		if err := tx.Model(user).Updates(updates).Error; err != nil {
+			return err
+		}
+		if err := endSessions(tx, user.ID, 0); err != nil {
+			return fmt.Errorf("end sessions: %w", err)
+		}
+		// Receiving the reset mail proves ownership of the address too.
+		if err := MarkEmailVerified(tx, user, now); err != nil {
+			return err
+		}
+		return revokeTokens(tx, user.ID, models.TokenPurposePasswordReset, now)
+	})
+	return user, err
+}
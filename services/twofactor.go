@@ -0,0 +1,192 @@
+package services
+
+import (
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"liven-one-go/models"
+	"liven-one-go/totp"
+)
+
+var (
+	ErrTwoFactorEnabled    = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorNotEnabled = errors.New("two-factor authentication is not enabled")
+	ErrTwoFactorNotStarted = errors.New("two-factor enrollment was not started")
+	ErrInvalidCode         = errors.New("invalid two-factor code")
+)
+
+// RecoveryCodeCount is how many recovery codes enrolling generates.
+const RecoveryCodeCount = 10
+
+// TwoFactorPolicy configures TOTP two-factor authentication.
+type TwoFactorPolicy struct {
+	// Issuer names the service in authenticator apps.
+	Issuer string
+	// RequireMerchants makes merchants and their staff enroll before they
+	// can use the merchant API.
+	RequireMerchants bool
+}
+
+// Required reports whether accounts of userType must use two-factor authentication.
+func (p TwoFactorPolicy) Required(userType string) bool {
+	return p.RequireMerchants && (userType == models.UserTypeMerchant || userType == models.UserTypeStaff)
+}
+
+// BeginTwoFactor generates a new TOTP secret for the user and returns it with
+// the provisioning URI to show as a QR code. Logins aren't affected until
+// EnableTwoFactor confirms the authenticator app produces valid codes.
+func BeginTwoFactor(db *gorm.DB, user *models.User, issuer string) (secret, uri string, err error) {
+	if user.TwoFactorEnabled() {
+		return "", "", ErrTwoFactorEnabled
+	}
+	if secret, err = totp.GenerateSecret(TokenSource); err != nil {
+		return "", "", fmt.Errorf("generate secret: %w", err)
+	}
+	if err := db.Model(user).Where("totp_enabled_at IS NULL").Update("totp_secret", secret).Error; err != nil {
+		return "", "", err
+	}
+	user.TOTPSecret = secret
+	return secret, totp.ProvisioningURI(issuer, user.Email, secret), nil
+}
+
+// EnableTwoFactor turns on two-factor authentication once code shows the
+// user's app holds the secret from BeginTwoFactor. It returns the recovery
+// codes, which are only ever shown this once.
+func EnableTwoFactor(db *gorm.DB, user *models.User, code string, now time.Time) ([]string, error) {
+	if user.TwoFactorEnabled() {
+		return nil, ErrTwoFactorEnabled
+	}
+	if user.TOTPSecret == "" {
+		return nil, ErrTwoFactorNotStarted
+	}
+	step, ok := totp.Validate(user.TOTPSecret, strings.TrimSpace(code), now)
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+
+	var codes []string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// The secret condition catches a setup restarted since user was loaded.
+		result := tx.Model(user).Where("totp_enabled_at IS NULL AND totp_secret = ?", user.TOTPSecret).
+			Updates(map[string]any{"totp_enabled_at": now, "totp_last_step": step})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrTwoFactorNotStarted
+		}
+		var err error
+		codes, err = replaceRecoveryCodes(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	user.TOTPEnabledAt, user.TOTPLastStep = &now, step
+	return codes, nil
+}
+
+// VerifySecondFactor checks a TOTP code or an unused recovery code of a user
+// with two-factor authentication enabled. Every code is accepted only once.
+func VerifySecondFactor(db *gorm.DB, user *models.User, code string, now time.Time) error {
+	if !user.TwoFactorEnabled() {
+		return ErrTwoFactorNotEnabled
+	}
+	code = strings.TrimSpace(code)
+
+	if step, ok := totp.Validate(user.TOTPSecret, code, now); ok {
+		// The step condition makes a replayed or concurrently used code update nothing.
+		result := db.Model(user).Where("totp_last_step < ?", step).Update("totp_last_step", step)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrInvalidCode
+		}
+		user.TOTPLastStep = step
+		return nil
+	}
+
+	result := db.Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, hashToken(normalizeRecoveryCode(code))).
+		Update("used_at", now)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// DisableTwoFactor turns off two-factor authentication for the user and
+// deletes their recovery codes.
+func DisableTwoFactor(db *gorm.DB, user *models.User) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		updates := map[string]any{"totp_secret": "", "totp_enabled_at": nil, "totp_last_step": 0}
+		if err := tx.Model(user).Updates(updates).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", user.ID).Delete(&models.RecoveryCode{}).Error
+	})
+	if err != nil {
+		return err
+	}
+	user.TOTPSecret, user.TOTPEnabledAt, user.TOTPLastStep = "", nil, 0
+	return nil
+}
+
+// ResetTwoFactor turns off two-factor authentication for the user with the
+// given email, for someone who lost both their authenticator and their
+// recovery codes.
+func ResetTwoFactor(db *gorm.DB, email string) (*models.User, error) {
+	user, err := FindUserByEmail(db, email)
+	if err != nil {
+		return nil, err
+	}
+	if !user.TwoFactorEnabled() && user.TOTPSecret == "" {
+		return nil, ErrTwoFactorNotEnabled
+	}
+	if err := DisableTwoFactor(db, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// replaceRecoveryCodes deletes the user's recovery codes and stores new ones.
+// It must run inside a transaction.
+func replaceRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, RecoveryCodeCount)
+	rows := make([]models.RecoveryCode, RecoveryCodeCount)
+	for i := range codes {
+		// Ten base32 characters carry 50 random bits.
+		secret := make([]byte, 7)
+		if _, err := io.ReadFull(TokenSource, secret); err != nil {
+			return nil, fmt.Errorf("generate recovery code: %w", err)
+		}
+		code := strings.ToLower(recoveryEncoding.EncodeToString(secret)[:10])
+		codes[i] = code[:5] + "-" + code[5:]
+		rows[i] = models.RecoveryCode{UserID: userID, CodeHash: hashToken(code)}
+	}
+	if err := tx.Create(&rows).Error; err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// normalizeRecoveryCode accepts recovery codes typed with any case and with
+// or without the separator.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
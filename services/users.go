@@ -0,0 +1,103 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"liven-one-go/models"
+)
+
+var (
+	ErrEmailTaken      = errors.New("email already registered")
+	ErrInvalidUserType = errors.New("invalid user type")
+	ErrUserNotFound    = errors.New("user not found")
+)
+
+// CreateUser registers a new account with a hashed password.
+func CreateUser(db *gorm.DB, email, password, userType string) (*models.User, error) {
+	if userType != models.UserTypeDiner && userType != models.UserTypeMerchant {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidUserType, userType)
+	}
+	return createAccount(db, email, password, userType)
+}
+
+// CreateAdmin creates a platform administrator. Only the command line calls
+// it; CreateUser refuses the admin type so the API can't.
+func CreateAdmin(db *gorm.DB, email, password string) (*models.User, error) {
+	return createAccount(db, email, password, models.UserTypeAdmin)
+}
+
+func createAccount(db *gorm.DB, email, password, userType string) (*models.User, error) {
+	if err := checkEmailFree(db, email, 0); err != nil {
+		return nil, err
+	}
+
+	user := models.User{
+		Email:    email,
+		UserType: userType,
+	}
+	if err := user.HashPassword(password); err != nil {
+		return nil, fmt.Errorf("hash password: %w", err)
+	}
+	if err := db.Create(&user).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// FindUserByEmail looks a user up by email.
+func FindUserByEmail(db *gorm.DB, email string) (*models.User, error) {
+	var user models.User
+	if err := db.Where("email = ?", email).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+// VerifyUser marks the address of the user with the given email as verified
+// without a mailed token.
+func VerifyUser(db *gorm.DB, email string, now time.Time) (*models.User, error) {
+	user, err := FindUserByEmail(db, email)
+	if err != nil {
+		return nil, err
+	}
+	if err := MarkEmailVerified(db, user, now); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// ResetPassword replaces the password of the user with the given email and
+// lifts any login lockout. Like ResetPasswordWithToken it revokes the user's
+// access tokens and ends their sessions, as the account may be compromised.
+// hashed is the Password of a models.User after HashPassword; bcrypt is
+// slow, so hash before starting the transaction this runs in.
+func ResetPassword(db *gorm.DB, email, hashed string, now time.Time) (*models.User, error) {
+	user, err := FindUserByEmail(db, email)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		updates := map[string]any{
+			"password": hashed, "failed_logins": 0, "locked_until": nil,
+			"tokens_revoked_at": tokensRevokedAt(now),
+		}
+		if err := tx.Model(user).Updates(updates).Error; err != nil {
+			return err
+		}
+		if err := endSessions(tx, user.ID, 0); err != nil {
+			return fmt.Errorf("end sessions: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	user.Password = hashed
+	return user, nil
+}
@@ -0,0 +1,45 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+	"liven-one-go/models"
+)
+
+var (
+	ErrVenueNotFound = errors.New("venue not found")
+	ErrNotMerchant   = errors.New("user is not a merchant")
+)
+
+// TransferVenue hands a venue, with its menu and order history, to another merchant.
+func TransferVenue(db *gorm.DB, venueID uint, merchantEmail string) (*models.Venue, error) {
+	merchant, err := FindUserByEmail(db, merchantEmail)
+	if err != nil {
+		return nil, err
+	}
+	if merchant.UserType != models.UserTypeMerchant {
+		return nil, fmt.Errorf("%w: %s", ErrNotMerchant, merchant.Email)
+	}
+
+	var venue models.Venue
+	if err := db.First(&venue, venueID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrVenueNotFound
+		}
+		return nil, err
+	}
+
+	// The previous owner's staff don't move with the venue.
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&venue).Update("merchant_id", merchant.ID).Error; err != nil {
+			return err
+		}
+		return tx.Where("venue_id = ?", venue.ID).Delete(&models.StaffAssignment{}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &venue, nil
+}
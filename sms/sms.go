@@ -0,0 +1,149 @@
+// Package sms sends the text messages of the account flows. The transport is
+// chosen by SMS_SENDER: a webhook of an SMS gateway in production, or a
+// console or file sink during development so codes can be read without a
+// phone.
+package sms
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Transport names for SMS_SENDER.
+const (
+	TransportNone    = "none"
+	TransportConsole = "console"
+	TransportFile    = "file"
+	TransportWebhook = "webhook"
+)
+
+// Message is a text message to a phone number in E.164 format.
+type Message struct {
+	To   string `json:"to"`
+	Body string `json:"body"`
+}
+
+// Sender delivers messages.
+type Sender interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// Options configures New.
+type Options struct {
+	Transport string
+	// File is the file the file transport appends messages to.
+	File string
+
+	// WebhookURL receives each message as a JSON POST, authenticated with
+	// WebhookToken as a bearer token when it is set.
+	WebhookURL   string
+	WebhookToken string
+}
+
+// New returns the sender for opts.Transport.
+func New(opts Options) (Sender, error) {
+	switch opts.Transport {
+	case TransportNone:
+		return Discard{}, nil
+	case TransportConsole:
+		return &WriterSender{W: os.Stdout}, nil
+	case TransportFile:
+		return &FileSender{Path: opts.File}, nil
+	case TransportWebhook:
+		if opts.WebhookURL == "" {
+			return nil, errors.New("SMS_WEBHOOK_URL is required by the webhook sender")
+		}
+		return &WebhookSender{URL: opts.WebhookURL, Token: opts.WebhookToken, Client: &http.Client{Timeout: 10 * time.Second}}, nil
+	default:
+		return nil, fmt.Errorf("unknown SMS sender %q", opts.Transport)
+	}
+}
+
+// Discard drops every message.
+type Discard struct{}
+
+func (Discard) Send(context.Context, Message) error { return nil }
+
+// WriterSender prints messages to W, one per line.
+type WriterSender struct {
+	W io.Writer
+
+	mu sync.Mutex
+}
+
+func (s *WriterSender) Send(_ context.Context, msg Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := fmt.Fprintln(s.W, format(msg, time.Now()))
+	return err
+}
+
+// FileSender appends messages to the file at Path, one per line.
+type FileSender struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+func (s *FileSender) Send(_ context.Context, msg Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, format(msg, time.Now())); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// WebhookSender posts each message as JSON to the URL of a gateway that
+// delivers it.
+type WebhookSender struct {
+	URL    string
+	Token  string
+	Client *http.Client
+}
+
+func (s *WebhookSender) Send(ctx context.Context, msg Message) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("SMS gateway answered %s", resp.Status)
+	}
+	return nil
+}
+
+// format renders msg on one line, so a sink holds one message per line.
+func format(msg Message, date time.Time) string {
+	line, _ := json.Marshal(struct {
+		Date string `json:"date"`
+		Message
+	}{date.Format(time.RFC3339), msg})
+	return string(line)
+}
@@ -0,0 +1,52 @@
+package sms
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriterSender(t *testing.T) {
+	var buf bytes.Buffer
+	s := &WriterSender{W: &buf}
+	if err := s.Send(context.Background(), Message{To: "+61400000000", Body: "Your code is 123456\nIt expires soon."}); err != nil {
+		t.Fatal(err)
+	}
+	// A line break in the body stays on the message's line.
+	if lines := bytes.Count(buf.Bytes(), []byte("\n")); lines != 1 {
+		t.Fatalf("wrote %d lines:\n%s", lines, buf.String())
+	}
+	var got Message
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil || got.To != "+61400000000" || got.Body != "Your code is 123456\nIt expires soon." {
+		t.Errorf("line = %s (%v)", buf.String(), err)
+	}
+}
+
+func TestWebhookSender(t *testing.T) {
+	var got Message
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer gateway-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer gateway.Close()
+
+	msg := Message{To: "+61400000000", Body: "Your code is 123456"}
+	s := &WebhookSender{URL: gateway.URL, Token: "gateway-token", Client: gateway.Client()}
+	if err := s.Send(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if got != msg {
+		t.Errorf("gateway received %+v", got)
+	}
+
+	s.Token = "wrong"
+	if err := s.Send(context.Background(), msg); err == nil {
+		t.Error("a refused message was reported as sent")
+	}
+}
@@ -0,0 +1,54 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRFC6238 checks the SHA-1 test vectors of RFC 6238, appendix B.
+func TestRFC6238(t *testing.T) {
+	key := []byte("12345678901234567890")
+	for unix, want := range map[int64]string{
+		59:          "94287082",
+		1111111109:  "07081804",
+		1111111111:  "14050471",
+		1234567890:  "89005924",
+		2000000000:  "69279037",
+		20000000000: "65353130",
+	} {
+		if got := hotp(key, Step(time.Unix(unix, 0)), 8); got != want {
+			t.Errorf("code at %d = %s, want %s", unix, got, want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret(strings.NewReader(strings.Repeat("k", 20)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	code, err := Code(secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if step, ok := Validate(secret, code, now.Add(Period)); !ok || step != Step(now) {
+		t.Errorf("a code of the previous step was refused")
+	}
+	if _, ok := Validate(secret, code, now.Add(3*Period)); ok {
+		t.Errorf("a code three steps old was accepted")
+	}
+	if _, ok := Validate(secret, "12345", now); ok {
+		t.Errorf("a short code was accepted")
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	got := ProvisioningURI("Liven One", "a@example.com", "ABC")
+	want := "otpauth://totp/Liven%20One:a@example.com?algorithm=SHA1&digits=6&issuer=Liven+One&period=30&secret=ABC"
+	if got != want {
+		t.Errorf("ProvisioningURI = %s\nwant %s", got, want)
+	}
+}
@@ -0,0 +1,88 @@
+package tracing
+
+import (
+	"errors"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+const spanKey = "tracing:span"
+
+// GormPlugin records a span for every GORM statement, as a child of the span
+// in the statement's context. Queries must be run with
+// db.WithContext(ctx) to be attached to the request that issued them.
+type GormPlugin struct{}
+
+func (GormPlugin) Name() string {
+	return "tracing"
+}
+
+func (GormPlugin) Initialize(db *gorm.DB) error {
+	cb := db.Callback()
+	return errors.Join(
+		cb.Create().Before("gorm:create").Register("tracing:before_create", start("create")),
+		cb.Create().After("gorm:create").Register("tracing:after_create", end),
+		cb.Query().Before("gorm:query").Register("tracing:before_query", start("query")),
+		cb.Query().After("gorm:query").Register("tracing:after_query", end),
+		cb.Update().Before("gorm:update").Register("tracing:before_update", start("update")),
+		cb.Update().After("gorm:update").Register("tracing:after_update", end),
+		cb.Delete().Before("gorm:delete").Register("tracing:before_delete", start("delete")),
+		cb.Delete().After("gorm:delete").Register("tracing:after_delete", end),
+		cb.Row().Before("gorm:row").Register("tracing:before_row", start("row")),
+		cb.Row().After("gorm:row").Register("tracing:after_row", end),
+		cb.Raw().Before("gorm:raw").Register("tracing:before_raw", start("raw")),
+		cb.Raw().After("gorm:raw").Register("tracing:after_raw", end),
+	)
+}
+
+func start(operation string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		ctx := db.Statement.Context
+		// Statements outside a traced request, such as migrations, aren't worth a root span each.
+		if !trace.SpanContextFromContext(ctx).IsValid() {
+			return
+		}
+
+		name := "db." + operation
+		if db.Statement.Table != "" {
+			name += " " + db.Statement.Table
+		}
+		ctx, span := Tracer().Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				semconv.DBSystemSqlite,
+				semconv.DBOperationName(operation),
+			),
+		)
+		db.Statement.Context = ctx
+		db.InstanceSet(spanKey, span)
+	}
+}
+
+func end(db *gorm.DB) {
+	value, ok := db.InstanceGet(spanKey)
+	if !ok {
+		return
+	}
+	span, ok := value.(trace.Span)
+	if !ok {
+		return
+	}
+	defer span.End()
+
+	span.SetAttributes(
+		semconv.DBQueryText(db.Statement.SQL.String()),
+		attribute.Int64("db.rows_affected", db.RowsAffected),
+	)
+	if db.Statement.Table != "" {
+		span.SetAttributes(semconv.DBCollectionName(db.Statement.Table))
+	}
+	if db.Error != nil && !errors.Is(db.Error, gorm.ErrRecordNotFound) {
+		span.RecordError(db.Error)
+		span.SetStatus(codes.Error, db.Error.Error())
+	}
+}
@@ -0,0 +1,118 @@
+// Package tracing configures OpenTelemetry tracing: the exporter spans are
+// sent to, W3C trace context propagation and the GORM statement spans.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InstrumentationName names the tracer used by the HTTP middleware and the GORM plugin.
+const InstrumentationName = "liven-one-go"
+
+// Exporters.
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterFile   = "file"
+	ExporterOTLP   = "otlp"
+)
+
+// Options selects where spans are exported.
+type Options struct {
+	// Exporter is one of the Exporter constants. With ExporterOTLP the
+	// endpoint, headers and protocol settings come from the standard
+	// OTEL_EXPORTER_OTLP_* environment variables.
+	Exporter string
+
+	// File is the path spans are appended to with ExporterFile.
+	File string
+
+	ServiceName string
+}
+
+// Tracer returns the application tracer from the global provider. Until
+// Setup installs a provider, spans are no-ops that still carry the trace
+// context received from the caller.
+func Tracer() trace.Tracer {
+	return otel.Tracer(InstrumentationName)
+}
+
+// Setup installs the global tracer provider and W3C trace context
+// propagator. The returned function flushes pending spans and must be called
+// before the process exits.
+func Setup(ctx context.Context, opts Options) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	exporter, closeOutput, err := newExporter(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	if exporter == nil {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		semconv.ServiceName(opts.ServiceName),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		return errors.Join(provider.Shutdown(ctx), closeOutput())
+	}, nil
+}
+
+func newExporter(ctx context.Context, opts Options) (sdktrace.SpanExporter, func() error, error) {
+	noClose := func() error { return nil }
+
+	switch strings.ToLower(opts.Exporter) {
+	case "", ExporterNone:
+		return nil, noClose, nil
+	case ExporterStdout:
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		return exporter, noClose, err
+	case ExporterFile:
+		if opts.File == "" {
+			return nil, nil, fmt.Errorf("the file trace exporter needs a file path")
+		}
+		file, err := os.OpenFile(opts.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, nil, err
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(io.Writer(file)))
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		return exporter, file.Close, nil
+	case ExporterOTLP:
+		exporter, err := otlptracehttp.New(ctx)
+		return exporter, noClose, err
+	default:
+		return nil, nil, fmt.Errorf("invalid trace exporter %q", opts.Exporter)
+	}
+}
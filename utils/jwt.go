@@ -1,79 +1,214 @@
 package utils
 
 import (
-	"log"
-	"os"
+	"errors"
 
 	"github.com/golang-jwt/jwt/v5"
-	"github.com/joho/godotenv"
+	"liven-one-go/keystore"
 	"time"
 )
 
-var jwtSecret []byte
+// Default claims checked when SetKeys wasn't given others.
+const (
+	DefaultIssuer   = "liven-one"
+	DefaultAudience = "liven-one-api"
+)
+
+// legacyIssuer is the issuer of the tokens signed with the shared secret
+// before issuers and audiences were configurable.
+const legacyIssuer = "GaruruCannonIssuer"
+
+var (
+	keys     = &keystore.Store{}
+	issuer   = DefaultIssuer
+	audience = DefaultAudience
+	// legacyCutoff is when the first release stopped issuing tokens. Zero
+	// refuses all of them.
+	legacyCutoff time.Time
+)
+
+// ErrMissingSecret is returned when tokens are issued without a signing key.
+var ErrMissingSecret = errors.New("no JWT signing key is configured")
+
+// ErrLegacyToken is returned for tokens of the first release that were
+// issued after the cutoff, in the future or for longer than AccessTokenTTL.
+var ErrLegacyToken = errors.New("legacy token is outside its allowed lifetime")
+
+// ErrWrongPurpose is returned when a valid token is presented for something
+// it wasn't issued for, such as a login challenge used as an access token.
+var ErrWrongPurpose = errors.New("token was issued for another purpose")
+
+// PurposeTwoFactorChallenge marks the tokens that prove a password was
+// checked and a second factor is still due.
+const PurposeTwoFactorChallenge = "2fa_challenge"
+
+// AccessTokenTTL is how long access tokens work.
+const AccessTokenTTL = 24 * time.Hour
+
+// IssuedAtPrecision is how precisely tokens record when they were issued.
+// Finer than the default second, so a token issued just after its account
+// revoked the older ones isn't mistaken for one of them.
+const IssuedAtPrecision = time.Millisecond
 
 func init() {
-	// Attempt to load .env file. This is useful for local development.
-	// In a containerized environment (like Docker/Cloud Run),
-	// environment variables are typically set directly by the platform.
-	err := godotenv.Load()
-	if err != nil {
-		// Don't make this fatal. It's okay if .env is not found in a container.
-		log.Printf("Warning: .env file not found or error loading: %v. Relying on OS environment variables.", err)
-	}
+	// Dates are encoded as float seconds, which don't hold milliseconds
+	// exactly. A finer precision keeps the error below what Issued rounds.
+	jwt.TimePrecision = time.Microsecond
+}
 
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		// This is a critical failure if the secret isn't set by any means
-		log.Fatal("FATAL: JWT_SECRET environment variable is not set.")
-	}
-	jwtSecret = []byte(secret)
+// SetKeys sets the keys that sign and verify tokens and the issuer and
+// audience written into and required of them.
+func SetKeys(store *keystore.Store, iss, aud string) {
+	keys, issuer, audience = store, iss, aud
+}
+
+// SetLegacyCutoff sets when the first release stopped issuing tokens. Its
+// tokens are accepted only if issued before then, so the last of them
+// expires AccessTokenTTL after it. The zero time refuses them all.
+func SetLegacyCutoff(cutoff time.Time) {
+	legacyCutoff = cutoff
+}
+
+// SetJWTSecret signs and verifies tokens with a shared HS256 secret.
+func SetJWTSecret(secret string) {
+	store, _ := keystore.New(keystore.NewSecretKey([]byte(secret)))
+	SetKeys(store, DefaultIssuer, DefaultAudience)
+}
+
+// Keys returns the keys set with SetKeys.
+func Keys() *keystore.Store {
+	return keys
 }
 
 type Claims struct {
 	UserID   uint   `json:"user_id"`
 	UserType string `json:"user_type"`
+	// MFA is set on tokens issued after a second factor was checked.
+	MFA bool `json:"mfa,omitempty"`
+	// Purpose limits what the token can be used for. Access tokens have none.
+	Purpose string `json:"purpose,omitempty"`
+	// ImpersonatorID is the admin a support token was issued to. Such
+	// tokens act as UserID but can only read.
+	ImpersonatorID uint `json:"impersonator_id,omitempty"`
+	// SessionID is the login an access token belongs to. Ending the session
+	// revokes the token. Impersonation tokens have none.
+	SessionID uint `json:"sid,omitempty"`
+	// Legacy is set on tokens signed with the shared secret before key IDs,
+	// issuers, audiences and sessions existed. Those issued before the
+	// legacy cutoff work until they expire.
+	Legacy bool `json:"-"`
+	// APIKeyID is the key a request authenticated with an API key used.
+	// Such claims are built by AuthMiddleware and never signed.
+	APIKeyID uint `json:"-"`
 	jwt.RegisteredClaims
 }
 
-func GenerateToken(userID uint, userType string) (string, error) {
-
-	claims := Claims{
-		UserID:   userID,
-		UserType: userType,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour * 24)), // Token expires in 24 hours
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			NotBefore: jwt.NewNumericDate(time.Now()),
-			Issuer:    "GaruruCannonIssuer",
-		},
+// Issued returns when the token was issued, to IssuedAtPrecision. It is the
+// zero time for tokens without an issue time.
+func (c *Claims) Issued() time.Time {
+	if c.IssuedAt == nil {
+		return time.Time{}
 	}
+	return c.IssuedAt.Round(IssuedAtPrecision)
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	ss, err := token.SignedString(jwtSecret)
+// GenerateToken issues an access token for the session sessionID.
+func GenerateToken(userID uint, userType string, sessionID uint) (string, error) {
+	return sign(Claims{UserID: userID, UserType: userType, SessionID: sessionID}, AccessTokenTTL)
+}
 
-	if err != nil {
-		return "", err
+// GenerateMFAToken issues an access token for a login that passed a second factor.
+func GenerateMFAToken(userID uint, userType string, sessionID uint) (string, error) {
+	return sign(Claims{UserID: userID, UserType: userType, MFA: true, SessionID: sessionID}, AccessTokenTTL)
+}
+
+// GenerateChallengeToken issues a token that can only be exchanged for an
+// access token together with a second factor.
+func GenerateChallengeToken(userID uint, userType string, ttl time.Duration) (string, error) {
+	return sign(Claims{UserID: userID, UserType: userType, Purpose: PurposeTwoFactorChallenge}, ttl)
+}
+
+// GenerateImpersonationToken issues a read-only access token for userID to
+// the admin adminID. mfa carries over whether the admin passed a second factor.
+func GenerateImpersonationToken(userID uint, userType string, adminID uint, mfa bool, ttl time.Duration) (string, error) {
+	return sign(Claims{UserID: userID, UserType: userType, MFA: mfa, ImpersonatorID: adminID}, ttl)
+}
+
+func sign(claims Claims, ttl time.Duration) (string, error) {
+	key := keys.SigningKey()
+	if key == nil {
+		return "", ErrMissingSecret
 	}
 
-	return ss, nil
+	now := time.Now()
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		IssuedAt:  jwt.NewNumericDate(now.Truncate(IssuedAtPrecision)),
+		NotBefore: jwt.NewNumericDate(now),
+		Issuer:    issuer,
+		Audience:  jwt.ClaimStrings{audience},
+	}
+
+	token := jwt.NewWithClaims(key.Method(), claims)
+	if key.ID != "" {
+		token.Header["kid"] = key.ID
+	}
+	return key.Sign(token)
 }
 
+// ValidateToken checks an access token.
 func ValidateToken(tokenString string) (*Claims, error) {
-	claims := &Claims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, jwt.ErrSignatureInvalid
-		}
-		return jwtSecret, nil
-	})
+	return validate(tokenString, "")
+}
 
+// ValidateChallengeToken checks a token from GenerateChallengeToken.
+func ValidateChallengeToken(tokenString string) (*Claims, error) {
+	return validate(tokenString, PurposeTwoFactorChallenge)
+}
+
+func validate(tokenString, purpose string) (*Claims, error) {
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, keys.VerificationKey,
+		jwt.WithValidMethods(keys.Algorithms()),
+		jwt.WithExpirationRequired(),
+	)
 	if err != nil {
 		return nil, err
 	}
+	// Tokens signed before issuers and audiences were configurable are
+	// accepted without them until they expire.
+	claims.Legacy = legacyToken(token, claims)
+	if claims.Legacy {
+		// They have no session, so only their lifetime limits them.
+		if !legacyLifetime(claims, time.Now()) {
+			return nil, ErrLegacyToken
+		}
+	} else if err := jwt.NewValidator(jwt.WithIssuer(issuer), jwt.WithAudience(audience)).Validate(claims); err != nil {
+		return nil, err
+	}
 
-	if !token.Valid {
-		return nil, jwt.ErrSignatureInvalid
+	if claims.Purpose != purpose {
+		return nil, ErrWrongPurpose
 	}
 
 	return claims, nil
 }
+
+// legacyToken reports whether the token was signed with the shared secret
+// before key IDs, issuers and audiences were configurable.
+func legacyToken(token *jwt.Token, claims *Claims) bool {
+	_, hasKeyID := token.Header["kid"]
+	return token.Method.Alg() == keystore.AlgorithmHS256 && !hasKeyID &&
+		claims.Issuer == legacyIssuer && len(claims.Audience) == 0
+}
+
+// legacyLifetime reports whether a legacy token was issued before the legacy
+// cutoff and not after now, and lasts no longer than the first release
+// issued tokens for.
+func legacyLifetime(claims *Claims, now time.Time) bool {
+	if claims.IssuedAt == nil || claims.ExpiresAt == nil {
+		return false
+	}
+	issued, expires := claims.IssuedAt.Time, claims.ExpiresAt.Time
+	return !issued.After(now) && issued.Before(legacyCutoff) && expires.Sub(issued) <= AccessTokenTTL
+}
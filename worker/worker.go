@@ -0,0 +1,83 @@
+// Package worker runs the background goroutines of the server, such as the
+// scheduled backups, so they can be health checked and stopped on shutdown.
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Group supervises a set of named workers sharing one cancellation context.
+type Group struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	stopped map[string]error
+}
+
+func NewGroup() *Group {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Group{ctx: ctx, cancel: cancel, stopped: map[string]error{}}
+}
+
+// Go runs fn in a goroutine. fn must return once ctx is cancelled; returning
+// earlier marks the worker as failed until the process restarts.
+func (g *Group) Go(name string, fn func(ctx context.Context) error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		err := fn(g.ctx)
+		if g.ctx.Err() != nil {
+			return
+		}
+
+		if err == nil {
+			err = errors.New("exited")
+		}
+		slog.Error("Background worker stopped", "worker", name, "error", err)
+		g.mu.Lock()
+		g.stopped[name] = err
+		g.mu.Unlock()
+	}()
+}
+
+// Check fails when a worker stopped before Stop was called.
+func (g *Group) Check() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if len(g.stopped) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(g.stopped))
+	for name, err := range g.stopped {
+		names = append(names, fmt.Sprintf("%s: %v", name, err))
+	}
+	sort.Strings(names)
+	return fmt.Errorf("worker stopped: %s", strings.Join(names, "; "))
+}
+
+// Stop cancels every worker and waits for them to return, or for ctx to end.
+func (g *Group) Stop(ctx context.Context) error {
+	g.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("workers did not stop in time: %w", ctx.Err())
+	}
+}
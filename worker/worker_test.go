@@ -0,0 +1,44 @@
+package worker
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestStopWaitsForWorkers(t *testing.T) {
+	g := NewGroup()
+	finished := false
+	g.Go("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		time.Sleep(20 * time.Millisecond)
+		finished = true
+		return nil
+	})
+
+	if err := g.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !finished {
+		t.Error("Stop returned before the worker finished")
+	}
+	if err := g.Check(); err != nil {
+		t.Errorf("a worker stopped by Stop is reported as failed: %v", err)
+	}
+}
+
+func TestStopGivesUpAtDeadline(t *testing.T) {
+	g := NewGroup()
+	release := make(chan struct{})
+	defer close(release)
+	g.Go("stuck", func(ctx context.Context) error {
+		<-release
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := g.Stop(ctx); err == nil {
+		t.Error("expected an error when a worker ignores cancellation")
+	}
+}